@@ -12,8 +12,8 @@ BINARY_X86_NAME="gobkm-AMD64"
 PACKAGE_ARCHIVE_NAME="gobkm.zip"
 STATIC_RESOURCES_ARCHIVE_NAME="static.zip"
 
-BUILD_ARMV7_CMD="env GOOS=linux GOARCH=arm CC=arm-linux-gnueabi-gcc GOARM=7 CGO_ENABLED=1 ENABLE_CGO=1 go build -o $OUTPUT_DIR/$BINARY_ARMV7_NAME ."
-BUILD_X86_CMD="go build -o $OUTPUT_DIR/$BINARY_X86_NAME ."
+BUILD_ARMV7_CMD="env GOOS=linux GOARCH=arm CC=arm-linux-gnueabi-gcc GOARM=7 CGO_ENABLED=1 ENABLE_CGO=1 go build -tags sqlite_fts5 -o $OUTPUT_DIR/$BINARY_ARMV7_NAME ."
+BUILD_X86_CMD="go build -tags sqlite_fts5 -o $OUTPUT_DIR/$BINARY_X86_NAME ."
 
 RICE_ARMV7_CMD="rice append --exec $OUTPUT_DIR/$BINARY_ARMV7_NAME"
 RICE_X86_CMD="rice append --exec $OUTPUT_DIR/$BINARY_X86_NAME"
@@ -4,6 +4,7 @@ logfile=""
 debug=""
 history=3
 username=""
+db="/data/bkm.db"
 
 if [ ! -z "$GOBKM_PROXYURL" ]
 then
@@ -25,6 +26,10 @@ if [ ! -z "$GOBKM_LOGFILE" ]
 then
       logfile="-logfile $GOBKM_LOGFILE"
 fi
+if [ ! -z "$GOBKM_DB" ]
+then
+      db="$GOBKM_DB"
+fi
 
 echo "proxy: $GOBKM_PROXYURL"
 echo "logfile: $GOBKM_LOGFILE"
@@ -32,7 +37,7 @@ echo "debug: $GOBKM_DEBUG"
 echo "history: $GOBKM_HISTORY"
 echo "username: $GOBKM_USERNAME"
 
-/var/www-data/gobkm -db /data/bkm.db \
+/var/www-data/gobkm -db $db \
 $debug \
 $proxy \
 $logfile \
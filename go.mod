@@ -4,10 +4,13 @@ go 1.18
 
 require (
 	github.com/justinas/alice v1.2.0
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.12
 	github.com/rs/cors v1.8.2
 	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/crypto v0.0.0-20220331220935-ae2d96664a29
 	golang.org/x/net v0.0.0-20220403103023-749bd193bc2b
+	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
 )
 
 require golang.org/x/sys v0.0.0-20220403020550-483a9cbc67c0 // indirect
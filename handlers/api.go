@@ -0,0 +1,1110 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// APIPrefix is the path prefix of the REST API.
+const APIPrefix = "/api/v1"
+
+// apiMaxBody is the maximum size of the API request bodies.
+const apiMaxBody = 1 << 20
+
+var (
+	// errRootFolderChange is returned when renaming, moving
+	// or sorting the root folder with the API.
+	errRootFolderChange = errors.New("the root folder can not be changed")
+	// errFolderCycle is returned when moving a folder into itself or its subfolders.
+	errFolderCycle = errors.New("a folder can not be moved into itself or its subfolders")
+	// errInvalidID is returned for a malformed or not positive API resource id.
+	errInvalidID = errors.New("invalid id")
+)
+
+// apiErrorStruct is the JSON error envelope of the API.
+type apiErrorStruct struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// apiFolder is the API representation of a folder.
+type apiFolder struct {
+	Id            int            `json:"id"`
+	Title         string         `json:"title"`
+	ParentId      *int           `json:"parent_id"` // nil for the root folder and the top shared folders
+	Sort          types.SortMode `json:"sort"`
+	Position      int            `json:"position"`
+	NbFolders     int            `json:"nb_folders"`
+	NbBookmarks   int            `json:"nb_bookmarks,omitempty"` // set by GET /folders/{id}
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	LastVisitedAt *time.Time     `json:"last_visited_at,omitempty"`
+	DeletedAt     *time.Time     `json:"deleted_at,omitempty"`
+	Shared        bool           `json:"shared,omitempty"`
+	Role          string         `json:"role,omitempty"`
+	Owner         string         `json:"owner,omitempty"`
+	Folders       []*apiFolder   `json:"folders,omitempty"`   // set by GET /folders/{id}
+	Bookmarks     []*apiBookmark `json:"bookmarks,omitempty"` // set by GET /folders/{id}
+}
+
+// apiBookmark is the API representation of a bookmark.
+type apiBookmark struct {
+	Id            int          `json:"id"`
+	Title         string       `json:"title"`
+	URL           string       `json:"url"`
+	Favicon       string       `json:"favicon,omitempty"`
+	Starred       bool         `json:"starred"`
+	FolderId      *int         `json:"folder_id"` // nil in the trash
+	Tags          []*types.Tag `json:"tags"`
+	Notes         string       `json:"notes"`
+	Position      int          `json:"position"`
+	CreatedAt     time.Time    `json:"created_at"`
+	UpdatedAt     time.Time    `json:"updated_at"`
+	LastVisitedAt *time.Time   `json:"last_visited_at,omitempty"`
+	DeletedAt     *time.Time   `json:"deleted_at,omitempty"`
+}
+
+// apiFolderInput is the body of the folder POST and PATCH requests,
+// the nil fields being left unchanged.
+type apiFolderInput struct {
+	Title    *string         `json:"title"`
+	ParentId *int            `json:"parent_id"`
+	Sort     *types.SortMode `json:"sort"`
+}
+
+// apiBookmarkInput is the body of the bookmark POST and PATCH requests,
+// the nil fields being left unchanged.
+type apiBookmarkInput struct {
+	Title    *string   `json:"title"`
+	URL      *string   `json:"url"`
+	Notes    *string   `json:"notes"`
+	FolderId *int      `json:"folder_id"`
+	Tags     *[]string `json:"tags"` // tag names, the unknown ones being created
+	Starred  *bool     `json:"starred"`
+}
+
+// apiTagInput is the body of the tag POST and PATCH requests.
+type apiTagInput struct {
+	Name string `json:"name"`
+}
+
+// apiRoute is a route of the API, the {id} of the pattern
+// being a positive resource id.
+type apiRoute struct {
+	Method  string
+	Pattern string
+	Handler func(w http.ResponseWriter, r *http.Request, id int)
+}
+
+// apiRoutes returns the routes of the API.
+func (env *Env) apiRoutes() []apiRoute {
+
+	return []apiRoute{
+		{http.MethodGet, "/folders", env.apiGetFolders},
+		{http.MethodPost, "/folders", env.apiAddFolder},
+		{http.MethodGet, "/folders/{id}", env.apiGetFolder},
+		{http.MethodPatch, "/folders/{id}", env.apiUpdateFolder},
+		{http.MethodDelete, "/folders/{id}", env.apiDeleteFolder},
+		{http.MethodGet, "/bookmarks", env.apiGetBookmarks},
+		{http.MethodPost, "/bookmarks", env.apiAddBookmark},
+		{http.MethodGet, "/bookmarks/{id}", env.apiGetBookmark},
+		{http.MethodPatch, "/bookmarks/{id}", env.apiUpdateBookmark},
+		{http.MethodDelete, "/bookmarks/{id}", env.apiDeleteBookmark},
+		{http.MethodGet, "/tags", env.apiGetTags},
+		{http.MethodPost, "/tags", env.apiAddTag},
+		{http.MethodGet, "/tags/{id}", env.apiGetTag},
+		{http.MethodPatch, "/tags/{id}", env.apiUpdateTag},
+		{http.MethodDelete, "/tags/{id}", env.apiDeleteTag},
+		{http.MethodGet, "/webhooks", env.apiGetWebhooks},
+		{http.MethodPost, "/webhooks", env.apiAddWebhook},
+		{http.MethodGet, "/webhooks/{id}", env.apiGetWebhook},
+		{http.MethodDelete, "/webhooks/{id}", env.apiDeleteWebhook},
+		{http.MethodGet, "/webhooks/{id}/deliveries", env.apiGetWebhookDeliveries},
+	}
+
+}
+
+// apiRequest returns true if the given request is an API one.
+func apiRequest(r *http.Request) bool {
+	return r.URL.Path == APIPrefix || strings.HasPrefix(r.URL.Path, APIPrefix+"/")
+}
+
+// statusCode returns the API error code of the given HTTP status.
+func statusCode(status int) string {
+
+	switch status {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusPreconditionFailed:
+		return "precondition_failed"
+	case http.StatusNotImplemented:
+		return "not_implemented"
+	}
+	return "internal_error"
+
+}
+
+// errorCode returns the API error code of the given datastore error.
+func errorCode(err error) string {
+
+	switch {
+	case errors.Is(err, models.ErrInvalidQuery):
+		return "invalid_query"
+	case errors.Is(err, models.ErrRootFolder), errors.Is(err, errRootFolderChange):
+		return "root_folder"
+	case errors.Is(err, errFolderCycle):
+		return "folder_cycle"
+	case errors.Is(err, errOtherOwner):
+		return "other_owner"
+	case errors.Is(err, errInvalidID):
+		return "invalid_id"
+	case errors.Is(err, errInvalidParam), errors.Is(err, models.ErrInvalidCursor):
+		return "invalid_parameter"
+	case errors.Is(err, models.ErrInvalidBatch):
+		return "invalid_operation"
+	}
+	return statusCode(datastoreStatus(err))
+
+}
+
+// failAPI sends an HTTP error (httpStatus) with the given code
+// and errorMessage in the JSON error envelope.
+func failAPI(w http.ResponseWriter, functionName string, code string, errorMessage string, httpStatus int) {
+
+	log.WithFields(log.Fields{
+		"functionName": functionName,
+		"code":         code,
+		"errorMessage": errorMessage,
+	}).Error("failAPI")
+
+	var e apiErrorStruct
+	e.Error.Code = code
+	e.Error.Message = errorMessage
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failAPI")
+	}
+
+}
+
+// failAPIStatus is failHTTP for the API requests, the error code
+// being the one of the HTTP status.
+func failAPIStatus(w http.ResponseWriter, functionName string, errorMessage string, httpStatus int) {
+	failAPI(w, functionName, statusCode(httpStatus), errorMessage, httpStatus)
+}
+
+// apiFail sends the API error of the given datastore error.
+func apiFail(w http.ResponseWriter, functionName string, err error) {
+	failAPI(w, functionName, errorCode(err), err.Error(), datastoreStatus(err))
+}
+
+// writeAPI sends the given value as JSON with the given HTTP status.
+func writeAPI(w http.ResponseWriter, functionName string, status int, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error(functionName + ":JSON encoding error")
+	}
+
+}
+
+// decodeAPI decodes the JSON body of the given request into v,
+// sending a 400 error and returning false if it is invalid.
+func decodeAPI(w http.ResponseWriter, r *http.Request, functionName string, v interface{}) bool {
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		failAPI(w, functionName, "invalid_body", "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+
+}
+
+// queryID returns the positive id of the given query parameter, 0 if empty.
+func queryID(r *http.Request, name string) (int, error) {
+
+	p := r.URL.Query().Get(name)
+	if p == "" {
+		return 0, nil
+	}
+	id, err := strconv.Atoi(p)
+	if err != nil || id <= 0 {
+		return 0, errInvalidID
+	}
+	return id, nil
+
+}
+
+// matchRoute returns the id of the given API path segments
+// if they match the given route pattern.
+func matchRoute(pattern string, segments []string) (int, bool, error) {
+
+	parts := strings.Split(strings.Trim(pattern, "/"), "/")
+	if len(parts) != len(segments) {
+		return 0, false, nil
+	}
+	var id int
+	for i, p := range parts {
+		if p == "{id}" {
+			var err error
+			if id, err = strconv.Atoi(segments[i]); err != nil || id <= 0 {
+				return 0, true, errInvalidID
+			}
+			continue
+		}
+		if p != segments[i] {
+			return 0, false, nil
+		}
+	}
+	return id, true, nil
+
+}
+
+// APIHandler serves the REST API: GET, POST, PATCH and DELETE
+// on the /api/v1/folders, /api/v1/bookmarks, /api/v1/tags
+// and /api/v1/webhooks resources.
+func (env *Env) APIHandler(w http.ResponseWriter, r *http.Request) {
+
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix), "/"), "/")
+	log.WithFields(log.Fields{
+		"method":   r.Method,
+		"segments": segments,
+	}).Debug("APIHandler")
+
+	var allowed []string
+	for _, route := range env.apiRoutes() {
+		id, ok, err := matchRoute(route.Pattern, segments)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			apiFail(w, "APIHandler", err)
+			return
+		}
+		if route.Method == r.Method {
+			route.Handler(w, r, id)
+			return
+		}
+		allowed = append(allowed, route.Method)
+	}
+
+	if len(allowed) == 0 {
+		failAPIStatus(w, "APIHandler", "unknown API resource "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	failAPIStatus(w, "APIHandler", r.Method+" not allowed", http.StatusMethodNotAllowed)
+
+}
+
+// newAPIFolder returns the API representation of the given folder.
+func newAPIFolder(f *types.Folder) *apiFolder {
+
+	af := &apiFolder{Id: f.Id, Title: f.Title, Sort: f.Sort, Position: f.Position, NbFolders: f.NbChildrenFolders, NbBookmarks: f.NbBookmarks,
+		CreatedAt: f.CreatedAt, UpdatedAt: f.UpdatedAt, LastVisitedAt: f.LastVisitedAt, DeletedAt: f.DeletedAt,
+		Shared: f.Shared, Role: f.Role, Owner: f.Owner}
+	if f.Parent != nil {
+		id := f.Parent.Id
+		af.ParentId = &id
+	}
+	for _, c := range f.Folders {
+		af.Folders = append(af.Folders, newAPIFolder(c))
+	}
+	for _, b := range f.Bookmarks {
+		af.Bookmarks = append(af.Bookmarks, newAPIBookmark(b))
+	}
+	return af
+
+}
+
+// newAPIFolders returns the API representation of the given folders.
+func newAPIFolders(flds []*types.Folder) []*apiFolder {
+
+	afs := []*apiFolder{}
+	for _, f := range flds {
+		afs = append(afs, newAPIFolder(f))
+	}
+	return afs
+
+}
+
+// newAPIBookmark returns the API representation of the given bookmark.
+func newAPIBookmark(b *types.Bookmark) *apiBookmark {
+
+	ab := &apiBookmark{Id: b.Id, Title: b.Title, URL: b.URL, Favicon: b.Favicon, Starred: b.Starred, Tags: b.Tags, Notes: b.Notes,
+		Position: b.Position, CreatedAt: b.CreatedAt, UpdatedAt: b.UpdatedAt, LastVisitedAt: b.LastVisitedAt, DeletedAt: b.DeletedAt}
+	if b.Folder != nil {
+		id := b.Folder.Id
+		ab.FolderId = &id
+	}
+	if ab.Tags == nil {
+		ab.Tags = []*types.Tag{}
+	}
+	return ab
+
+}
+
+// newAPIBookmarks returns the API representation of the given bookmarks.
+func newAPIBookmarks(bkms []*types.Bookmark) []*apiBookmark {
+
+	abs := []*apiBookmark{}
+	for _, b := range bkms {
+		abs = append(abs, newAPIBookmark(b))
+	}
+	return abs
+
+}
+
+// namedTags returns the tags of the given datastore with the given names,
+// new ones for the unknown names, without duplicates.
+func namedTags(ctx context.Context, ds models.Datastore, names []string) ([]*types.Tag, error) {
+
+	existing, err := ds.GetTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*types.Tag)
+	for _, t := range existing {
+		if _, ok := byName[t.Name]; !ok {
+			byName[t.Name] = t
+		}
+	}
+
+	var tags []*types.Tag
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		if t, ok := byName[name]; ok {
+			tags = append(tags, t)
+		} else {
+			tags = append(tags, &types.Tag{Name: name})
+		}
+	}
+	return tags, nil
+
+}
+
+// checkMoveFolder returns an error if the user can not move the given folder
+// of the given access to the folder with the given id.
+func (env *Env) checkMoveFolder(ctx context.Context, acc *access, fld *types.Folder, parentID int) error {
+
+	dst, err := env.folderAccess(ctx, parentID, types.RoleEditor)
+	if err != nil {
+		return err
+	}
+	return env.checkMove(ctx, acc, fld.Parent, dst)
+
+}
+
+// setFolderParent sets the parent of the given folder of the given datastore
+// to the folder with the given id, that must not be the folder or one of its subfolders.
+func setFolderParent(ctx context.Context, ds models.Datastore, fld *types.Folder, parentID int) error {
+
+	dstFld, err := ds.GetFolder(ctx, parentID)
+	if err != nil {
+		return err
+	}
+	for f := dstFld; f != nil; f = f.Parent {
+		if f.Id == fld.Id {
+			return errFolderCycle
+		}
+	}
+	fld.Parent = dstFld
+	return nil
+
+}
+
+// apiGetFolders returns a page of the subfolders of the ?parent= folder,
+// the root folder ones by default with the folders shared with the user.
+func (env *Env) apiGetFolders(w http.ResponseWriter, r *http.Request, _ int) {
+
+	parentID, err := queryID(r, "parent")
+	if err != nil {
+		apiFail(w, "apiGetFolders", err)
+		return
+	}
+	p, err := parseListParams(r, folderSorts, "title", reflect.TypeOf(apiFolder{}), true)
+	if err != nil {
+		apiFail(w, "apiGetFolders", err)
+		return
+	}
+
+	var (
+		flds []*types.Folder
+		next *listCursor
+	)
+	if parentID == 0 {
+		flds, next, err = env.rootFolders(r.Context(), p)
+	} else {
+		var acc *access
+		if acc, err = env.folderAccess(r.Context(), parentID, types.RoleViewer); err == nil {
+			var after *models.ListCursor
+			flds, after, err = acc.ds.ListFolders(r.Context(), parentID, p.options("title"))
+			next = p.cursor(after)
+		}
+	}
+	if err != nil {
+		apiFail(w, "apiGetFolders", err)
+		return
+	}
+
+	v, err := p.pick(newAPIFolders(flds))
+	if err != nil {
+		apiFail(w, "apiGetFolders", err)
+		return
+	}
+
+	env.setLink(w, r, next)
+	writeAPI(w, "apiGetFolders", http.StatusOK, v)
+
+}
+
+// rootFolders returns the page of the given parameters of the root subfolders
+// followed by the folders shared with the user, and the cursor of the next page.
+// The shared folders are sorted apart, after the ones of the user.
+func (env *Env) rootFolders(ctx context.Context, p *listParams) ([]*types.Folder, *listCursor, error) {
+
+	var (
+		flds []*types.Folder
+		opts = p.options("title")
+	)
+	if p.Cursor == nil || !p.Cursor.Shared {
+		ds := env.datastore(ctx)
+		root, err := ds.GetRootFolder(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		var next *models.ListCursor
+		if flds, next, err = ds.ListFolders(ctx, root.Id, opts); err != nil || next != nil {
+			return flds, p.cursor(next), err
+		}
+		// The shared folders fill the rest of the page.
+		opts.Limit -= len(flds)
+	}
+
+	shared, err := env.getSharedFolders(ctx, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.Limit > 0 && opts.Limit == 0 {
+		if len(shared) == 0 {
+			return flds, nil, nil
+		}
+		return flds, &listCursor{Sort: p.sortParam(), Shared: true}, nil
+	}
+	if p.Cursor != nil && p.Cursor.Shared && p.Cursor.Id != 0 {
+		opts.After = &models.ListCursor{Key: p.Cursor.Key, Id: p.Cursor.Id}
+	}
+	shared, next := models.PageFolders(shared, opts)
+	if c := p.cursor(next); c != nil {
+		c.Shared = true
+		return append(flds, shared...), c, nil
+	}
+	return append(flds, shared...), nil, nil
+
+}
+
+// apiGetFolder returns the folder with the given id with its subfolders and bookmarks
+// down to the depth parameter, 1 by default, the fields parameter selecting the bookmarks fields.
+func (env *Env) apiGetFolder(w http.ResponseWriter, r *http.Request, id int) {
+
+	p, err := parseListParams(r, bookmarkSorts, "", reflect.TypeOf(apiBookmark{}), false)
+	if err != nil {
+		apiFail(w, "apiGetFolder", err)
+		return
+	}
+	depth, err := parseDepth(r, 1)
+	if err != nil {
+		apiFail(w, "apiGetFolder", err)
+		return
+	}
+	acc, err := env.folderAccess(r.Context(), id, types.RoleViewer)
+	if err != nil {
+		apiFail(w, "apiGetFolder", err)
+		return
+	}
+	fld, err := acc.ds.GetFolder(r.Context(), id)
+	if err == nil {
+		err = env.setShared(r.Context(), acc, fld)
+	}
+	if err == nil {
+		err = env.getChildren(r.Context(), acc.ds, fld, depth)
+	}
+	if err != nil {
+		apiFail(w, "apiGetFolder", err)
+		return
+	}
+	v, err := p.pick(newAPIFolder(fld))
+	if err != nil {
+		apiFail(w, "apiGetFolder", err)
+		return
+	}
+
+	writeAPI(w, "apiGetFolder", http.StatusOK, v)
+
+}
+
+// apiAddFolder creates a folder with the POSTed title in the parent_id folder,
+// the root folder by default.
+func (env *Env) apiAddFolder(w http.ResponseWriter, r *http.Request, _ int) {
+
+	var in apiFolderInput
+	if !decodeAPI(w, r, "apiAddFolder", &in) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"in": in,
+	}).Debug("apiAddFolder")
+
+	// Parameters check.
+	if in.Title == nil || strings.TrimSpace(*in.Title) == "" {
+		failAPI(w, "apiAddFolder", "invalid_body", "title required", http.StatusBadRequest)
+		return
+	}
+	if in.Sort != nil && !in.Sort.IsValid() {
+		failAPI(w, "apiAddFolder", "invalid_body", "invalid sort mode", http.StatusBadRequest)
+		return
+	}
+
+	// Getting the parent folder, possibly shared with the user.
+	var (
+		err    error
+		parent *types.Folder
+		acc    = env.userAccess(r.Context())
+	)
+	if in.ParentId != nil {
+		if acc, err = env.folderAccess(r.Context(), *in.ParentId, types.RoleEditor); err == nil {
+			parent, err = acc.ds.GetFolder(r.Context(), *in.ParentId)
+		}
+	} else {
+		parent, err = acc.ds.GetRootFolder(r.Context())
+	}
+	if err != nil {
+		apiFail(w, "apiAddFolder", err)
+		return
+	}
+
+	newFolder := types.Folder{Title: *in.Title, Parent: parent}
+	if in.Sort != nil {
+		newFolder.Sort = *in.Sort
+	}
+	id, err := acc.ds.SaveFolder(r.Context(), &newFolder)
+	if err != nil {
+		apiFail(w, "apiAddFolder", err)
+		return
+	}
+	fld, err := acc.ds.GetFolder(r.Context(), int(id))
+	if err != nil {
+		apiFail(w, "apiAddFolder", err)
+		return
+	}
+	env.publishFolder(r.Context(), acc, types.OperationCreate, fld.Id, nil)
+	env.trimParents(r.Context(), acc, fld)
+
+	w.Header().Set("Location", APIPrefix+"/folders/"+strconv.Itoa(fld.Id))
+	writeAPI(w, "apiAddFolder", http.StatusCreated, newAPIFolder(fld))
+
+}
+
+// apiUpdateFolder renames, sorts or moves, with the parent_id, the folder with the given id.
+func (env *Env) apiUpdateFolder(w http.ResponseWriter, r *http.Request, id int) {
+
+	var in apiFolderInput
+	if !decodeAPI(w, r, "apiUpdateFolder", &in) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"id": id,
+		"in": in,
+	}).Debug("apiUpdateFolder")
+
+	acc, err := env.folderAccess(r.Context(), id, types.RoleEditor)
+	if err != nil {
+		apiFail(w, "apiUpdateFolder", err)
+		return
+	}
+	fld, err := acc.ds.GetFolder(r.Context(), id)
+	if err != nil {
+		apiFail(w, "apiUpdateFolder", err)
+		return
+	}
+	if root, err := acc.ds.GetRootFolder(r.Context()); err != nil || root.Id == id {
+		if err == nil {
+			err = errRootFolderChange
+		}
+		apiFail(w, "apiUpdateFolder", err)
+		return
+	}
+
+	// Parameters check.
+	if in.Title != nil {
+		if strings.TrimSpace(*in.Title) == "" {
+			failAPI(w, "apiUpdateFolder", "invalid_body", "title required", http.StatusBadRequest)
+			return
+		}
+		fld.Title = *in.Title
+	}
+	if in.Sort != nil {
+		if !in.Sort.IsValid() {
+			failAPI(w, "apiUpdateFolder", "invalid_body", "invalid sort mode", http.StatusBadRequest)
+			return
+		}
+		fld.Sort = *in.Sort
+	}
+	operation, users := types.OperationUpdate, audience{}
+	move := in.ParentId != nil && (fld.Parent == nil || fld.Parent.Id != *in.ParentId)
+	if move {
+		if err = env.checkMoveFolder(r.Context(), acc, fld, *in.ParentId); err != nil {
+			apiFail(w, "apiUpdateFolder", err)
+			return
+		}
+		operation, users = types.OperationMove, env.audience(r.Context(), acc, id)
+	}
+
+	// Checking the destination in the transaction of the move,
+	// not to move the folder into a subfolder moved meanwhile.
+	err = acc.ds.WithTx(r.Context(), func(tx models.Datastore) error {
+		if move {
+			if err := setFolderParent(r.Context(), tx, fld, *in.ParentId); err != nil {
+				return err
+			}
+		}
+		return tx.UpdateFolder(r.Context(), fld)
+	})
+	if err != nil {
+		apiFail(w, "apiUpdateFolder", err)
+		return
+	}
+	env.publishFolder(r.Context(), acc, operation, id, users)
+	if fld, err = acc.ds.GetFolder(r.Context(), id); err != nil {
+		apiFail(w, "apiUpdateFolder", err)
+		return
+	}
+	env.trimParents(r.Context(), acc, fld)
+
+	writeAPI(w, "apiUpdateFolder", http.StatusOK, newAPIFolder(fld))
+
+}
+
+// apiDeleteFolder moves the folder with the given id to the trash.
+func (env *Env) apiDeleteFolder(w http.ResponseWriter, r *http.Request, id int) {
+
+	// Checking the user can edit the folder and its parent.
+	acc, err := env.folderAccess(r.Context(), id, types.RoleEditor)
+	if err != nil {
+		apiFail(w, "apiDeleteFolder", err)
+		return
+	}
+	var users audience
+	fld, err := acc.ds.GetFolder(r.Context(), id)
+	if err == nil {
+		err = env.checkMove(r.Context(), acc, fld.Parent, acc)
+	}
+	if err == nil {
+		users = env.audience(r.Context(), acc, id)
+		err = acc.ds.TrashFolder(r.Context(), id)
+	}
+	if err != nil {
+		apiFail(w, "apiDeleteFolder", err)
+		return
+	}
+	env.publish(r.Context(), users, types.RevisionFolder, types.OperationDelete, id, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// apiGetBookmarks returns a page of the bookmarks matching the ?q= search query,
+// or of the ones of the ?folder= folder, of all the folders with the tag
+// or starred filters, or of the root folder by default.
+func (env *Env) apiGetBookmarks(w http.ResponseWriter, r *http.Request, _ int) {
+
+	var (
+		bkms []*types.Bookmark
+		ds   = env.datastore(r.Context())
+	)
+
+	p, err := parseListParams(r, bookmarkSorts, "title", reflect.TypeOf(apiBookmark{}), true)
+	if err != nil {
+		apiFail(w, "apiGetBookmarks", err)
+		return
+	}
+	q := r.URL.Query().Get("q")
+	log.WithFields(log.Fields{
+		"p": p,
+		"q": q,
+	}).Debug("apiGetBookmarks")
+
+	var after *models.ListCursor
+	f := models.BookmarkFilter{FolderId: p.Folder, Tag: p.Tag, Starred: p.Starred}
+	switch {
+	case q != "":
+		// The search results are filtered and sorted as they are matched.
+		if bkms, err = ds.SearchBookmarks(r.Context(), q); err == nil {
+			bkms, after = models.PageBookmarks(p.filterBookmarks(bkms), p.options("title"))
+		}
+	case p.Folder != 0:
+		var acc *access
+		if acc, err = env.folderAccess(r.Context(), p.Folder, types.RoleViewer); err == nil {
+			bkms, after, err = acc.ds.ListBookmarks(r.Context(), f, p.options("title"))
+		}
+	case p.filtered():
+		// All the bookmarks not in the trash.
+		bkms, after, err = ds.ListBookmarks(r.Context(), f, p.options("title"))
+	default:
+		var root *types.Folder
+		if root, err = ds.GetRootFolder(r.Context()); err == nil {
+			f.FolderId = root.Id
+			bkms, after, err = ds.ListBookmarks(r.Context(), f, p.options("title"))
+		}
+	}
+	if err != nil {
+		apiFail(w, "apiGetBookmarks", err)
+		return
+	}
+
+	next := p.cursor(after)
+	v, err := p.pick(newAPIBookmarks(bkms))
+	if err != nil {
+		apiFail(w, "apiGetBookmarks", err)
+		return
+	}
+
+	env.setLink(w, r, next)
+	writeAPI(w, "apiGetBookmarks", http.StatusOK, v)
+
+}
+
+// apiGetBookmark returns the bookmark with the given id.
+func (env *Env) apiGetBookmark(w http.ResponseWriter, r *http.Request, id int) {
+
+	acc, err := env.bookmarkAccess(r.Context(), id, types.RoleViewer)
+	if err != nil {
+		apiFail(w, "apiGetBookmark", err)
+		return
+	}
+	bkm, err := acc.ds.GetBookmark(r.Context(), id)
+	if err != nil {
+		apiFail(w, "apiGetBookmark", err)
+		return
+	}
+
+	writeAPI(w, "apiGetBookmark", http.StatusOK, newAPIBookmark(bkm))
+
+}
+
+// apiAddBookmark creates a bookmark with the POSTed title, url, notes, tags
+// and starred flag in the folder_id folder, the root folder by default.
+func (env *Env) apiAddBookmark(w http.ResponseWriter, r *http.Request, _ int) {
+
+	var in apiBookmarkInput
+	if !decodeAPI(w, r, "apiAddBookmark", &in) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"in": in,
+	}).Debug("apiAddBookmark")
+
+	// Parameters check.
+	if in.Title == nil || strings.TrimSpace(*in.Title) == "" || in.URL == nil || strings.TrimSpace(*in.URL) == "" {
+		failAPI(w, "apiAddBookmark", "invalid_body", "title and url required", http.StatusBadRequest)
+		return
+	}
+
+	// Getting the destination folder, possibly shared with the user.
+	var (
+		err error
+		fld *types.Folder
+		acc = env.userAccess(r.Context())
+	)
+	if in.FolderId != nil {
+		if acc, err = env.folderAccess(r.Context(), *in.FolderId, types.RoleEditor); err == nil {
+			fld, err = acc.ds.GetFolder(r.Context(), *in.FolderId)
+		}
+	} else {
+		fld, err = acc.ds.GetRootFolder(r.Context())
+	}
+	if err != nil {
+		apiFail(w, "apiAddBookmark", err)
+		return
+	}
+
+	newBookmark := types.Bookmark{Title: *in.Title, URL: *in.URL, Folder: fld}
+	if in.Notes != nil {
+		newBookmark.Notes = *in.Notes
+	}
+	if in.Starred != nil {
+		newBookmark.Starred = *in.Starred
+	}
+	if in.Tags != nil {
+		if newBookmark.Tags, err = namedTags(r.Context(), acc.ds, *in.Tags); err != nil {
+			apiFail(w, "apiAddBookmark", err)
+			return
+		}
+	}
+	id, err := acc.ds.SaveBookmark(r.Context(), &newBookmark)
+	if err != nil {
+		apiFail(w, "apiAddBookmark", err)
+		return
+	}
+	bkm, err := acc.ds.GetBookmark(r.Context(), int(id))
+	if err != nil {
+		apiFail(w, "apiAddBookmark", err)
+		return
+	}
+
+	env.publishBookmark(r.Context(), acc, types.OperationCreate, bkm.Id, nil)
+
+	// Updating the bookmark favicon.
+	go env.updateBookmarkFavicon(acc, &types.Bookmark{Id: bkm.Id, URL: bkm.URL})
+
+	w.Header().Set("Location", APIPrefix+"/bookmarks/"+strconv.Itoa(bkm.Id))
+	writeAPI(w, "apiAddBookmark", http.StatusCreated, newAPIBookmark(bkm))
+
+}
+
+// apiUpdateBookmark changes the PATCHed fields of the bookmark with the given id,
+// moving it with the folder_id.
+func (env *Env) apiUpdateBookmark(w http.ResponseWriter, r *http.Request, id int) {
+
+	var in apiBookmarkInput
+	if !decodeAPI(w, r, "apiUpdateBookmark", &in) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"id": id,
+		"in": in,
+	}).Debug("apiUpdateBookmark")
+
+	acc, err := env.bookmarkAccess(r.Context(), id, types.RoleEditor)
+	if err != nil {
+		apiFail(w, "apiUpdateBookmark", err)
+		return
+	}
+	bkm, err := acc.ds.GetBookmark(r.Context(), id)
+	if err != nil {
+		apiFail(w, "apiUpdateBookmark", err)
+		return
+	}
+	oldURL := bkm.URL
+
+	// Parameters check.
+	if in.Title != nil {
+		if strings.TrimSpace(*in.Title) == "" {
+			failAPI(w, "apiUpdateBookmark", "invalid_body", "title required", http.StatusBadRequest)
+			return
+		}
+		bkm.Title = *in.Title
+	}
+	if in.URL != nil {
+		if strings.TrimSpace(*in.URL) == "" {
+			failAPI(w, "apiUpdateBookmark", "invalid_body", "url required", http.StatusBadRequest)
+			return
+		}
+		bkm.URL = *in.URL
+	}
+	if in.Notes != nil {
+		bkm.Notes = *in.Notes
+	}
+	if in.Starred != nil {
+		bkm.Starred = *in.Starred
+	}
+	if in.Tags != nil {
+		if bkm.Tags, err = namedTags(r.Context(), acc.ds, *in.Tags); err != nil {
+			apiFail(w, "apiUpdateBookmark", err)
+			return
+		}
+	}
+	// Only starring the bookmark is a star operation.
+	operation, users := types.OperationUpdate, audience{}
+	if in.Starred != nil && in.Title == nil && in.URL == nil && in.Notes == nil && in.Tags == nil {
+		operation = types.OperationStar
+	}
+	if in.FolderId != nil && (bkm.Folder == nil || bkm.Folder.Id != *in.FolderId) {
+		operation, users = types.OperationMove, env.bookmarkAudience(r.Context(), acc, id)
+		dst, err := env.folderAccess(r.Context(), *in.FolderId, types.RoleEditor)
+		if err == nil {
+			err = env.checkMove(r.Context(), acc, nil, dst)
+		}
+		if err == nil {
+			bkm.Folder, err = acc.ds.GetFolder(r.Context(), *in.FolderId)
+		}
+		if err != nil {
+			apiFail(w, "apiUpdateBookmark", err)
+			return
+		}
+	}
+
+	if err = acc.ds.UpdateBookmark(r.Context(), bkm); err != nil {
+		apiFail(w, "apiUpdateBookmark", err)
+		return
+	}
+	env.publishBookmark(r.Context(), acc, operation, id, users)
+	if bkm, err = acc.ds.GetBookmark(r.Context(), id); err != nil {
+		apiFail(w, "apiUpdateBookmark", err)
+		return
+	}
+	if bkm.URL != oldURL {
+		go env.updateBookmarkFavicon(acc, &types.Bookmark{Id: bkm.Id, URL: bkm.URL})
+	}
+
+	writeAPI(w, "apiUpdateBookmark", http.StatusOK, newAPIBookmark(bkm))
+
+}
+
+// apiDeleteBookmark moves the bookmark with the given id to the trash.
+func (env *Env) apiDeleteBookmark(w http.ResponseWriter, r *http.Request, id int) {
+
+	var users audience
+	acc, err := env.bookmarkAccess(r.Context(), id, types.RoleEditor)
+	if err == nil {
+		users = env.bookmarkAudience(r.Context(), acc, id)
+		err = acc.ds.TrashBookmark(r.Context(), id)
+	}
+	if err != nil {
+		apiFail(w, "apiDeleteBookmark", err)
+		return
+	}
+	env.publish(r.Context(), users, types.RevisionBookmark, types.OperationDelete, id, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// apiGetTags returns a page of the tags of the user, sorted by name by default.
+func (env *Env) apiGetTags(w http.ResponseWriter, r *http.Request, _ int) {
+
+	p, err := parseListParams(r, tagSorts, "name", reflect.TypeOf(types.Tag{}), true)
+	if err != nil {
+		apiFail(w, "apiGetTags", err)
+		return
+	}
+	tags, after, err := env.datastore(r.Context()).ListTags(r.Context(), p.options("name"))
+	if err != nil {
+		apiFail(w, "apiGetTags", err)
+		return
+	}
+	next := p.cursor(after)
+	if tags == nil {
+		tags = []*types.Tag{}
+	}
+	v, err := p.pick(tags)
+	if err != nil {
+		apiFail(w, "apiGetTags", err)
+		return
+	}
+
+	env.setLink(w, r, next)
+	writeAPI(w, "apiGetTags", http.StatusOK, v)
+
+}
+
+// apiGetTag returns the tag with the given id.
+func (env *Env) apiGetTag(w http.ResponseWriter, r *http.Request, id int) {
+
+	tag, err := env.datastore(r.Context()).GetTag(r.Context(), id)
+	if err != nil {
+		apiFail(w, "apiGetTag", err)
+		return
+	}
+
+	writeAPI(w, "apiGetTag", http.StatusOK, tag)
+
+}
+
+// apiAddTag creates a tag with the POSTed name.
+func (env *Env) apiAddTag(w http.ResponseWriter, r *http.Request, _ int) {
+
+	var in apiTagInput
+	if !decodeAPI(w, r, "apiAddTag", &in) {
+		return
+	}
+	if in.Name = strings.TrimSpace(in.Name); in.Name == "" {
+		failAPI(w, "apiAddTag", "invalid_body", "name required", http.StatusBadRequest)
+		return
+	}
+
+	acc := env.userAccess(r.Context())
+	id, err := acc.ds.SaveTag(r.Context(), &types.Tag{Name: in.Name})
+	if err != nil {
+		apiFail(w, "apiAddTag", err)
+		return
+	}
+	env.publishTag(r.Context(), acc, types.OperationCreate, int(id), &types.Tag{Id: int(id), Name: in.Name})
+
+	w.Header().Set("Location", APIPrefix+"/tags/"+strconv.Itoa(int(id)))
+	writeAPI(w, "apiAddTag", http.StatusCreated, types.Tag{Id: int(id), Name: in.Name})
+
+}
+
+// apiUpdateTag renames the tag with the given id.
+func (env *Env) apiUpdateTag(w http.ResponseWriter, r *http.Request, id int) {
+
+	var in apiTagInput
+	if !decodeAPI(w, r, "apiUpdateTag", &in) {
+		return
+	}
+	if in.Name = strings.TrimSpace(in.Name); in.Name == "" {
+		failAPI(w, "apiUpdateTag", "invalid_body", "name required", http.StatusBadRequest)
+		return
+	}
+
+	acc := env.userAccess(r.Context())
+	tag := types.Tag{Id: id, Name: in.Name}
+	if err := acc.ds.UpdateTag(r.Context(), &tag); err != nil {
+		apiFail(w, "apiUpdateTag", err)
+		return
+	}
+	env.publishTag(r.Context(), acc, types.OperationUpdate, id, &tag)
+
+	writeAPI(w, "apiUpdateTag", http.StatusOK, tag)
+
+}
+
+// apiDeleteTag removes the tag with the given id from its bookmarks and deletes it.
+func (env *Env) apiDeleteTag(w http.ResponseWriter, r *http.Request, id int) {
+
+	acc := env.userAccess(r.Context())
+	if err := acc.ds.DeleteTag(r.Context(), id); err != nil {
+		apiFail(w, "apiDeleteTag", err)
+		return
+	}
+	env.publishTag(r.Context(), acc, types.OperationDelete, id, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
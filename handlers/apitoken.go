@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// newAPITokenStruct is the JSON of a new API token, the only time its value is shown.
+type newAPITokenStruct struct {
+	*types.APIToken
+	Token string `json:"token"`
+}
+
+// NewAPIToken saves a new API token of the user with the given id
+// and returns it with its value, only its hash being stored.
+// The token never expires if expiresAt is nil.
+func NewAPIToken(ctx context.Context, ds models.Datastore, userID int, name, scope string, expiresAt *time.Time) (string, *types.APIToken, error) {
+
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	apiToken := &types.APIToken{UserId: userID, Name: name, Hash: hashToken(token), Scope: scope, CreatedAt: time.Now().UTC(), ExpiresAt: expiresAt}
+	id, err := ds.SaveAPIToken(ctx, apiToken)
+	if err != nil {
+		return "", nil, err
+	}
+	apiToken.Id = int(id)
+
+	return token, apiToken, nil
+
+}
+
+// sessionUser returns the user logged in with a session cookie, failing
+// without authentication or with an API token, that can not manage the API tokens.
+func sessionUser(w http.ResponseWriter, r *http.Request, functionName string) *types.User {
+
+	user := UserFromContext(r.Context())
+	switch {
+	case user == nil:
+		failHTTP(w, functionName, "the API tokens require a user", http.StatusBadRequest)
+		return nil
+	case apiTokenFromContext(r.Context()) != nil:
+		failHTTP(w, functionName, "the API tokens can not be managed with an API token", http.StatusForbidden)
+		return nil
+	}
+	return user
+
+}
+
+// GetAPITokensHandler returns the API tokens of the logged in user, without their value.
+func (env *Env) GetAPITokensHandler(w http.ResponseWriter, r *http.Request) {
+
+	user := sessionUser(w, r, "GetAPITokensHandler")
+	if user == nil {
+		return
+	}
+
+	tokens, err := env.db(r.Context()).GetAPITokens(r.Context(), user.Id)
+	if err != nil {
+		failHTTP(w, "GetAPITokensHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(tokens); err != nil {
+		failHTTP(w, "GetAPITokensHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
+
+// AddAPITokenHandler creates an API token of the logged in user with the POSTed
+// name, scope, read by default, and optional expires_at date,
+// and returns it with its value.
+func (env *Env) AddAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err error
+		t   types.APIToken
+	)
+
+	if r.Method != http.MethodPost {
+		failHTTP(w, "AddAPITokenHandler", "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	user := sessionUser(w, r, "AddAPITokenHandler")
+	if user == nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(&t); err != nil {
+		failHTTP(w, "AddAPITokenHandler", "form decoding error", http.StatusBadRequest)
+		return
+	}
+	log.WithFields(log.Fields{
+		"name":      t.Name,
+		"scope":     t.Scope,
+		"expiresAt": t.ExpiresAt,
+	}).Debug("AddAPITokenHandler:Query parameter")
+
+	// Parameters check.
+	if t.Scope == "" {
+		t.Scope = types.ScopeRead
+	}
+	if t.ExpiresAt != nil && !t.ExpiresAt.After(time.Now()) {
+		failHTTP(w, "AddAPITokenHandler", "expires_at in the past", http.StatusBadRequest)
+		return
+	}
+
+	token, apiToken, err := NewAPIToken(r.Context(), env.db(r.Context()), user.Id, t.Name, t.Scope, t.ExpiresAt)
+	if err != nil {
+		failHTTP(w, "AddAPITokenHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(newAPITokenStruct{APIToken: apiToken, Token: token}); err != nil {
+		failHTTP(w, "AddAPITokenHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
+
+// RevokeAPITokenHandler deletes the given API token of the logged in user.
+func (env *Env) RevokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err error
+		id  int
+	)
+
+	if r.Method != http.MethodPost {
+		failHTTP(w, "RevokeAPITokenHandler", "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	user := sessionUser(w, r, "RevokeAPITokenHandler")
+	if user == nil {
+		return
+	}
+
+	// GET parameters retrieval.
+	idParam := r.URL.Query().Get("id")
+	log.WithFields(log.Fields{
+		"idParam": idParam,
+	}).Debug("RevokeAPITokenHandler:Query parameter")
+
+	// id int convertion.
+	if id, err = strconv.Atoi(idParam); err != nil {
+		failHTTP(w, "RevokeAPITokenHandler", "id Atoi conversion", http.StatusBadRequest)
+		return
+	}
+
+	if err = env.db(r.Context()).DeleteAPIToken(r.Context(), user.Id, id); err != nil {
+		failHTTP(w, "RevokeAPITokenHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	// Returning an empty JSON to trigger de done() ajax function.
+	if err = json.NewEncoder(w).Encode(types.APIToken{}); err != nil {
+		failHTTP(w, "RevokeAPITokenHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
@@ -0,0 +1,475 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+const (
+	sessionCookie = "gobkm_session" // the session token
+	loginCookie   = "gobkm_login"   // the CSRF token of the login form
+	csrfHeader    = "X-CSRF-Token"
+	csrfField     = "csrf_token"
+	bearerPrefix  = "Bearer "
+
+	// DefaultSessionLifetime is the session lifetime used if not set in the Env.
+	DefaultSessionLifetime = 30 * 24 * time.Hour
+)
+
+// contextKey is the type of the request context keys of the package.
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	sessionKey
+	apiTokenKey
+	txKey
+	eventsKey
+)
+
+// apiTokenUseDelay is the minimum delay between two updates
+// of the last used date of an API token.
+const apiTokenUseDelay = time.Minute
+
+// readOnlyPaths are the paths of the GET requests allowed
+// with a read-only API token, in addition to the main page.
+// Opening a folder or visiting a bookmark records its visit date,
+// the only change allowed with a read-only token, and without CSRF token
+// as the bookmarks are opened with links.
+var readOnlyPaths = []string{
+	"/wasm/",
+	"/getTags/",
+	"/getStars/",
+	"/getFolderChildren/",
+	"/getTree/",
+	"/events/",
+	"/export/",
+	"/searchBookmarks/",
+	"/visitBookmark/",
+	"/getTrash/",
+	"/getHistory/",
+	"/getFolderGrants/",
+	"/getShareLinks/",
+	APIPrefix + "/",
+}
+
+// sessionReadPaths are the paths of the GET requests of the logged in users
+// that do not change anything, in addition to the readOnlyPaths.
+var sessionReadPaths = []string{
+	"/getAPITokens/",
+}
+
+// loginDataStruct is used to pass data to the login template.
+type loginDataStruct struct {
+	Username  string
+	Next      string
+	CSRFToken string
+	Error     string
+}
+
+// UserFromContext returns the logged in user of the given request context,
+// nil if the authentication is disabled (ie. there is no user).
+func UserFromContext(ctx context.Context) *types.User {
+
+	u, _ := ctx.Value(userKey).(*types.User)
+	return u
+
+}
+
+// sessionFromContext returns the session of the given request context, nil if none.
+func sessionFromContext(ctx context.Context) *types.Session {
+
+	s, _ := ctx.Value(sessionKey).(*types.Session)
+	return s
+
+}
+
+// apiTokenFromContext returns the API token of the given request context,
+// nil if the request was authenticated with a session cookie.
+func apiTokenFromContext(ctx context.Context) *types.APIToken {
+
+	t, _ := ctx.Value(apiTokenKey).(*types.APIToken)
+	return t
+
+}
+
+// randomToken returns a new random URL safe token.
+func randomToken() (string, error) {
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+
+}
+
+// hashToken returns the hash of the given token stored in the datastore,
+// so that a leaked database does not give the sessions away.
+func hashToken(token string) string {
+
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+
+}
+
+// equalTokens returns true if the given tokens are equal and not empty.
+func equalTokens(a, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// safeMethod returns true for the HTTP methods that do not require a CSRF token.
+func safeMethod(method string) bool {
+
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+
+}
+
+// readOnlyRequest returns true if the given request
+// does not change the folders and bookmarks.
+func readOnlyRequest(r *http.Request) bool {
+
+	if !safeMethod(r.Method) {
+		return false
+	}
+	if r.URL.Path == "/" {
+		return true
+	}
+	for _, p := range readOnlyPaths {
+		if strings.HasPrefix(r.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+
+}
+
+// csrfRequired returns true if the given request of a session requires
+// its CSRF token: the requests that can change something, whatever
+// their method, not to be triggered by a cross-site link.
+func csrfRequired(r *http.Request) bool {
+
+	if readOnlyRequest(r) {
+		return false
+	}
+	if safeMethod(r.Method) {
+		for _, p := range sessionReadPaths {
+			if strings.HasPrefix(r.URL.Path, p) {
+				return false
+			}
+		}
+	}
+	return true
+
+}
+
+// bearerToken returns the token of the Authorization header
+// of the given request, empty if none.
+func bearerToken(r *http.Request) string {
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(bearerPrefix) || !strings.EqualFold(auth[:len(bearerPrefix)], bearerPrefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(bearerPrefix):])
+
+}
+
+// apiTokenUser returns the API token with the given value and its user,
+// ErrNotFound if it does not exist or has expired. Its last used date is updated.
+func (env *Env) apiTokenUser(ctx context.Context, token string) (*types.APIToken, *types.User, error) {
+
+	apiToken, err := env.DB.GetAPIToken(ctx, hashToken(token))
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := env.DB.GetUser(ctx, apiToken.UserId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Not writing on every request.
+	if now := time.Now(); apiToken.LastUsedAt == nil || now.Sub(*apiToken.LastUsedAt) > apiTokenUseDelay {
+		if err = env.DB.UseAPIToken(ctx, apiToken.Id, now); err != nil {
+			// Just logging the error.
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("apiTokenUser")
+		}
+	}
+
+	return apiToken, user, nil
+
+}
+
+// sessionLifetime returns the lifetime of the new sessions.
+func (env *Env) sessionLifetime() time.Duration {
+
+	if env.SessionLifetime <= 0 {
+		return DefaultSessionLifetime
+	}
+	return env.SessionLifetime
+
+}
+
+// setCookie sets the given cookie with the security attributes,
+// deleting it if maxAge is negative.
+func (env *Env) setCookie(w http.ResponseWriter, name, value string, maxAge int) {
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   env.SecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+}
+
+// authEnabled returns true if there is at least one user,
+// otherwise GoBkm is open as when it relied on the HTTP proxy.
+func (env *Env) authEnabled(ctx context.Context) (bool, error) {
+
+	return env.db(ctx).HasUsers(ctx)
+
+}
+
+// AuthHandler requires a valid session cookie to call the given handler,
+// and its CSRF token, in the X-CSRF-Token header or the csrf_token form field,
+// for the requests changing something, GET ones included, see csrfRequired.
+// The user and session are set in the request context.
+// The main page redirects to the login page, the other ones fail with 401.
+// A valid API token in an "Authorization: Bearer" header replaces the session
+// cookie and the CSRF token, the read-only ones fail with 403
+// on the requests changing the folders and bookmarks.
+func (env *Env) AuthHandler(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// The share links and the API documentation are public.
+		if strings.HasPrefix(r.URL.Path, "/login/") || strings.HasPrefix(r.URL.Path, sharePath) ||
+			r.URL.Path == OpenAPIPath || strings.HasPrefix(r.URL.Path, APIDocPath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The API errors are JSON ones.
+		fail := failHTTP
+		if apiRequest(r) {
+			fail = failAPIStatus
+		}
+
+		enabled, err := env.authEnabled(r.Context())
+		if err != nil {
+			fail(w, "AuthHandler", err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Getting the API token and its user.
+		if token := bearerToken(r); token != "" {
+			apiToken, user, err := env.apiTokenUser(r.Context(), token)
+			switch {
+			case errors.Is(err, models.ErrNotFound):
+				fail(w, "AuthHandler", "invalid API token", http.StatusUnauthorized)
+				return
+			case err != nil:
+				fail(w, "AuthHandler", err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if apiToken.Scope != types.ScopeWrite && !readOnlyRequest(r) {
+				fail(w, "AuthHandler", "read-only API token", http.StatusForbidden)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), userKey, user)
+			ctx = context.WithValue(ctx, apiTokenKey, apiToken)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		// Getting the session and its user.
+		var (
+			session *types.Session
+			user    *types.User
+		)
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			if session, err = env.DB.GetSession(r.Context(), hashToken(c.Value)); err == nil {
+				user, err = env.DB.GetUser(r.Context(), session.UserId)
+			}
+			if err != nil && !errors.Is(err, models.ErrNotFound) {
+				fail(w, "AuthHandler", err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if user == nil {
+			if r.URL.Path == "/" && r.Method == http.MethodGet {
+				http.Redirect(w, r, "/login/", http.StatusFound)
+				return
+			}
+			fail(w, "AuthHandler", "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		// Checking the CSRF token.
+		if csrfRequired(r) {
+			token := r.Header.Get(csrfHeader)
+			if token == "" {
+				token = r.PostFormValue(csrfField)
+			}
+			if !equalTokens(token, session.CSRFToken) {
+				fail(w, "AuthHandler", "invalid CSRF token", http.StatusForbidden)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), userKey, user)
+		ctx = context.WithValue(ctx, sessionKey, session)
+		next.ServeHTTP(w, r.WithContext(ctx))
+
+	})
+
+}
+
+// localPath returns the given path if it is a path of this site, "/" otherwise,
+// to redirect after the login without being an open redirect.
+func localPath(p string) string {
+
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return "/"
+	}
+	return p
+
+}
+
+// renderLogin renders the login page with a new login CSRF token.
+func (env *Env) renderLogin(w http.ResponseWriter, data loginDataStruct, status int) {
+
+	var err error
+	if data.CSRFToken, err = randomToken(); err != nil {
+		failHTTP(w, "renderLogin", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	env.setCookie(w, loginCookie, data.CSRFToken, 0)
+
+	htmlTpl := template.New("login")
+	if htmlTpl, err = htmlTpl.Parse(env.TplLoginData); err != nil {
+		failHTTP(w, "renderLogin", err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err = htmlTpl.Execute(w, data); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("renderLogin")
+	}
+
+}
+
+// LoginHandler shows the login page and logs the user in,
+// setting the session cookie, with a POST of its username and password.
+func (env *Env) LoginHandler(w http.ResponseWriter, r *http.Request) {
+
+	data := loginDataStruct{Next: localPath(r.FormValue("next"))}
+
+	if r.Method != http.MethodPost {
+		env.renderLogin(w, data, http.StatusOK)
+		return
+	}
+
+	// Checking the login form CSRF token (double submit cookie).
+	c, err := r.Cookie(loginCookie)
+	if err != nil || !equalTokens(r.PostFormValue(csrfField), c.Value) {
+		data.Error = "Your login form has expired, please try again."
+		env.renderLogin(w, data, http.StatusForbidden)
+		return
+	}
+
+	// Checking the credentials.
+	data.Username = r.PostFormValue("username")
+	log.WithFields(log.Fields{
+		"username": data.Username,
+	}).Debug("LoginHandler")
+
+	var hash string
+	user, err := env.db(r.Context()).GetUserByName(r.Context(), data.Username)
+	switch {
+	case err == nil:
+		hash = user.PasswordHash
+	case !errors.Is(err, models.ErrNotFound):
+		failHTTP(w, "LoginHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = models.CheckPassword(hash, r.PostFormValue("password")); err != nil {
+		data.Error = "Invalid username or password."
+		env.renderLogin(w, data, http.StatusUnauthorized)
+		return
+	}
+
+	// Creating the session.
+	token, err := randomToken()
+	if err != nil {
+		failHTTP(w, "LoginHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	csrfToken, err := randomToken()
+	if err != nil {
+		failHTTP(w, "LoginHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	lifetime := env.sessionLifetime()
+	session := &types.Session{Id: hashToken(token), UserId: user.Id, CSRFToken: csrfToken, ExpiresAt: time.Now().Add(lifetime)}
+	if err = env.db(r.Context()).SaveSession(r.Context(), session); err != nil {
+		failHTTP(w, "LoginHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	env.setCookie(w, loginCookie, "", -1)
+	env.setCookie(w, sessionCookie, token, int(lifetime.Seconds()))
+	http.Redirect(w, r, data.Next, http.StatusSeeOther)
+
+}
+
+// LogoutHandler closes the current session and redirects to the login page.
+func (env *Env) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		failHTTP(w, "LogoutHandler", "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if session := sessionFromContext(r.Context()); session != nil {
+		if err := env.db(r.Context()).DeleteSession(r.Context(), session.Id); err != nil {
+			failHTTP(w, "LogoutHandler", err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	env.setCookie(w, sessionCookie, "", -1)
+	http.Redirect(w, r, "/login/", http.StatusSeeOther)
+
+}
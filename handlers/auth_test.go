@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// testLoginTemplate is the login template of the tests, showing its error.
+const testLoginTemplate = `{{.Error}}`
+
+// newAuthEnv returns an Env of a new memory datastore
+// with the user alice of password "secret".
+func newAuthEnv(t *testing.T) *Env {
+
+	env := newTestEnv(t)
+	env.TplLoginData = testLoginTemplate
+	hash, err := models.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = env.DB.SaveUser(context.Background(), &types.User{Username: "alice", PasswordHash: hash}); err != nil {
+		t.Fatal(err)
+	}
+	return env
+
+}
+
+// serveForm returns the response of the given handler to the POST
+// of the given form to the given target, with the given cookies and CSRF header.
+func serveForm(h http.Handler, target string, form url.Values, csrf string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serveSession(h, req, csrf, cookies...)
+
+}
+
+// serveSession returns the response of the given handler to the given request
+// with the given cookies and CSRF header if not empty.
+func serveSession(h http.Handler, req *http.Request, csrf string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	if csrf != "" {
+		req.Header.Set(csrfHeader, csrf)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+
+}
+
+// responseCookie returns the cookie with the given name set by the given response, nil if none.
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+
+}
+
+// loginForm returns the login cookie of the login page and the form
+// of the given credentials with its CSRF token.
+func loginForm(t *testing.T, h http.Handler, username, password string) (*http.Cookie, url.Values) {
+
+	t.Helper()
+
+	w := serveSession(h, httptest.NewRequest(http.MethodGet, "/login/", nil), "")
+	c := responseCookie(w, loginCookie)
+	if w.Code != http.StatusOK || c == nil || c.Value == "" {
+		t.Fatalf("login page status %d and cookie %v, want 200 and a CSRF cookie", w.Code, c)
+	}
+	return c, url.Values{"username": {username}, "password": {password}, csrfField: {c.Value}}
+
+}
+
+// login logs alice in and returns the session cookie and CSRF token.
+func login(t *testing.T, env *Env, h http.Handler) (*http.Cookie, string) {
+
+	t.Helper()
+
+	c, form := loginForm(t, h, "alice", "secret")
+	w := serveForm(h, "/login/", form, "", c)
+	session := responseCookie(w, sessionCookie)
+	if w.Code != http.StatusSeeOther || session == nil || session.Value == "" {
+		t.Fatalf("login status %d and cookie %v, want 303 and a session cookie", w.Code, session)
+	}
+	s, err := env.DB.GetSession(context.Background(), hashToken(session.Value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session, s.CSRFToken
+
+}
+
+func TestLogin(t *testing.T) {
+
+	env := newAuthEnv(t)
+	h := testHandler(env)
+
+	// The CSRF token of the form must match the login cookie.
+	c, form := loginForm(t, h, "alice", "secret")
+	if w := serveForm(h, "/login/", form, ""); w.Code != http.StatusForbidden {
+		t.Errorf("login without cookie status %d, want 403", w.Code)
+	}
+	other := url.Values{"username": {"alice"}, "password": {"secret"}, csrfField: {"other"}}
+	if w := serveForm(h, "/login/", other, "", c); w.Code != http.StatusForbidden {
+		t.Errorf("login with another CSRF token status %d, want 403", w.Code)
+	}
+
+	// Wrong credentials.
+	for _, credentials := range [][2]string{{"alice", "wrong"}, {"nobody", "secret"}} {
+		c, form := loginForm(t, h, credentials[0], credentials[1])
+		w := serveForm(h, "/login/", form, "", c)
+		if w.Code != http.StatusUnauthorized || responseCookie(w, sessionCookie) != nil {
+			t.Errorf("login of %v status %d, want 401 without session", credentials, w.Code)
+		}
+	}
+
+	// The session cookie is set and the login one deleted.
+	c, form = loginForm(t, h, "alice", "secret")
+	form.Set("next", "//example.com/")
+	w := serveForm(h, "/login/", form, "", c)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Errorf("login status %d to %q, want 303 to /", w.Code, w.Header().Get("Location"))
+	}
+	session := responseCookie(w, sessionCookie)
+	if session == nil || session.Value == "" || !session.HttpOnly {
+		t.Fatalf("session cookie %v, want an HTTP only one", session)
+	}
+	if s, err := env.DB.GetSession(context.Background(), hashToken(session.Value)); err != nil || s.CSRFToken == "" {
+		t.Errorf("session %v, %v, want one with its CSRF token", s, err)
+	}
+	if c := responseCookie(w, loginCookie); c == nil || c.MaxAge >= 0 {
+		t.Errorf("login cookie %v, want it deleted", c)
+	}
+
+}
+
+func TestSession(t *testing.T) {
+
+	env := newAuthEnv(t)
+	h := testHandler(env)
+
+	// Without session.
+	w := serveSession(h, httptest.NewRequest(http.MethodGet, "/", nil), "")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/login/" {
+		t.Errorf("main page status %d to %q, want 302 to /login/", w.Code, w.Header().Get("Location"))
+	}
+	decode(t, serve(t, h, "", http.MethodGet, "/getTree/", nil), http.StatusUnauthorized, nil)
+	decode(t, serve(t, h, "", http.MethodGet, APIPrefix+"/folders", nil), http.StatusUnauthorized, nil)
+
+	session, csrf := login(t, env, h)
+
+	// The reads do not require the CSRF token.
+	decode(t, serveSession(h, httptest.NewRequest(http.MethodGet, "/getTree/", nil), "", session), http.StatusOK, nil)
+
+	// The writes require it, in the header.
+	add := func(csrf string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/addFolder/", strings.NewReader(`{"title":"csrf"}`))
+		req.Header.Set("Content-Type", "application/json")
+		return serveSession(h, req, csrf, session)
+	}
+	decode(t, add(""), http.StatusForbidden, nil)
+	decode(t, add("wrong"), http.StatusForbidden, nil)
+	var fld types.Folder
+	decode(t, add(csrf), http.StatusOK, &fld)
+
+	// The GET requests changing something too.
+	del := httptest.NewRequest(http.MethodGet, "/deleteFolder/?id="+strconv.Itoa(fld.Id), nil)
+	decode(t, serveSession(h, del, "", session), http.StatusForbidden, nil)
+	del = httptest.NewRequest(http.MethodGet, "/deleteFolder/?id="+strconv.Itoa(fld.Id), nil)
+	decode(t, serveSession(h, del, csrf, session), http.StatusOK, nil)
+
+	// Or in the form field.
+	w = serveForm(h, "/logout/", url.Values{csrfField: {"wrong"}}, "", session)
+	decode(t, w, http.StatusForbidden, nil)
+	w = serveForm(h, "/logout/", url.Values{csrfField: {csrf}}, "", session)
+	decode(t, w, http.StatusSeeOther, nil)
+
+}
+
+func TestLogout(t *testing.T) {
+
+	env := newAuthEnv(t)
+	h := testHandler(env)
+	session, csrf := login(t, env, h)
+
+	// Logging out requires a POST.
+	w := serveSession(h, httptest.NewRequest(http.MethodGet, "/logout/", nil), csrf, session)
+	decode(t, w, http.StatusMethodNotAllowed, nil)
+	decode(t, serveSession(h, httptest.NewRequest(http.MethodGet, "/getTree/", nil), "", session), http.StatusOK, nil)
+
+	w = serveSession(h, httptest.NewRequest(http.MethodPost, "/logout/", nil), csrf, session)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login/" {
+		t.Errorf("logout status %d to %q, want 303 to /login/", w.Code, w.Header().Get("Location"))
+	}
+	if c := responseCookie(w, sessionCookie); c == nil || c.MaxAge >= 0 {
+		t.Errorf("session cookie %v, want it deleted", c)
+	}
+	if _, err := env.DB.GetSession(context.Background(), hashToken(session.Value)); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetSession error %v, want ErrNotFound", err)
+	}
+	decode(t, serveSession(h, httptest.NewRequest(http.MethodGet, "/getTree/", nil), "", session), http.StatusUnauthorized, nil)
+
+}
+
+func TestReadOnlyToken(t *testing.T) {
+
+	env := newTestEnv(t)
+	h := testHandler(env)
+	write := addTestUser(t, env, "alice")
+	user, err := env.DB.GetUserByName(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := "alice-read-token"
+	tok := &types.APIToken{UserId: user.Id, Name: "read", Hash: hashToken(read), Scope: types.ScopeRead}
+	if _, err = env.DB.SaveAPIToken(context.Background(), tok); err != nil {
+		t.Fatal(err)
+	}
+
+	fld := addTestFolder(t, h, write, "fld")
+	bkm := addTestBookmark(t, h, write, "bkm", fld.Id)
+	folderID, bookmarkID := strconv.Itoa(fld.Id), strconv.Itoa(-bkm.Id)
+
+	// The requests changing the folders and bookmarks are forbidden, GET ones included.
+	for _, c := range []struct {
+		method string
+		target string
+		body   interface{}
+	}{
+		{http.MethodPost, "/addFolder/", &types.Folder{Title: "read"}},
+		{http.MethodPost, "/addBookmark/", &types.Bookmark{Title: "read", URL: "https://example.com/", Folder: &types.Folder{Id: fld.Id}}},
+		{http.MethodPost, "/updateFolder/", &types.Folder{Id: fld.Id, Title: "read"}},
+		{http.MethodPost, "/updateBookmark/", &types.Bookmark{Id: -bkm.Id, Title: "read", URL: "https://example.com/"}},
+		{http.MethodPost, "/sortFolder/?sort=url&id=" + folderID, nil},
+		{http.MethodPost, "/batch/", &batchRequestStruct{Operations: []*types.BatchOperation{{Op: "star", BookmarkId: bkm.Id}}}},
+		{http.MethodPost, "/shareFolder/", &types.Grant{FolderId: fld.Id, Username: "alice", Role: types.RoleViewer}},
+		{http.MethodPost, "/undo/", nil},
+		{http.MethodPost, "/restoreTrash/?id=" + folderID, nil},
+		{http.MethodPost, "/purgeTrash/", nil},
+		{http.MethodGet, "/deleteFolder/?id=" + folderID, nil},
+		{http.MethodGet, "/deleteBookmark/?id=" + bookmarkID, nil},
+		{http.MethodGet, "/starBookmark/?star=true&id=" + bookmarkID, nil},
+		{http.MethodPost, APIPrefix + "/folders", map[string]string{"title": "read"}},
+		{http.MethodPatch, APIPrefix + "/folders/" + folderID, map[string]string{"title": "read"}},
+		{http.MethodDelete, APIPrefix + "/folders/" + folderID, nil},
+		{http.MethodPost, APIPrefix + "/bookmarks", map[string]interface{}{"title": "read", "url": "https://example.com/", "folder_id": fld.Id}},
+		{http.MethodPatch, APIPrefix + "/bookmarks/" + strconv.Itoa(bkm.Id), map[string]bool{"starred": true}},
+		{http.MethodDelete, APIPrefix + "/bookmarks/" + strconv.Itoa(bkm.Id), nil},
+		{http.MethodPost, APIPrefix + "/tags", map[string]string{"name": "read"}},
+	} {
+		if w := serve(t, h, read, c.method, c.target, c.body); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s status %d, want 403", c.method, c.target, w.Code)
+		}
+	}
+
+	// The reads are allowed.
+	var children types.Folder
+	decode(t, serve(t, h, read, http.MethodGet, "/getFolderChildren/?id="+folderID, nil), http.StatusOK, &children)
+	if children.Title != "fld" || len(children.Bookmarks) != 1 || children.Bookmarks[0].Title != "bkm" || children.Bookmarks[0].Starred {
+		t.Errorf("folder %+v, want it unchanged", children)
+	}
+	decode(t, serve(t, h, read, http.MethodGet, APIPrefix+"/folders/"+folderID, nil), http.StatusOK, nil)
+
+	// And so are the visits.
+	w := serve(t, h, read, http.MethodGet, "/visitBookmark/?id="+bookmarkID, nil)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != bkm.URL {
+		t.Errorf("visit status %d to %q, want 302 to %q", w.Code, w.Header().Get("Location"), bkm.URL)
+	}
+	if b, err := env.DB.ForUser(user.Id).GetBookmark(context.Background(), bkm.Id); err != nil || b.LastVisitedAt == nil {
+		t.Errorf("visited bookmark %+v, %v, want its visit date", b, err)
+	}
+
+}
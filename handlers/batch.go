@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// batchMaxOperations is the maximum number of operations of a batch.
+const batchMaxOperations = 1000
+
+// The statuses of the operations of a batch.
+const (
+	batchApplied = "applied"
+	batchFailed  = "failed"
+	batchSkipped = "skipped" // not applied because of another failed operation
+)
+
+// batchResultStruct is the result of an operation of a batch.
+type batchResultStruct struct {
+	Index      int    `json:"index"`
+	BookmarkId int    `json:"bookmark_id"`
+	Status     string `json:"status"`
+	Code       string `json:"code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// batchRequestStruct is the body of the batch requests.
+type batchRequestStruct struct {
+	Operations []*types.BatchOperation `json:"operations"`
+}
+
+// batchStruct is the response of the batch requests.
+type batchStruct struct {
+	Applied bool                 `json:"applied"`
+	Results []*batchResultStruct `json:"results"`
+}
+
+// batchItem is an operation of a batch with the access to its bookmark
+// and the audience of the bookmark before the operation.
+type batchItem struct {
+	op    *types.BatchOperation
+	acc   *access
+	users audience
+}
+
+// failBatch sets the given result as failed with the given error.
+func failBatch(result *batchResultStruct, err error) {
+
+	result.Status = batchFailed
+	result.Code = errorCode(err)
+	result.Error = err.Error()
+
+}
+
+// checkBatchItem returns the given operation with the access to its bookmark,
+// checking the user can apply it, and sets its OwnerId to the owner
+// of the bookmark, the only one the operation is then applied on.
+func (env *Env) checkBatchItem(r *http.Request, op *types.BatchOperation) (*batchItem, error) {
+
+	if err := models.CheckBatchOperation(op); err != nil {
+		return nil, err
+	}
+	acc, err := env.bookmarkAccess(r.Context(), op.BookmarkId, types.RoleEditor)
+	if err != nil {
+		return nil, err
+	}
+	item := &batchItem{op: op, acc: acc}
+
+	switch op.Op {
+	case types.BatchMove:
+		dst, err := env.folderAccess(r.Context(), op.FolderId, types.RoleEditor)
+		if err == nil {
+			err = env.checkMove(r.Context(), acc, nil, dst)
+		}
+		if err != nil {
+			return nil, err
+		}
+		item.users = env.bookmarkAudience(r.Context(), acc, op.BookmarkId)
+	case types.BatchDelete:
+		item.users = env.bookmarkAudience(r.Context(), acc, op.BookmarkId)
+	}
+	op.OwnerId = acc.owner
+	return item, nil
+
+}
+
+// BatchHandler applies a POSTed list of operations on bookmarks:
+// {"operations": [{"op": "move", "bookmark_id": 3, "folder_id": 2},
+// {"op": "tag", "bookmark_id": 3, "tags": ["go"]}, {"op": "star", "bookmark_id": 4}]}.
+// The operations are move, tag, untag, star, unstar and delete (to the trash).
+// They are all applied in a single transaction, or none of them if one fails,
+// and the result of each one is returned.
+func (env *Env) BatchHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err   error
+		batch batchRequestStruct
+	)
+
+	if r.Method != http.MethodPost {
+		failHTTP(w, "BatchHandler", "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBody))
+	if err = decoder.Decode(&batch); err != nil {
+		failHTTP(w, "BatchHandler", "form decoding error", http.StatusBadRequest)
+		return
+	}
+	log.WithFields(log.Fields{
+		"operations": len(batch.Operations),
+	}).Debug("BatchHandler:Query parameter")
+
+	if len(batch.Operations) == 0 || len(batch.Operations) > batchMaxOperations {
+		failHTTP(w, "BatchHandler", "the batch must have between 1 and "+strconv.Itoa(batchMaxOperations)+" operations", http.StatusBadRequest)
+		return
+	}
+
+	// Checking all the operations before applying any.
+	status := http.StatusOK
+	response := batchStruct{Results: make([]*batchResultStruct, len(batch.Operations))}
+	items := make([]*batchItem, len(batch.Operations))
+	for i, op := range batch.Operations {
+		if op == nil {
+			op = &types.BatchOperation{}
+			batch.Operations[i] = op
+		}
+		// the ids in the view are negative, reverting
+		if op.BookmarkId < 0 {
+			op.BookmarkId = -op.BookmarkId
+		}
+		response.Results[i] = &batchResultStruct{Index: i, BookmarkId: op.BookmarkId, Status: batchSkipped}
+		if items[i], err = env.checkBatchItem(r, op); err != nil {
+			failBatch(response.Results[i], err)
+			if status == http.StatusOK {
+				status = datastoreStatus(err)
+			}
+		}
+	}
+
+	// Getting the tags of the owners before adding new ones.
+	tags := make(map[int]map[int]bool)
+	if status == http.StatusOK {
+		for _, item := range items {
+			if item.op.Op != types.BatchTag || tags[item.acc.owner] != nil {
+				continue
+			}
+			if tags[item.acc.owner], err = tagIDs(r, item.acc); err != nil {
+				failHTTP(w, "BatchHandler", err.Error(), datastoreStatus(err))
+				return
+			}
+		}
+	}
+
+	// Applying them, on the bookmarks of the owners set by checkBatchItem
+	// (OwnerId not being decoded from the request) and not of the user.
+	if status == http.StatusOK {
+		err = env.db(r.Context()).Batch(r.Context(), batch.Operations)
+		var berr *models.BatchError
+		switch {
+		case errors.As(err, &berr):
+			failBatch(response.Results[berr.Index], berr.Err)
+			status = datastoreStatus(berr.Err)
+		case err != nil:
+			failHTTP(w, "BatchHandler", err.Error(), datastoreStatus(err))
+			return
+		default:
+			response.Applied = true
+			for _, result := range response.Results {
+				result.Status = batchApplied
+			}
+		}
+	}
+
+	if response.Applied {
+		for _, item := range items {
+			switch item.op.Op {
+			case types.BatchMove:
+				env.publishBookmark(r.Context(), item.acc, types.OperationMove, item.op.BookmarkId, item.users)
+			case types.BatchDelete:
+				env.publish(r.Context(), item.users, types.RevisionBookmark, types.OperationDelete, item.op.BookmarkId, nil)
+			case types.BatchStar, types.BatchUnstar:
+				env.publishBookmark(r.Context(), item.acc, types.OperationStar, item.op.BookmarkId, nil)
+			default:
+				env.publishBookmark(r.Context(), item.acc, types.OperationUpdate, item.op.BookmarkId, nil)
+			}
+		}
+		env.publishNewTags(r, items, tags)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err = json.NewEncoder(w).Encode(response); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("BatchHandler:JSON encoding error")
+	}
+
+}
+
+// tagIDs returns the ids of the tags of the owner of the given access.
+func tagIDs(r *http.Request, acc *access) (map[int]bool, error) {
+
+	tags, err := acc.ds.GetTags(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[int]bool, len(tags))
+	for _, t := range tags {
+		ids[t.Id] = true
+	}
+	return ids, nil
+
+}
+
+// publishNewTags sends the creation events of the tags added by the given
+// batch items, the given tags being the ones of the owners before the batch.
+func (env *Env) publishNewTags(r *http.Request, items []*batchItem, tags map[int]map[int]bool) {
+
+	for _, item := range items {
+		before, ok := tags[item.acc.owner]
+		if !ok {
+			continue
+		}
+		delete(tags, item.acc.owner)
+
+		after, err := item.acc.ds.GetTags(r.Context())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("publishNewTags:GetTags")
+			continue
+		}
+		for _, t := range after {
+			if !before[t.Id] {
+				env.publishTag(r.Context(), item.acc, types.OperationCreate, t.Id, t)
+			}
+		}
+	}
+
+}
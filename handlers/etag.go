@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// dataVersion is the version of the data of the logged in user,
+// sent in the ETag and Last-Modified headers of the read requests.
+type dataVersion struct {
+	etag     string    // the quoted entity tag
+	modified time.Time // the last change date, zero if unknown
+}
+
+// dataVersion returns the version of the data of the logged in user
+// of the given context, including the folders shared with them:
+// the entity tag is the data revision of the user followed by the ones
+// of the owners of the shared folders, see models.Datastore.GetDataRevision.
+// It must be called before reading the data, so that the version
+// is never more recent than them.
+func (env *Env) dataVersion(ctx context.Context) (*dataVersion, error) {
+
+	ds := env.datastore(ctx)
+	rev, err := ds.GetDataRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	etag := strconv.FormatInt(rev.Revision, 10)
+	modified := rev.UpdatedAt
+
+	if UserFromContext(ctx) != nil {
+		// Getting the owners of the folders shared with the user, in a stable order.
+		flds, err := ds.GetSharedFolders(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var owners []int
+		seen := map[int]bool{}
+		for _, fld := range flds {
+			acc, err := env.folderAccess(ctx, fld.Id, types.RoleViewer)
+			if err != nil {
+				return nil, err
+			}
+			if !seen[acc.owner] {
+				seen[acc.owner] = true
+				owners = append(owners, acc.owner)
+			}
+		}
+		sort.Ints(owners)
+
+		for _, owner := range owners {
+			rev, err := env.db(ctx).ForUser(owner).GetDataRevision(ctx)
+			if err != nil {
+				return nil, err
+			}
+			etag += "-" + strconv.Itoa(owner) + "." + strconv.FormatInt(rev.Revision, 10)
+			if rev.UpdatedAt.After(modified) {
+				modified = rev.UpdatedAt
+			}
+		}
+	}
+
+	return &dataVersion{etag: `"` + etag + `"`, modified: modified}, nil
+
+}
+
+// setHeaders sets the ETag and Last-Modified headers of the version.
+func (v *dataVersion) setHeaders(w http.ResponseWriter) {
+
+	w.Header().Set("ETag", v.etag)
+	if !v.modified.IsZero() {
+		w.Header().Set("Last-Modified", v.modified.UTC().Format(http.TimeFormat))
+	}
+
+}
+
+// notModified sends a 304 Not Modified response and returns true
+// if the conditional headers of the given request match the version:
+// If-None-Match if any, If-Modified-Since otherwise.
+func (v *dataVersion) notModified(w http.ResponseWriter, r *http.Request) bool {
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !matchETag(inm, v.etag, false) {
+			return false
+		}
+	} else {
+		ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		// The header dates have a one second precision.
+		if err != nil || v.modified.IsZero() || v.modified.Truncate(time.Second).After(ims) {
+			return false
+		}
+	}
+
+	v.setHeaders(w)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+
+}
+
+// matchETag returns true if the given If-Match or If-None-Match header value
+// matches the given entity tag, with the strong comparison for If-Match
+// and the weak one, ignoring the W/ prefixes, for If-None-Match.
+func matchETag(header string, etag string, strong bool) bool {
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if strong {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+
+}
+
+// preconditionError is returned by the transaction of a request
+// whose If-Match header does not match the data version.
+type preconditionError struct {
+	etag string // the current entity tag
+}
+
+// Error returns the error message.
+func (e *preconditionError) Error() string {
+	return "the data changed, now " + e.etag
+}
+
+// errRequestFailed is returned by the transaction of a request
+// failing with an error response, to roll back its changes.
+var errRequestFailed = errors.New("request failed")
+
+// bufferedResponse is a http.ResponseWriter keeping the response
+// until it is sent by send, once the transaction of the request is over.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// Header returns the response header.
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+// Write writes the given data to the response body.
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(data)
+
+}
+
+// WriteHeader sets the response status.
+func (b *bufferedResponse) WriteHeader(status int) {
+
+	if b.status == 0 {
+		b.status = status
+	}
+
+}
+
+// send sends the response to the given writer.
+func (b *bufferedResponse) send(w http.ResponseWriter) {
+
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	w.WriteHeader(b.status)
+	if _, err := b.body.WriteTo(w); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("bufferedResponse:send")
+	}
+
+}
+
+// PreconditionHandler checks the If-Match header of the requests
+// changing the data against their current version, see dataVersion,
+// failing with a 412 Precondition Failed error if it does not match,
+// so that a client does not overwrite changes it has not seen.
+// The check and the request are done in a single transaction, see Env.db,
+// rolled back if the request fails, and the response and the events
+// of the request are sent once committed.
+func (env *Env) PreconditionHandler(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch == "" || readOnlyRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The API errors are JSON ones.
+		fail := failHTTP
+		if apiRequest(r) {
+			fail = failAPIStatus
+		}
+
+		resp := &bufferedResponse{header: http.Header{}}
+		ctx, events := withEventQueue(r.Context())
+		err := env.DB.WithTx(ctx, func(tx models.Datastore) error {
+
+			ctx := context.WithValue(ctx, txKey, tx)
+			v, err := env.dataVersion(ctx)
+			if err != nil {
+				return err
+			}
+			if !matchETag(ifMatch, v.etag, true) {
+				return &preconditionError{etag: v.etag}
+			}
+
+			next.ServeHTTP(resp, r.WithContext(ctx))
+			if resp.status >= http.StatusBadRequest {
+				return errRequestFailed
+			}
+			return nil
+
+		})
+
+		var perr *preconditionError
+		switch {
+		case err == nil:
+			env.flushEvents(events)
+			resp.send(w)
+		case errors.Is(err, errRequestFailed):
+			resp.send(w)
+		case errors.As(err, &perr):
+			w.Header().Set("ETag", perr.etag)
+			fail(w, "PreconditionHandler", "the data changed since "+ifMatch, http.StatusPreconditionFailed)
+		default:
+			fail(w, "PreconditionHandler", err.Error(), http.StatusInternalServerError)
+		}
+
+	})
+
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// newPreconditionEnv returns an Env of a new memory datastore and its current entity tag.
+func newPreconditionEnv(t *testing.T) (*Env, string) {
+
+	db := models.NewMemoryDBstore()
+	if err := db.CreateDatabase(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	env := &Env{DB: db}
+	v, err := env.dataVersion(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env, v.etag
+
+}
+
+// addFolder returns a handler adding a folder with the given title
+// in the datastore of the request, answering with the given status.
+func addFolder(env *Env, title string, status int) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		ds := env.datastore(r.Context())
+		root, err := ds.GetRootFolder(r.Context())
+		if err == nil {
+			_, err = ds.SaveFolder(r.Context(), &types.Folder{Title: title, Parent: root})
+		}
+		if err != nil {
+			status = http.StatusInternalServerError
+		}
+		w.WriteHeader(status)
+
+	})
+
+}
+
+// countFolders returns the number of root subfolders with the given title.
+func countFolders(t *testing.T, env *Env, title string) int {
+
+	ctx := context.Background()
+	root, err := env.DB.GetRootFolder(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flds, err := env.DB.GetFolderSubfolders(ctx, root.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, f := range flds {
+		if f.Title == title {
+			n++
+		}
+	}
+	return n
+
+}
+
+func TestPreconditionHandler(t *testing.T) {
+
+	env, etag := newPreconditionEnv(t)
+	post := func(h http.Handler, ifMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/addFolder/", strings.NewReader("{}"))
+		r.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		env.PreconditionHandler(h).ServeHTTP(w, r)
+		return w
+	}
+
+	// A failing request is rolled back.
+	if w := post(addFolder(env, "failed", http.StatusBadRequest), etag); w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if n := countFolders(t, env, "failed"); n != 0 {
+		t.Errorf("%d folders of a failed request", n)
+	}
+
+	if w := post(addFolder(env, "first", http.StatusCreated), etag); w.Code != http.StatusCreated {
+		t.Errorf("status %d, want %d", w.Code, http.StatusCreated)
+	}
+	// The entity tag is now stale.
+	w := post(addFolder(env, "second", http.StatusCreated), etag)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("status %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+	if w.Header().Get("ETag") == etag || w.Header().Get("ETag") == "" {
+		t.Errorf("ETag %q, want a new one", w.Header().Get("ETag"))
+	}
+	if n := countFolders(t, env, "second"); n != 0 {
+		t.Errorf("%d folders of a failed precondition", n)
+	}
+
+}
+
+func TestPreconditionHandlerConcurrent(t *testing.T) {
+
+	env, etag := newPreconditionEnv(t)
+
+	// Only one of the concurrent requests with the same entity tag succeeds.
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		statuses = map[int]int{}
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, "/addFolder/", strings.NewReader("{}"))
+			r.Header.Set("If-Match", etag)
+			w := httptest.NewRecorder()
+			env.PreconditionHandler(addFolder(env, "concurrent", http.StatusOK)).ServeHTTP(w, r)
+			mu.Lock()
+			statuses[w.Code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if statuses[http.StatusOK] != 1 || statuses[http.StatusPreconditionFailed] != 7 {
+		t.Errorf("statuses %v, want one 200 and seven 412", statuses)
+	}
+	if n := countFolders(t, env, "concurrent"); n != 1 {
+		t.Errorf("%d folders, want 1", n)
+	}
+
+}
+
+// failingCommit is a datastore whose transactions fail once done.
+type failingCommit struct {
+	models.Datastore
+}
+
+// WithTx calls the given function in a transaction and fails as if its commit failed.
+func (ds failingCommit) WithTx(ctx context.Context, f func(tx models.Datastore) error) error {
+
+	if err := ds.Datastore.WithTx(ctx, f); err != nil {
+		return err
+	}
+	return errors.New("commit failed")
+
+}
+
+func TestPreconditionHandlerEvents(t *testing.T) {
+
+	env, etag := newPreconditionEnv(t)
+	env.Events = NewEventBroker(DefaultEventsBufferSize)
+	c, _, _ := env.Events.subscribe(0, 0)
+	defer env.Events.unsubscribe(c)
+
+	// publish returns a handler publishing an event, checking it is not sent
+	// before the end of the transaction, and answering with the given status.
+	publish := func(id, status int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			env.publish(r.Context(), audience{0: true}, types.RevisionFolder, types.OperationCreate, id, nil)
+			if len(c.events) != 0 {
+				t.Error("event sent in the transaction")
+			}
+			w.WriteHeader(status)
+		})
+	}
+	post := func(h http.Handler) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/addFolder/", strings.NewReader("{}"))
+		r.Header.Set("If-Match", etag)
+		w := httptest.NewRecorder()
+		env.PreconditionHandler(h).ServeHTTP(w, r)
+		return w
+	}
+
+	// The events of a failed request or commit are dropped.
+	if w := post(publish(1, http.StatusBadRequest)); w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	db := env.DB
+	env.DB = failingCommit{db}
+	if w := post(publish(2, http.StatusOK)); w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	env.DB = db
+	if len(c.events) != 0 {
+		t.Errorf("%d events of failed requests", len(c.events))
+	}
+
+	// The events of a committed request are sent.
+	if w := post(publish(3, http.StatusOK)); w.Code != http.StatusOK {
+		t.Errorf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	if len(c.events) != 1 {
+		t.Fatalf("%d events, want 1", len(c.events))
+	}
+	if be := <-c.events; be.event.ItemId != 3 {
+		t.Errorf("event of %d, want 3", be.event.ItemId)
+	}
+
+}
@@ -0,0 +1,486 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+const (
+	// DefaultEventsBufferSize is the default number of events kept
+	// for the reconnecting clients.
+	DefaultEventsBufferSize = 1000
+	// eventsKeepAlive is the delay between the comments keeping
+	// the idle event streams open through the proxies.
+	eventsKeepAlive = 30 * time.Second
+	// eventsClientBuffer is the number of events waiting to be sent
+	// to a client before it is disconnected as too slow.
+	eventsClientBuffer = 64
+	// resetEvent is the event sent to the clients that missed events
+	// no longer in the buffer, that must reload their data.
+	resetEvent = "reset"
+)
+
+// audience is the set of the ids of the users an event is sent to.
+type audience map[int]bool
+
+// merge adds the users of the given audience and returns the result.
+func (a audience) merge(b audience) audience {
+
+	for id := range b {
+		a[id] = true
+	}
+	return a
+
+}
+
+// brokerEvent is a published event with its encoded data and audience.
+type brokerEvent struct {
+	event *types.Event
+	data  []byte
+	users audience
+}
+
+// eventClient is a client of the event stream of a user.
+type eventClient struct {
+	user   int
+	events chan *brokerEvent
+}
+
+// EventBroker sends the events to the connected clients of their users
+// and keeps the last ones for the reconnecting clients.
+type EventBroker struct {
+	mu      sync.Mutex
+	lastID  int64
+	size    int
+	buffer  []*brokerEvent // the last events, oldest first
+	clients map[*eventClient]bool
+}
+
+// NewEventBroker returns an EventBroker keeping the given number of events.
+func NewEventBroker(size int) *EventBroker {
+	return &EventBroker{size: size, clients: make(map[*eventClient]bool)}
+}
+
+// publish numbers the given event, keeps it and sends it to the clients
+// of the users of the given audience. The clients too slow to receive it
+// are disconnected, they get it back when reconnecting.
+func (b *EventBroker) publish(users audience, e *types.Event) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e.Id = b.lastID
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("publish:JSON encoding error")
+		return
+	}
+	be := &brokerEvent{event: e, data: data, users: users}
+
+	if b.size > 0 {
+		if len(b.buffer) == b.size {
+			b.buffer = append(b.buffer[:0], b.buffer[1:]...)
+		}
+		b.buffer = append(b.buffer, be)
+	}
+
+	for c := range b.clients {
+		if !users[c.user] {
+			continue
+		}
+		select {
+		case c.events <- be:
+		default:
+			delete(b.clients, c)
+			close(c.events)
+		}
+	}
+
+}
+
+// subscribe connects a client of the given user and returns it
+// with the buffered events following the given last event id, if not 0.
+// reset is true if some of them are not buffered anymore.
+func (b *EventBroker) subscribe(user int, lastID int64) (c *eventClient, replay []*brokerEvent, reset bool) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lastID > 0 {
+		// The ids restart from 1 with the server.
+		reset = lastID > b.lastID || (lastID < b.lastID && (len(b.buffer) == 0 || b.buffer[0].event.Id > lastID+1))
+		for _, be := range b.buffer {
+			if be.event.Id > lastID && be.users[user] {
+				replay = append(replay, be)
+			}
+		}
+	}
+
+	c = &eventClient{user: user, events: make(chan *brokerEvent, eventsClientBuffer)}
+	b.clients[c] = true
+	return c, replay, reset
+
+}
+
+// unsubscribe disconnects the given client.
+func (b *EventBroker) unsubscribe(c *eventClient) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.clients[c] {
+		delete(b.clients, c)
+		close(c.events)
+	}
+
+}
+
+// audience returns the users the given folders of the given access are visible to:
+// their owner and the users they are shared with, directly or with a parent folder.
+// The errors are just logged, the event being sent to the owner anyway.
+func (env *Env) audience(ctx context.Context, acc *access, folderIDs ...int) audience {
+
+	users := audience{acc.owner: true}
+	for _, id := range folderIDs {
+		fld, err := acc.ds.GetFolder(ctx, id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("audience:GetFolder")
+			continue
+		}
+		for f := fld; f != nil; f = f.Parent {
+			grants, err := acc.ds.GetFolderGrants(ctx, f.Id)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("audience:GetFolderGrants")
+				break
+			}
+			for _, g := range grants {
+				users[g.UserId] = true
+			}
+		}
+	}
+	return users
+
+}
+
+// bookmarkAudience returns the audience of the folder of the bookmark
+// with the given id of the given access, see audience.
+func (env *Env) bookmarkAudience(ctx context.Context, acc *access, id int) audience {
+
+	bkm, err := acc.ds.GetBookmark(ctx, id)
+	if err != nil || bkm.Folder == nil {
+		return env.audience(ctx, acc)
+	}
+	return env.audience(ctx, acc, bkm.Folder.Id)
+
+}
+
+// eventItem returns a copy of the given folder, bookmark or tag for an event,
+// without the parents and children that are not visible to all the users.
+func eventItem(item interface{}) interface{} {
+
+	switch v := item.(type) {
+	case *types.Folder:
+		c := *v
+		if c.Parent != nil {
+			c.Parent = &types.Folder{Id: c.Parent.Id}
+		}
+		c.Folders, c.Bookmarks = nil, nil
+		c.Role, c.Owner = "", ""
+		return &c
+	case *types.Bookmark:
+		c := *v
+		if c.Folder != nil {
+			c.Folder = &types.Folder{Id: c.Folder.Id}
+		}
+		return &c
+	}
+	return item
+
+}
+
+// queuedEvent is an event waiting for the transaction of its request.
+type queuedEvent struct {
+	users audience
+	event *types.Event
+}
+
+// eventQueue holds the events published by a request in a transaction,
+// sent once it is committed, see PreconditionHandler.
+type eventQueue struct {
+	events []queuedEvent
+}
+
+// withEventQueue returns a copy of the given context queuing the events
+// published with it in the returned queue.
+func withEventQueue(ctx context.Context) (context.Context, *eventQueue) {
+
+	q := &eventQueue{}
+	return context.WithValue(ctx, eventsKey, q), q
+
+}
+
+// publish sends the event of the given operation on the item of the given kind
+// and id, nil for the deletions, to the clients and webhooks of the users
+// of the given audience, or queues it if the given context has an event queue.
+func (env *Env) publish(ctx context.Context, users audience, kind, operation string, id int, item interface{}) {
+
+	if env.Events == nil && env.Webhooks == nil {
+		return
+	}
+	e := &types.Event{Type: types.EventType(kind, operation), ItemId: id, CreatedAt: time.Now().UTC()}
+	if item != nil {
+		e.Item = eventItem(item)
+	}
+	if q, ok := ctx.Value(eventsKey).(*eventQueue); ok {
+		q.events = append(q.events, queuedEvent{users: users, event: e})
+		return
+	}
+	env.send(users, e)
+
+}
+
+// send sends the given event to the clients and webhooks of the users
+// of the given audience.
+func (env *Env) send(users audience, e *types.Event) {
+
+	// Numbering the event before sending it to the webhooks.
+	if env.Events != nil {
+		env.Events.publish(users, e)
+	}
+	if env.Webhooks != nil {
+		env.Webhooks.send(users, e)
+	}
+
+}
+
+// flushEvents sends the events of the given queue.
+func (env *Env) flushEvents(q *eventQueue) {
+
+	for _, qe := range q.events {
+		env.send(qe.users, qe.event)
+	}
+	q.events = nil
+
+}
+
+// publishBookmark sends the event of the given operation on the bookmark
+// with the given id of the given access, reading it back,
+// to the users of its folder and of the given audience.
+func (env *Env) publishBookmark(ctx context.Context, acc *access, operation string, id int, users audience) {
+
+	bkm, err := acc.ds.GetBookmark(ctx, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("publishBookmark:GetBookmark")
+		return
+	}
+	folderIDs := []int{}
+	if bkm.Folder != nil {
+		folderIDs = append(folderIDs, bkm.Folder.Id)
+	}
+	env.publish(ctx, env.audience(ctx, acc, folderIDs...).merge(users), types.RevisionBookmark, operation, id, bkm)
+
+}
+
+// publishFolder sends the event of the given operation on the folder
+// with the given id of the given access, reading it back,
+// to the users of the folder and of the given audience.
+func (env *Env) publishFolder(ctx context.Context, acc *access, operation string, id int, users audience) {
+
+	fld, err := acc.ds.GetFolder(ctx, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("publishFolder:GetFolder")
+		return
+	}
+	env.publish(ctx, env.audience(ctx, acc, id).merge(users), types.RevisionFolder, operation, id, fld)
+
+}
+
+// publishTag sends the event of the given operation on the given tag,
+// nil for the deletions, of the given access to its owner.
+func (env *Env) publishTag(ctx context.Context, acc *access, operation string, id int, tag *types.Tag) {
+
+	var item interface{}
+	if tag != nil {
+		item = tag
+	}
+	env.publish(ctx, audience{acc.owner: true}, types.EventTag, operation, id, item)
+
+}
+
+// snapshotLocation is the location of a folder or bookmark
+// in a revision snapshot, see types.Revision.
+type snapshotLocation struct {
+	FolderId      int        `json:"folder_id"`
+	ParentId      int        `json:"parent_id"`
+	DeletedAt     *time.Time `json:"deleted_at"`
+	TrashParentId int        `json:"trash_parent_id"`
+}
+
+// decodeLocation returns the location of the given revision snapshot,
+// nil if there is none.
+func decodeLocation(snapshot json.RawMessage) *snapshotLocation {
+
+	var l *snapshotLocation
+	if len(snapshot) > 0 {
+		if err := json.Unmarshal(snapshot, &l); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("decodeLocation:JSON decoding error")
+		}
+	}
+	return l
+
+}
+
+// publishUndo sends the events of the folders and bookmarks of the given access
+// changed by the given undo revisions: delete events for the ones deleted
+// or moved to the trash, create events for the restored ones, move or update
+// events for the other ones, to the users of their folders before and after.
+func (env *Env) publishUndo(ctx context.Context, acc *access, revs []*types.Revision) {
+
+	for _, rev := range revs {
+		before, after := decodeLocation(rev.Before), decodeLocation(rev.After)
+		var folderIDs []int
+		for _, l := range []*snapshotLocation{before, after} {
+			if l == nil {
+				continue
+			}
+			for _, id := range []int{l.FolderId, l.ParentId, l.TrashParentId} {
+				if id != 0 {
+					folderIDs = append(folderIDs, id)
+				}
+			}
+		}
+		users := env.audience(ctx, acc, folderIDs...)
+
+		var operation string
+		switch {
+		case after == nil || after.DeletedAt != nil:
+			env.publish(ctx, users, rev.Kind, types.OperationDelete, rev.ItemId, nil)
+			continue
+		case before == nil || before.DeletedAt != nil:
+			operation = types.OperationCreate
+		case before.FolderId != after.FolderId || before.ParentId != after.ParentId:
+			operation = types.OperationMove
+		default:
+			operation = types.OperationUpdate
+		}
+		if rev.Kind == types.RevisionBookmark {
+			env.publishBookmark(ctx, acc, operation, rev.ItemId, users)
+		} else {
+			env.publishFolder(ctx, acc, operation, rev.ItemId, users)
+		}
+	}
+
+}
+
+// writeEvent writes the given Server-Sent Event.
+func writeEvent(w http.ResponseWriter, id int64, name string, data []byte) error {
+
+	if id > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	return err
+
+}
+
+// EventsHandler streams as Server-Sent Events the changes of the folders,
+// bookmarks and tags visible to the user: folder, bookmark and tag create,
+// update, move, star and delete events with the item as JSON data.
+// A client reconnecting with the Last-Event-ID header, or lastEventId parameter,
+// gets the buffered events it missed, and a reset event first
+// if some of them are not buffered anymore, to reload its data.
+func (env *Env) EventsHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err    error
+		lastID int64
+	)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok || env.Events == nil {
+		failHTTP(w, "EventsHandler", "events not supported", http.StatusNotImplemented)
+		return
+	}
+
+	// Last-Event-ID header or parameter retrieval.
+	lastIDParam := r.Header.Get("Last-Event-ID")
+	if lastIDParam == "" {
+		lastIDParam = r.URL.Query().Get("lastEventId")
+	}
+	log.WithFields(log.Fields{
+		"lastIdParam": lastIDParam,
+	}).Debug("EventsHandler:Query parameter")
+	if lastIDParam != "" {
+		if lastID, err = strconv.ParseInt(lastIDParam, 10, 64); err != nil || lastID < 0 {
+			failHTTP(w, "EventsHandler", "invalid last event id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	c, replay, reset := env.Events.subscribe(env.userAccess(r.Context()).owner, lastID)
+	defer env.Events.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Disabling the nginx proxy buffering.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if reset {
+		err = writeEvent(w, 0, resetEvent, []byte("{}"))
+	}
+	for _, be := range replay {
+		if err == nil {
+			err = writeEvent(w, be.event.Id, be.event.Type, be.data)
+		}
+	}
+	if err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case be, ok := <-c.events:
+			// The client was too slow and is disconnected.
+			if !ok {
+				return
+			}
+			err = writeEvent(w, be.event.Id, be.event.Type, be.data)
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+
+}
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tbellembois/gobkm/types"
+)
+
+// sseEvent is a Server-Sent Event read by an eventStream.
+type sseEvent struct {
+	id   string
+	name string
+	data string
+}
+
+// eventStream is the event stream of a user of a test server.
+type eventStream struct {
+	t      *testing.T
+	events chan sseEvent
+}
+
+// openEventStream opens the event stream of the user of the given API token
+// of the given server, with the given last event id if not empty.
+func openEventStream(t *testing.T, srv *httptest.Server, token, lastID string) *eventStream {
+
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/events/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("events status %d and type %q, want 200 and text/event-stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	s := &eventStream{t: t, events: make(chan sseEvent, 100)}
+	go func() {
+
+		defer close(s.events)
+		var e sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if e.name != "" {
+					s.events <- e
+				}
+				e = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				e.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+
+	}()
+	return s
+
+}
+
+// next returns the next event of the stream, failing after a second.
+func (s *eventStream) next() sseEvent {
+
+	s.t.Helper()
+
+	select {
+	case e, ok := <-s.events:
+		if !ok {
+			s.t.Fatal("event stream closed")
+		}
+		return e
+	case <-time.After(time.Second):
+		s.t.Fatal("no event")
+	}
+	return sseEvent{}
+
+}
+
+// itemID returns the id of the item of the given event.
+func (e sseEvent) itemID(t *testing.T) int {
+
+	t.Helper()
+
+	var ev types.Event
+	if err := json.Unmarshal([]byte(e.data), &ev); err != nil {
+		t.Fatalf("event data %q: %v", e.data, err)
+	}
+	return ev.ItemId
+
+}
+
+// newEventsServer returns a test server of a memory datastore
+// with an event broker keeping the given number of events,
+// and the API tokens of the users alice and bob.
+func newEventsServer(t *testing.T, size int) (*httptest.Server, string, string) {
+
+	env := newTestEnv(t)
+	env.Events = NewEventBroker(size)
+	alice, bob := addTestUser(t, env, "alice"), addTestUser(t, env, "bob")
+	srv := httptest.NewServer(testHandler(env))
+	t.Cleanup(srv.Close)
+	return srv, alice, bob
+
+}
+
+func TestEventsAudience(t *testing.T) {
+
+	srv, alice, bob := newEventsServer(t, DefaultEventsBufferSize)
+	h := srv.Config.Handler
+	aliceEvents, bobEvents := openEventStream(t, srv, alice, ""), openEventStream(t, srv, bob, "")
+
+	aliceFld := addTestFolder(t, h, alice, "alice")
+	bobFld := addTestFolder(t, h, bob, "bob")
+
+	// The events of alice are not sent to bob: the first one bob gets is the folder of bob.
+	e := aliceEvents.next()
+	if e.name != "folder.create" || e.itemID(t) != aliceFld.Id {
+		t.Errorf("alice event %s of %s, want folder.create of %d", e.name, e.data, aliceFld.Id)
+	}
+	e = bobEvents.next()
+	if e.name != "folder.create" || e.itemID(t) != bobFld.Id {
+		t.Errorf("bob event %s of %s, want folder.create of %d", e.name, e.data, bobFld.Id)
+	}
+
+	// Until alice shares the folder with bob.
+	shareTestFolder(t, h, alice, aliceFld.Id, "bob", types.RoleViewer)
+	fld := addSubfolder(t, h, alice, "shared", aliceFld.Id)
+	// Skipping the grant events.
+	e = bobEvents.next()
+	for e.name != "folder.create" {
+		e = bobEvents.next()
+	}
+	if e.itemID(t) != fld.Id {
+		t.Errorf("bob event of %s, want the one of the shared folder %d", e.data, fld.Id)
+	}
+
+}
+
+func TestEventsReplay(t *testing.T) {
+
+	srv, alice, bob := newEventsServer(t, DefaultEventsBufferSize)
+	h := srv.Config.Handler
+
+	var ids []int
+	for _, title := range []string{"a", "b", "c"} {
+		ids = append(ids, addTestFolder(t, h, alice, title).Id)
+	}
+	addTestFolder(t, h, bob, "bob")
+
+	// The events following the last one received, of the user only.
+	s := openEventStream(t, srv, alice, "1")
+	for i, id := range ids[1:] {
+		e := s.next()
+		if e.id != strconv.Itoa(i+2) || e.name != "folder.create" || e.itemID(t) != id {
+			t.Errorf("replayed event %s %s of %s, want %d folder.create of %d", e.id, e.name, e.data, i+2, id)
+		}
+	}
+
+	// Then the new ones.
+	fld := addTestFolder(t, h, alice, "d")
+	if e := s.next(); e.id != "5" || e.itemID(t) != fld.Id {
+		t.Errorf("event %s of %s, want 5 of %d", e.id, e.data, fld.Id)
+	}
+
+}
+
+func TestEventsReset(t *testing.T) {
+
+	srv, alice, _ := newEventsServer(t, 2)
+	h := srv.Config.Handler
+
+	var ids []int
+	for _, title := range []string{"a", "b", "c", "d"} {
+		ids = append(ids, addTestFolder(t, h, alice, title).Id)
+	}
+
+	// The event 2 is not buffered anymore.
+	s := openEventStream(t, srv, alice, "1")
+	if e := s.next(); e.name != resetEvent || e.id != "" {
+		t.Errorf("first event %s %s, want a reset without id", e.id, e.name)
+	}
+	for _, id := range ids[2:] {
+		if e := s.next(); e.itemID(t) != id {
+			t.Errorf("replayed event of %s, want the one of %d", e.data, id)
+		}
+	}
+
+	// Nothing is missed after the last buffered event.
+	s = openEventStream(t, srv, alice, "3")
+	if e := s.next(); e.id != "4" {
+		t.Errorf("first event %s %s, want 4", e.id, e.name)
+	}
+
+	// The ids of before a restart are unknown.
+	s = openEventStream(t, srv, alice, "100")
+	if e := s.next(); e.name != resetEvent {
+		t.Errorf("first event %s, want a reset", e.name)
+	}
+
+	decode(t, serve(t, h, alice, http.MethodGet, "/events/?lastEventId=-1", nil), http.StatusBadRequest, nil)
+
+}
+
+func TestEventsSlowClient(t *testing.T) {
+
+	b := NewEventBroker(DefaultEventsBufferSize)
+	slow, _, _ := b.subscribe(1, 0)
+	fast, _, _ := b.subscribe(1, 0)
+
+	// The fast client reads its events, the slow one does not.
+	for i := 0; i <= eventsClientBuffer; i++ {
+		if i == eventsClientBuffer {
+			for len(fast.events) > 0 {
+				<-fast.events
+			}
+		}
+		b.publish(audience{1: true}, &types.Event{Type: "folder.create", ItemId: i})
+	}
+	if be, ok := <-fast.events; !ok || be.event.ItemId != eventsClientBuffer {
+		t.Errorf("fast client last event %v, want the one of %d", be, eventsClientBuffer)
+	}
+
+	// The slow client gets the buffered events then is disconnected.
+	n := 0
+	for range slow.events {
+		n++
+	}
+	if n != eventsClientBuffer {
+		t.Errorf("slow client got %d events, want %d", n, eventsClientBuffer)
+	}
+	b.mu.Lock()
+	connected := b.clients[slow]
+	b.mu.Unlock()
+	if connected {
+		t.Error("slow client still connected")
+	}
+
+	// Reconnecting, it gets the event it missed back.
+	_, replay, reset := b.subscribe(1, eventsClientBuffer)
+	if reset || len(replay) != 1 || replay[0].event.ItemId != eventsClientBuffer {
+		t.Errorf("replay %v and reset %v, want the missed event", replay, reset)
+	}
+	b.unsubscribe(slow)
+	b.unsubscribe(fast)
+
+}
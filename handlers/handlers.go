@@ -2,14 +2,18 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
@@ -21,21 +25,30 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const faviconRequestBaseURL = "http://www.google.com/s2/favicons?domain_url="
+// DefaultFaviconURL is the favicon service URL used if not set in the Env.
+const DefaultFaviconURL = "http://www.google.com/s2/favicons?domain_url="
 
 // Env is a structure used to pass objects throughout the application.
 type Env struct {
 	DB                  models.Datastore
-	GoBkmProxyURL       string // the application URL
-	GoBkmProxyHost      string // the application Host
-	GoBkmHistorySize    int    // the folder history size
-	GoBkmUsername       string // the dfault login username
-	TplMainData         string // main template data
-	TplAddBookmarkData  string // add bookmark template data
-	TplTestData         string // test template data
-	CSSMainData         []byte // main css data
-	CSSAwesoneFontsData []byte // awesome fonts css data
-	JsData              []byte // js data
+	GoBkmProxyURL       string         // the application URL
+	GoBkmProxyHost      string         // the application Host
+	GoBkmHistorySize    int            // the folder history size
+	GoBkmUsername       string         // the dfault login username
+	SessionLifetime     time.Duration  // the login sessions lifetime
+	SecureCookies       bool           // true to send the cookies over HTTPS only
+	FaviconURL          string         // the favicon service URL, followed by the bookmark domain
+	TplMainData         string         // main template data
+	TplLoginData        string         // login template data
+	TplShareData        string         // share link template data
+	TplAPIDocData       string         // OpenAPI document viewer data
+	TplAddBookmarkData  string         // add bookmark template data
+	TplTestData         string         // test template data
+	Events              *EventBroker   // the events sent to the clients, nil to disable them
+	Webhooks            *WebhookSender // the events sent to the webhooks, nil to disable them
+	CSSMainData         []byte         // main css data
+	CSSAwesoneFontsData []byte         // awesome fonts css data
+	JsData              []byte         // js data
 }
 
 // staticDataStruct is used to pass static data to the Main template.
@@ -48,6 +61,7 @@ type staticDataStruct struct {
 	GoBkmProxyHost      string
 	GoBkmHistorySize    int
 	GoBkmUsername       string
+	CSRFToken           string
 	NewBookmarkURL      string
 	NewBookmarkTitle    string
 }
@@ -73,6 +87,25 @@ func failHTTP(w http.ResponseWriter, functionName string, errorMessage string, h
 
 }
 
+// datastoreStatus returns the HTTP status matching the given datastore error.
+func datastoreStatus(err error) int {
+
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, models.ErrInvalidQuery), errors.Is(err, models.ErrInvalidOrder), errors.Is(err, models.ErrRootFolder),
+		errors.Is(err, models.ErrInvalidAPIToken), errors.Is(err, models.ErrInvalidGrant), errors.Is(err, models.ErrInvalidWebhook), errors.Is(err, models.ErrInvalidBatch), errors.Is(err, errOtherOwner),
+		errors.Is(err, errRootFolderChange), errors.Is(err, errFolderCycle), errors.Is(err, errInvalidID), errors.Is(err, errInvalidParam), errors.Is(err, models.ErrInvalidCursor):
+		return http.StatusBadRequest
+	case errors.Is(err, models.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, models.ErrUndo):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+
+}
+
 // insertIndent the "depth" number of tabs to the given io.Writer.
 func insertIndent(wr io.Writer, depth int) {
 
@@ -88,14 +121,51 @@ func insertIndent(wr io.Writer, depth int) {
 
 }
 
-// updateBookmarkFavicon retrieves and updates the favicon for the given bookmark.
-func (env *Env) updateBookmarkFavicon(bkm *types.Bookmark) {
+// db returns the whole Datastore of the given request context: the transaction
+// of the request, if any, see PreconditionHandler, env.DB otherwise.
+func (env *Env) db(ctx context.Context) models.Datastore {
+
+	if tx, ok := ctx.Value(txKey).(models.Datastore); ok {
+		return tx
+	}
+	return env.DB
+
+}
+
+// datastore returns the Datastore of the user logged in the given request context,
+// the whole Datastore if the authentication is disabled.
+func (env *Env) datastore(ctx context.Context) models.Datastore {
+
+	if u := UserFromContext(ctx); u != nil {
+		return env.db(ctx).ForUser(u.Id)
+	}
+	return env.db(ctx)
+
+}
+
+// faviconURL returns the favicon service URL.
+func (env *Env) faviconURL() string {
+
+	if env.FaviconURL == "" {
+		return DefaultFaviconURL
+	}
+	return env.FaviconURL
+
+}
+
+// updateBookmarkFavicon retrieves and updates the favicon for the given bookmark
+// of the given access, sending its update event. It is called asynchronously
+// so it does not use the request context, nor its transaction if any.
+func (env *Env) updateBookmarkFavicon(acc *access, bkm *types.Bookmark) {
+
+	ctx := context.Background()
+	acc = &access{ds: env.DB.ForUser(acc.owner), owner: acc.owner, role: acc.role, shared: acc.shared}
 
 	if u, err := url.Parse(bkm.URL); err == nil {
 
 		// Building the favicon request URL.
 		bkmDomain := u.Scheme + "://" + u.Host
-		faviconRequestURL := faviconRequestBaseURL + bkmDomain
+		faviconRequestURL := env.faviconURL() + bkmDomain
 		log.WithFields(log.Fields{
 			"bkmDomain":         bkmDomain,
 			"faviconRequestUrl": faviconRequestURL,
@@ -125,19 +195,22 @@ func (env *Env) updateBookmarkFavicon(bkm *types.Bookmark) {
 				"bkm": bkm,
 			}).Debug("UpdateBookmarkFavicon")
 
-			// Updating the bookmark into the DB.
-			env.DB.UpdateBookmark(bkm)
-			if err = env.DB.FlushErrors(); err != nil {
+			// Updating the bookmark into the DB, only its favicon
+			// as the bookmark may have been changed meanwhile.
+			if err = acc.ds.SetBookmarkFavicon(ctx, bkm.Id, bkm.Favicon); err != nil {
 				log.WithFields(log.Fields{
 					"err": err,
 				}).Error("UpdateBookmarkFavicon")
+				return
 			}
+			env.publishBookmark(ctx, acc, types.OperationUpdate, bkm.Id, nil)
 		}
 	}
 
 }
 
-// SearchBookmarkHandler returns the bookmarks matching the search.
+// SearchBookmarkHandler returns the bookmarks matching the search query,
+// see models.ParseQuery for its syntax.
 func (env *Env) SearchBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 
 	var (
@@ -155,16 +228,35 @@ func (env *Env) SearchBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 		failHTTP(w, "SearchBookmarkHandler", "search empty", http.StatusBadRequest)
 		return
 	}
+	p, err := parseListParams(r, bookmarkSorts, "title", reflect.TypeOf(types.Bookmark{}), false)
+	if err != nil {
+		failHTTP(w, "SearchBookmarkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
 
 	// Searching the bookmarks.
-	bkms := env.DB.SearchBookmarks(search[0])
-
-	// Adding them into a map.
-	var bookmarksMap []*types.Bookmark
-	bookmarksMap = append(bookmarksMap, bkms...)
+	bkms, err := env.datastore(r.Context()).SearchBookmarks(r.Context(), search[0])
+	if err != nil {
+		failHTTP(w, "SearchBookmarkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	if p.filtered() {
+		bkms = p.filterBookmarks(bkms)
+	}
+	if p.sorted() {
+		// The search results are sorted as they are matched.
+		var next *models.ListCursor
+		bkms, next = models.PageBookmarks(bkms, p.options("title"))
+		env.setLink(w, r, p.cursor(next))
+	}
+	v, err := p.pick(bkms)
+	if err != nil {
+		failHTTP(w, "SearchBookmarkHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if err = json.NewEncoder(w).Encode(bookmarksMap); err != nil {
+	if err = json.NewEncoder(w).Encode(v); err != nil {
 		failHTTP(w, "SearchBookmarkHandler", err.Error(), http.StatusInternalServerError)
 	}
 
@@ -186,29 +278,52 @@ func (env *Env) AddBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	if err = decoder.Decode(&b); err != nil {
 		failHTTP(w, "AddBookmarkHandler", "form decoding error", http.StatusBadRequest)
+		return
 	}
 	log.WithFields(log.Fields{
 		"b": b,
 	}).Debug("AddBookmarkHandler:Query parameter")
 
-	// Getting the destination folder.
-	dstFld := env.DB.GetFolder(b.Folder.Id)
+	// Parameters check.
+	if b.Folder == nil {
+		failHTTP(w, "AddBookmarkHandler", "folder empty", http.StatusBadRequest)
+		return
+	}
+
+	// Getting the destination folder, possibly shared with the user.
+	acc, err := env.folderAccess(r.Context(), b.Folder.Id, types.RoleEditor)
+	if err != nil {
+		failHTTP(w, "AddBookmarkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	dstFld, err := acc.ds.GetFolder(r.Context(), b.Folder.Id)
+	if err != nil {
+		failHTTP(w, "AddBookmarkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
 	// Creating a new Bookmark.
-	newBookmark := types.Bookmark{Title: b.Title, URL: b.URL, Folder: dstFld, Tags: b.Tags}
+	newBookmark := types.Bookmark{Title: b.Title, URL: b.URL, Notes: b.Notes, Folder: dstFld, Tags: b.Tags}
 	// Saving the bookmark into the DB, getting its id.
-	bookmarkID := env.DB.SaveBookmark(&newBookmark)
-	// Datastore error check
-	if err = env.DB.FlushErrors(); err != nil {
+	bookmarkID, err := acc.ds.SaveBookmark(r.Context(), &newBookmark)
+	if err != nil {
 		failHTTP(w, "AddBookmarkHandler", err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Updating the bookmark favicon.
-	newBookmark.Id = int(bookmarkID)
-	go env.updateBookmarkFavicon(&newBookmark)
+	env.publishBookmark(r.Context(), acc, types.OperationCreate, int(bookmarkID), nil)
+	go env.updateBookmarkFavicon(acc, &types.Bookmark{Id: int(bookmarkID), URL: newBookmark.URL})
+
+	// Reading it back with its dates.
+	bkm, err := acc.ds.GetBookmark(r.Context(), int(bookmarkID))
+	if err != nil {
+		failHTTP(w, "AddBookmarkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	env.trimParents(r.Context(), acc, bkm.Folder)
 
 	w.Header().Set("Content-Type", "application/json")
-	if err = json.NewEncoder(w).Encode(newBookmark); err != nil {
+	if err = json.NewEncoder(w).Encode(bkm); err != nil {
 		failHTTP(w, "AddBookmarkHandler", err.Error(), http.StatusInternalServerError)
 	}
 
@@ -230,6 +345,7 @@ func (env *Env) AddFolderHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	if err = decoder.Decode(&f); err != nil {
 		failHTTP(w, "AddFolderHandler", "form decoding error", http.StatusBadRequest)
+		return
 	}
 	log.WithFields(log.Fields{
 		"f": f,
@@ -240,27 +356,51 @@ func (env *Env) AddFolderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Getting the root folder.
-	parentFolder := env.DB.GetFolder(f.Parent.Id)
+	// Getting the parent folder, possibly shared with the user, the root folder by default.
+	var (
+		parentFolder *types.Folder
+		acc          = env.userAccess(r.Context())
+		ds           = acc.ds
+	)
+	if f.Parent != nil {
+		if acc, err = env.folderAccess(r.Context(), f.Parent.Id, types.RoleEditor); err == nil {
+			ds = acc.ds
+			parentFolder, err = ds.GetFolder(r.Context(), f.Parent.Id)
+		}
+	} else {
+		parentFolder, err = ds.GetRootFolder(r.Context())
+	}
+	if err != nil {
+		failHTTP(w, "AddFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
 	// Creating a new Folder.
 	newFolder := types.Folder{Title: f.Title, Parent: parentFolder}
 	// Saving the folder into the DB, getting its id.
-	newFolder.Id = int(env.DB.SaveFolder(&newFolder))
-	// Datastore error check.
-	if err = env.DB.FlushErrors(); err != nil {
+	folderID, err := ds.SaveFolder(r.Context(), &newFolder)
+	if err != nil {
 		failHTTP(w, "AddFolderHandler", err.Error(), http.StatusInternalServerError)
 		return
 	}
+	env.publishFolder(r.Context(), acc, types.OperationCreate, int(folderID), nil)
+
+	// Reading it back with its dates.
+	fld, err := ds.GetFolder(r.Context(), int(folderID))
+	if err != nil {
+		failHTTP(w, "AddFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	env.trimParents(r.Context(), acc, fld.Parent)
 
 	w.Header().Set("Content-Type", "application/json")
-	//if err = json.NewEncoder(w).Encode(types.Folder{Id: int(folderID), Title: folderName[0], Parent: parentFolder}); err != nil {
-	if err = json.NewEncoder(w).Encode(newFolder); err != nil {
+	if err = json.NewEncoder(w).Encode(fld); err != nil {
 		failHTTP(w, "AddFolderHandler", err.Error(), http.StatusInternalServerError)
 	}
 
 }
 
-// DeleteFolderHandler handles the folders deletion.
+// DeleteFolderHandler handles the folders deletion,
+// moving them to the trash.
 func (env *Env) DeleteFolderHandler(w http.ResponseWriter, r *http.Request) {
 
 	var (
@@ -284,15 +424,29 @@ func (env *Env) DeleteFolderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Getting the folder.
-	fld := env.DB.GetFolder(folderID)
-	// Deleting it.
-	env.DB.DeleteFolder(fld)
-	// Datastore error check
-	if err = env.DB.FlushErrors(); err != nil {
-		failHTTP(w, "DeleteFolderHandler", err.Error(), http.StatusInternalServerError)
+	// Checking the user can edit the folder and its parent.
+	acc, err := env.folderAccess(r.Context(), folderID, types.RoleEditor)
+	if err != nil {
+		failHTTP(w, "DeleteFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	fld, err := acc.ds.GetFolder(r.Context(), folderID)
+	if err != nil {
+		failHTTP(w, "DeleteFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	if err = env.checkMove(r.Context(), acc, fld.Parent, acc); err != nil {
+		failHTTP(w, "DeleteFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+
+	// Moving the folder to the trash.
+	users := env.audience(r.Context(), acc, folderID)
+	if err = acc.ds.TrashFolder(r.Context(), folderID); err != nil {
+		failHTTP(w, "DeleteFolderHandler", err.Error(), datastoreStatus(err))
 		return
 	}
+	env.publish(r.Context(), users, types.RevisionFolder, types.OperationDelete, folderID, nil)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
@@ -303,7 +457,8 @@ func (env *Env) DeleteFolderHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// DeleteBookmarkHandler handles the bookmarks deletion.
+// DeleteBookmarkHandler handles the bookmarks deletion,
+// moving them to the trash.
 func (env *Env) DeleteBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 
 	var (
@@ -329,15 +484,18 @@ func (env *Env) DeleteBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 	// the id in the view in negative, reverting
 	bookmarkID = -bookmarkID
 
-	// Getting the bookmark.
-	bkm := env.DB.GetBookmark(bookmarkID)
-	// Deleting it.
-	env.DB.DeleteBookmark(bkm)
-	// Datastore error check.
-	if err = env.DB.FlushErrors(); err != nil {
-		failHTTP(w, "DeleteBookmarkHandler", err.Error(), http.StatusInternalServerError)
+	// Moving the bookmark to the trash.
+	acc, err := env.bookmarkAccess(r.Context(), bookmarkID, types.RoleEditor)
+	if err != nil {
+		failHTTP(w, "DeleteBookmarkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	users := env.bookmarkAudience(r.Context(), acc, bookmarkID)
+	if err = acc.ds.TrashBookmark(r.Context(), bookmarkID); err != nil {
+		failHTTP(w, "DeleteBookmarkHandler", err.Error(), datastoreStatus(err))
 		return
 	}
+	env.publish(r.Context(), users, types.RevisionBookmark, types.OperationDelete, bookmarkID, nil)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
@@ -348,6 +506,305 @@ func (env *Env) DeleteBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// GetTrashHandler returns the trashed folders and bookmarks.
+func (env *Env) GetTrashHandler(w http.ResponseWriter, r *http.Request) {
+
+	trash, err := env.datastore(r.Context()).GetTrash(r.Context())
+	if err != nil {
+		failHTTP(w, "GetTrashHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Negative bookmark ids as in the view.
+	for _, bkm := range trash.Bookmarks {
+		bkm.Id = -bkm.Id
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(trash); err != nil {
+		failHTTP(w, "GetTrashHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
+
+// RestoreTrashHandler moves the given folder, or bookmark with a
+// negative id, out of the trash. Its missing parent folders are recreated.
+func (env *Env) RestoreTrashHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err error
+		id  int
+	)
+
+	if r.Method != http.MethodPost {
+		failHTTP(w, "RestoreTrashHandler", "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// GET parameters retrieval.
+	idParam := r.URL.Query().Get("id")
+	log.WithFields(log.Fields{
+		"idParam": idParam,
+	}).Debug("RestoreTrashHandler:Query parameter")
+
+	// id int convertion.
+	if id, err = strconv.Atoi(idParam); err != nil {
+		failHTTP(w, "RestoreTrashHandler", "id Atoi conversion", http.StatusBadRequest)
+		return
+	}
+
+	// the id in the view in negative for the bookmarks,
+	// the restored items being created again in the view.
+	acc := env.userAccess(r.Context())
+	if id < 0 {
+		if err = acc.ds.RestoreBookmark(r.Context(), -id); err == nil {
+			env.publishBookmark(r.Context(), acc, types.OperationCreate, -id, nil)
+		}
+	} else {
+		if err = acc.ds.RestoreFolder(r.Context(), id); err == nil {
+			env.publishFolder(r.Context(), acc, types.OperationCreate, id, nil)
+		}
+	}
+	if err != nil {
+		failHTTP(w, "RestoreTrashHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	// Returning an empty JSON to trigger de done() ajax function.
+	if err = json.NewEncoder(w).Encode(types.Folder{}); err != nil {
+		failHTTP(w, "RestoreTrashHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
+
+// PurgeTrashHandler permanently deletes the given trashed folder, or bookmark
+// with a negative id, or the whole trash without id.
+func (env *Env) PurgeTrashHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err error
+		id  int
+	)
+
+	if r.Method != http.MethodPost {
+		failHTTP(w, "PurgeTrashHandler", "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// GET parameters retrieval.
+	idParam := r.URL.Query().Get("id")
+	log.WithFields(log.Fields{
+		"idParam": idParam,
+	}).Debug("PurgeTrashHandler:Query parameter")
+
+	switch {
+	case idParam == "":
+		_, err = env.datastore(r.Context()).PurgeTrash(r.Context(), time.Now())
+	default:
+		if id, err = strconv.Atoi(idParam); err != nil {
+			failHTTP(w, "PurgeTrashHandler", "id Atoi conversion", http.StatusBadRequest)
+			return
+		}
+		err = env.purgeTrashItem(r.Context(), id)
+	}
+	if err != nil {
+		failHTTP(w, "PurgeTrashHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	// Returning an empty JSON to trigger de done() ajax function.
+	if err = json.NewEncoder(w).Encode(types.Folder{}); err != nil {
+		failHTTP(w, "PurgeTrashHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
+
+// purgeTrashItem permanently deletes the given trashed folder,
+// or bookmark with a negative id. It fails if it is not in the trash.
+func (env *Env) purgeTrashItem(ctx context.Context, id int) error {
+
+	// Checking it is in the trash in the transaction of its deletion,
+	// not to delete it if restored meanwhile.
+	return env.datastore(ctx).WithTx(ctx, func(tx models.Datastore) error {
+		if id < 0 {
+			bkm, err := tx.GetBookmark(ctx, -id)
+			if err != nil {
+				return err
+			}
+			if bkm.DeletedAt == nil {
+				return models.ErrNotFound
+			}
+			return tx.DeleteBookmark(ctx, bkm)
+		}
+
+		fld, err := tx.GetFolder(ctx, id)
+		if err != nil {
+			return err
+		}
+		if fld.DeletedAt == nil {
+			return models.ErrNotFound
+		}
+		return tx.DeleteFolder(ctx, fld)
+	})
+
+}
+
+// viewRevisions negates the bookmark ids of the given revisions as in the view.
+func viewRevisions(revs []*types.Revision) {
+
+	for _, rev := range revs {
+		if rev.Kind == types.RevisionBookmark {
+			rev.ItemId = -rev.ItemId
+		}
+	}
+
+}
+
+// GetHistoryHandler returns the revisions of the given folder,
+// or bookmark with a negative id, most recent first.
+func (env *Env) GetHistoryHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err  error
+		id   int
+		revs []*types.Revision
+	)
+	// GET parameters retrieval.
+	idParam := r.URL.Query().Get("id")
+	log.WithFields(log.Fields{
+		"idParam": idParam,
+	}).Debug("GetHistoryHandler:Query parameter")
+
+	// id int convertion.
+	if id, err = strconv.Atoi(idParam); err != nil {
+		failHTTP(w, "GetHistoryHandler", "id Atoi conversion", http.StatusBadRequest)
+		return
+	}
+
+	// the id in the view in negative for the bookmarks
+	var acc *access
+	if id < 0 {
+		if acc, err = env.bookmarkAccess(r.Context(), -id, types.RoleViewer); err == nil {
+			revs, err = acc.ds.GetRevisions(r.Context(), types.RevisionBookmark, -id)
+		}
+	} else {
+		if acc, err = env.folderAccess(r.Context(), id, types.RoleViewer); err == nil {
+			revs, err = acc.ds.GetRevisions(r.Context(), types.RevisionFolder, id)
+		}
+	}
+	if err != nil {
+		failHTTP(w, "GetHistoryHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	viewRevisions(revs)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(revs); err != nil {
+		failHTTP(w, "GetHistoryHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
+
+// UndoHandler reverts the last n changes, 1 by default, and returns
+// the undo revisions. Nothing is reverted if one of them can not be.
+func (env *Env) UndoHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err error
+		n   = 1
+	)
+
+	if r.Method != http.MethodPost {
+		failHTTP(w, "UndoHandler", "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// GET parameters retrieval.
+	nParam := r.URL.Query().Get("n")
+	log.WithFields(log.Fields{
+		"nParam": nParam,
+	}).Debug("UndoHandler:Query parameter")
+
+	// n int convertion.
+	if nParam != "" {
+		if n, err = strconv.Atoi(nParam); err != nil || n < 1 {
+			failHTTP(w, "UndoHandler", "n must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	acc := env.userAccess(r.Context())
+	revs, err := acc.ds.Undo(r.Context(), n)
+	if err != nil {
+		failHTTP(w, "UndoHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	env.publishUndo(r.Context(), acc, revs)
+	if revs == nil {
+		revs = []*types.Revision{}
+	}
+	viewRevisions(revs)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(revs); err != nil {
+		failHTTP(w, "UndoHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
+
+// VisitBookmarkHandler records the bookmark visit
+// and redirects to the bookmark URL. It is allowed
+// with a read-only API token, see readOnlyPaths.
+func (env *Env) VisitBookmarkHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err        error
+		bookmarkID int
+	)
+	// GET parameters retrieval.
+	bookmarkIDParam := r.URL.Query()["id"]
+	log.WithFields(log.Fields{
+		"bookmarkIdParam": bookmarkIDParam,
+	}).Debug("VisitBookmarkHandler:Query parameter")
+
+	// Parameters check.
+	if len(bookmarkIDParam) == 0 {
+		failHTTP(w, "VisitBookmarkHandler", "bookmarkIdParam empty", http.StatusBadRequest)
+		return
+	}
+	// bookmarkId int convertion.
+	if bookmarkID, err = strconv.Atoi(bookmarkIDParam[0]); err != nil {
+		failHTTP(w, "VisitBookmarkHandler", "bookmarkId Atoi conversion", http.StatusInternalServerError)
+		return
+	}
+	// the id in the view in negative, reverting
+	bookmarkID = -bookmarkID
+
+	// Getting the bookmark.
+	acc, err := env.bookmarkAccess(r.Context(), bookmarkID, types.RoleViewer)
+	if err != nil {
+		failHTTP(w, "VisitBookmarkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	bkm, err := acc.ds.GetBookmark(r.Context(), bookmarkID)
+	if err != nil {
+		failHTTP(w, "VisitBookmarkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	// Recording the visit.
+	if err = acc.ds.VisitBookmark(r.Context(), bookmarkID); err != nil {
+		failHTTP(w, "VisitBookmarkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+
+	http.Redirect(w, r, bkm.URL, http.StatusFound)
+
+}
+
 // UpdateFolderHandler handles the folder rename.
 func (env *Env) UpdateFolderHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -364,6 +821,7 @@ func (env *Env) UpdateFolderHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	if err = decoder.Decode(&f); err != nil {
 		failHTTP(w, "UpdateFolderHandler", "form decoding error", http.StatusBadRequest)
+		return
 	}
 	log.WithFields(log.Fields{
 		"f": f,
@@ -374,21 +832,29 @@ func (env *Env) UpdateFolderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Getting the folder.
-	fld := env.DB.GetFolder(f.Id)
+	// Getting the folder, possibly shared with the user.
+	acc, err := env.folderAccess(r.Context(), f.Id, types.RoleEditor)
+	if err != nil {
+		failHTTP(w, "UpdateFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	fld, err := acc.ds.GetFolder(r.Context(), f.Id)
+	if err != nil {
+		failHTTP(w, "UpdateFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
 
 	// And its parent if it exist.
-	if f.Parent != nil && f.Parent.Id != 0 {
+	operation, users := types.OperationUpdate, audience{}
+	move := f.Parent != nil && f.Parent.Id != 0
+	if move {
 		// this is a move
 		// we will update only the parent folder
-		dstFld := env.DB.GetFolder(f.Parent.Id)
-		log.WithFields(log.Fields{
-			"f":      f,
-			"dstFld": dstFld,
-		}).Debug("UpdateFolderHandler: retrieved Folder instances")
-
-		// Updating the source folder parent.
-		f.Parent = dstFld
+		if err = env.checkMoveFolder(r.Context(), acc, fld, f.Parent.Id); err != nil {
+			failHTTP(w, "UpdateFolderHandler", err.Error(), datastoreStatus(err))
+			return
+		}
+		operation, users = types.OperationMove, env.audience(r.Context(), acc, fld.Id)
 	} else {
 		// this is an update
 		// we will update the folder fields
@@ -396,14 +862,26 @@ func (env *Env) UpdateFolderHandler(w http.ResponseWriter, r *http.Request) {
 		fld.Title = f.Title
 	}
 
-	// Updating the folder into the DB.
-	env.DB.UpdateFolder(fld)
-
-	// Datastore error check.
-	if err = env.DB.FlushErrors(); err != nil {
-		failHTTP(w, "UpdateFolderHandler", err.Error(), http.StatusInternalServerError)
+	// Updating the folder into the DB, checking the destination
+	// in the same transaction not to move it into a subfolder moved meanwhile.
+	err = acc.ds.WithTx(r.Context(), func(tx models.Datastore) error {
+		if move {
+			if err := setFolderParent(r.Context(), tx, fld, f.Parent.Id); err != nil {
+				return err
+			}
+			log.WithFields(log.Fields{
+				"f":      f,
+				"dstFld": fld.Parent,
+			}).Debug("UpdateFolderHandler: retrieved Folder instances")
+		}
+		return tx.UpdateFolder(r.Context(), fld)
+	})
+	if err != nil {
+		failHTTP(w, "UpdateFolderHandler", err.Error(), datastoreStatus(err))
 		return
 	}
+	env.publishFolder(r.Context(), acc, operation, fld.Id, users)
+	env.trimParents(r.Context(), acc, fld)
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 	if err = json.NewEncoder(w).Encode(fld); err != nil {
@@ -412,6 +890,123 @@ func (env *Env) UpdateFolderHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// SortFolderHandler handles the folder sort mode change.
+func (env *Env) SortFolderHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err      error
+		folderID int
+	)
+
+	if r.Method != http.MethodPost {
+		failHTTP(w, "SortFolderHandler", "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// GET parameters retrieval.
+	folderIDParam := r.URL.Query().Get("id")
+	sortParam := types.SortMode(r.URL.Query().Get("sort"))
+	log.WithFields(log.Fields{
+		"folderIdParam": folderIDParam,
+		"sortParam":     sortParam,
+	}).Debug("SortFolderHandler:Query parameter")
+
+	// Parameters check.
+	if folderID, err = strconv.Atoi(folderIDParam); err != nil {
+		failHTTP(w, "SortFolderHandler", "folderId Atoi conversion", http.StatusBadRequest)
+		return
+	}
+	if !sortParam.IsValid() {
+		failHTTP(w, "SortFolderHandler", "invalid sort mode", http.StatusBadRequest)
+		return
+	}
+
+	// Getting the folder, possibly shared with the user.
+	acc, err := env.folderAccess(r.Context(), folderID, types.RoleEditor)
+	if err != nil {
+		failHTTP(w, "SortFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	fld, err := acc.ds.GetFolder(r.Context(), folderID)
+	if err != nil {
+		failHTTP(w, "SortFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	// Updating it.
+	fld.Sort = sortParam
+	if err = acc.ds.UpdateFolder(r.Context(), fld); err != nil {
+		failHTTP(w, "SortFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	env.publishFolder(r.Context(), acc, types.OperationUpdate, fld.Id, nil)
+	env.trimParents(r.Context(), acc, fld)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(fld); err != nil {
+		failHTTP(w, "SortFolderHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
+
+// ReorderFolderHandler handles the manual ordering of the folder children.
+// The request body is the folder id and its children ids in the wanted order,
+// with negative bookmark ids as in the view: {"id": 2, "children": [4, -12, 3, -7]}.
+// The children not given are moved after the given ones.
+func (env *Env) ReorderFolderHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err   error
+		order struct {
+			Id       int   `json:"id"`
+			Children []int `json:"children"`
+		}
+		folderIDs, bookmarkIDs []int
+	)
+
+	if err = json.NewDecoder(r.Body).Decode(&order); err != nil {
+		failHTTP(w, "ReorderFolderHandler", "form decoding error", http.StatusBadRequest)
+		return
+	}
+	log.WithFields(log.Fields{
+		"order": order,
+	}).Debug("ReorderFolderHandler:Query parameter")
+
+	// Splitting the children, the ids in the view in negative for the bookmarks.
+	for _, id := range order.Children {
+		if id < 0 {
+			bookmarkIDs = append(bookmarkIDs, -id)
+		} else {
+			folderIDs = append(folderIDs, id)
+		}
+	}
+
+	acc, err := env.folderAccess(r.Context(), order.Id, types.RoleEditor)
+	if err != nil {
+		failHTTP(w, "ReorderFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	if err = acc.ds.ReorderFolderChildren(r.Context(), order.Id, folderIDs, bookmarkIDs); err != nil {
+		failHTTP(w, "ReorderFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	env.publishFolder(r.Context(), acc, types.OperationUpdate, order.Id, nil)
+
+	// Returning the reordered folder.
+	fld, err := acc.ds.GetFolder(r.Context(), order.Id)
+	if err != nil {
+		failHTTP(w, "ReorderFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	env.trimParents(r.Context(), acc, fld)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(fld); err != nil {
+		failHTTP(w, "ReorderFolderHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
+
 // UpdateBookmarkHandler handles the bookmarks rename.
 func (env *Env) UpdateBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -430,6 +1025,7 @@ func (env *Env) UpdateBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	if err = decoder.Decode(&b); err != nil {
 		failHTTP(w, "UpdateBookmarkHandler", "form decoding error", http.StatusBadRequest)
+		return
 	}
 	log.WithFields(log.Fields{
 		"b": b,
@@ -438,52 +1034,98 @@ func (env *Env) UpdateBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 	// the id in the view in negative, reverting
 	bookmarkID = -b.Id
 
-	// Getting the bookmark.
-	bkm := env.DB.GetBookmark(bookmarkID)
+	// Getting the bookmark, possibly shared with the user.
+	acc, err := env.bookmarkAccess(r.Context(), bookmarkID, types.RoleEditor)
+	if err != nil {
+		failHTTP(w, "UpdateBookmarkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
 
-	// Getting the destination folder if it exists.
-	if b.Folder != nil && b.Folder.Id != 0 {
-		// this is a move
-		// we will update only the parent folder
+	// Checking the user can move it to the destination folder if it is a move.
+	operation, users := types.OperationUpdate, audience{}
+	move := b.Folder != nil && b.Folder.Id != 0
+	if move {
+		dst, err := env.folderAccess(r.Context(), b.Folder.Id, types.RoleEditor)
+		if err == nil {
+			err = env.checkMove(r.Context(), acc, nil, dst)
+		}
+		if err != nil {
+			failHTTP(w, "UpdateBookmarkHandler", err.Error(), datastoreStatus(err))
+			return
+		}
+		operation, users = types.OperationMove, env.bookmarkAudience(r.Context(), acc, bookmarkID)
+	}
 
-		dstFld := env.DB.GetFolder(b.Folder.Id)
-		log.WithFields(log.Fields{
-			"srcBkm": bkm,
-			"dstFld": dstFld,
-		}).Debug("UpdateBookmarkHandler: retrieved Folder instances")
+	// Updating the bookmark with its new tags in a transaction.
+	var (
+		bkm     *types.Bookmark
+		newTags []*types.Tag
+	)
+	err = acc.ds.WithTx(r.Context(), func(tx models.Datastore) error {
+		var err error
+		if bkm, err = tx.GetBookmark(r.Context(), bookmarkID); err != nil {
+			return err
+		}
 
-		// Updating the folder parent.
-		bkm.Folder = dstFld
-	} else {
-		// this is an update
-		// we will update the bookmark fields
-
-		// Getting the tags.
-		for _, t := range b.Tags {
-			if t.Id == -1 {
-				// the tag is a new one with name t
-				// adding it into the db
-				t.Id = int(env.DB.SaveTag(&types.Tag{Name: string(t.Name)}))
+		if move {
+			// this is a move
+			// we will update only the parent folder
+			dstFld, err := tx.GetFolder(r.Context(), b.Folder.Id)
+			if err != nil {
+				return err
+			}
+			log.WithFields(log.Fields{
+				"srcBkm": bkm,
+				"dstFld": dstFld,
+			}).Debug("UpdateBookmarkHandler: retrieved Folder instances")
+
+			// Updating the folder parent.
+			bkm.Folder = dstFld
+		} else {
+			// this is an update
+			// we will update the bookmark fields
+
+			// Getting the tags.
+			for _, t := range b.Tags {
+				if t.Id == -1 {
+					// the tag is a new one with name t
+					// adding it into the db
+					tagID, err := tx.SaveTag(r.Context(), &types.Tag{Name: t.Name})
+					if err != nil {
+						return err
+					}
+					t.Id = int(tagID)
+					newTags = append(newTags, &types.Tag{Id: t.Id, Name: t.Name})
+				}
+				tag, err := tx.GetTag(r.Context(), t.Id)
+				if err != nil {
+					return err
+				}
+				bookmarkTags = append(bookmarkTags, tag)
 			}
-			bookmarkTags = append(bookmarkTags, env.DB.GetTag(t.Id))
+			log.WithFields(log.Fields{
+				"bookmarkTags": bookmarkTags,
+			}).Debug("UpdateBookmarkHandler")
+
+			// Updating it.
+			bkm.Title = b.Title
+			bkm.URL = b.URL
+			bkm.Notes = b.Notes
+			bkm.Tags = bookmarkTags
 		}
-		log.WithFields(log.Fields{
-			"bookmarkTags": bookmarkTags,
-		}).Debug("UpdateBookmarkHandler")
-
-		// Updating it.
-		bkm.Title = b.Title
-		bkm.URL = b.URL
-		bkm.Tags = bookmarkTags
-	}
 
-	// Updating the folder into the DB.
-	env.DB.UpdateBookmark(bkm)
-	// Datastore error check.
-	if err = env.DB.FlushErrors(); err != nil {
-		failHTTP(w, "UpdateBookmarkHandler", err.Error(), http.StatusInternalServerError)
+		// Updating the bookmark into the DB.
+		return tx.UpdateBookmark(r.Context(), bkm)
+	})
+	if err != nil {
+		failHTTP(w, "UpdateBookmarkHandler", err.Error(), datastoreStatus(err))
 		return
 	}
+	for _, t := range newTags {
+		env.publishTag(r.Context(), acc, types.OperationCreate, t.Id, t)
+	}
+	env.publishBookmark(r.Context(), acc, operation, bookmarkID, users)
+	env.trimParents(r.Context(), acc, bkm.Folder)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
@@ -530,17 +1172,25 @@ func (env *Env) StarBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 	// the id in the view in negative, reverting
 	bookmarkID = -bookmarkID
 
-	// Getting the bookmark.
-	bkm := env.DB.GetBookmark(bookmarkID)
-	// Renaming it.
+	// Getting the bookmark, possibly shared with the user.
+	acc, err := env.bookmarkAccess(r.Context(), bookmarkID, types.RoleEditor)
+	if err != nil {
+		failHTTP(w, "StarBookmarkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	bkm, err := acc.ds.GetBookmark(r.Context(), bookmarkID)
+	if err != nil {
+		failHTTP(w, "StarBookmarkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	// Starring it.
 	bkm.Starred = star
-	// Updating the folder into the DB.
-	env.DB.UpdateBookmark(bkm)
-	// Datastore error check.
-	if err = env.DB.FlushErrors(); err != nil {
+	// Updating the bookmark into the DB.
+	if err = acc.ds.UpdateBookmark(r.Context(), bkm); err != nil {
 		failHTTP(w, "StarBookmarkHandler", err.Error(), http.StatusInternalServerError)
 		return
 	}
+	env.publishBookmark(r.Context(), acc, types.OperationStar, bookmarkID, nil)
 
 	// Building the result struct.
 	resultBookmarkStruct := types.Bookmark{Id: bookmarkID, Title: bkm.Title, URL: bkm.URL, Favicon: bkm.Favicon, Starred: bkm.Starred}
@@ -556,152 +1206,305 @@ func (env *Env) StarBookmarkHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// getChildren recursively get subfolders and bookmarks of the folder f
-func (env *Env) getChildren(f *types.Folder) types.Folder {
+// getChildren gets the subfolders and bookmarks of the folder f
+// of the given datastore down to the given depth, the whole subtree if negative,
+// see models.Datastore.GetFolderTree.
+func (env *Env) getChildren(ctx context.Context, ds models.Datastore, f *types.Folder, depth int) error {
 
-	log.WithFields(log.Fields{"f.Id": f.Id}).Debug("getChildren")
+	log.WithFields(log.Fields{"f.Id": f.Id, "depth": depth}).Debug("getChildren")
 
-	f.Folders = env.DB.GetFolderSubfolders(f.Id)
-	if f.Folders != nil && len(f.Folders) > 0 {
-		for _, fld := range f.Folders {
-			log.WithFields(log.Fields{"fld": fld}).Debug("getChildren")
-			env.getChildren(fld)
-		}
+	tree, err := ds.GetFolderTree(ctx, f.Id, depth)
+	if err != nil {
+		return err
 	}
+	f.Folders, f.Bookmarks = tree.Folders, tree.Bookmarks
+	f.NbChildrenFolders, f.NbBookmarks = tree.NbChildrenFolders, tree.NbBookmarks
 
-	f.Bookmarks = env.DB.GetFolderBookmarks(f.Id)
-
-	return *f
+	return nil
 
 }
 
-// GetTreeHandler return the entire folder and bookmark tree
+// GetTreeHandler return the entire folder and bookmark tree,
+// or down to the depth parameter, the last level folders having
+// their number of subfolders and bookmarks but no children.
+// The fields parameter selects the bookmarks fields.
+// The conditional requests are supported, see dataVersion.
 func (env *Env) GetTreeHandler(w http.ResponseWriter, r *http.Request) {
 
 	var (
 		err error
 	)
 
-	// Adding root folder.
-	rootNode := &types.Folder{Id: 0, Title: "/"}
+	p, err := parseListParams(r, bookmarkSorts, "", reflect.TypeOf(types.Bookmark{}), false)
+	if err != nil {
+		failHTTP(w, "GetBranchNodesHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	depth, err := parseDepth(r, -1)
+	if err != nil {
+		failHTTP(w, "GetBranchNodesHandler", err.Error(), datastoreStatus(err))
+		return
+	}
 
-	// Getting the root folder children folders and bookmarks.
-	rootNode.Folders = env.DB.GetFolderSubfolders(1)
-	rootNode.Bookmarks = env.DB.GetFolderBookmarks(1)
+	// Getting the data version before the data.
+	version, err := env.dataVersion(r.Context())
+	if err != nil {
+		failHTTP(w, "GetBranchNodesHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if version.notModified(w, r) {
+		return
+	}
+
+	// Adding root folder, with its sort mode.
+	rootFolder, err := env.datastore(r.Context()).GetRootFolder(r.Context())
+	if err != nil {
+		failHTTP(w, "GetBranchNodesHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	rootNode := &types.Folder{Id: rootFolder.Id}
+
+	// Getting the root folder subtree.
+	if err = env.getChildren(r.Context(), env.datastore(r.Context()), rootNode, depth); err != nil {
+		failHTTP(w, "GetBranchNodesHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rootNode.Id, rootNode.Title, rootNode.Sort = 0, "/", rootFolder.Sort
 
-	// Datastore error check.
-	if err = env.DB.FlushErrors(); err != nil {
+	// Adding the folders shared with the user, with their content
+	// down to the same level as the root folder subfolders.
+	sharedDepth := depth - 1
+	if depth < 0 {
+		sharedDepth = depth
+	}
+	shared, err := env.getSharedFolders(r.Context(), sharedDepth)
+	if err != nil {
 		failHTTP(w, "GetBranchNodesHandler", err.Error(), http.StatusInternalServerError)
 		return
 	}
+	rootNode.Folders = append(rootNode.Folders, shared...)
+	rootNode.NbChildrenFolders += len(shared)
 
-	// Recursively getting the subfolders and bookmarks.
-	for _, fld := range rootNode.Folders {
-		env.getChildren(fld)
+	v, err := p.pick(rootNode)
+	if err != nil {
+		failHTTP(w, "GetBranchNodesHandler", err.Error(), http.StatusInternalServerError)
+		return
 	}
 
+	version.setHeaders(w)
 	w.Header().Set("Content-Type", "application/json")
-	if err = json.NewEncoder(w).Encode(rootNode); err != nil {
+	if err = json.NewEncoder(w).Encode(v); err != nil {
 		failHTTP(w, "GetBranchNodesHandler", err.Error(), http.StatusInternalServerError)
 	}
 
 }
 
 // GetTagsHandler retrieves the tags.
+// The conditional requests are supported, see dataVersion.
 func (env *Env) GetTagsHandler(w http.ResponseWriter, r *http.Request) {
 
 	var (
 		err error
 	)
 
+	p, err := parseListParams(r, tagSorts, "name", reflect.TypeOf(types.Tag{}), false)
+	if err != nil {
+		failHTTP(w, "GetTagsHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+
+	// Getting the data version before the data.
+	version, err := env.dataVersion(r.Context())
+	if err != nil {
+		failHTTP(w, "GetTagsHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if version.notModified(w, r) {
+		return
+	}
+
 	// Getting the tags.
-	tags := env.DB.GetTags()
-	// Datastore error check.
-	if err = env.DB.FlushErrors(); err != nil {
+	var (
+		tags []*types.Tag
+		next *models.ListCursor
+	)
+	if p.sorted() {
+		tags, next, err = env.datastore(r.Context()).ListTags(r.Context(), p.options("name"))
+	} else {
+		tags, err = env.datastore(r.Context()).GetTags(r.Context())
+	}
+	if err != nil {
+		failHTTP(w, "GetTagsHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	env.setLink(w, r, p.cursor(next))
+	v, err := p.pick(tags)
+	if err != nil {
 		failHTTP(w, "GetTagsHandler", err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	version.setHeaders(w)
 	w.Header().Set("Content-Type", "application/json")
-	if err = json.NewEncoder(w).Encode(tags); err != nil {
+	if err = json.NewEncoder(w).Encode(v); err != nil {
 		failHTTP(w, "GetTagsHandler", err.Error(), http.StatusInternalServerError)
 	}
 
 }
 
 // GetStarsHandler retrieves the starred bookmarks.
+// The conditional requests are supported, see dataVersion.
 func (env *Env) GetStarsHandler(w http.ResponseWriter, r *http.Request) {
 
 	var (
 		err error
+		ds  = env.datastore(r.Context())
 	)
 
+	p, err := parseListParams(r, bookmarkSorts, "title", reflect.TypeOf(types.Bookmark{}), false)
+	if err != nil {
+		failHTTP(w, "GetStarsHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+
+	// Getting the data version before the data.
+	version, err := env.dataVersion(r.Context())
+	if err != nil {
+		failHTTP(w, "GetStarsHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if version.notModified(w, r) {
+		return
+	}
+
 	// Getting the stars.
-	stars := env.DB.GetStars()
-	// Datastore error check.
-	if err = env.DB.FlushErrors(); err != nil {
+	var (
+		stars []*types.Bookmark
+		next  *models.ListCursor
+	)
+	switch {
+	case p.Starred != nil && !*p.Starred:
+		// No star is not starred.
+	case p.filtered() || p.sorted():
+		starred := true
+		f := models.BookmarkFilter{FolderId: p.Folder, Tag: p.Tag, Starred: &starred}
+		stars, next, err = ds.ListBookmarks(r.Context(), f, p.options("title"))
+	default:
+		stars, err = ds.GetStars(r.Context())
+	}
+	if err != nil {
+		failHTTP(w, "GetStarsHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	env.setLink(w, r, p.cursor(next))
+	v, err := p.pick(stars)
+	if err != nil {
 		failHTTP(w, "GetStarsHandler", err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	version.setHeaders(w)
 	w.Header().Set("Content-Type", "application/json")
-	if err = json.NewEncoder(w).Encode(stars); err != nil {
+	if err = json.NewEncoder(w).Encode(v); err != nil {
 		failHTTP(w, "GetStarsHandler", err.Error(), http.StatusInternalServerError)
 	}
 
 }
 
-// GetFolderChildrenHandler retrieves the subfolders and bookmarks of the given folder.
+// GetFolderChildrenHandler retrieves the subfolders and bookmarks of the given folder,
+// down to the depth parameter, 1 by default. The fields parameter selects the bookmarks fields.
+// The conditional requests are supported, see dataVersion, the visit being recorded anyway.
 func (env *Env) GetFolderChildrenHandler(w http.ResponseWriter, r *http.Request) {
 
 	var (
 		key int
 		err error
 		f   *types.Folder
+		ds  = env.datastore(r.Context())
 	)
 
+	p, err := parseListParams(r, bookmarkSorts, "", reflect.TypeOf(types.Bookmark{}), false)
+	if err != nil {
+		failHTTP(w, "GetFolderChildrenHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	depth, err := parseDepth(r, 1)
+	if err != nil {
+		failHTTP(w, "GetFolderChildrenHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+
+	// Getting the data version before the data.
+	version, err := env.dataVersion(r.Context())
+	if err != nil {
+		failHTTP(w, "GetFolderChildrenHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// GET parameters retrieval.
 	folderIdParam := r.URL.Query().Get("id")
 	log.WithFields(log.Fields{
 		"keyParam": folderIdParam,
 	}).Debug("GetFolderChildrenHandler:Query parameter")
 
-	// Returning the root folder if not parameters are passed.
+	// Getting this folder, possibly shared with the user,
+	// the root folder if not parameters are passed.
 	if len(folderIdParam) == 0 {
-		folderIdParam = "1"
-	}
-	// key int convertion.
-	if key, err = strconv.Atoi(folderIdParam); err != nil {
+		f, err = ds.GetRootFolder(r.Context())
+	} else if key, err = strconv.Atoi(folderIdParam); err != nil {
 		failHTTP(w, "GetFolderChildrenHandler", "key Atoi conversion", http.StatusInternalServerError)
 		return
+	} else {
+		var acc *access
+		if acc, err = env.folderAccess(r.Context(), key, types.RoleViewer); err == nil {
+			ds = acc.ds
+			if f, err = ds.GetFolder(r.Context(), key); err == nil {
+				err = env.setShared(r.Context(), acc, f)
+			}
+		}
+	}
+	if err != nil {
+		failHTTP(w, "GetFolderChildrenHandler", err.Error(), datastoreStatus(err))
+		return
 	}
+	key = f.Id
 
-	// Getting this folder
-	f = env.DB.GetFolder(key)
-	// Datastore error check.
-	if err = env.DB.FlushErrors(); err != nil {
-		failHTTP(w, "GetFolderChildrenHandler", err.Error(), http.StatusInternalServerError)
+	// Recording the folder visit, the folder is opened in the view.
+	if err = ds.VisitFolder(r.Context(), key); err != nil {
+		// Just logging the error.
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetFolderChildrenHandler:VisitFolder")
+	}
+	if version.notModified(w, r) {
 		return
 	}
 
-	// Getting the folder children folders.
-	f.Folders = env.DB.GetFolderSubfolders(key)
-	// Datastore error check.
-	if err = env.DB.FlushErrors(); err != nil {
+	// Getting the folder subfolders and bookmarks.
+	if err = env.getChildren(r.Context(), ds, f, depth); err != nil {
 		failHTTP(w, "GetFolderChildrenHandler", err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// And the folders shared with the user in the root folder.
+	if len(folderIdParam) == 0 {
+		shared, err := env.getSharedFolders(r.Context(), depth-1)
+		if err != nil {
+			failHTTP(w, "GetFolderChildrenHandler", err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f.Folders = append(f.Folders, shared...)
+		f.NbChildrenFolders += len(shared)
+	}
 
-	// Getting the folder bookmarks.
-	f.Bookmarks = env.DB.GetFolderBookmarks(key)
-	// Datastore error check.
-	if err = env.DB.FlushErrors(); err != nil {
+	v, err := p.pick(f)
+	if err != nil {
 		failHTTP(w, "GetFolderChildrenHandler", err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	version.setHeaders(w)
 	w.Header().Set("Content-Type", "application/json")
-	if err = json.NewEncoder(w).Encode(f); err != nil {
+	if err = json.NewEncoder(w).Encode(v); err != nil {
 		failHTTP(w, "GetFolderChildrenHandler", err.Error(), http.StatusInternalServerError)
 	}
 
@@ -716,7 +1519,11 @@ func (env *Env) MainHandler(w http.ResponseWriter, r *http.Request) {
 	)
 
 	// Getting the starred bookmarks.
-	starredBookmarks := env.DB.GetStars()
+	starredBookmarks, err := env.datastore(r.Context()).GetStars(r.Context())
+	if err != nil {
+		failHTTP(w, "MainHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	// Getting the static data.
 	folderAndBookmark.JsData = string(env.JsData)
@@ -724,6 +1531,12 @@ func (env *Env) MainHandler(w http.ResponseWriter, r *http.Request) {
 	folderAndBookmark.GoBkmProxyHost = env.GoBkmProxyHost
 	folderAndBookmark.GoBkmHistorySize = env.GoBkmHistorySize
 	folderAndBookmark.GoBkmUsername = env.GoBkmUsername
+	if user := UserFromContext(r.Context()); user != nil {
+		folderAndBookmark.GoBkmUsername = user.Username
+	}
+	if session := sessionFromContext(r.Context()); session != nil {
+		folderAndBookmark.CSRFToken = session.CSRFToken
+	}
 	folderAndBookmark.Bkms = starredBookmarks
 
 	// Building the HTML template.
@@ -739,6 +1552,52 @@ func (env *Env) MainHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// description returns the text of the <dd> description
+// following the given <dt> node, if any.
+func description(dt *html.Node) string {
+
+	// Skipping the blank text nodes.
+	n := dt.NextSibling
+	for n != nil && n.Type == html.TextNode && strings.TrimSpace(n.Data) == "" {
+		n = n.NextSibling
+	}
+	if n == nil || n.Type != html.ElementNode || n.Data != "dd" {
+		return ""
+	}
+
+	var b strings.Builder
+	for c := n.FirstChild; c != nil && c.Type == html.TextNode; c = c.NextSibling {
+		b.WriteString(c.Data)
+	}
+	return strings.TrimSpace(b.String())
+
+}
+
+// bookmarkDate returns the date of the given ADD_DATE, LAST_MODIFIED or LAST_VISIT
+// attribute value, in seconds since the epoch. Some browsers export milliseconds
+// or microseconds, recognized by their size. Returns the zero time if invalid.
+func bookmarkDate(val string) time.Time {
+
+	d, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+	if err != nil || d <= 0 {
+		return time.Time{}
+	}
+	switch {
+	case d > 1e14:
+		return time.UnixMicro(d).UTC()
+	case d > 1e11:
+		return time.UnixMilli(d).UTC()
+	}
+	return time.Unix(d, 0).UTC()
+
+}
+
+// exportDate returns the given date as an ADD_DATE, LAST_MODIFIED
+// or LAST_VISIT attribute value.
+func exportDate(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
 // ImportHandler handles the import requests.
 func (env *Env) ImportHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -758,14 +1617,15 @@ func (env *Env) ImportHandler(w http.ResponseWriter, r *http.Request) {
 	// Building a new import folder name.
 	currentDate := time.Now().Local()
 	importFolderName := "import-" + currentDate.Format("2006-01-02")
-	// Creating and saving a new folder.
 	importFolder := types.Folder{Title: importFolderName}
-	id := env.DB.SaveFolder(&importFolder)
-	importFolder.Id = int(id)
 
-	// Function to recursively parse the n node.
-	var f func(n *html.Node, parentFolder *types.Folder)
-	f = func(n *html.Node, parentFolder *types.Folder) {
+	// Function to recursively parse the n node,
+	// saving the folders and bookmarks into the ds datastore.
+	var (
+		ds models.Datastore
+		f  func(n *html.Node, parentFolder *types.Folder) error
+	)
+	f = func(n *html.Node, parentFolder *types.Folder) error {
 		// Keeping the parent folder before calling f recursively.
 		parentFolderBackup := *parentFolder
 
@@ -780,8 +1640,20 @@ func (env *Env) ImportHandler(w http.ResponseWriter, r *http.Request) {
 					// Building the new folder.
 					h3Value := dtTag.FirstChild.Data
 					newFolder := types.Folder{Title: h3Value, Parent: parentFolder}
+					// Keeping its dates, the datastore sets the missing ones.
+					for _, attr := range dtTag.Attr {
+						switch attr.Key {
+						case "add_date":
+							newFolder.CreatedAt = bookmarkDate(attr.Val)
+						case "last_modified":
+							newFolder.UpdatedAt = bookmarkDate(attr.Val)
+						}
+					}
 					// Saving it into the DB.
-					id := env.DB.SaveFolder(&newFolder)
+					id, err := ds.SaveFolder(r.Context(), &newFolder)
+					if err != nil {
+						return err
+					}
 					newFolder.Id = int(id)
 					// Updating the parent folder for next recursion.
 					parentFolder = &newFolder
@@ -790,16 +1662,26 @@ func (env *Env) ImportHandler(w http.ResponseWriter, r *http.Request) {
 					var h3Value string
 					var h3Href string
 					var h3Icon string
+					var h3AddDate, h3LastModified time.Time
+					var h3LastVisit *time.Time
 
-					// Parsing the link attributes for href and icon.
+					// Parsing the link attributes for href, icon and dates.
 					for _, attr := range dtTag.Attr {
 						key := attr.Key
 						val := attr.Val
-						if key == "href" {
+						switch key {
+						case "href":
 							h3Href = val
-						}
-						if key == "icon" {
+						case "icon":
 							h3Icon = val
+						case "add_date":
+							h3AddDate = bookmarkDate(val)
+						case "last_modified":
+							h3LastModified = bookmarkDate(val)
+						case "last_visit":
+							if d := bookmarkDate(val); !d.IsZero() {
+								h3LastVisit = &d
+							}
 						}
 					}
 					// Looking for a link title.
@@ -810,30 +1692,48 @@ func (env *Env) ImportHandler(w http.ResponseWriter, r *http.Request) {
 					}
 
 					// Creating the new Bookmark.
-					newBookmark := types.Bookmark{Title: h3Value, URL: h3Href, Favicon: h3Icon, Folder: parentFolder}
+					newBookmark := types.Bookmark{Title: h3Value, URL: h3Href, Favicon: h3Icon, Notes: description(c), Folder: parentFolder,
+						CreatedAt: h3AddDate, UpdatedAt: h3LastModified, LastVisitedAt: h3LastVisit}
 					log.WithFields(log.Fields{
 						"newBookmark": newBookmark,
 					}).Debug("ImportHandler:Saving bookmark")
 					// And saving it.
-					env.DB.SaveBookmark(&newBookmark)
+					if _, err := ds.SaveBookmark(r.Context(), &newBookmark); err != nil {
+						return err
+					}
 				}
 			}
 
 			// Calling recursively f for each child of n.
-			f(c, parentFolder)
+			if err := f(c, parentFolder); err != nil {
+				return err
+			}
 
 			// Restoring the parent folder.
 			parentFolder = &parentFolderBackup
 		}
+		return nil
 	}
 
-	// Importing the folders and bookmarks.
-	f(doc, &importFolder)
-	// Database errors check.
-	if err = env.DB.FlushErrors(); err != nil {
+	// Importing the folders and bookmarks in a transaction,
+	// nothing being imported if one of them fails.
+	err = env.datastore(r.Context()).WithTx(r.Context(), func(tx models.Datastore) error {
+		// Creating and saving a new folder.
+		id, err := tx.SaveFolder(r.Context(), &importFolder)
+		if err != nil {
+			return err
+		}
+		importFolder.Id = int(id)
+
+		ds = tx
+		return f(doc, &importFolder)
+	})
+	if err != nil {
 		failHTTP(w, "ImportHandler", err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// Sending a single event, the clients loading the import folder content.
+	env.publishFolder(r.Context(), env.userAccess(r.Context()), types.OperationCreate, importFolder.Id, nil)
 
 	// Returning "ok" to inform the AJAX caller that everyting was fine.
 	if _, err = w.Write([]byte("ok")); err != nil {
@@ -846,10 +1746,25 @@ func (env *Env) ImportHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // ExportHandler handles the export requests.
+// The conditional requests are supported, see dataVersion.
 func (env *Env) ExportHandler(w http.ResponseWriter, r *http.Request) {
 
+	// Getting the data version before the data.
+	version, err := env.dataVersion(r.Context())
+	if err != nil {
+		failHTTP(w, "ExportHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if version.notModified(w, r) {
+		return
+	}
+
 	// Getting the root folder.
-	rootFolder := env.DB.GetFolder(1)
+	rootFolder, err := env.datastore(r.Context()).GetRootFolder(r.Context())
+	if err != nil {
+		failHTTP(w, "ExportHandler", err.Error(), datastoreStatus(err))
+		return
+	}
 	// HTML header and footer definition.
 	header := `<!DOCTYPE NETSCAPE-Bookmark-file-1>
 <!-- This is an automatically generated file.
@@ -862,6 +1777,7 @@ func (env *Env) ExportHandler(w http.ResponseWriter, r *http.Request) {
 	footer := "</DL><p>\n"
 
 	// Writing the header meta informations.
+	version.setHeaders(w)
 	w.Header().Set("Content-Disposition", "attachment; filename=gobkm.html")
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	// Writing the HTML header
@@ -872,7 +1788,12 @@ func (env *Env) ExportHandler(w http.ResponseWriter, r *http.Request) {
 		}).Error("ExportHandler")
 	}
 	// Exporting the bookmarks.
-	env.exportTree(w, &exportBookmarksStruct{Fld: rootFolder}, 0)
+	if _, err = env.exportTree(r.Context(), w, &exportBookmarksStruct{Fld: rootFolder}, 0); err != nil {
+		// The response is already started, just logging the error.
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("ExportHandler")
+	}
 	// Writing the HTML footer.
 	if _, err := w.Write([]byte(footer)); err != nil {
 		// Just logging the error.
@@ -884,7 +1805,7 @@ func (env *Env) ExportHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // exportTree recursively exports in HTML the given bookmark struct.
-func (env *Env) exportTree(wr io.Writer, eb *exportBookmarksStruct, depth int) *exportBookmarksStruct {
+func (env *Env) exportTree(ctx context.Context, wr io.Writer, eb *exportBookmarksStruct, depth int) (*exportBookmarksStruct, error) {
 
 	// Depth is just for cosmetics indent purposes.
 	depth++
@@ -894,25 +1815,43 @@ func (env *Env) exportTree(wr io.Writer, eb *exportBookmarksStruct, depth int) *
 
 	// Writing the folder title.
 	insertIndent(wr, depth)
-	_, _ = wr.Write([]byte("<DT><H3>" + eb.Fld.Title + "</H3>\n"))
+	_, _ = wr.Write([]byte("<DT><H3 ADD_DATE=\"" + exportDate(eb.Fld.CreatedAt) + "\" LAST_MODIFIED=\"" + exportDate(eb.Fld.UpdatedAt) + "\">" + eb.Fld.Title + "</H3>\n"))
 	insertIndent(wr, depth)
 	_, _ = wr.Write([]byte("<DL><p>\n"))
 
 	// For each children folder recursively building the bookmars tree.
-	for _, child := range env.DB.GetFolderSubfolders(eb.Fld.Id) {
-		eb.Sub = append(eb.Sub, env.exportTree(wr, &exportBookmarksStruct{Fld: child}, depth))
+	children, err := env.datastore(ctx).GetFolderSubfolders(ctx, eb.Fld.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		sub, err := env.exportTree(ctx, wr, &exportBookmarksStruct{Fld: child}, depth)
+		if err != nil {
+			return nil, err
+		}
+		eb.Sub = append(eb.Sub, sub)
 	}
 
 	// Getting the folder bookmarks.
-	eb.Bkms = env.DB.GetFolderBookmarks(eb.Fld.Id)
+	if eb.Bkms, err = env.datastore(ctx).GetFolderBookmarks(ctx, eb.Fld.Id); err != nil {
+		return nil, err
+	}
 	// Writing them.
 	for _, bkm := range eb.Bkms {
 		insertIndent(wr, depth)
-		_, _ = wr.Write([]byte("<DT><A HREF=\"" + bkm.URL + "\" ICON=\"" + bkm.Favicon + "\">" + bkm.Title + "</A>\n"))
+		dates := " ADD_DATE=\"" + exportDate(bkm.CreatedAt) + "\" LAST_MODIFIED=\"" + exportDate(bkm.UpdatedAt) + "\""
+		if bkm.LastVisitedAt != nil {
+			dates += " LAST_VISIT=\"" + exportDate(*bkm.LastVisitedAt) + "\""
+		}
+		_, _ = wr.Write([]byte("<DT><A HREF=\"" + bkm.URL + "\"" + dates + " ICON=\"" + bkm.Favicon + "\">" + bkm.Title + "</A>\n"))
+		if bkm.Notes != "" {
+			insertIndent(wr, depth)
+			_, _ = wr.Write([]byte("<DD>" + html.EscapeString(bkm.Notes) + "\n"))
+		}
 	}
 	insertIndent(wr, depth)
 	_, _ = wr.Write([]byte("</DL><p>\n"))
 
-	return eb
+	return eb, nil
 
 }
@@ -0,0 +1,441 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// testFavicon is the favicon of the test favicon service.
+const testFavicon = "icon"
+
+// newTestEnv returns an Env of a new memory datastore
+// and of a test favicon service answering testFavicon.
+func newTestEnv(t *testing.T) *Env {
+
+	db := models.NewMemoryDBstore()
+	if err := db.CreateDatabase(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	favicons := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, testFavicon)
+	}))
+	t.Cleanup(favicons.Close)
+	return &Env{DB: db, FaviconURL: favicons.URL + "/?domain_url="}
+
+}
+
+// testHandler returns the handler of the routes of the tests,
+// with the authentication and preconditions of the server.
+func testHandler(env *Env) http.Handler {
+
+	mux := NewMux()
+	mux.HandleFunc("/login/", env.LoginHandler)
+	mux.HandleFunc("/logout/", env.LogoutHandler)
+	mux.HandleFunc("/events/", env.EventsHandler)
+	mux.HandleFunc("/addBookmark/", env.AddBookmarkHandler)
+	mux.HandleFunc("/addFolder/", env.AddFolderHandler)
+	mux.HandleFunc("/deleteBookmark/", env.DeleteBookmarkHandler)
+	mux.HandleFunc("/deleteFolder/", env.DeleteFolderHandler)
+	mux.HandleFunc("/getTags/", env.GetTagsHandler)
+	mux.HandleFunc("/getStars/", env.GetStarsHandler)
+	mux.HandleFunc("/getFolderChildren/", env.GetFolderChildrenHandler)
+	mux.HandleFunc("/getTree/", env.GetTreeHandler)
+	mux.HandleFunc("/updateFolder/", env.UpdateFolderHandler)
+	mux.HandleFunc("/sortFolder/", env.SortFolderHandler)
+	mux.HandleFunc("/updateBookmark/", env.UpdateBookmarkHandler)
+	mux.HandleFunc("/searchBookmarks/", env.SearchBookmarkHandler)
+	mux.HandleFunc("/starBookmark/", env.StarBookmarkHandler)
+	mux.HandleFunc("/visitBookmark/", env.VisitBookmarkHandler)
+	mux.HandleFunc("/getTrash/", env.GetTrashHandler)
+	mux.HandleFunc("/restoreTrash/", env.RestoreTrashHandler)
+	mux.HandleFunc("/purgeTrash/", env.PurgeTrashHandler)
+	mux.HandleFunc("/getHistory/", env.GetHistoryHandler)
+	mux.HandleFunc("/undo/", env.UndoHandler)
+	mux.HandleFunc("/batch/", env.BatchHandler)
+	mux.HandleFunc("/getFolderGrants/", env.GetFolderGrantsHandler)
+	mux.HandleFunc("/shareFolder/", env.ShareFolderHandler)
+	mux.HandleFunc("/getShareLinks/", env.GetShareLinksHandler)
+	mux.HandleFunc("/addShareLink/", env.AddShareLinkHandler)
+	mux.HandleFunc("/revokeShareLink/", env.RevokeShareLinkHandler)
+	mux.HandleFunc(sharePath, env.ShareHandler)
+	mux.HandleFunc(APIPrefix+"/", env.APIHandler)
+	return env.AuthHandler(env.PreconditionHandler(mux))
+
+}
+
+// serve returns the response of the given handler to the request
+// of the given method and target, with the given body encoded in JSON if not nil,
+// and authenticated with the given API token if not empty.
+func serve(t *testing.T, h http.Handler, token, method, target string, body interface{}) *httptest.ResponseRecorder {
+
+	t.Helper()
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, target, r)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+
+}
+
+// decode decodes the JSON body of the given response into v,
+// failing if its status is not the given one.
+func decode(t *testing.T, w *httptest.ResponseRecorder, status int, v interface{}) {
+
+	t.Helper()
+
+	if w.Code != status {
+		t.Fatalf("status %d, want %d: %s", w.Code, status, w.Body)
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+
+}
+
+// addTestBookmark adds a bookmark with the given title in the given folder.
+func addTestBookmark(t *testing.T, h http.Handler, token string, title string, folderID int) *types.Bookmark {
+
+	t.Helper()
+
+	var bkm types.Bookmark
+	body := &types.Bookmark{Title: title, URL: "http://127.0.0.1:1/" + title, Folder: &types.Folder{Id: folderID}}
+	decode(t, serve(t, h, token, http.MethodPost, "/addBookmark/", body), http.StatusOK, &bkm)
+	return &bkm
+
+}
+
+// addTestFolder adds a folder with the given title in the root folder.
+func addTestFolder(t *testing.T, h http.Handler, token string, title string) *types.Folder {
+
+	t.Helper()
+
+	var fld types.Folder
+	decode(t, serve(t, h, token, http.MethodPost, "/addFolder/", &types.Folder{Title: title}), http.StatusOK, &fld)
+	return &fld
+
+}
+
+// addSubfolder adds a folder with the given title in the given folder.
+func addSubfolder(t *testing.T, h http.Handler, token string, title string, parentID int) *types.Folder {
+
+	t.Helper()
+
+	var fld types.Folder
+	body := &types.Folder{Title: title, Parent: &types.Folder{Id: parentID}}
+	decode(t, serve(t, h, token, http.MethodPost, "/addFolder/", body), http.StatusOK, &fld)
+	return &fld
+
+}
+
+// shareTestFolder grants the given role on the given folder to the given user.
+func shareTestFolder(t *testing.T, h http.Handler, token string, folderID int, username, role string) {
+
+	t.Helper()
+
+	body := &types.Grant{FolderId: folderID, Username: username, Role: role}
+	decode(t, serve(t, h, token, http.MethodPost, "/shareFolder/", body), http.StatusOK, nil)
+
+}
+
+func TestAddFolderAndBookmark(t *testing.T) {
+
+	h := testHandler(newTestEnv(t))
+
+	fld := addTestFolder(t, h, "", "Go")
+	if fld.Id == 0 || fld.Title != "Go" || fld.CreatedAt.IsZero() || fld.Parent == nil {
+		t.Errorf("added folder %+v, want Go with its dates and parent", fld)
+	}
+	bkm := addTestBookmark(t, h, "", "golang", fld.Id)
+	if bkm.Id == 0 || bkm.Title != "golang" || bkm.CreatedAt.IsZero() || bkm.Folder == nil || bkm.Folder.Id != fld.Id {
+		t.Errorf("added bookmark %+v, want golang in %d with its dates", bkm, fld.Id)
+	}
+
+	// An unknown folder is not found.
+	body := &types.Bookmark{Title: "lost", URL: "http://127.0.0.1:1/", Folder: &types.Folder{Id: 999}}
+	decode(t, serve(t, h, "", http.MethodPost, "/addBookmark/", body), http.StatusNotFound, nil)
+
+	// The folder children.
+	var children types.Folder
+	decode(t, serve(t, h, "", http.MethodGet, "/getFolderChildren/?id="+strconv.Itoa(fld.Id), nil), http.StatusOK, &children)
+	if len(children.Bookmarks) != 1 || children.Bookmarks[0].Id != bkm.Id {
+		t.Errorf("folder children %+v, want the bookmark %d", children.Bookmarks, bkm.Id)
+	}
+
+	// The tree.
+	var tree types.Folder
+	decode(t, serve(t, h, "", http.MethodGet, "/getTree/", nil), http.StatusOK, &tree)
+	if len(tree.Folders) != 1 || tree.Folders[0].Id != fld.Id || len(tree.Folders[0].Bookmarks) != 1 {
+		t.Errorf("tree %+v, want the folder %d with its bookmark", tree.Folders, fld.Id)
+	}
+
+	// The search.
+	var found []*types.Bookmark
+	decode(t, serve(t, h, "", http.MethodGet, "/searchBookmarks/?search=golang", nil), http.StatusOK, &found)
+	if len(found) != 1 || found[0].Id != bkm.Id {
+		t.Errorf("search results %v, want the bookmark %d", found, bkm.Id)
+	}
+
+}
+
+func TestBookmarkFavicon(t *testing.T) {
+
+	env := newTestEnv(t)
+	h := testHandler(env)
+	fld := addTestFolder(t, h, "", "fld")
+	bkm := addTestBookmark(t, h, "", "favicon", fld.Id)
+
+	// The favicon is retrieved asynchronously.
+	want := "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte(testFavicon))
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		b, err := env.DB.GetBookmark(context.Background(), bkm.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Favicon == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("favicon %q, want %q", b.Favicon, want)
+		}
+	}
+
+}
+
+func TestStarBookmark(t *testing.T) {
+
+	h := testHandler(newTestEnv(t))
+	fld := addTestFolder(t, h, "", "fld")
+	bkm := addTestBookmark(t, h, "", "star", fld.Id)
+
+	// The ids of the view are negative.
+	decode(t, serve(t, h, "", http.MethodGet, "/starBookmark/?star=true&id="+strconv.Itoa(-bkm.Id), nil), http.StatusOK, nil)
+	var stars []*types.Bookmark
+	decode(t, serve(t, h, "", http.MethodGet, "/getStars/", nil), http.StatusOK, &stars)
+	if len(stars) != 1 || stars[0].Id != bkm.Id {
+		t.Errorf("stars %v, want the bookmark %d", stars, bkm.Id)
+	}
+
+	decode(t, serve(t, h, "", http.MethodGet, "/starBookmark/?id="+strconv.Itoa(-bkm.Id), nil), http.StatusOK, nil)
+	stars = nil
+	decode(t, serve(t, h, "", http.MethodGet, "/getStars/", nil), http.StatusOK, &stars)
+	if len(stars) != 0 {
+		t.Errorf("stars %v, want none", stars)
+	}
+
+}
+
+func TestTrash(t *testing.T) {
+
+	h := testHandler(newTestEnv(t))
+	fld := addTestFolder(t, h, "", "fld")
+	bkm := addTestBookmark(t, h, "", "trashed", fld.Id)
+
+	decode(t, serve(t, h, "", http.MethodGet, "/deleteBookmark/?id="+strconv.Itoa(-bkm.Id), nil), http.StatusOK, nil)
+	decode(t, serve(t, h, "", http.MethodGet, "/deleteFolder/?id="+strconv.Itoa(fld.Id), nil), http.StatusOK, nil)
+	var trash types.Trash
+	decode(t, serve(t, h, "", http.MethodGet, "/getTrash/", nil), http.StatusOK, &trash)
+	if len(trash.Folders) != 1 || len(trash.Bookmarks) != 1 {
+		t.Fatalf("trash %+v, want the folder and the bookmark", trash)
+	}
+
+	// Restoring and purging require a POST.
+	decode(t, serve(t, h, "", http.MethodGet, "/restoreTrash/?id="+strconv.Itoa(fld.Id), nil), http.StatusMethodNotAllowed, nil)
+	decode(t, serve(t, h, "", http.MethodGet, "/purgeTrash/", nil), http.StatusMethodNotAllowed, nil)
+
+	decode(t, serve(t, h, "", http.MethodPost, "/restoreTrash/?id="+strconv.Itoa(fld.Id), nil), http.StatusOK, nil)
+	decode(t, serve(t, h, "", http.MethodPost, "/purgeTrash/", nil), http.StatusOK, nil)
+	trash = types.Trash{}
+	decode(t, serve(t, h, "", http.MethodGet, "/getTrash/", nil), http.StatusOK, &trash)
+	if len(trash.Folders) != 0 || len(trash.Bookmarks) != 0 {
+		t.Errorf("trash %+v, want it empty", trash)
+	}
+	var children types.Folder
+	decode(t, serve(t, h, "", http.MethodGet, "/getFolderChildren/?id="+strconv.Itoa(fld.Id), nil), http.StatusOK, &children)
+	if children.Title != "fld" || len(children.Bookmarks) != 0 {
+		t.Errorf("restored folder %+v, want fld without the purged bookmark", children)
+	}
+
+}
+
+func TestUndo(t *testing.T) {
+
+	h := testHandler(newTestEnv(t))
+	fld := addTestFolder(t, h, "", "undone")
+
+	decode(t, serve(t, h, "", http.MethodGet, "/undo/", nil), http.StatusMethodNotAllowed, nil)
+
+	var revs []*types.Revision
+	decode(t, serve(t, h, "", http.MethodPost, "/undo/", nil), http.StatusOK, &revs)
+	if len(revs) != 1 || revs[0].ItemId != fld.Id {
+		t.Errorf("undo revisions %+v, want the folder %d one", revs, fld.Id)
+	}
+	decode(t, serve(t, h, "", http.MethodGet, "/getFolderChildren/?id="+strconv.Itoa(fld.Id), nil), http.StatusNotFound, nil)
+
+}
+
+func TestSortFolder(t *testing.T) {
+
+	h := testHandler(newTestEnv(t))
+	fld := addTestFolder(t, h, "", "sorted")
+
+	decode(t, serve(t, h, "", http.MethodGet, "/sortFolder/?sort=url&id="+strconv.Itoa(fld.Id), nil), http.StatusMethodNotAllowed, nil)
+	decode(t, serve(t, h, "", http.MethodPost, "/sortFolder/?sort=size&id="+strconv.Itoa(fld.Id), nil), http.StatusBadRequest, nil)
+
+	var sorted types.Folder
+	decode(t, serve(t, h, "", http.MethodPost, "/sortFolder/?sort=url&id="+strconv.Itoa(fld.Id), nil), http.StatusOK, &sorted)
+	if sorted.Sort != types.SortURL {
+		t.Errorf("folder sort %q, want %q", sorted.Sort, types.SortURL)
+	}
+
+}
+
+func TestBatch(t *testing.T) {
+
+	h := testHandler(newTestEnv(t))
+	src := addTestFolder(t, h, "", "src")
+	dst := addTestFolder(t, h, "", "dst")
+	b1 := addTestBookmark(t, h, "", "one", src.Id)
+	b2 := addTestBookmark(t, h, "", "two", src.Id)
+
+	decode(t, serve(t, h, "", http.MethodGet, "/batch/", nil), http.StatusMethodNotAllowed, nil)
+
+	var res batchStruct
+	body := &batchRequestStruct{Operations: []*types.BatchOperation{
+		{Op: "move", BookmarkId: b1.Id, FolderId: dst.Id},
+		{Op: "star", BookmarkId: -b2.Id},
+		{Op: "tag", BookmarkId: b2.Id, Tags: []string{"go"}},
+	}}
+	decode(t, serve(t, h, "", http.MethodPost, "/batch/", body), http.StatusOK, &res)
+	if !res.Applied {
+		t.Fatalf("batch %+v, want it applied", res.Results)
+	}
+
+	var children types.Folder
+	decode(t, serve(t, h, "", http.MethodGet, "/getFolderChildren/?id="+strconv.Itoa(dst.Id), nil), http.StatusOK, &children)
+	if len(children.Bookmarks) != 1 || children.Bookmarks[0].Id != b1.Id {
+		t.Errorf("destination bookmarks %v, want the moved one", children.Bookmarks)
+	}
+	var stars []*types.Bookmark
+	decode(t, serve(t, h, "", http.MethodGet, "/getStars/?tag=go", nil), http.StatusOK, &stars)
+	if len(stars) != 1 || stars[0].Id != b2.Id {
+		t.Errorf("tagged stars %v, want the bookmark %d", stars, b2.Id)
+	}
+
+	// Nothing is applied if an operation fails.
+	body = &batchRequestStruct{Operations: []*types.BatchOperation{
+		{Op: "unstar", BookmarkId: b2.Id},
+		{Op: "move", BookmarkId: b1.Id, FolderId: 999},
+	}}
+	res = batchStruct{}
+	decode(t, serve(t, h, "", http.MethodPost, "/batch/", body), http.StatusNotFound, &res)
+	if res.Applied {
+		t.Errorf("batch %+v applied, want it refused", res.Results)
+	}
+	stars = nil
+	decode(t, serve(t, h, "", http.MethodGet, "/getStars/", nil), http.StatusOK, &stars)
+	if len(stars) != 1 {
+		t.Errorf("stars %v, want the bookmark %d still starred", stars, b2.Id)
+	}
+
+}
+
+func TestAPIPagination(t *testing.T) {
+
+	h := testHandler(newTestEnv(t))
+	for _, title := range []string{"c", "A", "b", "d", "E"} {
+		addTestFolder(t, h, "", title)
+	}
+
+	var titles []string
+	target := APIPrefix + "/folders?limit=2&sort=-title"
+	for n := 0; target != ""; n++ {
+		if n > 5 {
+			t.Fatal("too many pages")
+		}
+		w := serve(t, h, "", http.MethodGet, target, nil)
+		var page []*apiFolder
+		decode(t, w, http.StatusOK, &page)
+		if len(page) > 2 {
+			t.Fatalf("page of %d folders, want 2 at most", len(page))
+		}
+		for _, f := range page {
+			titles = append(titles, f.Title)
+		}
+		target = nextLink(w)
+	}
+	if got, want := titles, []string{"E", "d", "c", "b", "A"}; !equalStrings(got, want) {
+		t.Errorf("folders %v, want %v", got, want)
+	}
+
+	// A cursor of another sort is refused.
+	w := serve(t, h, "", http.MethodGet, APIPrefix+"/folders?limit=2&sort=-title", nil)
+	u, err := url.Parse(nextLink(w))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("sort", "title")
+	u.RawQuery = q.Encode()
+	decode(t, serve(t, h, "", http.MethodGet, u.String(), nil), http.StatusBadRequest, nil)
+
+}
+
+// nextLink returns the next page URL of the Link header
+// of the given response, empty if none.
+func nextLink(w *httptest.ResponseRecorder) string {
+
+	link := w.Header().Get("Link")
+	start, end := strings.IndexByte(link, '<'), strings.IndexByte(link, '>')
+	if start < 0 || end < start {
+		return ""
+	}
+	return link[start+1 : end]
+
+}
+
+// equalStrings returns true if the given string slices are equal.
+func equalStrings(a, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+
+}
@@ -0,0 +1,340 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+const (
+	// defaultPageSize is the number of items of a page without limit parameter.
+	defaultPageSize = 100
+	// maxPageSize is the maximum number of items of a page.
+	maxPageSize = 1000
+)
+
+// errInvalidParam is returned for an invalid list parameter.
+var errInvalidParam = errors.New("invalid parameter")
+
+// Sort keys of the list endpoints.
+var (
+	bookmarkSorts = []string{"id", "title", "url", "created", "updated", "visited", "position"}
+	folderSorts   = []string{"id", "title", "created", "updated", "visited", "position"}
+	tagSorts      = []string{"id", "name"}
+)
+
+// listCursor is the position after the last item of a page,
+// given by its sort key and id, see models.ListCursor.
+// Shared is true after the folders of the user, in the folders shared with them.
+type listCursor struct {
+	Sort   string `json:"s"`
+	Key    string `json:"k"`
+	Id     int    `json:"id"`
+	Shared bool   `json:"sh,omitempty"`
+}
+
+// listParams are the pagination, sort, field selection and filter
+// parameters of the list endpoints:
+//
+//	limit=50                the page size, the next page being given by the Link header
+//	cursor=...              the opaque position of the page, set by the Link header
+//	sort=-created           the sort key, descending with a leading minus
+//	fields=id,title,url     the returned fields, or the omitted ones with fields=-favicon
+//	folder=2, tag=go, starred=true  the bookmarks filters
+type listParams struct {
+	Limit   int // 0 without pagination
+	Cursor  *listCursor
+	Sort    string // empty for the default order
+	Desc    bool
+	Fields  map[string]bool // nil for all the fields
+	Exclude bool            // true if Fields are the omitted ones
+	Folder  int
+	Tag     string
+	Starred *bool
+}
+
+// invalidParam returns an errInvalidParam error with the given message.
+func invalidParam(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", errInvalidParam, fmt.Sprintf(format, a...))
+}
+
+// jsonFields returns the JSON field names of the given struct type.
+func jsonFields(t reflect.Type) map[string]bool {
+
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name != "-" && f.IsExported() {
+			if name == "" {
+				name = f.Name
+			}
+			fields[name] = true
+		}
+	}
+	return fields
+
+}
+
+// parseListParams returns the list parameters of the given request.
+// The items have the given sort keys, the defaultSort being used when paginating
+// without sort parameter, and the JSON fields of the given item type.
+// The pagination is enabled with a limit or cursor parameter, or by the paginate flag.
+func parseListParams(r *http.Request, sorts []string, defaultSort string, item reflect.Type, paginate bool) (*listParams, error) {
+
+	var (
+		err error
+		p   = new(listParams)
+		q   = r.URL.Query()
+	)
+
+	// Sort.
+	if s := q.Get("sort"); s != "" {
+		p.Desc = strings.HasPrefix(s, "-")
+		p.Sort = strings.TrimPrefix(s, "-")
+		found := false
+		for _, k := range sorts {
+			found = found || k == p.Sort
+		}
+		if !found {
+			return nil, invalidParam("sort must be one of %s, with an optional leading -", strings.Join(sorts, ", "))
+		}
+	}
+
+	// Pagination.
+	if l := q.Get("limit"); l != "" {
+		if p.Limit, err = strconv.Atoi(l); err != nil || p.Limit < 1 || p.Limit > maxPageSize {
+			return nil, invalidParam("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+	if c := q.Get("cursor"); c != "" {
+		b, err := base64.RawURLEncoding.DecodeString(c)
+		if err == nil {
+			err = json.Unmarshal(b, &p.Cursor)
+		}
+		if err != nil || p.Cursor == nil {
+			return nil, invalidParam("invalid cursor")
+		}
+	}
+	if p.Limit == 0 && (paginate || p.Cursor != nil) {
+		p.Limit = defaultPageSize
+	}
+	if p.Limit > 0 && p.Sort == "" {
+		p.Sort = defaultSort
+	}
+	if p.Cursor != nil && p.Cursor.Sort != p.sortParam() {
+		return nil, invalidParam("the cursor is not the one of this sort")
+	}
+
+	// Field selection.
+	if f := q.Get("fields"); f != "" {
+		known := jsonFields(item)
+		p.Fields = make(map[string]bool)
+		for i, name := range strings.Split(f, ",") {
+			exclude := strings.HasPrefix(name, "-")
+			if i == 0 {
+				p.Exclude = exclude
+			} else if exclude != p.Exclude {
+				return nil, invalidParam("the fields can not be both selected and omitted")
+			}
+			name = strings.TrimPrefix(name, "-")
+			if !known[name] {
+				return nil, invalidParam("unknown field %q", name)
+			}
+			p.Fields[name] = true
+		}
+	}
+
+	// Bookmarks filters.
+	if f := q.Get("folder"); f != "" {
+		if p.Folder, err = strconv.Atoi(f); err != nil || p.Folder <= 0 {
+			return nil, invalidParam("folder must be a folder id")
+		}
+	}
+	p.Tag = q.Get("tag")
+	if s := q.Get("starred"); s != "" {
+		starred, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, invalidParam("starred must be true or false")
+		}
+		p.Starred = &starred
+	}
+
+	return p, nil
+
+}
+
+// parseDepth returns the depth parameter of the given request, the number
+// of folder levels returned with their subfolders and bookmarks,
+// the given default one if not set.
+func parseDepth(r *http.Request, defaultDepth int) (int, error) {
+
+	d := r.URL.Query().Get("depth")
+	if d == "" {
+		return defaultDepth, nil
+	}
+	depth, err := strconv.Atoi(d)
+	if err != nil || depth < 1 {
+		return 0, invalidParam("depth must be a positive integer")
+	}
+	return depth, nil
+
+}
+
+// sortParam returns the sort parameter of the sort key and order.
+func (p *listParams) sortParam() string {
+
+	if p.Desc {
+		return "-" + p.Sort
+	}
+	return p.Sort
+
+}
+
+// options returns the datastore list options of the parameters,
+// sorted by the given key without sort parameter.
+func (p *listParams) options(defaultSort string) models.ListOptions {
+
+	opts := models.ListOptions{Sort: p.Sort, Desc: p.Desc, Limit: p.Limit}
+	if opts.Sort == "" {
+		opts.Sort = defaultSort
+	}
+	if p.Cursor != nil && !p.Cursor.Shared {
+		opts.After = &models.ListCursor{Key: p.Cursor.Key, Id: p.Cursor.Id}
+	}
+	return opts
+
+}
+
+// cursor returns the cursor of the next page of the given datastore cursor, if any.
+func (p *listParams) cursor(next *models.ListCursor) *listCursor {
+
+	if next == nil {
+		return nil
+	}
+	return &listCursor{Sort: p.sortParam(), Key: next.Key, Id: next.Id}
+
+}
+
+// filterBookmarks returns the given bookmarks in the folder,
+// with the tag and starred, of the filters.
+// The bookmarks must have their tags for the tag filter.
+func (p *listParams) filterBookmarks(bkms []*types.Bookmark) []*types.Bookmark {
+
+	var filtered []*types.Bookmark
+	for _, b := range bkms {
+		if p.Folder != 0 && (b.Folder == nil || b.Folder.Id != p.Folder) {
+			continue
+		}
+		if p.Starred != nil && b.Starred != *p.Starred {
+			continue
+		}
+		if p.Tag != "" {
+			tagged := false
+			for _, t := range b.Tags {
+				tagged = tagged || strings.EqualFold(t.Name, p.Tag)
+			}
+			if !tagged {
+				continue
+			}
+		}
+		filtered = append(filtered, b)
+	}
+	return filtered
+
+}
+
+// filtered returns true if the bookmarks filters are set.
+func (p *listParams) filtered() bool {
+	return p.Folder != 0 || p.Tag != "" || p.Starred != nil
+}
+
+// sorted returns true if the items are sorted or paginated.
+func (p *listParams) sorted() bool {
+	return p.Sort != "" || p.Limit > 0 || p.Cursor != nil
+}
+
+// selectFields keeps the selected fields of the given JSON object.
+func (p *listParams) selectFields(o map[string]interface{}) {
+
+	for name := range o {
+		if p.Fields[name] == p.Exclude {
+			delete(o, name)
+		}
+	}
+
+}
+
+// pick returns the given value with the selected fields of its items, if a list,
+// or of the bookmarks of its folders otherwise.
+func (p *listParams) pick(v interface{}) (interface{}, error) {
+
+	if p.Fields == nil {
+		return v, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var generic interface{}
+	if err = decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	// bookmarks selects the bookmarks fields of the given folder and its subfolders.
+	var bookmarks func(f map[string]interface{})
+	bookmarks = func(f map[string]interface{}) {
+		if bkms, ok := f["bookmarks"].([]interface{}); ok {
+			for _, b := range bkms {
+				if o, ok := b.(map[string]interface{}); ok {
+					p.selectFields(o)
+				}
+			}
+		}
+		if flds, ok := f["folders"].([]interface{}); ok {
+			for _, c := range flds {
+				if o, ok := c.(map[string]interface{}); ok {
+					bookmarks(o)
+				}
+			}
+		}
+	}
+
+	switch g := generic.(type) {
+	case []interface{}:
+		for _, item := range g {
+			if o, ok := item.(map[string]interface{}); ok {
+				p.selectFields(o)
+			}
+		}
+	case map[string]interface{}:
+		bookmarks(g)
+	}
+	return generic, nil
+
+}
+
+// setLink sets the Link header of the next page with the given cursor, if any.
+func (env *Env) setLink(w http.ResponseWriter, r *http.Request, next *listCursor) {
+
+	if next == nil {
+		return
+	}
+	b, _ := json.Marshal(next)
+	q := r.URL.Query()
+	q.Set("cursor", base64.RawURLEncoding.EncodeToString(b))
+	w.Header().Set("Link", "<"+strings.TrimSuffix(env.GoBkmProxyURL, "/")+r.URL.Path+"?"+q.Encode()+`>; rel="next"`)
+
+}
@@ -0,0 +1,679 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+const (
+	// OpenAPIPath is the path of the OpenAPI document.
+	OpenAPIPath = "/openapi.json"
+	// APIDocPath is the path of the OpenAPI document viewer.
+	APIDocPath = "/apidoc/"
+)
+
+// operation describes a route of the OpenAPI document,
+// the bodies being described by the schema of their Go type.
+type operation struct {
+	Summary      string
+	Tag          string
+	Params       []param
+	Body         interface{} // JSON request body, nil if none
+	BodyType     string      // request body media type if not JSON, described as a string
+	Response     interface{} // JSON response body, nil if none
+	ResponseType string      // response media type if not JSON, described as a string
+	Status       int         // success status, 200 by default
+	Paged        bool        // true if the response may have a Link header of the next page
+	Conditional  bool        // true if the response has ETag and Last-Modified headers, see dataVersion
+	Public       bool        // true if the route does not require authentication
+}
+
+// param is a query or path parameter of an operation.
+type param struct {
+	Name        string
+	In          string
+	Type        string
+	Description string
+	Required    bool
+}
+
+// query returns an optional query parameter.
+func query(name, typ, description string) param {
+	return param{Name: name, In: "query", Type: typ, Description: description}
+}
+
+// requiredQuery returns a required query parameter.
+func requiredQuery(name, typ, description string) param {
+	return param{Name: name, In: "query", Type: typ, Description: description, Required: true}
+}
+
+// fieldsQuery is the fields parameter of the endpoints returning items or bookmarks.
+var fieldsQuery = query("fields", "string", "comma separated fields to return, or to omit if prefixed with -, as in -favicon")
+
+// conditionalHeaders are the headers of the conditional requests.
+var conditionalHeaders = []param{
+	{Name: "If-None-Match", In: "header", Type: "string", Description: "ETag of a previous response, 304 if the data did not change"},
+	{Name: "If-Modified-Since", In: "header", Type: "string", Description: "Last-Modified of a previous response, ignored with If-None-Match"},
+}
+
+// depthQuery returns the depth parameter of the folder trees with the given default.
+func depthQuery(defaultDepth string) param {
+	return query("depth", "integer", "number of folder levels returned with their children, "+defaultDepth+
+		", the last level folders only having their number of subfolders and bookmarks")
+}
+
+// listQuery returns the pagination, sort and fields parameters of a list
+// with the given sort keys.
+func listQuery(sorts []string) []param {
+	return []param{
+		query("limit", "integer", fmt.Sprintf("page size, %d by default for the API, at most %d", defaultPageSize, maxPageSize)),
+		query("cursor", "string", "next page cursor of the Link header"),
+		query("sort", "string", strings.Join(sorts, ", ")+", descending if prefixed with -"),
+		fieldsQuery,
+	}
+}
+
+// filterQuery are the bookmarks filter parameters.
+var filterQuery = []param{
+	query("folder", "integer", "folder id"),
+	query("tag", "string", "tag name"),
+	query("starred", "boolean", "starred or not"),
+}
+
+// bookmarkListQuery are the parameters of the bookmark lists.
+var bookmarkListQuery = append(listQuery(bookmarkSorts), filterQuery...)
+
+// pathID is the {id} parameter of the API resources.
+var pathID = param{Name: "id", In: "path", Type: "integer", Description: "resource id", Required: true}
+
+// reorderStruct is the body of the /reorderFolder/ requests.
+type reorderStruct struct {
+	Id       int   `json:"id"`
+	Children []int `json:"children"` // negative bookmark ids
+}
+
+// emptyStruct is the empty JSON of the legacy endpoints not returning anything.
+type emptyStruct struct{}
+
+// legacyID is the id parameter of the legacy endpoints, negative for the bookmarks.
+func legacyID(description string) param {
+	return requiredQuery("id", "integer", description)
+}
+
+// operations are the OpenAPI operations by path and method.
+// The legacy endpoints, used by the web interface, accept any method,
+// the ones changing the data being described with GET and POST.
+var operations = map[string]map[string]operation{
+	"/": {
+		http.MethodGet: {Summary: "Main page of the web interface", Tag: "web", ResponseType: "text/html"},
+	},
+	"/wasm/{file}": {
+		http.MethodGet: {Summary: "Web interface WebAssembly files", Tag: "web", ResponseType: "application/octet-stream",
+			Params: []param{{Name: "file", In: "path", Type: "string", Required: true}}},
+	},
+	"/login/": {
+		http.MethodGet:  {Summary: "Login page", Tag: "auth", ResponseType: "text/html", Public: true, Params: []param{query("next", "string", "local page opened after the login")}},
+		http.MethodPost: {Summary: "Login form, setting the session cookie and redirecting", Tag: "auth", BodyType: "application/x-www-form-urlencoded", Status: http.StatusSeeOther, Public: true},
+	},
+	"/logout/": {
+		http.MethodPost: {Summary: "Logout, deleting the session and redirecting to the login page", Tag: "auth", Status: http.StatusSeeOther},
+	},
+	"/getAPITokens/": {
+		http.MethodGet: {Summary: "API tokens of the logged in user", Tag: "auth", Response: []*types.APIToken{}},
+	},
+	"/addAPIToken/": {
+		http.MethodPost: {Summary: "New API token, its value being only returned here", Tag: "auth", Body: types.APIToken{}, Response: newAPITokenStruct{}},
+	},
+	"/revokeAPIToken/": {
+		http.MethodPost: {Summary: "API token revocation", Tag: "auth", Params: []param{legacyID("API token id")}, Response: emptyStruct{}},
+	},
+	"/addBookmark/": {
+		http.MethodPost: {Summary: "New bookmark in the folder with the given id", Tag: "legacy", Body: types.Bookmark{}, Response: types.Bookmark{}},
+	},
+	"/addFolder/": {
+		http.MethodPost: {Summary: "New folder in the parent with the given id, the root folder by default", Tag: "legacy", Body: types.Folder{}, Response: types.Folder{}},
+	},
+	"/updateBookmark/": {
+		http.MethodPost: {Summary: "Bookmark update, or move if its folder changes", Tag: "legacy", Body: types.Bookmark{}, Response: types.Bookmark{}},
+	},
+	"/updateFolder/": {
+		http.MethodPost: {Summary: "Folder rename, or move if its parent changes", Tag: "legacy", Body: types.Folder{}, Response: types.Folder{}},
+	},
+	"/deleteBookmark/": {
+		http.MethodGet:  {Summary: "Bookmark move to the trash", Tag: "legacy", Params: []param{legacyID("negative bookmark id")}, Response: emptyStruct{}},
+		http.MethodPost: {Summary: "Bookmark move to the trash", Tag: "legacy", Params: []param{legacyID("negative bookmark id")}, Response: emptyStruct{}},
+	},
+	"/deleteFolder/": {
+		http.MethodGet:  {Summary: "Folder move to the trash", Tag: "legacy", Params: []param{legacyID("folder id")}, Response: emptyStruct{}},
+		http.MethodPost: {Summary: "Folder move to the trash", Tag: "legacy", Params: []param{legacyID("folder id")}, Response: emptyStruct{}},
+	},
+	"/starBookmark/": {
+		http.MethodGet: {Summary: "Bookmark starring", Tag: "legacy", Response: types.Bookmark{},
+			Params: []param{legacyID("negative bookmark id"), requiredQuery("star", "boolean", "true to star, false to unstar")}},
+		http.MethodPost: {Summary: "Bookmark starring", Tag: "legacy", Response: types.Bookmark{},
+			Params: []param{legacyID("negative bookmark id"), requiredQuery("star", "boolean", "true to star, false to unstar")}},
+	},
+	"/visitBookmark/": {
+		http.MethodGet: {Summary: "Bookmark visit record and redirection to its URL, allowed with a read-only API token", Tag: "legacy", Status: http.StatusFound, Params: []param{legacyID("negative bookmark id")}},
+	},
+	"/sortFolder/": {
+		http.MethodPost: {Summary: "Folder sort mode change", Tag: "legacy", Response: types.Folder{},
+			Params: []param{legacyID("folder id"), requiredQuery("sort", "string", "title, url, created, visited or manual")}},
+	},
+	"/reorderFolder/": {
+		http.MethodPost: {Summary: "Folder children manual order", Tag: "legacy", Body: reorderStruct{}, Response: types.Folder{}},
+	},
+	"/batch/": {
+		http.MethodPost: {Summary: "Bookmark moves, tags, untags, stars, unstars and deletes applied all or none, with the result of each one", Tag: "legacy",
+			Body: batchRequestStruct{}, Response: batchStruct{}},
+	},
+	"/getTree/": {
+		http.MethodGet: {Summary: "Folders and bookmarks tree", Tag: "legacy", Response: types.Folder{}, Conditional: true, Params: []param{depthQuery("the whole tree by default"), fieldsQuery}},
+	},
+	"/events/": {
+		http.MethodGet: {Summary: "Server-Sent Events stream of the folder, bookmark and tag changes, named as bookmark.update with the JSON event as data", Tag: "legacy",
+			ResponseType: "text/event-stream", Params: []param{
+				{Name: "Last-Event-ID", In: "header", Type: "integer", Description: "id of the last received event, to get the missed ones, or a reset event if they are not kept anymore"},
+				query("lastEventId", "integer", "Last-Event-ID header alternative"),
+			}},
+	},
+	"/getFolderChildren/": {
+		http.MethodGet: {Summary: "Folder with its subfolders and bookmarks, recording its visit", Tag: "legacy", Response: types.Folder{}, Conditional: true,
+			Params: []param{query("id", "integer", "folder id, the root folder by default"), depthQuery("1 by default"), fieldsQuery}},
+	},
+	"/getTags/": {
+		http.MethodGet: {Summary: "Tags, paginated with a limit or cursor", Tag: "legacy", Response: []*types.Tag{}, Paged: true, Conditional: true, Params: listQuery(tagSorts)},
+	},
+	"/getStars/": {
+		http.MethodGet: {Summary: "Starred bookmarks, paginated with a limit or cursor", Tag: "legacy", Response: []*types.Bookmark{}, Paged: true, Conditional: true, Params: bookmarkListQuery},
+	},
+	"/searchBookmarks/": {
+		http.MethodGet: {Summary: "Bookmarks search, paginated with a limit or cursor", Tag: "legacy", Response: []*types.Bookmark{}, Paged: true,
+			Params: append([]param{requiredQuery("search", "string", "search query")}, bookmarkListQuery...)},
+	},
+	"/import/": {
+		http.MethodPost: {Summary: "Netscape bookmark file import in a new import folder", Tag: "legacy", BodyType: "text/html", ResponseType: "text/plain"},
+	},
+	"/export/": {
+		http.MethodGet: {Summary: "Netscape bookmark file export", Tag: "legacy", ResponseType: "text/html", Conditional: true},
+	},
+	"/getTrash/": {
+		http.MethodGet: {Summary: "Folders and bookmarks in the trash", Tag: "trash", Response: types.Trash{}},
+	},
+	"/restoreTrash/": {
+		http.MethodPost: {Summary: "Trash restoration", Tag: "trash", Params: []param{legacyID("folder id or negative bookmark id")}, Response: emptyStruct{}},
+	},
+	"/purgeTrash/": {
+		http.MethodPost: {Summary: "Permanent deletion from the trash", Tag: "trash", Response: emptyStruct{},
+			Params: []param{query("id", "integer", "folder id or negative bookmark id, the whole trash by default")}},
+	},
+	"/getHistory/": {
+		http.MethodGet: {Summary: "Revisions of a folder or bookmark, most recent first", Tag: "history", Response: []*types.Revision{},
+			Params: []param{legacyID("folder id or negative bookmark id")}},
+	},
+	"/undo/": {
+		http.MethodPost: {Summary: "Last changes revert", Tag: "history", Response: []*types.Revision{}, Params: []param{query("n", "integer", "number of changes, 1 by default")}},
+	},
+	"/getFolderGrants/": {
+		http.MethodGet: {Summary: "Users a folder is shared with", Tag: "sharing", Response: []*types.Grant{}, Params: []param{legacyID("folder id")}},
+	},
+	"/shareFolder/": {
+		http.MethodPost: {Summary: "Folder sharing with a user, an empty role unsharing it", Tag: "sharing", Body: types.Grant{}, Response: []*types.Grant{}},
+	},
+	"/getShareLinks/": {
+		http.MethodGet: {Summary: "Share links of a folder", Tag: "sharing", Response: []*types.ShareLink{}, Params: []param{legacyID("folder id")}},
+	},
+	"/addShareLink/": {
+		http.MethodPost: {Summary: "New share link, its URL being only returned here", Tag: "sharing", Body: newShareLinkStruct{}, Response: newShareLinkStruct{}},
+	},
+	"/revokeShareLink/": {
+		http.MethodPost: {Summary: "Share link revocation", Tag: "sharing", Params: []param{legacyID("share link id")}, Response: emptyStruct{}},
+	},
+	"/share/{token}": {
+		http.MethodGet: {Summary: "Shared folder page", Tag: "sharing", ResponseType: "text/html", Public: true,
+			Params: []param{{Name: "token", In: "path", Type: "string", Required: true}}},
+		http.MethodPost: {Summary: "Shared folder password form", Tag: "sharing", BodyType: "application/x-www-form-urlencoded", Status: http.StatusSeeOther, Public: true,
+			Params: []param{{Name: "token", In: "path", Type: "string", Required: true}}},
+	},
+	"/share/{token}/feed.json": {
+		http.MethodGet: {Summary: "Shared folder JSON feed, the password being the one of a basic authentication", Tag: "sharing", Response: types.Folder{}, Public: true,
+			Params: []param{{Name: "token", In: "path", Type: "string", Required: true}}},
+	},
+	OpenAPIPath: {
+		http.MethodGet: {Summary: "This OpenAPI document", Tag: "web", Public: true, ResponseType: "application/json"},
+	},
+	APIDocPath: {
+		http.MethodGet: {Summary: "OpenAPI document viewer", Tag: "web", Public: true, ResponseType: "text/html"},
+	},
+	APIPrefix + "/folders": {
+		http.MethodGet: {Summary: "Subfolders of a folder, the root folder ones and the shared folders by default", Tag: "folders", Response: []*apiFolder{}, Paged: true,
+			Params: append([]param{query("parent", "integer", "parent folder id")}, listQuery(folderSorts)...)},
+		http.MethodPost: {Summary: "New folder, in the root folder by default", Tag: "folders", Body: apiFolderInput{}, Response: apiFolder{}, Status: http.StatusCreated},
+	},
+	APIPrefix + "/folders/{id}": {
+		http.MethodGet:    {Summary: "Folder with its subfolders and bookmarks", Tag: "folders", Params: []param{pathID, depthQuery("1 by default"), fieldsQuery}, Response: apiFolder{}},
+		http.MethodPatch:  {Summary: "Folder rename, sort or move", Tag: "folders", Params: []param{pathID}, Body: apiFolderInput{}, Response: apiFolder{}},
+		http.MethodDelete: {Summary: "Folder move to the trash", Tag: "folders", Params: []param{pathID}, Status: http.StatusNoContent},
+	},
+	APIPrefix + "/bookmarks": {
+		http.MethodGet: {Summary: "Bookmarks of a folder, the root folder by default, search or filtered bookmarks", Tag: "bookmarks", Response: []*apiBookmark{}, Paged: true,
+			Params: append([]param{query("q", "string", "search query")}, bookmarkListQuery...)},
+		http.MethodPost: {Summary: "New bookmark, in the root folder by default", Tag: "bookmarks", Body: apiBookmarkInput{}, Response: apiBookmark{}, Status: http.StatusCreated},
+	},
+	APIPrefix + "/bookmarks/{id}": {
+		http.MethodGet:    {Summary: "Bookmark", Tag: "bookmarks", Params: []param{pathID}, Response: apiBookmark{}},
+		http.MethodPatch:  {Summary: "Bookmark change or move", Tag: "bookmarks", Params: []param{pathID}, Body: apiBookmarkInput{}, Response: apiBookmark{}},
+		http.MethodDelete: {Summary: "Bookmark move to the trash", Tag: "bookmarks", Params: []param{pathID}, Status: http.StatusNoContent},
+	},
+	APIPrefix + "/tags": {
+		http.MethodGet:  {Summary: "Tags, sorted by name by default", Tag: "tags", Response: []*types.Tag{}, Paged: true, Params: listQuery(tagSorts)},
+		http.MethodPost: {Summary: "New tag", Tag: "tags", Body: apiTagInput{}, Response: types.Tag{}, Status: http.StatusCreated},
+	},
+	APIPrefix + "/tags/{id}": {
+		http.MethodGet:    {Summary: "Tag", Tag: "tags", Params: []param{pathID}, Response: types.Tag{}},
+		http.MethodPatch:  {Summary: "Tag rename", Tag: "tags", Params: []param{pathID}, Body: apiTagInput{}, Response: types.Tag{}},
+		http.MethodDelete: {Summary: "Tag removal from its bookmarks and deletion", Tag: "tags", Params: []param{pathID}, Status: http.StatusNoContent},
+	},
+	APIPrefix + "/webhooks": {
+		http.MethodGet: {Summary: "Webhooks, without their secret", Tag: "webhooks", Response: []*types.Webhook{}},
+		http.MethodPost: {Summary: "New webhook posting the matching events, as on /events/, signed with the secret in the " + WebhookSignatureHeader +
+			" header, the secret being generated if empty and only returned here", Tag: "webhooks", Body: apiWebhookInput{}, Response: newWebhookStruct{}, Status: http.StatusCreated},
+	},
+	APIPrefix + "/webhooks/{id}": {
+		http.MethodGet:    {Summary: "Webhook, without its secret", Tag: "webhooks", Params: []param{pathID}, Response: types.Webhook{}},
+		http.MethodDelete: {Summary: "Webhook deletion", Tag: "webhooks", Params: []param{pathID}, Status: http.StatusNoContent},
+	},
+	APIPrefix + "/webhooks/{id}/deliveries": {
+		http.MethodGet: {Summary: "Last delivery attempts of the webhook, most recent first", Tag: "webhooks", Params: []param{pathID}, Response: []*types.WebhookDelivery{}},
+	},
+}
+
+// enums are the allowed values of the string types.
+var enums = map[reflect.Type][]string{
+	reflect.TypeOf(types.SortMode("")): {string(types.SortTitle), string(types.SortURL), string(types.SortCreated), string(types.SortVisited), string(types.SortManual)},
+}
+
+// schemas generates the JSON schemas of Go types,
+// the named structs being components referenced by name.
+type schemas struct {
+	components map[string]interface{}
+}
+
+// schemaName returns the component name of the given named struct type.
+func schemaName(t reflect.Type) string {
+
+	name := strings.TrimSuffix(t.Name(), "Struct")
+	if strings.HasPrefix(name, "api") {
+		return "API" + strings.TrimPrefix(name, "api")
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+
+}
+
+// schema returns the JSON schema of the given type.
+func (s *schemas) schema(t reflect.Type) map[string]interface{} {
+
+	if e, ok := enums[t]; ok {
+		return map[string]interface{}{"type": "string", "enum": e}
+	}
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{"description": "any JSON value"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		sch := s.schema(t.Elem())
+		if _, ok := sch["$ref"]; ok {
+			// $ref siblings are ignored in OpenAPI 3.0.
+			return map[string]interface{}{"allOf": []interface{}{sch}, "nullable": true}
+		}
+		sch["nullable"] = true
+		return sch
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		// The nil slices are null, their elements never.
+		elem := t.Elem()
+		if elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		return map[string]interface{}{"type": "array", "items": s.schema(elem), "nullable": t.Kind() == reflect.Slice}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := s.components[name]; !ok {
+			// Registering the name first for the recursive types.
+			s.components[name] = nil
+			s.components[name] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+
+}
+
+// object returns the JSON schema of the given struct type,
+// the embedded structs fields being its own ones.
+func (s *schemas) object(t reflect.Type) map[string]interface{} {
+
+	properties := make(map[string]interface{})
+	var required []string
+
+	var fields func(t reflect.Type)
+	fields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" {
+				ft := f.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				fields(ft)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			properties[name] = s.schema(f.Type)
+			if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+	}
+	fields(t)
+
+	o := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		o["required"] = required
+	}
+	return o
+
+}
+
+// content returns the OpenAPI content of the given JSON value or media type.
+func (s *schemas) content(v interface{}, mediaType string) map[string]interface{} {
+
+	if mediaType != "" {
+		return map[string]interface{}{mediaType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+	}
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": s.schema(reflect.TypeOf(v))}}
+
+}
+
+// operationID returns the OpenAPI operation id of the given method and path.
+func operationID(method, path string) string {
+
+	id := strings.ToLower(method)
+	for _, w := range strings.FieldsFunc(path, func(r rune) bool { return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') }) {
+		id += strings.ToUpper(w[:1]) + w[1:]
+	}
+	return id
+
+}
+
+// OpenAPI returns the OpenAPI 3 document of the routes,
+// served at the given URL.
+func OpenAPI(serverURL string) map[string]interface{} {
+
+	s := &schemas{components: make(map[string]interface{})}
+	apiError := s.schema(reflect.TypeOf(apiErrorStruct{}))
+
+	paths := make(map[string]interface{})
+	for path, methods := range operations {
+		item := make(map[string]interface{})
+		for method, op := range methods {
+			o := map[string]interface{}{
+				"summary":     op.Summary,
+				"operationId": operationID(method, path),
+				"tags":        []string{op.Tag},
+			}
+
+			var params []interface{}
+			opParams := op.Params
+			if op.Conditional {
+				opParams = append(opParams[:len(opParams):len(opParams)], conditionalHeaders...)
+			}
+			for _, p := range opParams {
+				params = append(params, map[string]interface{}{
+					"name":        p.Name,
+					"in":          p.In,
+					"description": p.Description,
+					"required":    p.Required,
+					"schema":      map[string]interface{}{"type": p.Type},
+				})
+			}
+			if params != nil {
+				o["parameters"] = params
+			}
+			if op.Body != nil || op.BodyType != "" {
+				o["requestBody"] = map[string]interface{}{"required": true, "content": s.content(op.Body, op.BodyType)}
+			}
+
+			status := op.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			success := map[string]interface{}{"description": http.StatusText(status)}
+			if op.Response != nil || op.ResponseType != "" {
+				success["content"] = s.content(op.Response, op.ResponseType)
+			}
+			headers := make(map[string]interface{})
+			if op.Paged {
+				headers["Link"] = map[string]interface{}{
+					"description": `next page URL, with rel="next", if any`,
+					"schema":      map[string]interface{}{"type": "string"},
+				}
+			}
+			if op.Conditional {
+				headers["ETag"] = map[string]interface{}{
+					"description": "version of the data, changed by every change",
+					"schema":      map[string]interface{}{"type": "string"},
+				}
+				headers["Last-Modified"] = map[string]interface{}{
+					"description": "date of the last change, if any",
+					"schema":      map[string]interface{}{"type": "string"},
+				}
+			}
+			if len(headers) > 0 {
+				success["headers"] = headers
+			}
+			responses := map[string]interface{}{strconv.Itoa(status): success}
+			if op.Conditional {
+				responses[strconv.Itoa(http.StatusNotModified)] = map[string]interface{}{"description": "data not modified"}
+			}
+			if strings.HasPrefix(path, APIPrefix+"/") {
+				for _, code := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+					responses[strconv.Itoa(code)] = map[string]interface{}{"$ref": "#/components/responses/APIError"}
+				}
+			} else {
+				responses["default"] = map[string]interface{}{"$ref": "#/components/responses/Error"}
+			}
+			o["responses"] = responses
+
+			if op.Public {
+				o["security"] = []interface{}{}
+			}
+			item[strings.ToLower(method)] = o
+		}
+		paths[path] = item
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "GoBkm",
+			"version": strings.TrimPrefix(APIPrefix, "/api/"),
+			"description": "GoBkm bookmarks manager. The /api/v1 REST API uses positive ids, the legacy endpoints of the web interface negative bookmark ids. " +
+				"The requests changing the data fail with a 412 error if their If-Match header does not match the current ETag of the data.",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": strings.TrimSuffix(serverURL, "/")}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": s.components,
+			"responses": map[string]interface{}{
+				"APIError": map[string]interface{}{
+					"description": "API error",
+					"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": apiError}},
+				},
+				"Error": map[string]interface{}{
+					"description": "error message",
+					"content":     map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "description": "API token"},
+				"cookieAuth": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": sessionCookie,
+					"description": "login session, the requests changing something, whatever their method, requiring its CSRF token in a " + csrfHeader + " header"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearerAuth": []string{}},
+			map[string]interface{}{"cookieAuth": []string{}},
+		},
+	}
+
+}
+
+// describes returns true if the given OpenAPI document path
+// is served by the given route pattern, a pattern ending
+// with a slash serving the paths it prefixes.
+func describes(path, pattern string) bool {
+	return path == pattern || pattern != "/" && strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern)
+}
+
+// CheckOpenAPI returns an error listing the given route patterns,
+// and the API routes, without an OpenAPI document entry,
+// and the entries without route.
+func (env *Env) CheckOpenAPI(patterns []string) error {
+
+	var missing, unknown []string
+	for _, pattern := range patterns {
+		found := false
+		for path := range operations {
+			if describes(path, pattern) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, pattern)
+		}
+	}
+	for _, route := range env.apiRoutes() {
+		if _, ok := operations[APIPrefix+route.Pattern][route.Method]; !ok {
+			missing = append(missing, route.Method+" "+APIPrefix+route.Pattern)
+		}
+	}
+	for path := range operations {
+		found := false
+		for _, pattern := range patterns {
+			if describes(path, pattern) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, path)
+		}
+	}
+
+	var errs []string
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		errs = append(errs, "routes without OpenAPI entry: "+strings.Join(missing, ", "))
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		errs = append(errs, "OpenAPI entries without route: "+strings.Join(unknown, ", "))
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+
+}
+
+// OpenAPIHandler returns the OpenAPI document.
+func (env *Env) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := json.NewEncoder(w).Encode(OpenAPI(env.GoBkmProxyURL)); err != nil {
+		failHTTP(w, "OpenAPIHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
+
+// APIDocHandler shows the OpenAPI document viewer.
+func (env *Env) APIDocHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := w.Write([]byte(env.TplAPIDocData)); err != nil {
+		// Just logging the error.
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("APIDocHandler")
+	}
+
+}
+
+// Mux is an http.ServeMux keeping its patterns,
+// to check the OpenAPI document describes them.
+type Mux struct {
+	*http.ServeMux
+	Patterns []string
+}
+
+// NewMux returns a new Mux.
+func NewMux() *Mux {
+	return &Mux{ServeMux: http.NewServeMux()}
+}
+
+// Handle registers the handler for the given pattern.
+func (m *Mux) Handle(pattern string, handler http.Handler) {
+
+	m.ServeMux.Handle(pattern, handler)
+	m.Patterns = append(m.Patterns, pattern)
+
+}
+
+// HandleFunc registers the handler function for the given pattern.
+func (m *Mux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.Handle(pattern, http.HandlerFunc(handler))
+}
@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// access is the access of the logged in user to a folder or bookmark,
+// possibly shared with them by another user.
+type access struct {
+	ds     models.Datastore // the datastore of the owner
+	owner  int              // the id of the owner
+	role   string           // the role of the user, owner for their own folders
+	shared bool             // true if the owner is another user
+}
+
+// newAccess returns the access of the logged in user of the given context
+// to the folders of the given owner with the given role,
+// failing with models.ErrForbidden if it does not allow the wanted one.
+func (env *Env) newAccess(ctx context.Context, owner int, role, wanted string) (*access, error) {
+
+	if err := models.CheckRole(role, wanted); err != nil {
+		return nil, err
+	}
+
+	var userID int
+	if u := UserFromContext(ctx); u != nil {
+		userID = u.Id
+	}
+	return &access{ds: env.db(ctx).ForUser(owner), owner: owner, role: role, shared: owner != userID}, nil
+
+}
+
+// userAccess returns the access of the logged in user of the given context
+// to their own folders, the whole datastore if the authentication is disabled.
+func (env *Env) userAccess(ctx context.Context) *access {
+
+	var owner int
+	if u := UserFromContext(ctx); u != nil {
+		owner = u.Id
+	}
+	return &access{ds: env.datastore(ctx), owner: owner, role: types.RoleOwner}
+
+}
+
+// folderAccess returns the access of the logged in user to the folder with the given id,
+// failing with models.ErrNotFound if the folder is not shared with them
+// and models.ErrForbidden if their role does not allow the wanted one.
+func (env *Env) folderAccess(ctx context.Context, id int, wanted string) (*access, error) {
+
+	owner, role, err := env.datastore(ctx).GetFolderAccess(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return env.newAccess(ctx, owner, role, wanted)
+
+}
+
+// bookmarkAccess returns the access of the logged in user to the bookmark with the given id,
+// failing with models.ErrNotFound if the bookmark is not shared with them
+// and models.ErrForbidden if their role does not allow the wanted one.
+func (env *Env) bookmarkAccess(ctx context.Context, id int, wanted string) (*access, error) {
+
+	owner, role, err := env.datastore(ctx).GetBookmarkAccess(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return env.newAccess(ctx, owner, role, wanted)
+
+}
+
+// checkMove returns an error if the logged in user can not move the given folder,
+// or folder content, of the given access out of its parent folder,
+// for which the editor role is required, into the folder of the given destination access.
+func (env *Env) checkMove(ctx context.Context, acc *access, parent *types.Folder, dst *access) error {
+
+	if dst.owner != acc.owner {
+		return errOtherOwner
+	}
+	if parent == nil {
+		return nil
+	}
+	if _, err := env.folderAccess(ctx, parent.Id, types.RoleEditor); err != nil {
+		// The parent of a folder shared with the user is not.
+		if errors.Is(err, models.ErrNotFound) {
+			return models.ErrForbidden
+		}
+		return err
+	}
+	return nil
+
+}
+
+// errOtherOwner is returned when moving a folder or bookmark
+// into a folder of another user.
+var errOtherOwner = errors.New("the folders and bookmarks can not be moved to the folders of another user")
+
+// trimParents removes from the parents of the given folder of the given access
+// the ones not shared with the logged in user.
+func (env *Env) trimParents(ctx context.Context, acc *access, fld *types.Folder) {
+
+	if !acc.shared || fld == nil {
+		return
+	}
+	for f := fld; f.Parent != nil; f = f.Parent {
+		if _, err := env.folderAccess(ctx, f.Parent.Id, types.RoleViewer); err != nil {
+			f.Parent = nil
+			return
+		}
+	}
+
+}
+
+// setShared sets the role and owner username of the given folder
+// if it is shared with the logged in user, trimming its parents.
+func (env *Env) setShared(ctx context.Context, acc *access, fld *types.Folder) error {
+
+	if !acc.shared {
+		return nil
+	}
+	u, err := env.db(ctx).GetUser(ctx, acc.owner)
+	if err != nil {
+		return err
+	}
+	fld.Role = acc.role
+	fld.Owner = u.Username
+	env.trimParents(ctx, acc, fld)
+	return nil
+
+}
+
+// getSharedFolders returns the folders shared with the logged in user,
+// with their content down to the given depth, see getChildren.
+func (env *Env) getSharedFolders(ctx context.Context, depth int) ([]*types.Folder, error) {
+
+	if UserFromContext(ctx) == nil {
+		return nil, nil
+	}
+
+	flds, err := env.datastore(ctx).GetSharedFolders(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, fld := range flds {
+		acc, err := env.folderAccess(ctx, fld.Id, types.RoleViewer)
+		if err != nil {
+			return nil, err
+		}
+		if err = env.getChildren(ctx, acc.ds, fld, depth); err != nil {
+			return nil, err
+		}
+	}
+	return flds, nil
+
+}
+
+// GetFolderGrantsHandler returns the grants of the given folder.
+func (env *Env) GetFolderGrantsHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err      error
+		folderID int
+	)
+	// GET parameters retrieval.
+	folderIDParam := r.URL.Query().Get("id")
+	log.WithFields(log.Fields{
+		"folderIdParam": folderIDParam,
+	}).Debug("GetFolderGrantsHandler:Query parameter")
+
+	// folderId int convertion.
+	if folderID, err = strconv.Atoi(folderIDParam); err != nil {
+		failHTTP(w, "GetFolderGrantsHandler", "folderId Atoi conversion", http.StatusBadRequest)
+		return
+	}
+
+	acc, err := env.folderAccess(r.Context(), folderID, types.RoleOwner)
+	if err != nil {
+		failHTTP(w, "GetFolderGrantsHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	grants, err := acc.ds.GetFolderGrants(r.Context(), folderID)
+	if err != nil {
+		failHTTP(w, "GetFolderGrantsHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(grants); err != nil {
+		failHTTP(w, "GetFolderGrantsHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
+
+// ShareFolderHandler grants a role on a folder to a user with a POSTed
+// grant: {"folder_id": 2, "username": "bob", "role": "editor"}.
+// An empty role deletes the grant. It requires the owner role on the folder.
+func (env *Env) ShareFolderHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err error
+		g   types.Grant
+	)
+
+	if r.Method != http.MethodPost {
+		failHTTP(w, "ShareFolderHandler", "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(&g); err != nil {
+		failHTTP(w, "ShareFolderHandler", "form decoding error", http.StatusBadRequest)
+		return
+	}
+	log.WithFields(log.Fields{
+		"g": g,
+	}).Debug("ShareFolderHandler:Query parameter")
+
+	acc, err := env.folderAccess(r.Context(), g.FolderId, types.RoleOwner)
+	if err != nil {
+		failHTTP(w, "ShareFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	u, err := env.db(r.Context()).GetUserByName(r.Context(), g.Username)
+	if err != nil {
+		failHTTP(w, "ShareFolderHandler", "user "+g.Username+": "+err.Error(), datastoreStatus(err))
+		return
+	}
+
+	if g.Role == "" {
+		err = acc.ds.UnshareFolder(r.Context(), g.FolderId, u.Id)
+	} else {
+		err = acc.ds.ShareFolder(r.Context(), g.FolderId, u.Id, g.Role)
+	}
+	if err != nil {
+		failHTTP(w, "ShareFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+
+	// Returning the folder grants.
+	grants, err := acc.ds.GetFolderGrants(r.Context(), g.FolderId)
+	if err != nil {
+		failHTTP(w, "ShareFolderHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(grants); err != nil {
+		failHTTP(w, "ShareFolderHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
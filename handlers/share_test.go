@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/tbellembois/gobkm/types"
+)
+
+// roleCase is a request of a user on a shared folder with its wanted status.
+type roleCase struct {
+	name   string
+	method string
+	target string
+	body   interface{}
+	status int
+}
+
+func TestSharedFolderRoles(t *testing.T) {
+
+	env := newTestEnv(t)
+	h := testHandler(env)
+	alice := addTestUser(t, env, "alice")
+	bob, carol := addTestUser(t, env, "bob"), addTestUser(t, env, "carol")
+
+	// The folder of alice shared with bob as viewer and carol as editor.
+	shared := addTestFolder(t, h, alice, "shared")
+	sub := addSubfolder(t, h, alice, "sub", shared.Id)
+	private := addTestFolder(t, h, alice, "private")
+	bkm := addTestBookmark(t, h, alice, "bkm", shared.Id)
+	shareTestFolder(t, h, alice, shared.Id, "bob", types.RoleViewer)
+	shareTestFolder(t, h, alice, shared.Id, "carol", types.RoleEditor)
+	carolFld := addTestFolder(t, h, carol, "carol")
+
+	sharedID, subID, bookmarkID := strconv.Itoa(shared.Id), strconv.Itoa(sub.Id), strconv.Itoa(-bkm.Id)
+	newBookmark := &types.Bookmark{Title: "new", URL: "https://example.com/", Folder: &types.Folder{Id: shared.Id}}
+	grant := &types.Grant{FolderId: shared.Id, Username: "bob", Role: types.RoleEditor}
+
+	// The viewer reads the folder but does not change it.
+	for _, c := range []roleCase{
+		{"read", http.MethodGet, "/getFolderChildren/?id=" + sharedID, nil, http.StatusOK},
+		{"api read", http.MethodGet, APIPrefix + "/bookmarks/" + strconv.Itoa(bkm.Id), nil, http.StatusOK},
+		{"update folder", http.MethodPost, "/updateFolder/", &types.Folder{Id: sub.Id, Title: "viewer"}, http.StatusForbidden},
+		{"add folder", http.MethodPost, "/addFolder/", &types.Folder{Title: "viewer", Parent: &types.Folder{Id: shared.Id}}, http.StatusForbidden},
+		{"add bookmark", http.MethodPost, "/addBookmark/", newBookmark, http.StatusForbidden},
+		{"update bookmark", http.MethodPost, "/updateBookmark/", &types.Bookmark{Id: -bkm.Id, Title: "viewer", URL: bkm.URL}, http.StatusForbidden},
+		{"move bookmark", http.MethodPost, "/updateBookmark/", &types.Bookmark{Id: -bkm.Id, Folder: &types.Folder{Id: sub.Id}}, http.StatusForbidden},
+		{"star bookmark", http.MethodGet, "/starBookmark/?star=true&id=" + bookmarkID, nil, http.StatusForbidden},
+		{"delete bookmark", http.MethodGet, "/deleteBookmark/?id=" + bookmarkID, nil, http.StatusForbidden},
+		{"delete folder", http.MethodGet, "/deleteFolder/?id=" + subID, nil, http.StatusForbidden},
+		{"api update folder", http.MethodPatch, APIPrefix + "/folders/" + subID, map[string]string{"title": "viewer"}, http.StatusForbidden},
+		{"api delete bookmark", http.MethodDelete, APIPrefix + "/bookmarks/" + strconv.Itoa(bkm.Id), nil, http.StatusForbidden},
+		{"grants", http.MethodGet, "/getFolderGrants/?id=" + sharedID, nil, http.StatusForbidden},
+		{"share", http.MethodPost, "/shareFolder/", grant, http.StatusForbidden},
+		{"other folder", http.MethodGet, "/getFolderChildren/?id=" + strconv.Itoa(private.Id), nil, http.StatusNotFound},
+	} {
+		t.Run("viewer "+c.name, func(t *testing.T) {
+			decode(t, serve(t, h, bob, c.method, c.target, c.body), c.status, nil)
+		})
+	}
+
+	// The editor changes the folder content, within the folders of alice,
+	// but not its grants.
+	for _, c := range []roleCase{
+		{"add bookmark", http.MethodPost, "/addBookmark/", newBookmark, http.StatusOK},
+		{"update bookmark", http.MethodPost, "/updateBookmark/", &types.Bookmark{Id: -bkm.Id, Title: "edited", URL: bkm.URL}, http.StatusOK},
+		{"move bookmark", http.MethodPost, "/updateBookmark/", &types.Bookmark{Id: -bkm.Id, Folder: &types.Folder{Id: sub.Id}}, http.StatusOK},
+		{"move to an unshared folder", http.MethodPost, "/updateBookmark/", &types.Bookmark{Id: -bkm.Id, Folder: &types.Folder{Id: private.Id}}, http.StatusNotFound},
+		{"move to another owner", http.MethodPost, "/updateBookmark/", &types.Bookmark{Id: -bkm.Id, Folder: &types.Folder{Id: carolFld.Id}}, http.StatusBadRequest},
+		{"move the shared folder", http.MethodPost, "/updateFolder/", &types.Folder{Id: shared.Id, Title: "shared", Parent: &types.Folder{Id: private.Id}}, http.StatusNotFound},
+		{"grants", http.MethodGet, "/getFolderGrants/?id=" + sharedID, nil, http.StatusForbidden},
+		{"share", http.MethodPost, "/shareFolder/", grant, http.StatusForbidden},
+		{"unshare", http.MethodPost, "/shareFolder/", &types.Grant{FolderId: shared.Id, Username: "bob"}, http.StatusForbidden},
+		{"share the subfolder", http.MethodPost, "/shareFolder/", &types.Grant{FolderId: sub.Id, Username: "bob", Role: types.RoleEditor}, http.StatusForbidden},
+		{"delete folder", http.MethodGet, "/deleteFolder/?id=" + subID, nil, http.StatusOK},
+	} {
+		t.Run("editor "+c.name, func(t *testing.T) {
+			decode(t, serve(t, h, carol, c.method, c.target, c.body), c.status, nil)
+		})
+	}
+
+	// The grants are unchanged.
+	var grants []*types.Grant
+	decode(t, serve(t, h, alice, http.MethodGet, "/getFolderGrants/?id="+sharedID, nil), http.StatusOK, &grants)
+	roles := map[string]string{}
+	for _, g := range grants {
+		roles[g.Username] = g.Role
+	}
+	if len(roles) != 2 || roles["bob"] != types.RoleViewer || roles["carol"] != types.RoleEditor {
+		t.Errorf("grants %v, want bob viewer and carol editor", roles)
+	}
+
+}
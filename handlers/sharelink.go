@@ -0,0 +1,466 @@
+package handlers
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+const (
+	sharePath   = "/share/"
+	shareCookie = "gobkm_share" // proves the password of a protected share link
+	shareFeed   = "feed.json"
+
+	// shareFreeAttempts is the number of wrong passwords of a share link
+	// before the next attempts are delayed.
+	shareFreeAttempts = 5
+	// shareMinDelay and shareMaxDelay bound the delay before the next attempt
+	// once there are too many wrong passwords, doubling with each one.
+	// The wrong passwords are forgotten after shareMaxDelay without attempt.
+	shareMinDelay = time.Second
+	shareMaxDelay = 15 * time.Minute
+)
+
+// shareAttempts are the wrong passwords of a protected share link.
+type shareAttempts struct {
+	failures int
+	last     time.Time // the last wrong password date
+	until    time.Time // the next attempt date
+}
+
+// shareThrottle delays the password attempts of the protected share links
+// after too many wrong ones, not to be brute forced.
+type shareThrottle struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	attempts map[string]*shareAttempts // by share link hash
+}
+
+// sharePasswords is the throttle of the share link passwords.
+var sharePasswords = &shareThrottle{now: time.Now, attempts: make(map[string]*shareAttempts)}
+
+// wait returns the delay before the next password attempt
+// of the share link with the given hash, 0 if it can be done now.
+func (s *shareThrottle) wait(hash string) time.Duration {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.attempts[hash]
+	if !ok {
+		return 0
+	}
+	if d := a.until.Sub(s.now()); d > 0 {
+		return d
+	}
+	return 0
+
+}
+
+// fail records a wrong password of the share link with the given hash,
+// delaying the next attempt if there are too many.
+func (s *shareThrottle) fail(hash string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	// Forgetting the old attempts.
+	for h, a := range s.attempts {
+		if now.Sub(a.last) > shareMaxDelay {
+			delete(s.attempts, h)
+		}
+	}
+
+	a, ok := s.attempts[hash]
+	if !ok {
+		a = &shareAttempts{}
+		s.attempts[hash] = a
+	}
+	a.failures++
+	a.last = now
+	if n := a.failures - shareFreeAttempts; n >= 0 {
+		delay := shareMaxDelay
+		if n < 20 && shareMinDelay<<n < shareMaxDelay {
+			delay = shareMinDelay << n
+		}
+		a.until = now.Add(delay)
+	}
+
+}
+
+// succeed forgets the wrong passwords of the share link with the given hash.
+func (s *shareThrottle) succeed(hash string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, hash)
+
+}
+
+// checkSharePassword returns true if the given password is the one
+// of the given protected share link, or the delay before the link
+// can be tried again, without checking the password, if there were
+// too many wrong ones.
+func checkSharePassword(link *types.ShareLink, password string) (bool, time.Duration) {
+
+	if wait := sharePasswords.wait(link.Hash); wait > 0 {
+		return false, wait
+	}
+	if models.CheckPassword(link.PasswordHash, password) != nil {
+		sharePasswords.fail(link.Hash)
+		return false, 0
+	}
+	sharePasswords.succeed(link.Hash)
+	return true, 0
+
+}
+
+// retryAfter sets the Retry-After header of the given delay.
+func retryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+}
+
+// newShareLinkStruct is the POSTed share link and the JSON of a new share link,
+// the only time its URL is shown.
+type newShareLinkStruct struct {
+	*types.ShareLink
+	Password string `json:"password,omitempty"`
+	URL      string `json:"url"`
+}
+
+// shareDataStruct is used to pass data to the share template,
+// the folder being nil to ask the password.
+type shareDataStruct struct {
+	Folder *types.Folder
+	Path   string
+	Error  string
+}
+
+// shareLinkPath returns the token of the given share link path,
+// /share/{token} or /share/{token}/feed.json, and true for the JSON feed.
+func shareLinkPath(p string) (token string, feed bool, ok bool) {
+
+	token, rest, _ := strings.Cut(strings.TrimPrefix(p, sharePath), "/")
+	switch {
+	case token == "":
+		return "", false, false
+	case rest == "":
+		return token, false, true
+	case rest == shareFeed:
+		return token, true, true
+	}
+	return "", false, false
+
+}
+
+// shareCookieValue returns the cookie value proving the password
+// of the given share link with the given token, changing with the password.
+func shareCookieValue(token string, link *types.ShareLink) string {
+	return hashToken(token + link.PasswordHash)
+}
+
+// shareUnlocked returns true if the given request proves the password of the given
+// protected share link with the cookie set by the password form.
+func shareUnlocked(r *http.Request, token string, link *types.ShareLink) bool {
+
+	c, err := r.Cookie(shareCookie)
+	return err == nil && equalTokens(c.Value, shareCookieValue(token, link))
+
+}
+
+// publicFolder removes from the given folder, its subfolders
+// and bookmarks the data kept private by a share link.
+func publicFolder(fld *types.Folder) {
+
+	fld.Shared = false
+	fld.LastVisitedAt = nil
+	for _, f := range fld.Folders {
+		publicFolder(f)
+	}
+	for _, b := range fld.Bookmarks {
+		b.LastVisitedAt = nil
+	}
+
+}
+
+// faviconURL returns the given bookmark favicon as an URL of the share template,
+// empty if it is not an image.
+func faviconURL(favicon string) template.URL {
+
+	if !strings.HasPrefix(favicon, "data:image/") {
+		return ""
+	}
+	return template.URL(favicon)
+
+}
+
+// renderShare renders the share page of the given data.
+func (env *Env) renderShare(w http.ResponseWriter, data shareDataStruct, status int) {
+
+	htmlTpl, err := template.New("share").Funcs(template.FuncMap{"favicon": faviconURL}).Parse(env.TplShareData)
+	if err != nil {
+		failHTTP(w, "renderShare", err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err = htmlTpl.Execute(w, data); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("renderShare")
+	}
+
+}
+
+// ShareHandler shows the folder of a share link, without authentication,
+// as an HTML page on /share/{token} and a JSON feed on /share/{token}/feed.json.
+// The password of a protected link is POSTed with the page form
+// or sent as the password of a basic authentication, the attempts
+// being delayed after too many wrong passwords, see shareThrottle.
+func (env *Env) ShareHandler(w http.ResponseWriter, r *http.Request) {
+
+	token, feed, ok := shareLinkPath(r.URL.Path)
+	if !ok {
+		failHTTP(w, "ShareHandler", "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && (feed || r.Method != http.MethodPost) {
+		failHTTP(w, "ShareHandler", "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	link, err := env.db(r.Context()).GetShareLink(r.Context(), hashToken(token))
+	if err != nil {
+		failHTTP(w, "ShareHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	// Not leaking the token to the bookmarked sites nor to the search engines.
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+
+	// Checking the password.
+	path := sharePath + token
+	if link.Protected && r.Method == http.MethodPost {
+		ok, wait := checkSharePassword(link, r.PostFormValue("password"))
+		if wait > 0 {
+			retryAfter(w, wait)
+			env.renderShare(w, shareDataStruct{Path: path, Error: "Too many invalid passwords, please try again later."}, http.StatusTooManyRequests)
+			return
+		}
+		if !ok {
+			env.renderShare(w, shareDataStruct{Path: path, Error: "Invalid password."}, http.StatusUnauthorized)
+			return
+		}
+		var maxAge int
+		if link.ExpiresAt != nil {
+			maxAge = int(time.Until(*link.ExpiresAt).Seconds())
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     shareCookie,
+			Value:    shareCookieValue(token, link),
+			Path:     path,
+			MaxAge:   maxAge,
+			HttpOnly: true,
+			Secure:   env.SecureCookies,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, path, http.StatusSeeOther)
+		return
+	}
+	unlocked := !link.Protected || shareUnlocked(r, token, link)
+	if _, password, ok := r.BasicAuth(); ok && !unlocked {
+		var wait time.Duration
+		if unlocked, wait = checkSharePassword(link, password); wait > 0 {
+			retryAfter(w, wait)
+			failHTTP(w, "ShareHandler", "too many invalid passwords", http.StatusTooManyRequests)
+			return
+		}
+	}
+	if !unlocked {
+		if feed {
+			w.Header().Set("WWW-Authenticate", `Basic realm="GoBkm shared folder"`)
+			failHTTP(w, "ShareHandler", "password required", http.StatusUnauthorized)
+			return
+		}
+		env.renderShare(w, shareDataStruct{Path: path}, http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodPost {
+		http.Redirect(w, r, path, http.StatusSeeOther)
+		return
+	}
+
+	// Getting the folder content from the datastore of its owner.
+	ds := env.db(r.Context()).ForUser(link.OwnerId)
+	fld, err := ds.GetFolder(r.Context(), link.FolderId)
+	if err != nil {
+		failHTTP(w, "ShareHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	fld.Parent = nil
+	if err = env.getChildren(r.Context(), ds, fld, -1); err != nil {
+		failHTTP(w, "ShareHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	publicFolder(fld)
+
+	if feed {
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(fld); err != nil {
+			failHTTP(w, "ShareHandler", err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	env.renderShare(w, shareDataStruct{Folder: fld, Path: path}, http.StatusOK)
+
+}
+
+// GetShareLinksHandler returns the share links of the given folder, without their URL.
+func (env *Env) GetShareLinksHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err      error
+		folderID int
+	)
+	// GET parameters retrieval.
+	folderIDParam := r.URL.Query().Get("id")
+	log.WithFields(log.Fields{
+		"folderIdParam": folderIDParam,
+	}).Debug("GetShareLinksHandler:Query parameter")
+
+	// folderId int convertion.
+	if folderID, err = strconv.Atoi(folderIDParam); err != nil {
+		failHTTP(w, "GetShareLinksHandler", "folderId Atoi conversion", http.StatusBadRequest)
+		return
+	}
+
+	acc, err := env.folderAccess(r.Context(), folderID, types.RoleOwner)
+	if err != nil {
+		failHTTP(w, "GetShareLinksHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	links, err := acc.ds.GetShareLinks(r.Context(), folderID)
+	if err != nil {
+		failHTTP(w, "GetShareLinksHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(links); err != nil {
+		failHTTP(w, "GetShareLinksHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
+
+// AddShareLinkHandler creates a share link of a folder with the POSTed folder_id
+// and optional password and expires_at date, and returns it with its URL.
+// It requires the owner role on the folder.
+func (env *Env) AddShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err error
+		l   = newShareLinkStruct{ShareLink: new(types.ShareLink)}
+	)
+
+	if r.Method != http.MethodPost {
+		failHTTP(w, "AddShareLinkHandler", "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(&l); err != nil {
+		failHTTP(w, "AddShareLinkHandler", "form decoding error", http.StatusBadRequest)
+		return
+	}
+	log.WithFields(log.Fields{
+		"folderId":  l.FolderId,
+		"expiresAt": l.ExpiresAt,
+	}).Debug("AddShareLinkHandler:Query parameter")
+
+	// Parameters check.
+	if l.ExpiresAt != nil && !l.ExpiresAt.After(time.Now()) {
+		failHTTP(w, "AddShareLinkHandler", "expires_at in the past", http.StatusBadRequest)
+		return
+	}
+	acc, err := env.folderAccess(r.Context(), l.FolderId, types.RoleOwner)
+	if err != nil {
+		failHTTP(w, "AddShareLinkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		failHTTP(w, "AddShareLinkHandler", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	link := &types.ShareLink{FolderId: l.FolderId, Hash: hashToken(token), CreatedAt: time.Now().UTC(), ExpiresAt: l.ExpiresAt}
+	if l.Password != "" {
+		if link.PasswordHash, err = models.HashPassword(l.Password); err != nil {
+			failHTTP(w, "AddShareLinkHandler", err.Error(), http.StatusInternalServerError)
+			return
+		}
+		link.Protected = true
+	}
+	id, err := acc.ds.SaveShareLink(r.Context(), link)
+	if err != nil {
+		failHTTP(w, "AddShareLinkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+	link.Id = int(id)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(newShareLinkStruct{ShareLink: link, URL: strings.TrimSuffix(env.GoBkmProxyURL, "/") + sharePath + token}); err != nil {
+		failHTTP(w, "AddShareLinkHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
+
+// RevokeShareLinkHandler deletes the given share link of a folder of the logged in user.
+func (env *Env) RevokeShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		err error
+		id  int
+	)
+
+	if r.Method != http.MethodPost {
+		failHTTP(w, "RevokeShareLinkHandler", "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// GET parameters retrieval.
+	idParam := r.URL.Query().Get("id")
+	log.WithFields(log.Fields{
+		"idParam": idParam,
+	}).Debug("RevokeShareLinkHandler:Query parameter")
+
+	// id int convertion.
+	if id, err = strconv.Atoi(idParam); err != nil {
+		failHTTP(w, "RevokeShareLinkHandler", "id Atoi conversion", http.StatusBadRequest)
+		return
+	}
+
+	if err = env.datastore(r.Context()).DeleteShareLink(r.Context(), id); err != nil {
+		failHTTP(w, "RevokeShareLinkHandler", err.Error(), datastoreStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	// Returning an empty JSON to trigger de done() ajax function.
+	if err = json.NewEncoder(w).Encode(types.ShareLink{}); err != nil {
+		failHTTP(w, "RevokeShareLinkHandler", err.Error(), http.StatusInternalServerError)
+	}
+
+}
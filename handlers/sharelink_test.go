@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tbellembois/gobkm/types"
+)
+
+// testShareTemplate is the share template of the tests,
+// showing the folder title or the error.
+const testShareTemplate = `{{if .Folder}}{{.Folder.Title}}{{else}}password{{.Error}}{{end}}`
+
+// newShareEnv returns an Env of a new memory datastore with the share template
+// of the tests, a folder of the user alice, the API token of alice and the handler.
+func newShareEnv(t *testing.T) (*Env, *types.Folder, string, http.Handler) {
+
+	env := newTestEnv(t)
+	env.TplShareData = testShareTemplate
+	h := testHandler(env)
+	alice := addTestUser(t, env, "alice")
+	fld := addTestFolder(t, h, alice, "public")
+	addTestBookmark(t, h, alice, "bkm", fld.Id)
+	return env, fld, alice, h
+
+}
+
+// addTestShareLink adds a share link of the given folder with the given password
+// and returns it with its path.
+func addTestShareLink(t *testing.T, h http.Handler, token string, folderID int, password string) (*newShareLinkStruct, string) {
+
+	t.Helper()
+
+	l := newShareLinkStruct{ShareLink: new(types.ShareLink)}
+	body := map[string]interface{}{"folder_id": folderID, "password": password}
+	decode(t, serve(t, h, token, http.MethodPost, "/addShareLink/", body), http.StatusOK, &l)
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &l, u.Path
+
+}
+
+// postSharePassword posts the given password to the share link with the given path.
+func postSharePassword(h http.Handler, path, password string) *httptest.ResponseRecorder {
+	return serveForm(h, path, url.Values{"password": {password}}, "")
+}
+
+func TestSharePage(t *testing.T) {
+
+	_, fld, alice, h := newShareEnv(t)
+	_, path := addTestShareLink(t, h, alice, fld.Id, "")
+
+	w := serveSession(h, httptest.NewRequest(http.MethodGet, path, nil), "")
+	if w.Code != http.StatusOK || w.Body.String() != "public" {
+		t.Errorf("share page %d %q, want 200 public", w.Code, w.Body)
+	}
+	if w.Header().Get("Referrer-Policy") != "no-referrer" || !strings.Contains(w.Header().Get("X-Robots-Tag"), "noindex") {
+		t.Errorf("share page headers %v, want no-referrer and noindex", w.Header())
+	}
+
+	var feed types.Folder
+	decode(t, serveSession(h, httptest.NewRequest(http.MethodGet, path+"/"+shareFeed, nil), ""), http.StatusOK, &feed)
+	if feed.Title != "public" || len(feed.Bookmarks) != 1 || feed.Bookmarks[0].Title != "bkm" {
+		t.Errorf("share feed %+v, want the folder with its bookmark", feed)
+	}
+
+	decode(t, serveSession(h, httptest.NewRequest(http.MethodGet, sharePath+"unknown", nil), ""), http.StatusNotFound, nil)
+
+}
+
+func TestSharePassword(t *testing.T) {
+
+	_, fld, alice, h := newShareEnv(t)
+	_, path := addTestShareLink(t, h, alice, fld.Id, "secret")
+	get := func(cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		return serveSession(h, httptest.NewRequest(http.MethodGet, path, nil), "", cookies...)
+	}
+
+	// The password form.
+	if w := get(); w.Code != http.StatusUnauthorized || w.Body.String() != "password" {
+		t.Errorf("protected share page %d %q, want 401 and the password form", w.Code, w.Body)
+	}
+	w := postSharePassword(h, path, "wrong")
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "Invalid password") || responseCookie(w, shareCookie) != nil {
+		t.Errorf("wrong password %d %q, want 401 without cookie", w.Code, w.Body)
+	}
+	if w.Header().Get("Referrer-Policy") != "no-referrer" || !strings.Contains(w.Header().Get("X-Robots-Tag"), "noindex") {
+		t.Errorf("password form headers %v, want no-referrer and noindex", w.Header())
+	}
+
+	// The cookie of the right password.
+	w = postSharePassword(h, path, "secret")
+	c := responseCookie(w, shareCookie)
+	if w.Code != http.StatusSeeOther || c == nil || c.Path != path || !c.HttpOnly {
+		t.Fatalf("password %d with cookie %v, want 303 and an HTTP only cookie of the link", w.Code, c)
+	}
+	if w := get(c); w.Code != http.StatusOK || w.Body.String() != "public" {
+		t.Errorf("unlocked share page %d %q, want 200 public", w.Code, w.Body)
+	}
+	if w := get(&http.Cookie{Name: shareCookie, Value: "forged"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("share page with a forged cookie %d, want 401", w.Code)
+	}
+
+	// The feed with a basic authentication.
+	feed := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path+"/"+shareFeed, nil)
+		if password != "" {
+			req.SetBasicAuth("", password)
+		}
+		return serveSession(h, req, "")
+	}
+	if w := feed(""); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("protected feed %d, want 401 with a basic authentication", w.Code)
+	}
+	decode(t, feed("wrong"), http.StatusUnauthorized, nil)
+	decode(t, feed("secret"), http.StatusOK, nil)
+
+}
+
+func TestShareUnavailable(t *testing.T) {
+
+	env, fld, alice, h := newShareEnv(t)
+
+	// A revoked link.
+	l, path := addTestShareLink(t, h, alice, fld.Id, "")
+	decode(t, serve(t, h, alice, http.MethodPost, "/revokeShareLink/?id="+strconv.Itoa(l.Id), nil), http.StatusOK, nil)
+	decode(t, serveSession(h, httptest.NewRequest(http.MethodGet, path, nil), ""), http.StatusNotFound, nil)
+	decode(t, serveSession(h, httptest.NewRequest(http.MethodGet, path+"/"+shareFeed, nil), ""), http.StatusNotFound, nil)
+
+	// An expired link.
+	user, err := env.DB.GetUserByName(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-time.Minute)
+	link := &types.ShareLink{FolderId: fld.Id, Hash: hashToken("expired"), ExpiresAt: &expired}
+	if _, err = env.DB.ForUser(user.Id).SaveShareLink(context.Background(), link); err != nil {
+		t.Fatal(err)
+	}
+	decode(t, serveSession(h, httptest.NewRequest(http.MethodGet, sharePath+"expired", nil), ""), http.StatusNotFound, nil)
+
+	// A link of a folder in the trash.
+	_, path = addTestShareLink(t, h, alice, fld.Id, "")
+	decode(t, serve(t, h, alice, http.MethodGet, "/deleteFolder/?id="+strconv.Itoa(fld.Id), nil), http.StatusOK, nil)
+	decode(t, serveSession(h, httptest.NewRequest(http.MethodGet, path, nil), ""), http.StatusNotFound, nil)
+
+}
+
+func TestSharePasswordThrottle(t *testing.T) {
+
+	now := time.Now()
+	sharePasswords.now = func() time.Time { return now }
+	defer func() { sharePasswords.now = time.Now }()
+
+	_, fld, alice, h := newShareEnv(t)
+	l, path := addTestShareLink(t, h, alice, fld.Id, "secret")
+	_, other := addTestShareLink(t, h, alice, fld.Id, "secret")
+	defer sharePasswords.succeed(l.Hash)
+
+	for i := 0; i < shareFreeAttempts; i++ {
+		decode(t, postSharePassword(h, path, "wrong"), http.StatusUnauthorized, nil)
+	}
+
+	// The next attempts are delayed, even with the right password,
+	// on the form as with the basic authentication.
+	w := postSharePassword(h, path, "secret")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("delayed attempt %d retry after %q, want 429 after 1s", w.Code, w.Header().Get("Retry-After"))
+	}
+	req := httptest.NewRequest(http.MethodGet, path+"/"+shareFeed, nil)
+	req.SetBasicAuth("", "secret")
+	decode(t, serveSession(h, req, ""), http.StatusTooManyRequests, nil)
+
+	// The other links are not.
+	decode(t, postSharePassword(h, other, "secret"), http.StatusSeeOther, nil)
+
+	// The delay doubles with each wrong password.
+	now = now.Add(time.Second)
+	decode(t, postSharePassword(h, path, "wrong"), http.StatusUnauthorized, nil)
+	now = now.Add(time.Second)
+	if w := postSharePassword(h, path, "secret"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("delayed attempt %d retry after %q, want 429 after 1s", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// The right password resets the delay.
+	now = now.Add(time.Second)
+	decode(t, postSharePassword(h, path, "secret"), http.StatusSeeOther, nil)
+	decode(t, postSharePassword(h, path, "wrong"), http.StatusUnauthorized, nil)
+	decode(t, postSharePassword(h, path, "secret"), http.StatusSeeOther, nil)
+
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/tbellembois/gobkm/types"
+)
+
+// addTestUser saves a user with the given name and a write API token
+// and returns the token.
+func addTestUser(t *testing.T, env *Env, name string) string {
+
+	t.Helper()
+
+	id, err := env.DB.SaveUser(context.Background(), &types.User{Username: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := name + "-token"
+	tok := &types.APIToken{UserId: int(id), Name: name, Hash: hashToken(token), Scope: types.ScopeWrite}
+	if _, err = env.DB.SaveAPIToken(context.Background(), tok); err != nil {
+		t.Fatal(err)
+	}
+	return token
+
+}
+
+func TestUserIsolation(t *testing.T) {
+
+	env := newTestEnv(t)
+	h := testHandler(env)
+	alice, bob := addTestUser(t, env, "alice"), addTestUser(t, env, "bob")
+
+	fld := addTestFolder(t, h, alice, "private")
+	bkm := addTestBookmark(t, h, alice, "secret", fld.Id)
+	bobFld := addTestFolder(t, h, bob, "bob")
+	bobBkm := addTestBookmark(t, h, bob, "mine", bobFld.Id)
+
+	folderID, bookmarkID := strconv.Itoa(fld.Id), strconv.Itoa(-bkm.Id)
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   interface{}
+	}{
+		{"getFolderChildren", http.MethodGet, "/getFolderChildren/?id=" + folderID, nil},
+		{"getHistory folder", http.MethodGet, "/getHistory/?id=" + folderID, nil},
+		{"getHistory bookmark", http.MethodGet, "/getHistory/?id=" + bookmarkID, nil},
+		{"getFolderGrants", http.MethodGet, "/getFolderGrants/?id=" + folderID, nil},
+		{"updateFolder", http.MethodPost, "/updateFolder/", &types.Folder{Id: fld.Id, Title: "stolen"}},
+		{"sortFolder", http.MethodPost, "/sortFolder/?sort=url&id=" + folderID, nil},
+		{"deleteFolder", http.MethodGet, "/deleteFolder/?id=" + folderID, nil},
+		{"updateBookmark", http.MethodPost, "/updateBookmark/", &types.Bookmark{Id: -bkm.Id, Title: "stolen", URL: "http://127.0.0.1:1/"}},
+		{"starBookmark", http.MethodGet, "/starBookmark/?star=true&id=" + bookmarkID, nil},
+		{"deleteBookmark", http.MethodGet, "/deleteBookmark/?id=" + bookmarkID, nil},
+		{"move to the folder", http.MethodPost, "/updateBookmark/", &types.Bookmark{Id: -bobBkm.Id, Folder: &types.Folder{Id: fld.Id}}},
+		{"add to the folder", http.MethodPost, "/addBookmark/", &types.Bookmark{Title: "intruder", URL: "http://127.0.0.1:1/", Folder: &types.Folder{Id: fld.Id}}},
+		{"api get folder", http.MethodGet, APIPrefix + "/folders/" + folderID, nil},
+		{"api update folder", http.MethodPatch, APIPrefix + "/folders/" + folderID, map[string]string{"title": "stolen"}},
+		{"api delete folder", http.MethodDelete, APIPrefix + "/folders/" + folderID, nil},
+		{"api get bookmark", http.MethodGet, APIPrefix + "/bookmarks/" + strconv.Itoa(bkm.Id), nil},
+		{"api update bookmark", http.MethodPatch, APIPrefix + "/bookmarks/" + strconv.Itoa(bkm.Id), map[string]string{"title": "stolen"}},
+		{"api delete bookmark", http.MethodDelete, APIPrefix + "/bookmarks/" + strconv.Itoa(bkm.Id), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decode(t, serve(t, h, bob, test.method, test.target, test.body), http.StatusNotFound, nil)
+		})
+	}
+
+	// The bookmarks of alice are not listed for bob.
+	var found []*types.Bookmark
+	decode(t, serve(t, h, bob, http.MethodGet, "/searchBookmarks/?search=secret", nil), http.StatusOK, &found)
+	if len(found) != 0 {
+		t.Errorf("bob search results %v, want none", found)
+	}
+	var tree types.Folder
+	decode(t, serve(t, h, bob, http.MethodGet, "/getTree/", nil), http.StatusOK, &tree)
+	if len(tree.Folders) != 1 || tree.Folders[0].Id != bobFld.Id {
+		t.Errorf("bob tree %+v, want only the folder of bob", tree.Folders)
+	}
+
+	// The folder and bookmark of alice are unchanged.
+	var children types.Folder
+	decode(t, serve(t, h, alice, http.MethodGet, "/getFolderChildren/?id="+folderID, nil), http.StatusOK, &children)
+	if children.Title != "private" || children.Sort != fld.Sort {
+		t.Errorf("alice folder %+v, want it unchanged", children)
+	}
+	if len(children.Bookmarks) != 1 {
+		t.Fatalf("alice bookmarks %v, want only the one of alice", children.Bookmarks)
+	}
+	got := children.Bookmarks[0]
+	if got.Id != bkm.Id || got.Title != "secret" || got.URL != bkm.URL || got.Starred {
+		t.Errorf("alice bookmark %+v, want it unchanged", got)
+	}
+	var trash types.Trash
+	decode(t, serve(t, h, alice, http.MethodGet, "/getTrash/", nil), http.StatusOK, &trash)
+	if len(trash.Folders) != 0 || len(trash.Bookmarks) != 0 {
+		t.Errorf("alice trash %+v, want it empty", trash)
+	}
+
+}
@@ -0,0 +1,474 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+const (
+	// WebhookSignatureHeader is the header of the webhook requests
+	// with the signature of their body, see signPayload.
+	WebhookSignatureHeader = "X-GoBkm-Signature"
+	// WebhookEventHeader is the header of the webhook requests
+	// with the type of their event.
+	WebhookEventHeader = "X-GoBkm-Event"
+	// webhookAttempts is the number of attempts to deliver an event to a webhook.
+	webhookAttempts = 6
+	// webhookRetryDelay is the delay before the first retry of a failed delivery,
+	// doubled at each attempt.
+	webhookRetryDelay = 30 * time.Second
+	// webhookTimeout is the timeout of the webhook requests.
+	webhookTimeout = 10 * time.Second
+	// webhookQueueSize is the number of events waiting to be sent
+	// to the webhooks before the next ones are dropped.
+	webhookQueueSize = 1000
+	// webhookWorkers is the number of concurrent deliveries.
+	webhookWorkers = 4
+)
+
+var (
+	// errWebhookAddress is returned when a webhook host has a loopback, private
+	// or link-local address, not to post the events inside the server network.
+	errWebhookAddress = errors.New("webhook address not allowed")
+	// errDeliveryDropped is the error logged for the deliveries
+	// dropped because the queue is full.
+	errDeliveryDropped = errors.New("delivery queue full, delivery dropped")
+)
+
+// webhookEvent is a published event with its audience.
+type webhookEvent struct {
+	event *types.Event
+	users audience
+}
+
+// webhookDelivery is the delivery of an event to a webhook of a user.
+type webhookDelivery struct {
+	owner     int
+	webhookID int
+	event     *types.Event
+	payload   []byte
+	attempt   int
+}
+
+// WebhookSender posts in the background the events to the webhooks
+// of their users matching them, retrying the failed deliveries
+// with an exponential backoff, and logs the deliveries.
+type WebhookSender struct {
+	db         models.Datastore
+	client     *http.Client
+	retryDelay time.Duration
+	events     chan *webhookEvent
+	deliveries chan *webhookDelivery
+	// allowPrivate allows the non public addresses, for the tests.
+	allowPrivate bool
+}
+
+// NewWebhookSender returns a WebhookSender of the webhooks of the given datastore,
+// sending the events once Run is called.
+func NewWebhookSender(db models.Datastore) *WebhookSender {
+
+	s := &WebhookSender{
+		db:         db,
+		retryDelay: webhookRetryDelay,
+		events:     make(chan *webhookEvent, webhookQueueSize),
+		deliveries: make(chan *webhookDelivery, webhookQueueSize),
+	}
+	s.client = &http.Client{
+		Timeout: webhookTimeout,
+		// Without proxy, the addresses being checked when dialing.
+		Transport: &http.Transport{
+			DialContext:         s.dialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+			MaxIdleConnsPerHost: webhookWorkers,
+		},
+		// A redirection is a failure, not to post the events elsewhere.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return s
+
+}
+
+// publicIP returns true if the given address is not a loopback, private,
+// link-local, multicast or unspecified one.
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// lookupHost returns the addresses of the given host,
+// errWebhookAddress if one of them is not a public one.
+func (s *WebhookSender) lookupHost(ctx context.Context, host string) ([]net.IPAddr, error) {
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if !s.allowPrivate && !publicIP(ip.IP) {
+			return nil, errWebhookAddress
+		}
+	}
+	return ips, nil
+
+}
+
+// dialContext connects to the given address of a webhook, resolving its host
+// to refuse the non public addresses when delivering, whatever they were
+// when the webhook was registered.
+func (s *WebhookSender) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := s.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		conn   net.Conn
+		dialer = &net.Dialer{Timeout: webhookTimeout}
+	)
+	err = errWebhookAddress
+	for _, ip := range ips {
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+
+}
+
+// checkURL returns ErrInvalidWebhook if the host of the given webhook URL
+// has a non public address. The hosts that can not be resolved yet are accepted,
+// the addresses being checked again when delivering.
+func (s *WebhookSender) checkURL(ctx context.Context, webhookURL string) error {
+
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return nil
+	}
+	if _, err = s.lookupHost(ctx, u.Hostname()); errors.Is(err, errWebhookAddress) {
+		return models.ErrInvalidWebhook
+	}
+	return nil
+
+}
+
+// Run sends the events to the webhooks, it never returns.
+func (s *WebhookSender) Run() {
+
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for d := range s.deliveries {
+				s.deliver(d)
+			}
+		}()
+	}
+	for we := range s.events {
+		s.dispatch(we)
+	}
+
+}
+
+// send queues the given event for the webhooks of the users of the given audience.
+// The event is dropped if the queue is full.
+func (s *WebhookSender) send(users audience, e *types.Event) {
+
+	select {
+	case s.events <- &webhookEvent{event: e, users: users}:
+	default:
+		log.WithFields(log.Fields{
+			"type":   e.Type,
+			"itemId": e.ItemId,
+		}).Error("send:webhook queue full, event dropped")
+	}
+
+}
+
+// dispatch queues the deliveries of the given event to the matching webhooks.
+func (s *WebhookSender) dispatch(we *webhookEvent) {
+
+	payload, err := json.Marshal(we.event)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("dispatch:JSON encoding error")
+		return
+	}
+
+	for user := range we.users {
+		webhooks, err := s.db.ForUser(user).GetWebhooks(context.Background())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"user": user,
+			}).Error("dispatch:GetWebhooks")
+			continue
+		}
+		for _, w := range webhooks {
+			if w.Matches(we.event.Type) {
+				s.queue(&webhookDelivery{owner: user, webhookID: w.Id, event: we.event, payload: payload, attempt: 1})
+			}
+		}
+	}
+
+}
+
+// queue queues the given delivery. It is dropped, and logged as failed,
+// if the queue is full, not to block the dispatch of the events.
+func (s *WebhookSender) queue(d *webhookDelivery) {
+
+	select {
+	case s.deliveries <- d:
+	default:
+		log.WithFields(log.Fields{
+			"webhookId": d.webhookID,
+			"eventId":   d.event.Id,
+			"attempt":   d.attempt,
+		}).Error("queue:webhook delivery queue full, delivery dropped")
+		s.logDelivery(s.db.ForUser(d.owner), &types.WebhookDelivery{WebhookId: d.webhookID, EventId: d.event.Id, EventType: d.event.Type,
+			Attempt: d.attempt, Error: errDeliveryDropped.Error()})
+	}
+
+}
+
+// logDelivery saves the given delivery in the log of its webhook, if not deleted.
+func (s *WebhookSender) logDelivery(ds models.Datastore, delivery *types.WebhookDelivery) {
+
+	if _, err := ds.SaveWebhookDelivery(context.Background(), delivery); err != nil && !errors.Is(err, models.ErrNotFound) {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("logDelivery:SaveWebhookDelivery")
+	}
+
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of the given payload
+// with the given secret.
+func signPayload(secret string, payload []byte) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+
+}
+
+// post posts the payload of the given delivery to the given webhook
+// and returns the response status, failing without a 2xx one.
+func (s *WebhookSender) post(w *types.Webhook, d *webhookDelivery) (int, error) {
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GoBkm-Webhook")
+	req.Header.Set(WebhookEventHeader, d.event.Type)
+	req.Header.Set(WebhookSignatureHeader, "sha256="+signPayload(w.Secret, d.payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Reading the body to reuse the connection.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("HTTP " + resp.Status)
+	}
+	return resp.StatusCode, nil
+
+}
+
+// deliver posts the given delivery to its webhook, if not deleted, logs it
+// and schedules its retry if it failed.
+func (s *WebhookSender) deliver(d *webhookDelivery) {
+
+	ctx := context.Background()
+	ds := s.db.ForUser(d.owner)
+	w, err := ds.GetWebhook(ctx, d.webhookID)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("deliver:GetWebhook")
+		}
+		return
+	}
+
+	status, err := s.post(w, d)
+	delivery := &types.WebhookDelivery{WebhookId: w.Id, EventId: d.event.Id, EventType: d.event.Type, Attempt: d.attempt, StatusCode: status}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	log.WithFields(log.Fields{
+		"webhookId": w.Id,
+		"eventId":   d.event.Id,
+		"attempt":   d.attempt,
+		"status":    status,
+		"err":       err,
+	}).Debug("deliver")
+	s.logDelivery(ds, delivery)
+
+	if err != nil && d.attempt < webhookAttempts {
+		delay := s.retryDelay << (d.attempt - 1)
+		d.attempt++
+		time.AfterFunc(delay, func() {
+			s.queue(d)
+		})
+	}
+
+}
+
+// apiWebhookInput is the body of the webhook POST requests,
+// the secret being generated if empty.
+type apiWebhookInput struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"` // all the events if empty
+	Secret string   `json:"secret"`
+}
+
+// newWebhookStruct is the JSON of a new webhook, the only time its secret is shown.
+type newWebhookStruct struct {
+	*types.Webhook
+	Secret string `json:"secret"`
+}
+
+// webhooksEnabled returns true if the webhooks are enabled,
+// sending an error otherwise.
+func (env *Env) webhooksEnabled(w http.ResponseWriter, functionName string) bool {
+
+	if env.Webhooks == nil {
+		failAPIStatus(w, functionName, "webhooks disabled", http.StatusNotImplemented)
+		return false
+	}
+	return true
+
+}
+
+// apiGetWebhooks returns the webhooks of the user, without their secret.
+func (env *Env) apiGetWebhooks(w http.ResponseWriter, r *http.Request, _ int) {
+
+	if !env.webhooksEnabled(w, "apiGetWebhooks") {
+		return
+	}
+	webhooks, err := env.datastore(r.Context()).GetWebhooks(r.Context())
+	if err != nil {
+		apiFail(w, "apiGetWebhooks", err)
+		return
+	}
+
+	writeAPI(w, "apiGetWebhooks", http.StatusOK, webhooks)
+
+}
+
+// apiGetWebhook returns the webhook with the given id, without its secret.
+func (env *Env) apiGetWebhook(w http.ResponseWriter, r *http.Request, id int) {
+
+	if !env.webhooksEnabled(w, "apiGetWebhook") {
+		return
+	}
+	webhook, err := env.datastore(r.Context()).GetWebhook(r.Context(), id)
+	if err != nil {
+		apiFail(w, "apiGetWebhook", err)
+		return
+	}
+
+	writeAPI(w, "apiGetWebhook", http.StatusOK, webhook)
+
+}
+
+// apiAddWebhook creates a webhook with the POSTed URL, events and secret
+// and returns it with its secret.
+func (env *Env) apiAddWebhook(w http.ResponseWriter, r *http.Request, _ int) {
+
+	if !env.webhooksEnabled(w, "apiAddWebhook") {
+		return
+	}
+	var in apiWebhookInput
+	if !decodeAPI(w, r, "apiAddWebhook", &in) {
+		return
+	}
+
+	webhook := &types.Webhook{URL: strings.TrimSpace(in.URL), Events: []string{}, Secret: in.Secret, CreatedAt: time.Now().UTC()}
+	for _, e := range in.Events {
+		if e = strings.TrimSpace(e); e != "" {
+			webhook.Events = append(webhook.Events, e)
+		}
+	}
+	if err := env.Webhooks.checkURL(r.Context(), webhook.URL); err != nil {
+		apiFail(w, "apiAddWebhook", err)
+		return
+	}
+	if webhook.Secret == "" {
+		var err error
+		if webhook.Secret, err = randomToken(); err != nil {
+			apiFail(w, "apiAddWebhook", err)
+			return
+		}
+	}
+
+	id, err := env.datastore(r.Context()).SaveWebhook(r.Context(), webhook)
+	if err != nil {
+		apiFail(w, "apiAddWebhook", err)
+		return
+	}
+	webhook.Id = int(id)
+
+	w.Header().Set("Location", APIPrefix+"/webhooks/"+strconv.Itoa(webhook.Id))
+	writeAPI(w, "apiAddWebhook", http.StatusCreated, newWebhookStruct{Webhook: webhook, Secret: webhook.Secret})
+
+}
+
+// apiDeleteWebhook deletes the webhook with the given id and its deliveries.
+func (env *Env) apiDeleteWebhook(w http.ResponseWriter, r *http.Request, id int) {
+
+	if !env.webhooksEnabled(w, "apiDeleteWebhook") {
+		return
+	}
+	if err := env.datastore(r.Context()).DeleteWebhook(r.Context(), id); err != nil {
+		apiFail(w, "apiDeleteWebhook", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// apiGetWebhookDeliveries returns the last deliveries of the webhook
+// with the given id, most recent first.
+func (env *Env) apiGetWebhookDeliveries(w http.ResponseWriter, r *http.Request, id int) {
+
+	if !env.webhooksEnabled(w, "apiGetWebhookDeliveries") {
+		return
+	}
+	deliveries, err := env.datastore(r.Context()).GetWebhookDeliveries(r.Context(), id)
+	if err != nil {
+		apiFail(w, "apiGetWebhookDeliveries", err)
+		return
+	}
+
+	writeAPI(w, "apiGetWebhookDeliveries", http.StatusOK, deliveries)
+
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// webhookReceiver is a webhook test server answering the given statuses
+// in turn, then 200, and recording the requests.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+	times    []time.Time
+}
+
+// newWebhookReceiver returns a started webhookReceiver.
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+
+	rcv := &webhookReceiver{statuses: statuses}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		body, _ := io.ReadAll(r.Body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.requests = append(rcv.requests, r)
+		rcv.bodies = append(rcv.bodies, body)
+		rcv.times = append(rcv.times, time.Now())
+		status := http.StatusOK
+		if len(rcv.statuses) > 0 {
+			status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+		}
+		w.WriteHeader(status)
+
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+
+}
+
+// count returns the number of received requests.
+func (rcv *webhookReceiver) count() int {
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return len(rcv.requests)
+
+}
+
+// newTestWebhook returns a sender of a memory datastore allowing the loopback
+// addresses, and the id of a webhook of all the events posting to the given URL.
+func newTestWebhook(t *testing.T, url string) (*WebhookSender, int) {
+
+	db := models.NewMemoryDBstore()
+	s := NewWebhookSender(db)
+	s.allowPrivate = true
+	s.retryDelay = 20 * time.Millisecond
+	id, err := db.SaveWebhook(context.Background(), &types.Webhook{URL: url, Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, int(id)
+
+}
+
+// waitDeliveries waits for the given number of deliveries of the given webhook
+// and returns them, oldest first.
+func waitDeliveries(t *testing.T, s *WebhookSender, webhookID, n int) []*types.WebhookDelivery {
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries, err := s.db.GetWebhookDeliveries(context.Background(), webhookID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) >= n {
+			for i, j := 0, len(deliveries)-1; i < j; i, j = i+1, j-1 {
+				deliveries[i], deliveries[j] = deliveries[j], deliveries[i]
+			}
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d deliveries, want %d", len(deliveries), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+}
+
+func TestWebhookSignature(t *testing.T) {
+
+	rcv := newWebhookReceiver(t)
+	s, id := newTestWebhook(t, rcv.URL+"/hook")
+	go s.Run()
+
+	s.send(audience{0: true}, &types.Event{Id: 7, Type: "bookmark.create", ItemId: 3})
+	deliveries := waitDeliveries(t, s, id, 1)
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if len(rcv.requests) != 1 {
+		t.Fatalf("%d requests, want 1", len(rcv.requests))
+	}
+	req, body := rcv.requests[0], rcv.bodies[0]
+	if got, want := req.Header.Get(WebhookSignatureHeader), "sha256="+signPayload("s3cret", body); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	if got := req.Header.Get(WebhookEventHeader); got != "bookmark.create" {
+		t.Errorf("event header %q, want bookmark.create", got)
+	}
+	if !strings.Contains(string(body), `"item_id":3`) {
+		t.Errorf("body %s without the event", body)
+	}
+	if d := deliveries[0]; d.EventId != 7 || d.Attempt != 1 || d.StatusCode != http.StatusOK || d.Error != "" {
+		t.Errorf("delivery %+v, want a delivered first attempt", d)
+	}
+
+}
+
+func TestWebhookRetry(t *testing.T) {
+
+	rcv := newWebhookReceiver(t, http.StatusInternalServerError, http.StatusBadGateway)
+	s, id := newTestWebhook(t, rcv.URL)
+	go s.Run()
+
+	s.send(audience{0: true}, &types.Event{Id: 1, Type: "folder.update", ItemId: 2})
+	deliveries := waitDeliveries(t, s, id, 3)
+
+	for i, want := range []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK} {
+		d := deliveries[i]
+		if d.Attempt != i+1 || d.StatusCode != want || (d.Error == "") != (want == http.StatusOK) {
+			t.Errorf("delivery %d %+v, want attempt %d with status %d", i, d, i+1, want)
+		}
+	}
+	// The delay doubles at each attempt.
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if d := rcv.times[1].Sub(rcv.times[0]); d < s.retryDelay {
+		t.Errorf("first retry after %v, want %v", d, s.retryDelay)
+	}
+	if d := rcv.times[2].Sub(rcv.times[1]); d < 2*s.retryDelay {
+		t.Errorf("second retry after %v, want %v", d, 2*s.retryDelay)
+	}
+
+}
+
+func TestWebhookPrivateAddress(t *testing.T) {
+
+	rcv := newWebhookReceiver(t)
+	s, id := newTestWebhook(t, rcv.URL)
+	s.allowPrivate = false
+
+	if err := s.checkURL(context.Background(), rcv.URL); err != models.ErrInvalidWebhook {
+		t.Errorf("checkURL %v, want %v", err, models.ErrInvalidWebhook)
+	}
+	if err := s.checkURL(context.Background(), "http://169.254.169.254/latest"); err != models.ErrInvalidWebhook {
+		t.Errorf("checkURL %v, want %v", err, models.ErrInvalidWebhook)
+	}
+
+	// Refused when delivering too.
+	s.deliver(&webhookDelivery{webhookID: id, event: &types.Event{Id: 1, Type: "tag.create"}, payload: []byte("{}"), attempt: webhookAttempts})
+	deliveries := waitDeliveries(t, s, id, 1)
+	if rcv.count() != 0 {
+		t.Errorf("%d requests to a loopback address", rcv.count())
+	}
+	if d := deliveries[0]; !strings.Contains(d.Error, errWebhookAddress.Error()) {
+		t.Errorf("delivery error %q, want %q", d.Error, errWebhookAddress)
+	}
+
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+
+	s, id := newTestWebhook(t, "https://hooks.example.com/bkm")
+	// Without queue nor workers.
+	s.deliveries = make(chan *webhookDelivery)
+
+	s.dispatch(&webhookEvent{event: &types.Event{Id: 4, Type: "bookmark.delete", ItemId: 5}, users: audience{0: true}})
+	deliveries := waitDeliveries(t, s, id, 1)
+	if d := deliveries[0]; d.EventId != 4 || d.Error != errDeliveryDropped.Error() {
+		t.Errorf("delivery %+v, want a dropped one", d)
+	}
+
+}
+
+func TestPublicIP(t *testing.T) {
+
+	for _, tt := range []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.10", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	} {
+		if got := publicIP(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("publicIP(%s) %v, want %v", tt.ip, got, tt.public)
+		}
+	}
+
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"flag"
 	"net/http"
 	"net/url"
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/tbellembois/gobkm/handlers"
@@ -16,7 +18,7 @@ import (
 )
 
 var (
-	datastore *models.SQLiteDataStore
+	datastore models.Database
 	err       error
 	logf      *os.File
 
@@ -25,20 +27,55 @@ var (
 
 	//go:embed static/index.html
 	embedIndex string
+
+	//go:embed static/login.html
+	embedLogin string
+
+	//go:embed static/share.html
+	embedShare string
+
+	//go:embed static/apidoc.html
+	embedAPIDoc string
 )
 
 func main() {
 
+	// Running the subcommands.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		user(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		token(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "openapi" {
+		openapi(os.Args[2:])
+		return
+	}
+
 	// Getting the program parameters.
 	listenPort := flag.String("port", "8081", "the port to listen")
 	proxyURL := flag.String("proxy", "http://localhost:"+*listenPort, "the proxy full URL if used")
 	historySize := flag.Int("history", 3, "the folder history size")
 	username := flag.String("username", "", "the default login username")
-	dbPath := flag.String("db", "bkm.db", "the full sqlite db path")
+	dbPath := flag.String("db", "bkm.db", "the full sqlite db path, a postgres:// URL or "+models.MemoryDataSourceName+" for an in-memory database")
+	demo := flag.Bool("demo", false, "demo mode, sample data in an in-memory database")
+	trashRetention := flag.Duration("trashretention", 30*24*time.Hour, "the deleted folders and bookmarks retention in the trash, 0 to keep them forever")
+	sessionLifetime := flag.Duration("sessionlifetime", handlers.DefaultSessionLifetime, "the login sessions lifetime")
+	eventsBuffer := flag.Int("eventsbuffer", handlers.DefaultEventsBufferSize, "the number of events kept for the reconnecting clients")
 	logfile := flag.String("logfile", "", "log to the given file")
 	debug := flag.Bool("debug", false, "debug (verbose log), default is error")
 	flag.Parse()
 
+	if *demo {
+		*dbPath = models.MemoryDataSourceName
+	}
+
 	// Logging to file if logfile parameter specified.
 	if *logfile != "" {
 		if logf, err = os.OpenFile(*logfile, os.O_WRONLY|os.O_CREATE, 0755); err != nil {
@@ -54,25 +91,41 @@ func main() {
 		log.SetLevel(log.ErrorLevel)
 	}
 	log.WithFields(log.Fields{
-		"listenPort":  *listenPort,
-		"proxyURL":    *proxyURL,
-		"historySize": *historySize,
-		"username":    *username,
-		"logfile":     *logfile,
-		"debug":       *debug,
+		"listenPort":      *listenPort,
+		"proxyURL":        *proxyURL,
+		"historySize":     *historySize,
+		"username":        *username,
+		"logfile":         *logfile,
+		"debug":           *debug,
+		"demo":            *demo,
+		"trashRetention":  *trashRetention,
+		"sessionLifetime": *sessionLifetime,
+		"eventsBuffer":    *eventsBuffer,
 	}).Debug("main:flags")
 
 	// Database initialization.
-	if datastore, err = models.NewDBstore(*dbPath); err != nil {
+	if datastore, err = models.Open(*dbPath); err != nil {
 		log.Panic(err)
 	}
 	// Database creation.
-	datastore.CreateDatabase()
-	datastore.PopulateDatabase()
-	// Error check.
-	if datastore.FlushErrors() != nil {
+	if err = datastore.CreateDatabase(context.Background()); err != nil {
 		log.Panic(err)
 	}
+	if err = datastore.PopulateDatabase(context.Background()); err != nil {
+		log.Panic(err)
+	}
+	// Trash purge.
+	if *trashRetention > 0 {
+		go purgeTrash(datastore, *trashRetention)
+	}
+	// Expired sessions purge.
+	go purgeSessions(datastore)
+	// Webhooks, disabled in the demo mode open to anyone.
+	var webhooks *handlers.WebhookSender
+	if !*demo {
+		webhooks = handlers.NewWebhookSender(datastore)
+		go webhooks.Run()
+	}
 
 	// Host from URL.
 	u, err := url.Parse(*proxyURL)
@@ -88,20 +141,40 @@ func main() {
 		GoBkmProxyHost:   u.Host,
 		GoBkmHistorySize: *historySize,
 		GoBkmUsername:    *username,
+		SessionLifetime:  *sessionLifetime,
+		Events:           handlers.NewEventBroker(*eventsBuffer),
+		Webhooks:         webhooks,
+		// The cookies are sent over HTTPS only if GoBkm is served over HTTPS.
+		SecureCookies: u.Scheme == "https",
 	}
 
 	env.TplMainData = embedIndex
+	env.TplLoginData = embedLogin
+	env.TplShareData = embedShare
+	env.TplAPIDocData = embedAPIDoc
 
 	// CORS handler.
 	c := cors.New(cors.Options{
 		Debug:            true,
 		AllowedOrigins:   []string{"http://localhost:8081", *proxyURL},
 		AllowCredentials: true,
-		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodOptions},
-		AllowedHeaders:   []string{"Authorization", "DNT", "User-Agent", "X-Requested-With", "If-Modified-Since", "Cache-Control", "Content-Type", "Range"},
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete, http.MethodOptions},
+		AllowedHeaders:   []string{"Authorization", "DNT", "User-Agent", "X-Requested-With", "If-Modified-Since", "Cache-Control", "Content-Type", "Range", "X-CSRF-Token", "If-None-Match", "If-Match"},
+		ExposedHeaders:   []string{"ETag", "Last-Modified", "Link"},
 	})
 
-	mux := http.NewServeMux()
+	chain := alice.New(c.Handler, env.AuthHandler, env.PreconditionHandler).Then(routes(&env))
+
+	if err = http.ListenAndServe(":"+*listenPort, chain); err != nil {
+		log.Fatal(err)
+	}
+
+}
+
+// routes returns the mux of the handlers of the given environment.
+func routes(env *handlers.Env) *handlers.Mux {
+
+	mux := handlers.NewMux()
 
 	// Handlers initialization.
 	mux.Handle("/wasm/", http.StripPrefix("/wasm/", http.FileServer(http.FS(embedWasmBox))))
@@ -114,18 +187,94 @@ func main() {
 	mux.HandleFunc("/getStars/", env.GetStarsHandler)
 	mux.HandleFunc("/getFolderChildren/", env.GetFolderChildrenHandler)
 	mux.HandleFunc("/getTree/", env.GetTreeHandler)
+	mux.HandleFunc("/events/", env.EventsHandler)
 	mux.HandleFunc("/import/", env.ImportHandler)
 	mux.HandleFunc("/export/", env.ExportHandler)
 	mux.HandleFunc("/updateFolder/", env.UpdateFolderHandler)
+	mux.HandleFunc("/sortFolder/", env.SortFolderHandler)
+	mux.HandleFunc("/reorderFolder/", env.ReorderFolderHandler)
 	mux.HandleFunc("/updateBookmark/", env.UpdateBookmarkHandler)
 	mux.HandleFunc("/searchBookmarks/", env.SearchBookmarkHandler)
 	mux.HandleFunc("/starBookmark/", env.StarBookmarkHandler)
+	mux.HandleFunc("/visitBookmark/", env.VisitBookmarkHandler)
+	mux.HandleFunc("/getTrash/", env.GetTrashHandler)
+	mux.HandleFunc("/restoreTrash/", env.RestoreTrashHandler)
+	mux.HandleFunc("/purgeTrash/", env.PurgeTrashHandler)
+	mux.HandleFunc("/getHistory/", env.GetHistoryHandler)
+	mux.HandleFunc("/undo/", env.UndoHandler)
+	mux.HandleFunc("/batch/", env.BatchHandler)
+	mux.HandleFunc("/getFolderGrants/", env.GetFolderGrantsHandler)
+	mux.HandleFunc("/shareFolder/", env.ShareFolderHandler)
+	mux.HandleFunc("/getShareLinks/", env.GetShareLinksHandler)
+	mux.HandleFunc("/addShareLink/", env.AddShareLinkHandler)
+	mux.HandleFunc("/revokeShareLink/", env.RevokeShareLinkHandler)
+	mux.HandleFunc("/share/", env.ShareHandler)
+	mux.HandleFunc(handlers.APIPrefix+"/", env.APIHandler)
+	mux.HandleFunc("/login/", env.LoginHandler)
+	mux.HandleFunc("/logout/", env.LogoutHandler)
+	mux.HandleFunc(handlers.OpenAPIPath, env.OpenAPIHandler)
+	mux.HandleFunc(handlers.APIDocPath, env.APIDocHandler)
+	mux.HandleFunc("/getAPITokens/", env.GetAPITokensHandler)
+	mux.HandleFunc("/addAPIToken/", env.AddAPITokenHandler)
+	mux.HandleFunc("/revokeAPIToken/", env.RevokeAPITokenHandler)
 	mux.HandleFunc("/", env.MainHandler)
 
-	chain := alice.New(c.Handler).Then(mux)
+	return mux
 
-	if err = http.ListenAndServe(":"+*listenPort, chain); err != nil {
-		log.Fatal(err)
+}
+
+// purgeTrash permanently deletes every hour the folders and bookmarks
+// in the trash of each user for more than the given retention.
+func purgeTrash(ds models.Datastore, retention time.Duration) {
+
+	for {
+		ctx := context.Background()
+		// The folders and bookmarks saved without authentication have no user.
+		owners := []int{0}
+		users, err := ds.GetUsers(ctx)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("purgeTrash")
+		}
+		for _, u := range users {
+			owners = append(owners, u.Id)
+		}
+
+		for _, owner := range owners {
+			n, err := ds.ForUser(owner).PurgeTrash(ctx, time.Now().Add(-retention))
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err":   err,
+					"owner": owner,
+				}).Error("purgeTrash")
+			} else {
+				log.WithFields(log.Fields{
+					"purged": n,
+					"owner":  owner,
+				}).Debug("purgeTrash")
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+
+}
+
+// purgeSessions deletes every hour the expired login sessions.
+func purgeSessions(ds models.Datastore) {
+
+	for {
+		n, err := ds.PurgeSessions(context.Background(), time.Now())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("purgeSessions")
+		} else {
+			log.WithFields(log.Fields{
+				"purged": n,
+			}).Debug("purgeSessions")
+		}
+		time.Sleep(time.Hour)
 	}
 
 }
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tbellembois/gobkm/handlers"
+)
+
+// TestOpenAPI checks that the OpenAPI document describes all the routes.
+func TestOpenAPI(t *testing.T) {
+
+	env := &handlers.Env{}
+	if err := env.CheckOpenAPI(routes(env).Patterns); err != nil {
+		t.Error(err)
+	}
+
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/models"
+)
+
+// migrate implements the "gobkm migrate" command
+// upgrading the database schema without starting the server.
+func migrate(args []string) {
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbPath := fs.String("db", "bkm.db", "the full sqlite db path or a postgres:// URL")
+	status := fs.Bool("status", false, "only print the schema version")
+	debug := fs.Bool("debug", false, "debug (verbose log), default is error")
+	if err := fs.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.ErrorLevel)
+	}
+
+	ctx := context.Background()
+
+	db, err := models.Open(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	ds, ok := db.(models.Migrator)
+	if !ok {
+		log.Fatal("the database does not support migrations")
+	}
+
+	current, latest, err := ds.SchemaVersion(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("database schema version: %d, latest version: %d\n", current, latest)
+
+	if *status {
+		return
+	}
+
+	if err = ds.Migrate(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if current < latest {
+		fmt.Printf("database migrated to version %d\n", latest)
+	} else {
+		fmt.Println("database is up to date")
+	}
+
+}
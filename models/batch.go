@@ -0,0 +1,162 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// ErrInvalidBatch is returned for an unknown batch operation
+// or an operation without its folder or tags.
+var ErrInvalidBatch = errors.New("invalid batch operation")
+
+// BatchError is returned by Batch when an operation fails,
+// none of the operations being applied.
+type BatchError struct {
+	Index int // the index of the failed operation
+	Err   error
+}
+
+// Error returns the error of the failed operation.
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch operation %d: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the error of the failed operation.
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// CheckBatchOperation returns ErrInvalidBatch if the given operation is not valid.
+func CheckBatchOperation(op *types.BatchOperation) error {
+
+	switch op.Op {
+	case types.BatchMove:
+		if op.FolderId <= 0 {
+			return ErrInvalidBatch
+		}
+	case types.BatchTag, types.BatchUntag:
+		if len(op.Tags) == 0 {
+			return ErrInvalidBatch
+		}
+		for _, name := range op.Tags {
+			if strings.TrimSpace(name) == "" {
+				return ErrInvalidBatch
+			}
+		}
+	case types.BatchStar, types.BatchUnstar, types.BatchDelete:
+	default:
+		return ErrInvalidBatch
+	}
+	return nil
+
+}
+
+// batchTags returns the given bookmark tags with the tags of the given names
+// of the given datastore added, new ones for the unknown names, or removed.
+func batchTags(ctx context.Context, ds Datastore, tags []*types.Tag, names []string, add bool) ([]*types.Tag, error) {
+
+	named := make(map[string]bool)
+	for _, name := range names {
+		named[strings.TrimSpace(name)] = true
+	}
+
+	var result []*types.Tag
+	for _, t := range tags {
+		if add || !named[t.Name] {
+			result = append(result, t)
+		}
+		delete(named, t.Name)
+	}
+	if !add || len(named) == 0 {
+		return result, nil
+	}
+
+	existing, err := ds.GetTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range existing {
+		if named[t.Name] {
+			result = append(result, t)
+			delete(named, t.Name)
+		}
+	}
+	for _, name := range names {
+		if name = strings.TrimSpace(name); named[name] {
+			result = append(result, &types.Tag{Name: name})
+			delete(named, name)
+		}
+	}
+	return result, nil
+
+}
+
+// applyBatchOperation applies the given operation on a bookmark of the given datastore.
+func applyBatchOperation(ctx context.Context, ds Datastore, op *types.BatchOperation) error {
+
+	if err := CheckBatchOperation(op); err != nil {
+		return err
+	}
+
+	bkm, err := ds.GetBookmark(ctx, op.BookmarkId)
+	if err != nil {
+		return err
+	}
+	if bkm.DeletedAt != nil {
+		return ErrNotFound
+	}
+
+	switch op.Op {
+	case types.BatchDelete:
+		return ds.TrashBookmark(ctx, op.BookmarkId)
+	case types.BatchMove:
+		fld, err := ds.GetFolder(ctx, op.FolderId)
+		if err != nil {
+			return err
+		}
+		if !isLive(fld) {
+			return ErrNotFound
+		}
+		bkm.Folder = fld
+	case types.BatchTag, types.BatchUntag:
+		if bkm.Tags, err = batchTags(ctx, ds, bkm.Tags, op.Tags, op.Op == types.BatchTag); err != nil {
+			return err
+		}
+	case types.BatchStar, types.BatchUnstar:
+		bkm.Starred = op.Op == types.BatchStar
+	}
+	return ds.UpdateBookmark(ctx, bkm)
+
+}
+
+// applyBatch applies the given operations on the bookmarks of their owners
+// of the given datastore, returning a BatchError at the first failure.
+func applyBatch(ctx context.Context, ds Datastore, ops []*types.BatchOperation) error {
+
+	for i, op := range ops {
+		if err := applyBatchOperation(ctx, ds.ForUser(op.OwnerId), op); err != nil {
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+	return nil
+
+}
+
+// Batch applies the given operations on the bookmarks of their owners
+// in a transaction, none of them if one fails with a BatchError.
+func (db *sqlDataStore) Batch(ctx context.Context, ops []*types.BatchOperation) error {
+
+	log.WithFields(log.Fields{
+		"operations": len(ops),
+	}).Debug("Batch")
+
+	return db.withTx(ctx, func(db *sqlDataStore) error {
+		return applyBatch(ctx, db, ops)
+	})
+
+}
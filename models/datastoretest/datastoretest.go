@@ -0,0 +1,2772 @@
+// Package datastoretest implements a conformance test suite
+// for the models.Datastore implementations.
+//
+// Each backend test file only has to provide a constructor:
+//
+//	func TestSQLiteDataStore(t *testing.T) {
+//		datastoretest.Run(t, func(t *testing.T) models.Datastore {
+//			db, err := models.NewDBstore(filepath.Join(t.TempDir(), "bkm.db"))
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return db
+//		})
+//	}
+package datastoretest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// NewDatastore returns a new empty Datastore.
+// If it implements models.Database the suite creates it
+// (ie. the root folder) and closes it at the end of the test.
+type NewDatastore func(t *testing.T) models.Datastore
+
+// Run runs the conformance test suite against the Datastores
+// returned by newDatastore, a new one for each subtest.
+func Run(t *testing.T, newDatastore NewDatastore) {
+
+	tests := []struct {
+		name string
+		test func(context.Context, *testing.T, models.Datastore)
+	}{
+		{"RootFolder", testRootFolder},
+		{"NotFound", testNotFound},
+		{"SaveFolder", testSaveFolder},
+		{"MoveFolder", testMoveFolder},
+		{"DeleteFolderCascade", testDeleteFolderCascade},
+		{"FolderTree", testFolderTree},
+		{"SaveBookmark", testSaveBookmark},
+		{"UpdateBookmarkTags", testUpdateBookmarkTags},
+		{"UpdateDeleteTag", testUpdateDeleteTag},
+		{"StarBookmark", testStarBookmark},
+		{"SearchBookmarks", testSearchBookmarks},
+		{"SearchQuery", testSearchQuery},
+		{"InvalidSearchQuery", testInvalidSearchQuery},
+		{"DeleteBookmark", testDeleteBookmark},
+		{"BookmarkDates", testBookmarkDates},
+		{"FolderDates", testFolderDates},
+		{"SortModes", testSortModes},
+		{"ReorderFolderChildren", testReorderFolderChildren},
+		{"ListBookmarks", testListBookmarks},
+		{"ListFolders", testListFolders},
+		{"ListTags", testListTags},
+		{"TrashBookmark", testTrashBookmark},
+		{"TrashFolder", testTrashFolder},
+		{"RestoreMissingParent", testRestoreMissingParent},
+		{"PurgeTrash", testPurgeTrash},
+		{"History", testHistory},
+		{"Undo", testUndo},
+		{"UndoAtomic", testUndoAtomic},
+		{"DataRevision", testDataRevision},
+		{"Users", testUsers},
+		{"Sessions", testSessions},
+		{"APITokens", testAPITokens},
+		{"UserRootFolders", testUserRootFolders},
+		{"UserIsolation", testUserIsolation},
+		{"SharedFolders", testSharedFolders},
+		{"ShareLinks", testShareLinks},
+		{"Webhooks", testWebhooks},
+		{"Batch", testBatch},
+		{"WithTx", testWithTx},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tt.test(ctx, t, open(ctx, t, newDatastore))
+		})
+	}
+
+}
+
+// open returns a new created Datastore.
+func open(ctx context.Context, t *testing.T, newDatastore NewDatastore) models.Datastore {
+
+	t.Helper()
+
+	ds := newDatastore(t)
+	if db, ok := ds.(models.Database); ok {
+		if err := db.CreateDatabase(ctx); err != nil {
+			t.Fatalf("CreateDatabase: %v", err)
+		}
+		t.Cleanup(func() {
+			if err := db.Close(); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+		})
+	}
+
+	return ds
+
+}
+
+// saveFolder saves a new folder and returns it as stored.
+func saveFolder(ctx context.Context, t *testing.T, ds models.Datastore, title string, parent *types.Folder) *types.Folder {
+
+	t.Helper()
+
+	id, err := ds.SaveFolder(ctx, &types.Folder{Title: title, Parent: parent})
+	if err != nil {
+		t.Fatalf("SaveFolder(%q): %v", title, err)
+	}
+	fld, err := ds.GetFolder(ctx, int(id))
+	if err != nil {
+		t.Fatalf("GetFolder(%d): %v", id, err)
+	}
+
+	return fld
+
+}
+
+// saveBookmark saves a new bookmark and returns it as stored.
+func saveBookmark(ctx context.Context, t *testing.T, ds models.Datastore, bkm *types.Bookmark) *types.Bookmark {
+
+	t.Helper()
+
+	id, err := ds.SaveBookmark(ctx, bkm)
+	if err != nil {
+		t.Fatalf("SaveBookmark(%q): %v", bkm.Title, err)
+	}
+	saved, err := ds.GetBookmark(ctx, int(id))
+	if err != nil {
+		t.Fatalf("GetBookmark(%d): %v", id, err)
+	}
+
+	return saved
+
+}
+
+// folderTitles returns the titles of the given folders.
+func folderTitles(flds []*types.Folder) []string {
+
+	var titles []string
+	for _, f := range flds {
+		titles = append(titles, f.Title)
+	}
+	return titles
+
+}
+
+// bookmarkTitles returns the titles of the given bookmarks.
+func bookmarkTitles(bkms []*types.Bookmark) []string {
+
+	var titles []string
+	for _, b := range bkms {
+		titles = append(titles, b.Title)
+	}
+	return titles
+
+}
+
+// tagNames returns the names of the given tags.
+func tagNames(tags []*types.Tag) []string {
+
+	var names []string
+	for _, tag := range tags {
+		names = append(names, tag.Name)
+	}
+	return names
+
+}
+
+// equal returns true if the given string slices are equal.
+func equal(a, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+
+}
+
+func testRootFolder(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	root, err := ds.GetFolder(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetFolder(1): %v", err)
+	}
+	if root.Title != "/" || !root.IsRootFolder() {
+		t.Errorf("GetFolder(1) = %v, want the / root folder", root)
+	}
+	if root, err = ds.GetRootFolder(ctx); err != nil || root.Id != 1 {
+		t.Errorf("GetRootFolder = %v, %v, want the folder 1", root, err)
+	}
+
+	flds, err := ds.GetFolderSubfolders(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetFolderSubfolders(1): %v", err)
+	}
+	if len(flds) != 0 {
+		t.Errorf("GetFolderSubfolders(1) = %v, want no folders", folderTitles(flds))
+	}
+
+}
+
+func testNotFound(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	if _, err := ds.GetFolder(ctx, 999); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetFolder(999) error = %v, want ErrNotFound", err)
+	}
+	if _, err := ds.GetBookmark(ctx, 999); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetBookmark(999) error = %v, want ErrNotFound", err)
+	}
+	if _, err := ds.GetTag(ctx, 999); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetTag(999) error = %v, want ErrNotFound", err)
+	}
+	if err := ds.UpdateFolder(ctx, &types.Folder{Id: 999, Title: "none"}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("UpdateFolder(999) error = %v, want ErrNotFound", err)
+	}
+
+}
+
+func testSaveFolder(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	it := saveFolder(ctx, t, ds, "IT", nil)
+	dev := saveFolder(ctx, t, ds, "Development", it)
+	saveFolder(ctx, t, ds, "Admin", it)
+
+	if it.Parent == nil || it.Parent.Id != 1 {
+		t.Errorf("folder without parent = %v, want it in the root folder", it)
+	}
+	if dev.Parent == nil || dev.Parent.Id != it.Id || dev.Parent.Parent == nil || dev.Parent.Parent.Id != 1 {
+		t.Errorf("GetFolder(%d) = %v, want the /IT parents", dev.Id, dev)
+	}
+
+	flds, err := ds.GetFolderSubfolders(ctx, it.Id)
+	if err != nil {
+		t.Fatalf("GetFolderSubfolders(%d): %v", it.Id, err)
+	}
+	if got, want := folderTitles(flds), []string{"Admin", "Development"}; !equal(got, want) {
+		t.Errorf("GetFolderSubfolders(%d) = %v, want %v sorted by title", it.Id, got, want)
+	}
+	for _, f := range flds {
+		if f.Parent == nil || f.Parent.Id != it.Id {
+			t.Errorf("subfolder %q parent = %v, want %d", f.Title, f.Parent, it.Id)
+		}
+	}
+
+}
+
+func testMoveFolder(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	src := saveFolder(ctx, t, ds, "src", nil)
+	dst := saveFolder(ctx, t, ds, "dst", nil)
+	child := saveFolder(ctx, t, ds, "child", nil)
+
+	// Moving child into src, then into dst.
+	for _, parent := range []*types.Folder{src, dst} {
+		child.Parent = parent
+		if err := ds.UpdateFolder(ctx, child); err != nil {
+			t.Fatalf("UpdateFolder(%d): %v", child.Id, err)
+		}
+	}
+
+	moved, err := ds.GetFolder(ctx, child.Id)
+	if err != nil {
+		t.Fatalf("GetFolder(%d): %v", child.Id, err)
+	}
+	if moved.Parent == nil || moved.Parent.Id != dst.Id {
+		t.Errorf("moved folder parent = %v, want %d", moved.Parent, dst.Id)
+	}
+
+	// Checking the nbChildrenFolders bookkeeping.
+	for _, c := range []struct {
+		id   int
+		want int
+	}{{src.Id, 0}, {dst.Id, 1}, {1, 2}} {
+		f, err := ds.GetFolder(ctx, c.id)
+		if err != nil {
+			t.Fatalf("GetFolder(%d): %v", c.id, err)
+		}
+		if f.NbChildrenFolders != c.want {
+			t.Errorf("folder %q NbChildrenFolders = %d, want %d", f.Title, f.NbChildrenFolders, c.want)
+		}
+		if f.HasChildrenFolders() != (c.want > 0) {
+			t.Errorf("folder %q HasChildrenFolders = %t, want %t", f.Title, f.HasChildrenFolders(), c.want > 0)
+		}
+	}
+
+	// Renaming.
+	moved.Title = "renamed"
+	if err = ds.UpdateFolder(ctx, moved); err != nil {
+		t.Fatalf("UpdateFolder(%d): %v", moved.Id, err)
+	}
+	renamed, err := ds.GetFolder(ctx, moved.Id)
+	if err != nil {
+		t.Fatalf("GetFolder(%d): %v", moved.Id, err)
+	}
+	if renamed.Title != "renamed" || renamed.Parent == nil || renamed.Parent.Id != dst.Id {
+		t.Errorf("renamed folder = %v, want title renamed in %d", renamed, dst.Id)
+	}
+
+}
+
+func testDeleteFolderCascade(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	top := saveFolder(ctx, t, ds, "top", nil)
+	sub := saveFolder(ctx, t, ds, "sub", top)
+	kept := saveFolder(ctx, t, ds, "kept", nil)
+	b1 := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "b1", URL: "https://b1.org/", Folder: top, Tags: []*types.Tag{{Name: "t1"}}})
+	b2 := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "b2", URL: "https://b2.org/", Folder: sub, Tags: []*types.Tag{{Name: "t2"}}})
+	b3 := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "b3", URL: "https://b3.org/", Folder: kept})
+
+	if err := ds.DeleteFolder(ctx, top); err != nil {
+		t.Fatalf("DeleteFolder(%d): %v", top.Id, err)
+	}
+
+	for _, id := range []int{top.Id, sub.Id} {
+		if _, err := ds.GetFolder(ctx, id); !errors.Is(err, models.ErrNotFound) {
+			t.Errorf("GetFolder(%d) of a deleted folder error = %v, want ErrNotFound", id, err)
+		}
+	}
+	for _, id := range []int{b1.Id, b2.Id} {
+		if _, err := ds.GetBookmark(ctx, id); !errors.Is(err, models.ErrNotFound) {
+			t.Errorf("GetBookmark(%d) in a deleted folder error = %v, want ErrNotFound", id, err)
+		}
+	}
+	if _, err := ds.GetFolder(ctx, kept.Id); err != nil {
+		t.Errorf("GetFolder(%d) of a kept folder: %v", kept.Id, err)
+	}
+	if _, err := ds.GetBookmark(ctx, b3.Id); err != nil {
+		t.Errorf("GetBookmark(%d) of a kept bookmark: %v", b3.Id, err)
+	}
+
+	flds, err := ds.GetFolderSubfolders(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetFolderSubfolders(1): %v", err)
+	}
+	if got, want := folderTitles(flds), []string{"kept"}; !equal(got, want) {
+		t.Errorf("GetFolderSubfolders(1) = %v, want %v", got, want)
+	}
+
+}
+
+func testFolderTree(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	// /top/{a/{deep}, b} with bookmarks in top, a and deep, and a trashed one.
+	top := saveFolder(ctx, t, ds, "top", nil)
+	a := saveFolder(ctx, t, ds, "a", top)
+	saveFolder(ctx, t, ds, "b", top)
+	deep := saveFolder(ctx, t, ds, "deep", a)
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "t1", URL: "https://t1.org/", Folder: top, Tags: []*types.Tag{{Name: "z"}, {Name: "y"}}})
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "a1", URL: "https://a1.org/", Folder: a})
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "a2", URL: "https://a2.org/", Folder: a})
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "d1", URL: "https://d1.org/", Folder: deep})
+	trashed := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "trashed", URL: "https://trashed.org/", Folder: a})
+	if err := ds.TrashBookmark(ctx, trashed.Id); err != nil {
+		t.Fatalf("TrashBookmark(%d): %v", trashed.Id, err)
+	}
+
+	// The whole subtree.
+	fld, err := ds.GetFolderTree(ctx, top.Id, -1)
+	if err != nil {
+		t.Fatalf("GetFolderTree(%d, -1): %v", top.Id, err)
+	}
+	if fld.Parent == nil || fld.Parent.Id != 1 {
+		t.Errorf("GetFolderTree(%d) parent = %v, want the root folder", top.Id, fld.Parent)
+	}
+	if got, want := folderTitles(fld.Folders), []string{"a", "b"}; !equal(got, want) {
+		t.Fatalf("GetFolderTree(%d) folders = %v, want %v", top.Id, got, want)
+	}
+	if got, want := bookmarkTitles(fld.Bookmarks), []string{"t1"}; !equal(got, want) {
+		t.Errorf("GetFolderTree(%d) bookmarks = %v, want %v", top.Id, got, want)
+	}
+	if got, want := tagNames(fld.Bookmarks[0].Tags), []string{"y", "z"}; !equal(got, want) {
+		t.Errorf("GetFolderTree(%d) bookmark tags = %v, want %v", top.Id, got, want)
+	}
+	fa := fld.Folders[0]
+	if fa.Parent == nil || fa.Parent.Id != top.Id {
+		t.Errorf("GetFolderTree(%d) subfolder parent = %v, want %d", top.Id, fa.Parent, top.Id)
+	}
+	if got, want := bookmarkTitles(fa.Bookmarks), []string{"a1", "a2"}; !equal(got, want) {
+		t.Errorf("GetFolderTree(%d) a bookmarks = %v, want %v", top.Id, got, want)
+	}
+	if len(fa.Folders) != 1 || !equal(bookmarkTitles(fa.Folders[0].Bookmarks), []string{"d1"}) {
+		t.Errorf("GetFolderTree(%d) a folders = %v, want deep with d1", top.Id, fa.Folders)
+	}
+
+	// Down to the first level, the subfolders having their counts but no children.
+	fld, err = ds.GetFolderTree(ctx, top.Id, 1)
+	if err != nil {
+		t.Fatalf("GetFolderTree(%d, 1): %v", top.Id, err)
+	}
+	if fld.NbChildrenFolders != 2 || fld.NbBookmarks != 1 {
+		t.Errorf("GetFolderTree(%d, 1) counts = %d, %d, want 2, 1", top.Id, fld.NbChildrenFolders, fld.NbBookmarks)
+	}
+	if got, want := folderTitles(fld.Folders), []string{"a", "b"}; !equal(got, want) {
+		t.Fatalf("GetFolderTree(%d, 1) folders = %v, want %v", top.Id, got, want)
+	}
+	fa = fld.Folders[0]
+	if fa.Folders != nil || fa.Bookmarks != nil {
+		t.Errorf("GetFolderTree(%d, 1) last level folder children = %v, %v, want none", top.Id, fa.Folders, fa.Bookmarks)
+	}
+	if fa.NbChildrenFolders != 1 || fa.NbBookmarks != 2 {
+		t.Errorf("GetFolderTree(%d, 1) last level counts = %d, %d, want 1, 2", top.Id, fa.NbChildrenFolders, fa.NbBookmarks)
+	}
+
+	// The folder only.
+	fld, err = ds.GetFolderTree(ctx, top.Id, 0)
+	if err != nil {
+		t.Fatalf("GetFolderTree(%d, 0): %v", top.Id, err)
+	}
+	if fld.Folders != nil || fld.Bookmarks != nil || fld.NbChildrenFolders != 2 || fld.NbBookmarks != 1 {
+		t.Errorf("GetFolderTree(%d, 0) = %v, want the counts only", top.Id, fld)
+	}
+
+	if _, err = ds.GetFolderTree(ctx, 999, 1); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetFolderTree(999) error = %v, want ErrNotFound", err)
+	}
+
+}
+
+func testSaveBookmark(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	fld := saveFolder(ctx, t, ds, "fld", nil)
+
+	tagID, err := ds.SaveTag(ctx, &types.Tag{Name: "existing"})
+	if err != nil {
+		t.Fatalf("SaveTag: %v", err)
+	}
+
+	bkm := saveBookmark(ctx, t, ds, &types.Bookmark{
+		Title:   "GoLang",
+		URL:     "https://golang.org/",
+		Favicon: "data:image/png;base64,AAAA",
+		Notes:   "The Go programming language.",
+		Folder:  fld,
+		Tags:    []*types.Tag{{Id: int(tagID), Name: "existing"}, {Name: "new"}},
+	})
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "Awesome Go", URL: "https://awesome-go.com/", Folder: fld})
+
+	if bkm.Title != "GoLang" || bkm.URL != "https://golang.org/" || bkm.Favicon != "data:image/png;base64,AAAA" || bkm.Notes != "The Go programming language." || bkm.Starred {
+		t.Errorf("GetBookmark(%d) = %v, want the saved fields", bkm.Id, bkm)
+	}
+	if bkm.Folder == nil || bkm.Folder.Id != fld.Id || bkm.PathString() != "/fld" {
+		t.Errorf("GetBookmark(%d) folder = %v, want %d with its parents", bkm.Id, bkm.Folder, fld.Id)
+	}
+
+	tags, err := ds.GetBookmarkTags(ctx, bkm.Id)
+	if err != nil {
+		t.Fatalf("GetBookmarkTags(%d): %v", bkm.Id, err)
+	}
+	if got, want := tagNames(tags), []string{"existing", "new"}; !equal(got, want) {
+		t.Errorf("GetBookmarkTags(%d) = %v, want %v", bkm.Id, got, want)
+	}
+	for _, tag := range tags {
+		if tag.Name == "existing" && tag.Id != int(tagID) {
+			t.Errorf("existing tag id = %d, want %d", tag.Id, tagID)
+		}
+	}
+
+	bkms, err := ds.GetFolderBookmarks(ctx, fld.Id)
+	if err != nil {
+		t.Fatalf("GetFolderBookmarks(%d): %v", fld.Id, err)
+	}
+	if got, want := bookmarkTitles(bkms), []string{"Awesome Go", "GoLang"}; !equal(got, want) {
+		t.Errorf("GetFolderBookmarks(%d) = %v, want %v sorted by title", fld.Id, got, want)
+	}
+	for _, b := range bkms {
+		if b.Folder == nil || b.Folder.Id != fld.Id {
+			t.Errorf("bookmark %q folder = %v, want %d", b.Title, b.Folder, fld.Id)
+		}
+		if b.Title == "GoLang" && len(b.Tags) != 2 {
+			t.Errorf("bookmark %q tags = %v, want 2 tags", b.Title, tagNames(b.Tags))
+		}
+	}
+
+	// Bookmarks without folder go to the root folder.
+	root := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "root", URL: "https://root.org/"})
+	if root.Folder == nil || root.Folder.Id != 1 {
+		t.Errorf("bookmark without folder = %v, want it in the root folder", root)
+	}
+
+}
+
+func testUpdateBookmarkTags(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	bkm := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "b", URL: "https://b.org/", Tags: []*types.Tag{{Name: "keep"}, {Name: "orphan"}}})
+	other := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "other", URL: "https://other.org/", Tags: []*types.Tag{{Name: "shared"}}})
+
+	var keep, shared *types.Tag
+	for _, tag := range bkm.Tags {
+		if tag.Name == "keep" {
+			keep = tag
+		}
+	}
+	for _, tag := range other.Tags {
+		if tag.Name == "shared" {
+			shared = tag
+		}
+	}
+	if keep == nil || shared == nil {
+		t.Fatalf("saved bookmarks tags = %v %v, want keep and shared", tagNames(bkm.Tags), tagNames(other.Tags))
+	}
+
+	// Replacing the orphan tag by the shared one, and a new one.
+	bkm.Title = "b updated"
+	bkm.Tags = []*types.Tag{keep, shared, {Name: "added"}}
+	if err := ds.UpdateBookmark(ctx, bkm); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", bkm.Id, err)
+	}
+
+	updated, err := ds.GetBookmark(ctx, bkm.Id)
+	if err != nil {
+		t.Fatalf("GetBookmark(%d): %v", bkm.Id, err)
+	}
+	if updated.Title != "b updated" {
+		t.Errorf("updated bookmark title = %q, want %q", updated.Title, "b updated")
+	}
+	if got, want := tagNames(updated.Tags), []string{"added", "keep", "shared"}; !equal(got, want) {
+		t.Errorf("updated bookmark tags = %v, want %v", got, want)
+	}
+
+	// The orphan tag must have been cleaned.
+	tags, err := ds.GetTags(ctx)
+	if err != nil {
+		t.Fatalf("GetTags: %v", err)
+	}
+	if got, want := tagNames(tags), []string{"added", "keep", "shared"}; !equal(got, want) {
+		t.Errorf("GetTags = %v, want %v", got, want)
+	}
+
+	// Removing all the tags.
+	updated.Tags = nil
+	if err = ds.UpdateBookmark(ctx, updated); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", bkm.Id, err)
+	}
+	if tags, err = ds.GetBookmarkTags(ctx, bkm.Id); err != nil {
+		t.Fatalf("GetBookmarkTags(%d): %v", bkm.Id, err)
+	}
+	if len(tags) != 0 {
+		t.Errorf("GetBookmarkTags(%d) = %v, want none", bkm.Id, tagNames(tags))
+	}
+	if tags, err = ds.GetTags(ctx); err != nil {
+		t.Fatalf("GetTags: %v", err)
+	}
+	if got, want := tagNames(tags), []string{"shared"}; !equal(got, want) {
+		t.Errorf("GetTags = %v, want %v", got, want)
+	}
+
+}
+
+func testUpdateDeleteTag(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	a := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "a", URL: "https://a.org/", Tags: []*types.Tag{{Name: "go"}, {Name: "web"}}})
+	var goTag *types.Tag
+	for _, tag := range a.Tags {
+		if tag.Name == "go" {
+			goTag = tag
+		}
+	}
+	b := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "b", URL: "https://b.org/", Tags: []*types.Tag{goTag}})
+
+	// Renaming the tag renames it on all its bookmarks.
+	if err := ds.UpdateTag(ctx, &types.Tag{Id: goTag.Id, Name: "golang"}); err != nil {
+		t.Fatalf("UpdateTag(%d): %v", goTag.Id, err)
+	}
+	tags, err := ds.GetBookmarkTags(ctx, b.Id)
+	if err != nil {
+		t.Fatalf("GetBookmarkTags(%d): %v", b.Id, err)
+	}
+	if got, want := tagNames(tags), []string{"golang"}; !equal(got, want) {
+		t.Errorf("GetBookmarkTags(%d) after rename = %v, want %v", b.Id, got, want)
+	}
+
+	// The tags of the other users are not found.
+	other := ds.ForUser(42)
+	if err = other.UpdateTag(ctx, &types.Tag{Id: goTag.Id, Name: "stolen"}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("other UpdateTag(%d) error = %v, want ErrNotFound", goTag.Id, err)
+	}
+	if err = other.DeleteTag(ctx, goTag.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("other DeleteTag(%d) error = %v, want ErrNotFound", goTag.Id, err)
+	}
+
+	// Deleting the tag removes it from its bookmarks, logging their change.
+	if err = ds.DeleteTag(ctx, goTag.Id); err != nil {
+		t.Fatalf("DeleteTag(%d): %v", goTag.Id, err)
+	}
+	if _, err = ds.GetTag(ctx, goTag.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetTag(%d) after deletion error = %v, want ErrNotFound", goTag.Id, err)
+	}
+	if tags, err = ds.GetBookmarkTags(ctx, a.Id); err != nil {
+		t.Fatalf("GetBookmarkTags(%d): %v", a.Id, err)
+	}
+	if got, want := tagNames(tags), []string{"web"}; !equal(got, want) {
+		t.Errorf("GetBookmarkTags(%d) after deletion = %v, want %v", a.Id, got, want)
+	}
+	checkHistory(ctx, t, ds, types.RevisionBookmark, b.Id, []string{types.OperationTag, types.OperationCreate})
+	if err = ds.DeleteTag(ctx, goTag.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("DeleteTag(%d) twice error = %v, want ErrNotFound", goTag.Id, err)
+	}
+
+}
+
+func testStarBookmark(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	fld := saveFolder(ctx, t, ds, "fld", nil)
+	b1 := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "zeta", URL: "https://zeta.org/", Folder: fld})
+	b2 := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "alpha", URL: "https://alpha.org/", Starred: true})
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "not starred", URL: "https://ns.org/"})
+
+	b1.Starred = true
+	if err := ds.UpdateBookmark(ctx, b1); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", b1.Id, err)
+	}
+
+	stars, err := ds.GetStars(ctx)
+	if err != nil {
+		t.Fatalf("GetStars: %v", err)
+	}
+	if got, want := bookmarkTitles(stars), []string{"alpha", "zeta"}; !equal(got, want) {
+		t.Fatalf("GetStars = %v, want %v", got, want)
+	}
+	if stars[1].Folder == nil || stars[1].Folder.Id != fld.Id || !stars[1].Starred {
+		t.Errorf("starred bookmark = %v, want starred in folder %d", stars[1], fld.Id)
+	}
+
+	b2.Starred = false
+	if err = ds.UpdateBookmark(ctx, b2); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", b2.Id, err)
+	}
+	if stars, err = ds.GetStars(ctx); err != nil {
+		t.Fatalf("GetStars: %v", err)
+	}
+	if got, want := bookmarkTitles(stars), []string{"zeta"}; !equal(got, want) {
+		t.Errorf("GetStars = %v, want %v", got, want)
+	}
+
+}
+
+func testSearchBookmarks(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	fld := saveFolder(ctx, t, ds, "fld", nil)
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "GoLang", URL: "https://golang.org/", Folder: fld})
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "GoBkm Github", URL: "https://github.com/tbellembois/gobkm", Tags: []*types.Tag{{Name: "bookmarks"}}})
+	rust := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "Rust", URL: "https://rust-lang.org/", Notes: "A memory safe language.", Tags: []*types.Tag{{Name: "golang-alternative"}, {Name: "systems"}}})
+
+	for _, c := range []struct {
+		search string
+		want   []string
+	}{
+		{"golang", []string{"GoLang", "Rust"}},
+		{"GO", []string{"GoBkm Github", "GoLang", "Rust"}},
+		{"bookmark", []string{"GoBkm Github"}},
+		{"system", []string{"Rust"}},
+		{"github.com", []string{"GoBkm Github"}},
+		{"rust-lang", []string{"Rust"}},
+		{"memory", []string{"Rust"}},
+		{"nothing", nil},
+	} {
+		bkms, err := ds.SearchBookmarks(ctx, c.search)
+		if err != nil {
+			t.Fatalf("SearchBookmarks(%q): %v", c.search, err)
+		}
+		// The results order depends on the implementation ranking.
+		got := bookmarkTitles(bkms)
+		sort.Strings(got)
+		if !equal(got, c.want) {
+			t.Errorf("SearchBookmarks(%q) = %v, want %v", c.search, got, c.want)
+		}
+		for _, b := range bkms {
+			if b.Title == "GoLang" && (b.Folder == nil || b.Folder.Id != fld.Id) {
+				t.Errorf("SearchBookmarks(%q) bookmark %q folder = %v, want %d", c.search, b.Title, b.Folder, fld.Id)
+			}
+		}
+	}
+
+	// The search must follow the bookmarks updates and deletions.
+	rust.Title = "Rustlang"
+	rust.Notes = ""
+	rust.Tags = []*types.Tag{{Name: "ferris"}}
+	if err := ds.UpdateBookmark(ctx, rust); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", rust.Id, err)
+	}
+	if err := ds.DeleteFolder(ctx, fld); err != nil {
+		t.Fatalf("DeleteFolder(%d): %v", fld.Id, err)
+	}
+
+	for _, c := range []struct {
+		search string
+		want   []string
+	}{
+		{"rustlang", []string{"Rustlang"}},
+		{"ferris", []string{"Rustlang"}},
+		{"memory", nil},
+		{"systems", nil},
+		{"golang", nil},
+	} {
+		bkms, err := ds.SearchBookmarks(ctx, c.search)
+		if err != nil {
+			t.Fatalf("SearchBookmarks(%q): %v", c.search, err)
+		}
+		if got := bookmarkTitles(bkms); !equal(got, c.want) {
+			t.Errorf("SearchBookmarks(%q) after update = %v, want %v", c.search, got, c.want)
+		}
+	}
+
+}
+
+func testSearchQuery(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	it := saveFolder(ctx, t, ds, "IT", nil)
+	dev := saveFolder(ctx, t, ds, "Dev", it)
+	perso := saveFolder(ctx, t, ds, "Perso", nil)
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "Go Packages", URL: "https://pkg.go.dev/", Notes: "Find Go modules.", Starred: true, Folder: dev, Tags: []*types.Tag{{Name: "GoLang"}}})
+	gobkm := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "GoBkm", URL: "https://github.com/tbellembois/gobkm", Folder: it})
+	gobkm.Tags = []*types.Tag{{Name: "old"}}
+	for _, tag := range saveBookmark(ctx, t, ds, &types.Bookmark{Title: "x", URL: "https://x.org/", Tags: []*types.Tag{{Name: "golang"}}}).Tags {
+		// Reusing the existing golang tag.
+		gobkm.Tags = append(gobkm.Tags, tag)
+	}
+	if err := ds.UpdateBookmark(ctx, gobkm); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", gobkm.Id, err)
+	}
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "Gist", URL: "https://gist.github.com/", Folder: perso, Tags: []*types.Tag{{Name: "snippets"}}})
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "Rust book", URL: "https://doc.rust-lang.org/book/", Notes: "The exact phrase here.", Starred: true})
+
+	for _, c := range []struct {
+		search string
+		want   []string
+	}{
+		{"tag:golang", []string{"Go Packages", "GoBkm", "x"}},
+		{"tag:GOLANG -tag:old", []string{"Go Packages", "x"}},
+		{`tag:"golang"`, []string{"Go Packages", "GoBkm", "x"}},
+		{"tag:gola", nil},
+		{"folder:/IT", []string{"Go Packages", "GoBkm"}},
+		{"folder:/it/dev", []string{"Go Packages"}},
+		{"folder:IT/Dev/", []string{"Go Packages"}},
+		{"folder:/I", nil},
+		{"folder:/", []string{"Gist", "Go Packages", "GoBkm", "Rust book", "x"}},
+		{`folder:"/Perso"`, []string{"Gist"}},
+		{"-folder:/", nil},
+		{"folder:/ -folder:/it", []string{"Gist", "Rust book", "x"}},
+		{"starred:true", []string{"Go Packages", "Rust book"}},
+		{"starred:false", []string{"Gist", "GoBkm", "x"}},
+		{"site:github.com", []string{"Gist", "GoBkm"}},
+		{"domain:gist.github.com", []string{"Gist"}},
+		{"site:https://GitHub.com/foo", []string{"Gist", "GoBkm"}},
+		{"site:hub.com", nil},
+		{`"exact phrase"`, []string{"Rust book"}},
+		{`"phrase exact"`, nil},
+		{"modules", []string{"Go Packages"}},
+		{"go OR rust", []string{"Go Packages", "GoBkm", "Rust book", "x"}},
+		{"go AND rust", nil},
+		{"NOT tag:golang", []string{"Gist", "Rust book"}},
+		{"-go", []string{"Gist", "Rust book"}},
+		{"(tag:snippets OR starred:true) -site:rust-lang.org", []string{"Gist", "Go Packages"}},
+		{"tag:golang AND starred:true", []string{"Go Packages"}},
+		{`-"exact phrase" starred:true`, []string{"Go Packages"}},
+		{"tag:golang folder:/IT starred:false site:github.com gobkm", []string{"GoBkm"}},
+		{"tag:golang OR tag:snippets starred:true", []string{"Go Packages", "GoBkm", "x"}},
+		{"http://x.org", []string{"x"}},
+	} {
+		bkms, err := ds.SearchBookmarks(ctx, c.search)
+		if err != nil {
+			t.Fatalf("SearchBookmarks(%q): %v", c.search, err)
+		}
+		got := bookmarkTitles(bkms)
+		sort.Strings(got)
+		if !equal(got, c.want) {
+			t.Errorf("SearchBookmarks(%q) = %v, want %v", c.search, got, c.want)
+		}
+	}
+
+}
+
+func testInvalidSearchQuery(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "b", URL: "https://b.org/"})
+
+	for _, search := range []string{
+		"tag:",
+		"tag: golang",
+		`"unterminated`,
+		`tag:"unterminated`,
+		"(a",
+		"a)",
+		"()",
+		"a OR",
+		"OR a",
+		"a AND AND b",
+		"NOT",
+		"- a",
+		"starred:maybe",
+		"site:://",
+	} {
+		_, err := ds.SearchBookmarks(ctx, search)
+		var qerr *models.QueryError
+		if !errors.Is(err, models.ErrInvalidQuery) || !errors.As(err, &qerr) {
+			t.Errorf("SearchBookmarks(%q) error = %v, want a QueryError", search, err)
+		}
+	}
+
+}
+
+func testDeleteBookmark(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	bkm := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "b", URL: "https://b.org/", Tags: []*types.Tag{{Name: "tag"}}})
+	other := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "other", URL: "https://other.org/"})
+
+	if err := ds.DeleteBookmark(ctx, bkm); err != nil {
+		t.Fatalf("DeleteBookmark(%d): %v", bkm.Id, err)
+	}
+	if _, err := ds.GetBookmark(ctx, bkm.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetBookmark(%d) of a deleted bookmark error = %v, want ErrNotFound", bkm.Id, err)
+	}
+	if _, err := ds.GetBookmark(ctx, other.Id); err != nil {
+		t.Errorf("GetBookmark(%d) of another bookmark: %v", other.Id, err)
+	}
+
+}
+
+// recent returns true if t is between start and now,
+// with a margin for the databases time precision.
+func recent(t time.Time, start time.Time) bool {
+	return !t.Before(start.Add(-time.Second)) && !t.After(time.Now().Add(time.Second))
+}
+
+func testBookmarkDates(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	start := time.Now()
+
+	// New bookmarks are created now.
+	bkm := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "new", URL: "https://new.org/"})
+	if !recent(bkm.CreatedAt, start) || !bkm.UpdatedAt.Equal(bkm.CreatedAt) || bkm.LastVisitedAt != nil {
+		t.Errorf("new bookmark dates = %v %v %v, want now, now and nil", bkm.CreatedAt, bkm.UpdatedAt, bkm.LastVisitedAt)
+	}
+
+	// Imported bookmarks keep their dates.
+	created := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	updated := created.AddDate(1, 0, 0)
+	visited := created.AddDate(2, 0, 0)
+	imported := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "imported", URL: "https://imported.org/", CreatedAt: created, UpdatedAt: updated, LastVisitedAt: &visited})
+	if !imported.CreatedAt.Equal(created) || !imported.UpdatedAt.Equal(updated) || imported.LastVisitedAt == nil || !imported.LastVisitedAt.Equal(visited) {
+		t.Errorf("imported bookmark dates = %v %v %v, want %v %v %v", imported.CreatedAt, imported.UpdatedAt, imported.LastVisitedAt, created, updated, visited)
+	}
+
+	// Updates change the update date only.
+	imported.Title = "updated"
+	if err := ds.UpdateBookmark(ctx, imported); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", imported.Id, err)
+	}
+	updatedBkm, err := ds.GetBookmark(ctx, imported.Id)
+	if err != nil {
+		t.Fatalf("GetBookmark(%d): %v", imported.Id, err)
+	}
+	if !updatedBkm.CreatedAt.Equal(created) || !recent(updatedBkm.UpdatedAt, start) || updatedBkm.LastVisitedAt == nil || !updatedBkm.LastVisitedAt.Equal(visited) {
+		t.Errorf("updated bookmark dates = %v %v %v, want %v, now and %v", updatedBkm.CreatedAt, updatedBkm.UpdatedAt, updatedBkm.LastVisitedAt, created, visited)
+	}
+
+	// Visits change the visit date only.
+	if err = ds.VisitBookmark(ctx, bkm.Id); err != nil {
+		t.Fatalf("VisitBookmark(%d): %v", bkm.Id, err)
+	}
+	visitedBkm, err := ds.GetBookmark(ctx, bkm.Id)
+	if err != nil {
+		t.Fatalf("GetBookmark(%d): %v", bkm.Id, err)
+	}
+	if visitedBkm.LastVisitedAt == nil || !recent(*visitedBkm.LastVisitedAt, start) || !visitedBkm.UpdatedAt.Equal(bkm.UpdatedAt) {
+		t.Errorf("visited bookmark dates = %v %v, want %v and now", visitedBkm.UpdatedAt, visitedBkm.LastVisitedAt, bkm.UpdatedAt)
+	}
+	if err = ds.VisitBookmark(ctx, 999); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("VisitBookmark(999) error = %v, want ErrNotFound", err)
+	}
+
+}
+
+func testFolderDates(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	start := time.Now()
+
+	// New folders are created now.
+	fld := saveFolder(ctx, t, ds, "new", nil)
+	if !recent(fld.CreatedAt, start) || !fld.UpdatedAt.Equal(fld.CreatedAt) || fld.LastVisitedAt != nil {
+		t.Errorf("new folder dates = %v %v %v, want now, now and nil", fld.CreatedAt, fld.UpdatedAt, fld.LastVisitedAt)
+	}
+
+	// Imported folders keep their dates.
+	created := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	updated := created.AddDate(1, 0, 0)
+	id, err := ds.SaveFolder(ctx, &types.Folder{Title: "imported", CreatedAt: created, UpdatedAt: updated})
+	if err != nil {
+		t.Fatalf("SaveFolder: %v", err)
+	}
+	imported, err := ds.GetFolder(ctx, int(id))
+	if err != nil {
+		t.Fatalf("GetFolder(%d): %v", id, err)
+	}
+	if !imported.CreatedAt.Equal(created) || !imported.UpdatedAt.Equal(updated) {
+		t.Errorf("imported folder dates = %v %v, want %v %v", imported.CreatedAt, imported.UpdatedAt, created, updated)
+	}
+
+	// Updates change the update date only.
+	imported.Title = "updated"
+	if err = ds.UpdateFolder(ctx, imported); err != nil {
+		t.Fatalf("UpdateFolder(%d): %v", imported.Id, err)
+	}
+	updatedFld, err := ds.GetFolder(ctx, imported.Id)
+	if err != nil {
+		t.Fatalf("GetFolder(%d): %v", imported.Id, err)
+	}
+	if !updatedFld.CreatedAt.Equal(created) || !recent(updatedFld.UpdatedAt, start) {
+		t.Errorf("updated folder dates = %v %v, want %v and now", updatedFld.CreatedAt, updatedFld.UpdatedAt, created)
+	}
+
+	// Visits change the visit date only.
+	if err = ds.VisitFolder(ctx, fld.Id); err != nil {
+		t.Fatalf("VisitFolder(%d): %v", fld.Id, err)
+	}
+	visitedFld, err := ds.GetFolder(ctx, fld.Id)
+	if err != nil {
+		t.Fatalf("GetFolder(%d): %v", fld.Id, err)
+	}
+	if visitedFld.LastVisitedAt == nil || !recent(*visitedFld.LastVisitedAt, start) || !visitedFld.UpdatedAt.Equal(fld.UpdatedAt) {
+		t.Errorf("visited folder dates = %v %v, want %v and now", visitedFld.UpdatedAt, visitedFld.LastVisitedAt, fld.UpdatedAt)
+	}
+	if err = ds.VisitFolder(ctx, 999); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("VisitFolder(999) error = %v, want ErrNotFound", err)
+	}
+
+	// The subfolders have their dates too.
+	flds, err := ds.GetFolderSubfolders(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetFolderSubfolders(1): %v", err)
+	}
+	for _, f := range flds {
+		if f.CreatedAt.IsZero() || f.UpdatedAt.IsZero() {
+			t.Errorf("subfolder %q dates = %v %v, want set", f.Title, f.CreatedAt, f.UpdatedAt)
+		}
+	}
+
+}
+
+// setSort sets the sort mode of the given folder.
+func setSort(ctx context.Context, t *testing.T, ds models.Datastore, fld *types.Folder, m types.SortMode) {
+
+	t.Helper()
+
+	fld.Sort = m
+	if err := ds.UpdateFolder(ctx, fld); err != nil {
+		t.Fatalf("UpdateFolder(%d): %v", fld.Id, err)
+	}
+
+}
+
+// checkChildren checks the order of the subfolders and bookmarks of the given folder.
+func checkChildren(ctx context.Context, t *testing.T, ds models.Datastore, id int, wantFolders, wantBookmarks []string) {
+
+	t.Helper()
+
+	flds, err := ds.GetFolderSubfolders(ctx, id)
+	if err != nil {
+		t.Fatalf("GetFolderSubfolders(%d): %v", id, err)
+	}
+	if got := folderTitles(flds); !equal(got, wantFolders) {
+		t.Errorf("GetFolderSubfolders(%d) = %v, want %v", id, got, wantFolders)
+	}
+	bkms, err := ds.GetFolderBookmarks(ctx, id)
+	if err != nil {
+		t.Fatalf("GetFolderBookmarks(%d): %v", id, err)
+	}
+	if got := bookmarkTitles(bkms); !equal(got, wantBookmarks) {
+		t.Errorf("GetFolderBookmarks(%d) = %v, want %v", id, got, wantBookmarks)
+	}
+
+	// The tree children have the same order.
+	fld, err := ds.GetFolderTree(ctx, id, 1)
+	if err != nil {
+		t.Fatalf("GetFolderTree(%d, 1): %v", id, err)
+	}
+	if got := folderTitles(fld.Folders); !equal(got, wantFolders) {
+		t.Errorf("GetFolderTree(%d, 1) folders = %v, want %v", id, got, wantFolders)
+	}
+	if got := bookmarkTitles(fld.Bookmarks); !equal(got, wantBookmarks) {
+		t.Errorf("GetFolderTree(%d, 1) bookmarks = %v, want %v", id, got, wantBookmarks)
+	}
+
+}
+
+func testSortModes(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	fld := saveFolder(ctx, t, ds, "sorted", nil)
+	if fld.Sort != types.SortTitle {
+		t.Errorf("new folder sort = %q, want %q", fld.Sort, types.SortTitle)
+	}
+
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, b := range []struct{ title, url string }{
+		{"b", "https://c.org/"},
+		{"c", "https://a.org/"},
+		{"a", "https://b.org/"},
+	} {
+		saveBookmark(ctx, t, ds, &types.Bookmark{Title: b.title, URL: b.url, Folder: fld, CreatedAt: date.AddDate(0, 0, i)})
+	}
+	for i, title := range []string{"y", "z", "x"} {
+		if _, err := ds.SaveFolder(ctx, &types.Folder{Title: title, Parent: fld, CreatedAt: date.AddDate(0, 0, i)}); err != nil {
+			t.Fatalf("SaveFolder(%q): %v", title, err)
+		}
+	}
+
+	checkChildren(ctx, t, ds, fld.Id, []string{"x", "y", "z"}, []string{"a", "b", "c"})
+
+	setSort(ctx, t, ds, fld, types.SortURL)
+	checkChildren(ctx, t, ds, fld.Id, []string{"x", "y", "z"}, []string{"c", "a", "b"})
+
+	setSort(ctx, t, ds, fld, types.SortCreated)
+	checkChildren(ctx, t, ds, fld.Id, []string{"x", "z", "y"}, []string{"a", "c", "b"})
+
+	// The never visited children are the last ones.
+	setSort(ctx, t, ds, fld, types.SortVisited)
+	bkms, err := ds.GetFolderBookmarks(ctx, fld.Id)
+	if err != nil {
+		t.Fatalf("GetFolderBookmarks(%d): %v", fld.Id, err)
+	}
+	for _, b := range []*types.Bookmark{bkms[2], bkms[1]} {
+		if err = ds.VisitBookmark(ctx, b.Id); err != nil {
+			t.Fatalf("VisitBookmark(%d): %v", b.Id, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkChildren(ctx, t, ds, fld.Id, []string{"x", "y", "z"}, []string{"b", "c", "a"})
+
+	// The children are in their creation order by default.
+	setSort(ctx, t, ds, fld, types.SortManual)
+	checkChildren(ctx, t, ds, fld.Id, []string{"y", "z", "x"}, []string{"b", "c", "a"})
+
+	updated, err := ds.GetFolder(ctx, fld.Id)
+	if err != nil {
+		t.Fatalf("GetFolder(%d): %v", fld.Id, err)
+	}
+	if updated.Sort != types.SortManual {
+		t.Errorf("updated folder sort = %q, want %q", updated.Sort, types.SortManual)
+	}
+
+}
+
+func testReorderFolderChildren(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	fld := saveFolder(ctx, t, ds, "ordered", nil)
+	other := saveFolder(ctx, t, ds, "other", nil)
+	ids := make(map[string]int)
+	for _, title := range []string{"a", "b", "c"} {
+		ids[title] = saveBookmark(ctx, t, ds, &types.Bookmark{Title: title, URL: "https://" + title + ".org/", Folder: fld}).Id
+		ids[title+title] = saveFolder(ctx, t, ds, title+title, fld).Id
+	}
+
+	// The children not given keep their order after the given ones.
+	if err := ds.ReorderFolderChildren(ctx, fld.Id, []int{ids["cc"]}, []int{ids["c"], ids["a"]}); err != nil {
+		t.Fatalf("ReorderFolderChildren(%d): %v", fld.Id, err)
+	}
+	checkChildren(ctx, t, ds, fld.Id, []string{"cc", "aa", "bb"}, []string{"c", "a", "b"})
+
+	reordered, err := ds.GetFolder(ctx, fld.Id)
+	if err != nil {
+		t.Fatalf("GetFolder(%d): %v", fld.Id, err)
+	}
+	if reordered.Sort != types.SortManual {
+		t.Errorf("reordered folder sort = %q, want %q", reordered.Sort, types.SortManual)
+	}
+
+	// The new and moved children are the last ones.
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "0", URL: "https://0.org/", Folder: fld})
+	moved := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "1", URL: "https://1.org/", Folder: other})
+	moved.Folder = fld
+	if err = ds.UpdateBookmark(ctx, moved); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", moved.Id, err)
+	}
+	checkChildren(ctx, t, ds, fld.Id, []string{"cc", "aa", "bb"}, []string{"c", "a", "b", "0", "1"})
+
+	// Invalid orders change nothing.
+	for _, o := range []struct {
+		name                   string
+		folderIDs, bookmarkIDs []int
+	}{
+		{"not a child", []int{other.Id}, nil},
+		{"twice", nil, []int{ids["b"], ids["b"]}},
+		{"valid then invalid", []int{ids["bb"]}, []int{ids["b"], 999}},
+	} {
+		if err = ds.ReorderFolderChildren(ctx, fld.Id, o.folderIDs, o.bookmarkIDs); !errors.Is(err, models.ErrInvalidOrder) {
+			t.Errorf("ReorderFolderChildren %s error = %v, want ErrInvalidOrder", o.name, err)
+		}
+	}
+	checkChildren(ctx, t, ds, fld.Id, []string{"cc", "aa", "bb"}, []string{"c", "a", "b", "0", "1"})
+
+	if err = ds.ReorderFolderChildren(ctx, 999, nil, nil); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("ReorderFolderChildren(999) error = %v, want ErrNotFound", err)
+	}
+
+}
+
+// listSorts are the sort keys of ListBookmarks and ListFolders.
+var listSorts = []string{"", "id", "title", "created", "updated", "visited", "position"}
+
+// listPages returns the titles or names of the items listed by the given function
+// with the given options, page by page after the first one.
+// It fails if a page is longer than the limit or if a page of all the items has a next one.
+func listPages(t *testing.T, opts models.ListOptions, list func(opts models.ListOptions) ([]string, *models.ListCursor, error)) []string {
+
+	t.Helper()
+
+	var all []string
+	for n := 0; n <= 100; n++ {
+		page, next, err := list(opts)
+		if err != nil {
+			t.Fatalf("list %+v: %v", opts, err)
+		}
+		if opts.Limit > 0 && len(page) > opts.Limit {
+			t.Fatalf("list %+v = %v, more than the limit", opts, page)
+		}
+		if opts.Limit == 0 && next != nil {
+			t.Fatalf("list %+v next page %+v, want none", opts, next)
+		}
+		all = append(all, page...)
+		if next == nil {
+			return all
+		}
+		opts.After = next
+	}
+	t.Fatalf("list %+v: too many pages", opts)
+	return nil
+
+}
+
+// checkPages checks the items listed by the given function with the given options,
+// in one page and in pages of one and two items.
+func checkPages(t *testing.T, opts models.ListOptions, want []string, list func(opts models.ListOptions) ([]string, *models.ListCursor, error)) {
+
+	t.Helper()
+
+	all := listPages(t, opts, list)
+	if want != nil && !equal(all, want) {
+		t.Errorf("list %+v = %v, want %v", opts, all, want)
+	}
+	for _, limit := range []int{1, 2} {
+		opts.Limit = limit
+		if got := listPages(t, opts, list); !equal(got, all) {
+			t.Errorf("list %+v = %v, want %v", opts, got, all)
+		}
+	}
+
+}
+
+func testListBookmarks(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	root, err := ds.GetRootFolder(ctx)
+	if err != nil {
+		t.Fatalf("GetRootFolder: %v", err)
+	}
+	fld := saveFolder(ctx, t, ds, "fld", nil)
+	date := func(year int) time.Time { return time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC) }
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "Beta", URL: "https://b.org/", CreatedAt: date(2001)})
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "alpha", URL: "https://c.org/", CreatedAt: date(2003), Starred: true, Folder: fld, Tags: []*types.Tag{{Name: "go"}}})
+	gamma := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "Gamma", URL: "https://a.org/", CreatedAt: date(2002), Tags: []*types.Tag{{Name: "web"}}})
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "beta", URL: "https://d.org/", CreatedAt: date(2001)})
+	trashed := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "trashed", URL: "https://t.org/", Starred: true})
+	if err = ds.TrashBookmark(ctx, trashed.Id); err != nil {
+		t.Fatalf("TrashBookmark(%d): %v", trashed.Id, err)
+	}
+	if err = ds.VisitBookmark(ctx, gamma.Id); err != nil {
+		t.Fatalf("VisitBookmark(%d): %v", gamma.Id, err)
+	}
+
+	list := func(f models.BookmarkFilter) func(opts models.ListOptions) ([]string, *models.ListCursor, error) {
+		return func(opts models.ListOptions) ([]string, *models.ListCursor, error) {
+			bkms, next, err := ds.ListBookmarks(ctx, f, opts)
+			for _, b := range bkms {
+				if b.Folder == nil || b.Folder.Id == 0 {
+					t.Errorf("listed bookmark %q without folder", b.Title)
+				}
+			}
+			return bookmarkTitles(bkms), next, err
+		}
+	}
+	all := list(models.BookmarkFilter{})
+
+	// The titles and URLs are sorted case insensitively, the ties by id.
+	for _, tt := range []struct {
+		sort string
+		desc bool
+		want []string
+	}{
+		{"title", false, []string{"alpha", "Beta", "beta", "Gamma"}},
+		{"title", true, []string{"Gamma", "beta", "Beta", "alpha"}},
+		{"url", false, []string{"Gamma", "Beta", "alpha", "beta"}},
+		{"created", false, []string{"Beta", "beta", "Gamma", "alpha"}},
+		{"created", true, []string{"alpha", "Gamma", "beta", "Beta"}},
+		{"visited", false, []string{"Beta", "alpha", "beta", "Gamma"}},
+		{"visited", true, []string{"Gamma", "beta", "alpha", "Beta"}},
+	} {
+		checkPages(t, models.ListOptions{Sort: tt.sort, Desc: tt.desc}, tt.want, all)
+	}
+	for _, s := range listSorts {
+		checkPages(t, models.ListOptions{Sort: s}, nil, all)
+		checkPages(t, models.ListOptions{Sort: s, Desc: true}, nil, all)
+	}
+
+	// Filters.
+	starred, notStarred := true, false
+	for _, tt := range []struct {
+		filter models.BookmarkFilter
+		want   []string
+	}{
+		{models.BookmarkFilter{FolderId: root.Id}, []string{"Beta", "beta", "Gamma"}},
+		{models.BookmarkFilter{FolderId: fld.Id}, []string{"alpha"}},
+		{models.BookmarkFilter{Starred: &starred}, []string{"alpha"}},
+		{models.BookmarkFilter{Starred: &notStarred}, []string{"Beta", "beta", "Gamma"}},
+		{models.BookmarkFilter{Tag: "GO"}, []string{"alpha"}},
+		{models.BookmarkFilter{FolderId: root.Id, Tag: "go"}, nil},
+	} {
+		checkPages(t, models.ListOptions{Sort: "title"}, tt.want, list(tt.filter))
+	}
+
+	// With their tags.
+	bkms, _, err := ds.ListBookmarks(ctx, models.BookmarkFilter{Tag: "web"}, models.ListOptions{})
+	if err != nil {
+		t.Fatalf("ListBookmarks: %v", err)
+	}
+	if len(bkms) != 1 || !equal(tagNames(bkms[0].Tags), []string{"web"}) {
+		t.Errorf("ListBookmarks(web) = %v, want Gamma with its tag", bkms)
+	}
+
+}
+
+func testListFolders(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	root, err := ds.GetRootFolder(ctx)
+	if err != nil {
+		t.Fatalf("GetRootFolder: %v", err)
+	}
+	saveFolder(ctx, t, ds, "b", nil)
+	a := saveFolder(ctx, t, ds, "A", nil)
+	c := saveFolder(ctx, t, ds, "c", nil)
+	saveFolder(ctx, t, ds, "sub", c)
+	if err = ds.VisitFolder(ctx, a.Id); err != nil {
+		t.Fatalf("VisitFolder(%d): %v", a.Id, err)
+	}
+
+	list := func(id int) func(opts models.ListOptions) ([]string, *models.ListCursor, error) {
+		return func(opts models.ListOptions) ([]string, *models.ListCursor, error) {
+			flds, next, err := ds.ListFolders(ctx, id, opts)
+			return folderTitles(flds), next, err
+		}
+	}
+
+	checkPages(t, models.ListOptions{Sort: "title"}, []string{"A", "b", "c"}, list(root.Id))
+	checkPages(t, models.ListOptions{Sort: "title", Desc: true}, []string{"c", "b", "A"}, list(root.Id))
+	checkPages(t, models.ListOptions{Sort: "id"}, []string{"b", "A", "c"}, list(root.Id))
+	checkPages(t, models.ListOptions{Sort: "visited"}, []string{"b", "c", "A"}, list(root.Id))
+	checkPages(t, models.ListOptions{Sort: "visited", Desc: true}, []string{"A", "c", "b"}, list(root.Id))
+	checkPages(t, models.ListOptions{Sort: "title"}, []string{"sub"}, list(c.Id))
+	for _, s := range listSorts {
+		checkPages(t, models.ListOptions{Sort: s}, nil, list(root.Id))
+		checkPages(t, models.ListOptions{Sort: s, Desc: true}, nil, list(root.Id))
+	}
+
+}
+
+func testListTags(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	for _, name := range []string{"b", "A", "c"} {
+		if _, err := ds.SaveTag(ctx, &types.Tag{Name: name}); err != nil {
+			t.Fatalf("SaveTag(%q): %v", name, err)
+		}
+	}
+
+	list := func(opts models.ListOptions) ([]string, *models.ListCursor, error) {
+		tags, next, err := ds.ListTags(ctx, opts)
+		return tagNames(tags), next, err
+	}
+
+	checkPages(t, models.ListOptions{Sort: "name"}, []string{"A", "b", "c"}, list)
+	checkPages(t, models.ListOptions{Sort: "name", Desc: true}, []string{"c", "b", "A"}, list)
+	checkPages(t, models.ListOptions{Sort: "id"}, []string{"b", "A", "c"}, list)
+	checkPages(t, models.ListOptions{Sort: "id", Desc: true}, []string{"c", "A", "b"}, list)
+
+}
+
+// checkTrash checks the titles of the trashed folders and bookmarks.
+func checkTrash(ctx context.Context, t *testing.T, ds models.Datastore, wantFolders, wantBookmarks []string) *types.Trash {
+
+	t.Helper()
+
+	trash, err := ds.GetTrash(ctx)
+	if err != nil {
+		t.Fatalf("GetTrash: %v", err)
+	}
+	if got := folderTitles(trash.Folders); !equal(got, wantFolders) {
+		t.Errorf("GetTrash folders = %v, want %v", got, wantFolders)
+	}
+	if got := bookmarkTitles(trash.Bookmarks); !equal(got, wantBookmarks) {
+		t.Errorf("GetTrash bookmarks = %v, want %v", got, wantBookmarks)
+	}
+
+	return trash
+
+}
+
+// checkSearch checks the titles of the bookmarks found by the given search.
+func checkSearch(ctx context.Context, t *testing.T, ds models.Datastore, s string, want []string) {
+
+	t.Helper()
+
+	bkms, err := ds.SearchBookmarks(ctx, s)
+	if err != nil {
+		t.Fatalf("SearchBookmarks(%q): %v", s, err)
+	}
+	got := bookmarkTitles(bkms)
+	sort.Strings(got)
+	if !equal(got, want) {
+		t.Errorf("SearchBookmarks(%q) = %v, want %v", s, got, want)
+	}
+
+}
+
+func testTrashBookmark(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	it := saveFolder(ctx, t, ds, "it", nil)
+	dev := saveFolder(ctx, t, ds, "dev", it)
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "first", URL: "https://first.org/", Folder: dev})
+	bkm := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "gopher", URL: "https://gopher.org/", Folder: dev, Starred: true, Tags: []*types.Tag{{Name: "go"}}})
+
+	if err := ds.TrashBookmark(ctx, bkm.Id); err != nil {
+		t.Fatalf("TrashBookmark(%d): %v", bkm.Id, err)
+	}
+	checkChildren(ctx, t, ds, dev.Id, nil, []string{"first"})
+	checkSearch(ctx, t, ds, "gopher", nil)
+	checkSearch(ctx, t, ds, "tag:go", nil)
+	stars, err := ds.GetStars(ctx)
+	if err != nil {
+		t.Fatalf("GetStars: %v", err)
+	}
+	if got := bookmarkTitles(stars); len(got) != 0 {
+		t.Errorf("GetStars = %v, want none", got)
+	}
+
+	trash := checkTrash(ctx, t, ds, nil, []string{"gopher"})
+	if len(trash.Bookmarks) == 1 {
+		b := trash.Bookmarks[0]
+		if b.DeletedAt == nil || !equal(b.TrashPath, []string{"it", "dev"}) || !equal(tagNames(b.Tags), []string{"go"}) {
+			t.Errorf("trashed bookmark = %v %v %v, want a deletion date, [it dev] and [go]", b.DeletedAt, b.TrashPath, tagNames(b.Tags))
+		}
+	}
+	if err = ds.TrashBookmark(ctx, bkm.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("TrashBookmark(%d) twice error = %v, want ErrNotFound", bkm.Id, err)
+	}
+
+	// The restored bookmark is the last one of its folder.
+	if err = ds.RestoreBookmark(ctx, bkm.Id); err != nil {
+		t.Fatalf("RestoreBookmark(%d): %v", bkm.Id, err)
+	}
+	checkTrash(ctx, t, ds, nil, nil)
+	restored, err := ds.GetBookmark(ctx, bkm.Id)
+	if err != nil {
+		t.Fatalf("GetBookmark(%d): %v", bkm.Id, err)
+	}
+	if restored.Folder == nil || restored.Folder.Id != dev.Id || restored.DeletedAt != nil || restored.TrashPath != nil || !restored.Starred {
+		t.Errorf("restored bookmark = %v, want a starred bookmark in %d", restored, dev.Id)
+	}
+	dev.Sort = types.SortManual
+	if err = ds.UpdateFolder(ctx, dev); err != nil {
+		t.Fatalf("UpdateFolder(%d): %v", dev.Id, err)
+	}
+	checkChildren(ctx, t, ds, dev.Id, nil, []string{"first", "gopher"})
+	checkSearch(ctx, t, ds, "tag:go", []string{"gopher"})
+
+	if err = ds.RestoreBookmark(ctx, bkm.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("RestoreBookmark(%d) not in trash error = %v, want ErrNotFound", bkm.Id, err)
+	}
+	if err = ds.TrashBookmark(ctx, 999); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("TrashBookmark(999) error = %v, want ErrNotFound", err)
+	}
+
+}
+
+func testTrashFolder(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	it := saveFolder(ctx, t, ds, "it", nil)
+	dev := saveFolder(ctx, t, ds, "dev", it)
+	sub := saveFolder(ctx, t, ds, "sub", dev)
+	saveBookmark(ctx, t, ds, &types.Bookmark{Title: "gopher", URL: "https://gopher.org/", Folder: sub, Starred: true})
+
+	if err := ds.TrashFolder(ctx, dev.Id); err != nil {
+		t.Fatalf("TrashFolder(%d): %v", dev.Id, err)
+	}
+	checkChildren(ctx, t, ds, it.Id, nil, nil)
+	parent, err := ds.GetFolder(ctx, it.Id)
+	if err != nil {
+		t.Fatalf("GetFolder(%d): %v", it.Id, err)
+	}
+	if parent.NbChildrenFolders != 0 {
+		t.Errorf("parent folder NbChildrenFolders = %d, want 0", parent.NbChildrenFolders)
+	}
+	checkSearch(ctx, t, ds, "gopher", nil)
+	checkSearch(ctx, t, ds, "folder:/it", nil)
+	stars, err := ds.GetStars(ctx)
+	if err != nil {
+		t.Fatalf("GetStars: %v", err)
+	}
+	if got := bookmarkTitles(stars); len(got) != 0 {
+		t.Errorf("GetStars = %v, want none", got)
+	}
+	trash := checkTrash(ctx, t, ds, []string{"dev"}, nil)
+	if len(trash.Folders) == 1 && !equal(trash.Folders[0].TrashPath, []string{"it"}) {
+		t.Errorf("trashed folder path = %v, want [it]", trash.Folders[0].TrashPath)
+	}
+
+	// The trashed folder keeps its content.
+	checkChildren(ctx, t, ds, dev.Id, []string{"sub"}, nil)
+
+	if err = ds.TrashFolder(ctx, 1); !errors.Is(err, models.ErrRootFolder) {
+		t.Errorf("TrashFolder(1) error = %v, want ErrRootFolder", err)
+	}
+
+	if err = ds.RestoreFolder(ctx, dev.Id); err != nil {
+		t.Fatalf("RestoreFolder(%d): %v", dev.Id, err)
+	}
+	checkTrash(ctx, t, ds, nil, nil)
+	checkChildren(ctx, t, ds, it.Id, []string{"dev"}, nil)
+	checkSearch(ctx, t, ds, "folder:/it/dev/sub", []string{"gopher"})
+	if parent, err = ds.GetFolder(ctx, it.Id); err != nil {
+		t.Fatalf("GetFolder(%d): %v", it.Id, err)
+	}
+	if parent.NbChildrenFolders != 1 {
+		t.Errorf("parent folder NbChildrenFolders = %d, want 1", parent.NbChildrenFolders)
+	}
+
+}
+
+func testRestoreMissingParent(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	it := saveFolder(ctx, t, ds, "it", nil)
+	dev := saveFolder(ctx, t, ds, "dev", it)
+	bkm := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "gopher", URL: "https://gopher.org/", Folder: dev})
+	other := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "other", URL: "https://other.org/", Folder: dev})
+
+	// Previous folder in the trash.
+	for _, id := range []int{bkm.Id, other.Id} {
+		if err := ds.TrashBookmark(ctx, id); err != nil {
+			t.Fatalf("TrashBookmark(%d): %v", id, err)
+		}
+	}
+	if err := ds.TrashFolder(ctx, dev.Id); err != nil {
+		t.Fatalf("TrashFolder(%d): %v", dev.Id, err)
+	}
+	if err := ds.RestoreBookmark(ctx, bkm.Id); err != nil {
+		t.Fatalf("RestoreBookmark(%d): %v", bkm.Id, err)
+	}
+	restored, err := ds.GetBookmark(ctx, bkm.Id)
+	if err != nil {
+		t.Fatalf("GetBookmark(%d): %v", bkm.Id, err)
+	}
+	if restored.Folder == nil || restored.Folder.Id == dev.Id || restored.PathString() != "/it/dev" {
+		t.Errorf("restored bookmark folder = %v, want a new /it/dev folder", restored.Folder)
+	}
+	checkTrash(ctx, t, ds, []string{"dev"}, []string{"other"})
+
+	// Previous folders deleted, the new dev folder is reused.
+	if err = ds.DeleteFolder(ctx, it); err != nil {
+		t.Fatalf("DeleteFolder(%d): %v", it.Id, err)
+	}
+	if err = ds.RestoreBookmark(ctx, other.Id); err != nil {
+		t.Fatalf("RestoreBookmark(%d): %v", other.Id, err)
+	}
+	if restored, err = ds.GetBookmark(ctx, other.Id); err != nil {
+		t.Fatalf("GetBookmark(%d): %v", other.Id, err)
+	}
+	if restored.PathString() != "/it/dev" {
+		t.Errorf("restored bookmark path = %q, want /it/dev", restored.PathString())
+	}
+	checkChildren(ctx, t, ds, restored.Folder.Id, nil, []string{"other"})
+	checkSearch(ctx, t, ds, "folder:/it", []string{"other"})
+
+}
+
+func testPurgeTrash(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	fld := saveFolder(ctx, t, ds, "fld", nil)
+	sub := saveFolder(ctx, t, ds, "sub", fld)
+	inFolder := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "in", URL: "https://in.org/", Folder: sub})
+	bkm := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "bkm", URL: "https://bkm.org/"})
+	kept := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "kept", URL: "https://kept.org/"})
+
+	if err := ds.TrashFolder(ctx, fld.Id); err != nil {
+		t.Fatalf("TrashFolder(%d): %v", fld.Id, err)
+	}
+	if err := ds.TrashBookmark(ctx, bkm.Id); err != nil {
+		t.Fatalf("TrashBookmark(%d): %v", bkm.Id, err)
+	}
+
+	// Nothing deleted before the retention.
+	n, err := ds.PurgeTrash(ctx, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("PurgeTrash: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("PurgeTrash an hour ago = %d, want 0", n)
+	}
+	checkTrash(ctx, t, ds, []string{"fld"}, []string{"bkm"})
+
+	if n, err = ds.PurgeTrash(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("PurgeTrash: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("PurgeTrash now = %d, want 2", n)
+	}
+	checkTrash(ctx, t, ds, nil, nil)
+	for _, id := range []int{inFolder.Id, bkm.Id} {
+		if _, err = ds.GetBookmark(ctx, id); !errors.Is(err, models.ErrNotFound) {
+			t.Errorf("GetBookmark(%d) after purge error = %v, want ErrNotFound", id, err)
+		}
+	}
+	if _, err = ds.GetFolder(ctx, sub.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetFolder(%d) after purge error = %v, want ErrNotFound", sub.Id, err)
+	}
+	if _, err = ds.GetBookmark(ctx, kept.Id); err != nil {
+		t.Errorf("GetBookmark(%d) kept: %v", kept.Id, err)
+	}
+
+}
+
+// operations returns the operations of the given revisions.
+func operations(revs []*types.Revision) []string {
+
+	var ops []string
+	for _, rev := range revs {
+		ops = append(ops, rev.Operation)
+	}
+	return ops
+
+}
+
+// checkHistory checks the operations of the revisions of the folder
+// or bookmark with the given kind and id, most recent first.
+func checkHistory(ctx context.Context, t *testing.T, ds models.Datastore, kind string, id int, want []string) []*types.Revision {
+
+	t.Helper()
+
+	revs, err := ds.GetRevisions(ctx, kind, id)
+	if err != nil {
+		t.Fatalf("GetRevisions(%s, %d): %v", kind, id, err)
+	}
+	if got := operations(revs); !equal(got, want) {
+		t.Errorf("GetRevisions(%s, %d) = %v, want %v", kind, id, got, want)
+	}
+
+	return revs
+
+}
+
+// undo undoes the last n revisions and checks the reverted ones.
+func undo(ctx context.Context, t *testing.T, ds models.Datastore, n int, want []*types.Revision) {
+
+	t.Helper()
+
+	revs, err := ds.Undo(ctx, n)
+	if err != nil {
+		t.Fatalf("Undo(%d): %v", n, err)
+	}
+	if len(revs) != len(want) {
+		t.Fatalf("Undo(%d) = %d revisions, want %d", n, len(revs), len(want))
+	}
+	for i, rev := range revs {
+		if rev.Operation != types.OperationUndo || rev.Reverts != want[i].Id || rev.ItemId != want[i].ItemId {
+			t.Errorf("Undo(%d)[%d] = %s of %d reverting %d, want an undo reverting %d", n, i, rev.Operation, rev.ItemId, rev.Reverts, want[i].Id)
+		}
+	}
+
+}
+
+func testHistory(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	fld := saveFolder(ctx, t, ds, "fld", nil)
+	other := saveFolder(ctx, t, ds, "other", nil)
+	bkm := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "gopher", URL: "https://gopher.org/", Folder: fld, Tags: []*types.Tag{{Name: "go"}}})
+
+	bkm.Title = "gopher!"
+	if err := ds.UpdateBookmark(ctx, bkm); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", bkm.Id, err)
+	}
+	bkm.Folder = other
+	if err := ds.UpdateBookmark(ctx, bkm); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", bkm.Id, err)
+	}
+	bkm.Tags = append(bkm.Tags, &types.Tag{Name: "mascot"})
+	if err := ds.UpdateBookmark(ctx, bkm); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", bkm.Id, err)
+	}
+	bkm.Starred = true
+	if err := ds.UpdateBookmark(ctx, bkm); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", bkm.Id, err)
+	}
+	// Neither the unchanged updates, the favicons nor the visits are logged.
+	if err := ds.UpdateBookmark(ctx, bkm); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", bkm.Id, err)
+	}
+	if err := ds.SetBookmarkFavicon(ctx, bkm.Id, "data:image/png;base64,"); err != nil {
+		t.Fatalf("SetBookmarkFavicon(%d): %v", bkm.Id, err)
+	}
+	if err := ds.VisitBookmark(ctx, bkm.Id); err != nil {
+		t.Fatalf("VisitBookmark(%d): %v", bkm.Id, err)
+	}
+	if err := ds.TrashBookmark(ctx, bkm.Id); err != nil {
+		t.Fatalf("TrashBookmark(%d): %v", bkm.Id, err)
+	}
+	if err := ds.RestoreBookmark(ctx, bkm.Id); err != nil {
+		t.Fatalf("RestoreBookmark(%d): %v", bkm.Id, err)
+	}
+
+	revs := checkHistory(ctx, t, ds, types.RevisionBookmark, bkm.Id,
+		[]string{types.OperationRestore, types.OperationDelete, types.OperationStar, types.OperationTag, types.OperationMove, types.OperationUpdate, types.OperationCreate})
+	if len(revs) == 7 {
+		if created := revs[6]; created.Before != nil || created.After == nil || created.ItemId != bkm.Id || created.CreatedAt.IsZero() {
+			t.Errorf("creation revision = %+v, want no before snapshot", created)
+		}
+		if revs[0].Id <= revs[1].Id {
+			t.Errorf("revision ids = %d, %d, want increasing ids", revs[1].Id, revs[0].Id)
+		}
+	}
+
+	fld.Title = "folder"
+	if err := ds.UpdateFolder(ctx, fld); err != nil {
+		t.Fatalf("UpdateFolder(%d): %v", fld.Id, err)
+	}
+	if err := ds.TrashFolder(ctx, fld.Id); err != nil {
+		t.Fatalf("TrashFolder(%d): %v", fld.Id, err)
+	}
+	checkHistory(ctx, t, ds, types.RevisionFolder, fld.Id, []string{types.OperationDelete, types.OperationUpdate, types.OperationCreate})
+	checkHistory(ctx, t, ds, types.RevisionFolder, 999, nil)
+
+}
+
+func testUndo(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	fld := saveFolder(ctx, t, ds, "fld", nil)
+	other := saveFolder(ctx, t, ds, "other", nil)
+	bkm := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "gopher", URL: "https://gopher.org/", Folder: fld, Tags: []*types.Tag{{Name: "go"}}})
+
+	// The go tag is deleted with its last bookmark.
+	bkm.Tags = []*types.Tag{{Name: "mascot"}}
+	if err := ds.UpdateBookmark(ctx, bkm); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", bkm.Id, err)
+	}
+	bkm.Title, bkm.Folder, bkm.Starred = "gopher!", other, true
+	if err := ds.UpdateBookmark(ctx, bkm); err != nil {
+		t.Fatalf("UpdateBookmark(%d): %v", bkm.Id, err)
+	}
+	if err := ds.TrashBookmark(ctx, bkm.Id); err != nil {
+		t.Fatalf("TrashBookmark(%d): %v", bkm.Id, err)
+	}
+	revs := checkHistory(ctx, t, ds, types.RevisionBookmark, bkm.Id,
+		[]string{types.OperationDelete, types.OperationUpdate, types.OperationTag, types.OperationCreate})
+	if len(revs) != 4 {
+		t.FailNow()
+	}
+
+	// Undoing the deletion.
+	undo(ctx, t, ds, 1, revs[:1])
+	checkTrash(ctx, t, ds, nil, nil)
+	checkChildren(ctx, t, ds, other.Id, nil, []string{"gopher!"})
+
+	// Undoing the update and the tags change at once.
+	undo(ctx, t, ds, 2, revs[1:3])
+	got, err := ds.GetBookmark(ctx, bkm.Id)
+	if err != nil {
+		t.Fatalf("GetBookmark(%d): %v", bkm.Id, err)
+	}
+	if got.Title != "gopher" || got.Starred || got.Folder == nil || got.Folder.Id != fld.Id || !equal(tagNames(got.Tags), []string{"go"}) {
+		t.Errorf("undone bookmark = %q starred %v in %v tags %v, want gopher in %d tagged go", got.Title, got.Starred, got.Folder, tagNames(got.Tags), fld.Id)
+	}
+	tags, err := ds.GetTags(ctx)
+	if err != nil {
+		t.Fatalf("GetTags: %v", err)
+	}
+	if got := tagNames(tags); !equal(got, []string{"go"}) {
+		t.Errorf("GetTags = %v, want [go]", got)
+	}
+
+	// Undoing the creations.
+	undo(ctx, t, ds, 1, revs[3:])
+	if _, err = ds.GetBookmark(ctx, bkm.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetBookmark(%d) after undo error = %v, want ErrNotFound", bkm.Id, err)
+	}
+	if tags, err = ds.GetTags(ctx); err != nil || len(tags) != 0 {
+		t.Errorf("GetTags = %v, %v, want none", tagNames(tags), err)
+	}
+	undo(ctx, t, ds, 5, []*types.Revision{{Id: revs[3].Id - 1, ItemId: other.Id}, {Id: revs[3].Id - 2, ItemId: fld.Id}})
+	checkChildren(ctx, t, ds, 1, nil, nil)
+	undo(ctx, t, ds, 1, nil)
+
+	// The undo revisions are logged too.
+	checkHistory(ctx, t, ds, types.RevisionBookmark, bkm.Id,
+		[]string{types.OperationUndo, types.OperationUndo, types.OperationUndo, types.OperationUndo,
+			types.OperationDelete, types.OperationUpdate, types.OperationTag, types.OperationCreate})
+
+}
+
+func testUndoAtomic(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	fld := saveFolder(ctx, t, ds, "fld", nil)
+	bkm := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "gopher", URL: "https://gopher.org/", Folder: fld})
+	if err := ds.TrashBookmark(ctx, bkm.Id); err != nil {
+		t.Fatalf("TrashBookmark(%d): %v", bkm.Id, err)
+	}
+	if _, err := ds.PurgeTrash(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("PurgeTrash: %v", err)
+	}
+	fld.Title = "folder"
+	if err := ds.UpdateFolder(ctx, fld); err != nil {
+		t.Fatalf("UpdateFolder(%d): %v", fld.Id, err)
+	}
+
+	// The purged bookmark deletion can not be undone, nor the folder rename before it.
+	if _, err := ds.Undo(ctx, 2); !errors.Is(err, models.ErrUndo) {
+		t.Errorf("Undo(2) error = %v, want ErrUndo", err)
+	}
+	got, err := ds.GetFolder(ctx, fld.Id)
+	if err != nil {
+		t.Fatalf("GetFolder(%d): %v", fld.Id, err)
+	}
+	if got.Title != "folder" {
+		t.Errorf("folder title = %q, want folder", got.Title)
+	}
+	checkHistory(ctx, t, ds, types.RevisionFolder, fld.Id, []string{types.OperationUpdate, types.OperationCreate})
+
+	// The rename alone can be undone.
+	undo(ctx, t, ds, 1, checkHistory(ctx, t, ds, types.RevisionFolder, fld.Id, []string{types.OperationUpdate, types.OperationCreate})[:1])
+	if got, err = ds.GetFolder(ctx, fld.Id); err != nil || got.Title != "fld" {
+		t.Errorf("GetFolder(%d) = %v, %v, want fld", fld.Id, got, err)
+	}
+
+}
+
+// dataRevision returns the data revision of the given datastore.
+func dataRevision(ctx context.Context, t *testing.T, ds models.Datastore) int64 {
+
+	t.Helper()
+
+	rev, err := ds.GetDataRevision(ctx)
+	if err != nil {
+		t.Fatalf("GetDataRevision: %v", err)
+	}
+	return rev.Revision
+
+}
+
+func testDataRevision(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	fld := saveFolder(ctx, t, ds, "fld", nil)
+	bkm := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "gopher", URL: "https://gopher.org/", Folder: fld})
+	tagID, err := ds.SaveTag(ctx, &types.Tag{Name: "go"})
+	if err != nil {
+		t.Fatalf("SaveTag: %v", err)
+	}
+
+	rev := dataRevision(ctx, t, ds)
+	if rev == 0 {
+		t.Fatalf("data revision = 0 after changes, want > 0")
+	}
+	if r, err := ds.GetDataRevision(ctx); err != nil || r.UpdatedAt.IsZero() {
+		t.Errorf("GetDataRevision = %+v, %v, want an update date", r, err)
+	}
+
+	// Every change increases the revision, the visits do not.
+	for _, c := range []struct {
+		name    string
+		change  func() error
+		changed bool
+	}{
+		{"VisitBookmark", func() error { return ds.VisitBookmark(ctx, bkm.Id) }, false},
+		{"VisitFolder", func() error { return ds.VisitFolder(ctx, fld.Id) }, false},
+		{"SetBookmarkFavicon", func() error { return ds.SetBookmarkFavicon(ctx, bkm.Id, "data:image/png;base64,") }, true},
+		{"UpdateTag", func() error { return ds.UpdateTag(ctx, &types.Tag{Id: int(tagID), Name: "golang"}) }, true},
+		{"DeleteTag", func() error { return ds.DeleteTag(ctx, int(tagID)) }, true},
+		{"ReorderFolderChildren", func() error { return ds.ReorderFolderChildren(ctx, fld.Id, nil, []int{bkm.Id}) }, true},
+		{"TrashBookmark", func() error { return ds.TrashBookmark(ctx, bkm.Id) }, true},
+		{"PurgeTrash", func() error { _, err := ds.PurgeTrash(ctx, time.Now().Add(time.Hour)); return err }, true},
+		{"PurgeEmptyTrash", func() error { _, err := ds.PurgeTrash(ctx, time.Now().Add(time.Hour)); return err }, false},
+		{"DeleteFolder", func() error { return ds.DeleteFolder(ctx, fld) }, true},
+	} {
+		if err := c.change(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		next := dataRevision(ctx, t, ds)
+		if c.changed && next <= rev {
+			t.Errorf("data revision after %s = %d, want > %d", c.name, next, rev)
+		}
+		if !c.changed && next != rev {
+			t.Errorf("data revision after %s = %d, want %d", c.name, next, rev)
+		}
+		rev = next
+	}
+
+	// The revisions of the users are independent.
+	var users []models.Datastore
+	for _, name := range []string{"alice", "bob"} {
+		id, err := ds.SaveUser(ctx, &types.User{Username: name, PasswordHash: "hash"})
+		if err != nil {
+			t.Fatalf("SaveUser(%s): %v", name, err)
+		}
+		users = append(users, ds.ForUser(int(id)))
+	}
+	alice, bob := users[0], users[1]
+	before := dataRevision(ctx, t, alice)
+	saveFolder(ctx, t, bob, "bob", nil)
+	if got := dataRevision(ctx, t, alice); got != before {
+		t.Errorf("alice data revision = %d after a change of bob, want %d", got, before)
+	}
+
+}
+
+func testUsers(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	users, err := ds.GetUsers(ctx)
+	if err != nil {
+		t.Fatalf("GetUsers: %v", err)
+	}
+	if len(users) != 0 {
+		t.Errorf("GetUsers = %d users, want none", len(users))
+	}
+	if has, err := ds.HasUsers(ctx); err != nil || has {
+		t.Errorf("HasUsers = %v, %v, want false", has, err)
+	}
+
+	var ids []int
+	for _, name := range []string{"bob", "alice"} {
+		id, err := ds.SaveUser(ctx, &types.User{Username: name, PasswordHash: "hash-" + name})
+		if err != nil {
+			t.Fatalf("SaveUser(%s): %v", name, err)
+		}
+		ids = append(ids, int(id))
+	}
+	if _, err = ds.SaveUser(ctx, &types.User{Username: "bob", PasswordHash: "other"}); !errors.Is(err, models.ErrUserExists) {
+		t.Errorf("SaveUser(bob) twice error = %v, want ErrUserExists", err)
+	}
+	if has, err := ds.HasUsers(ctx); err != nil || !has {
+		t.Errorf("HasUsers = %v, %v, want true", has, err)
+	}
+
+	if users, err = ds.GetUsers(ctx); err != nil {
+		t.Fatalf("GetUsers: %v", err)
+	}
+	var names []string
+	for _, u := range users {
+		names = append(names, u.Username)
+	}
+	if !equal(names, []string{"alice", "bob"}) {
+		t.Errorf("GetUsers = %v, want [alice bob]", names)
+	}
+
+	bob, err := ds.GetUserByName(ctx, "bob")
+	if err != nil {
+		t.Fatalf("GetUserByName(bob): %v", err)
+	}
+	if bob.Id != ids[0] || bob.PasswordHash != "hash-bob" || bob.CreatedAt.IsZero() {
+		t.Errorf("GetUserByName(bob) = %+v, want id %d and its hash", bob, ids[0])
+	}
+	if err = ds.UpdateUserPassword(ctx, bob.Id, "new-hash"); err != nil {
+		t.Fatalf("UpdateUserPassword(%d): %v", bob.Id, err)
+	}
+	if bob, err = ds.GetUser(ctx, bob.Id); err != nil || bob.PasswordHash != "new-hash" {
+		t.Errorf("GetUser(%d) = %+v, %v, want the new hash", ids[0], bob, err)
+	}
+
+	if err = ds.DeleteUser(ctx, ids[1]); err != nil {
+		t.Fatalf("DeleteUser(%d): %v", ids[1], err)
+	}
+	if _, err = ds.GetUserByName(ctx, "alice"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetUserByName(alice) after delete error = %v, want ErrNotFound", err)
+	}
+	if err = ds.DeleteUser(ctx, ids[1]); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("DeleteUser(%d) twice error = %v, want ErrNotFound", ids[1], err)
+	}
+	if err = ds.UpdateUserPassword(ctx, 999, "hash"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("UpdateUserPassword(999) error = %v, want ErrNotFound", err)
+	}
+
+}
+
+func testSessions(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	id, err := ds.SaveUser(ctx, &types.User{Username: "bob", PasswordHash: "hash"})
+	if err != nil {
+		t.Fatalf("SaveUser(bob): %v", err)
+	}
+	userID := int(id)
+
+	expires := time.Now().Add(time.Hour)
+	for _, s := range []*types.Session{
+		{Id: "live", UserId: userID, CSRFToken: "csrf", ExpiresAt: expires},
+		{Id: "other", UserId: userID, CSRFToken: "csrf2", ExpiresAt: expires},
+		{Id: "expired", UserId: userID, CSRFToken: "csrf3", ExpiresAt: time.Now().Add(-time.Hour)},
+	} {
+		if err = ds.SaveSession(ctx, s); err != nil {
+			t.Fatalf("SaveSession(%s): %v", s.Id, err)
+		}
+	}
+
+	s, err := ds.GetSession(ctx, "live")
+	if err != nil {
+		t.Fatalf("GetSession(live): %v", err)
+	}
+	if s.UserId != userID || s.CSRFToken != "csrf" || !s.ExpiresAt.Round(time.Second).Equal(expires.Round(time.Second)) {
+		t.Errorf("GetSession(live) = %+v, want user %d, csrf and %v", s, userID, expires)
+	}
+	for _, id := range []string{"expired", "none"} {
+		if _, err = ds.GetSession(ctx, id); !errors.Is(err, models.ErrNotFound) {
+			t.Errorf("GetSession(%s) error = %v, want ErrNotFound", id, err)
+		}
+	}
+
+	n, err := ds.PurgeSessions(ctx, time.Now())
+	if err != nil {
+		t.Fatalf("PurgeSessions: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("PurgeSessions = %d, want 1", n)
+	}
+
+	if err = ds.DeleteSession(ctx, "other"); err != nil {
+		t.Fatalf("DeleteSession(other): %v", err)
+	}
+	if _, err = ds.GetSession(ctx, "other"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetSession(other) after delete error = %v, want ErrNotFound", err)
+	}
+
+	// Changing the password closes the sessions.
+	if err = ds.UpdateUserPassword(ctx, userID, "new-hash"); err != nil {
+		t.Fatalf("UpdateUserPassword(%d): %v", userID, err)
+	}
+	if _, err = ds.GetSession(ctx, "live"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetSession(live) after password change error = %v, want ErrNotFound", err)
+	}
+
+}
+
+func testAPITokens(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	var userIDs []int
+	for _, name := range []string{"alice", "bob"} {
+		id, err := ds.SaveUser(ctx, &types.User{Username: name, PasswordHash: "hash"})
+		if err != nil {
+			t.Fatalf("SaveUser(%s): %v", name, err)
+		}
+		userIDs = append(userIDs, int(id))
+	}
+	alice, bob := userIDs[0], userIDs[1]
+
+	for _, tok := range []*types.APIToken{
+		{UserId: alice, Name: "", Hash: "h0", Scope: types.ScopeRead},
+		{UserId: alice, Name: "script", Hash: "h0", Scope: "admin"},
+	} {
+		if _, err := ds.SaveAPIToken(ctx, tok); !errors.Is(err, models.ErrInvalidAPIToken) {
+			t.Errorf("SaveAPIToken(%q, %q) error = %v, want ErrInvalidAPIToken", tok.Name, tok.Scope, err)
+		}
+	}
+
+	expires := time.Now().Add(time.Hour)
+	expired := time.Now().Add(-time.Hour)
+	ids := make(map[string]int)
+	for _, tok := range []*types.APIToken{
+		{UserId: alice, Name: "script", Hash: "h1", Scope: types.ScopeWrite, CreatedAt: time.Now().Add(-2 * time.Hour)},
+		{UserId: alice, Name: "extension", Hash: "h2", Scope: types.ScopeRead, ExpiresAt: &expires, CreatedAt: time.Now().Add(-time.Hour)},
+		{UserId: alice, Name: "old", Hash: "h3", Scope: types.ScopeRead, ExpiresAt: &expired},
+		{UserId: bob, Name: "bob", Hash: "h4", Scope: types.ScopeWrite},
+	} {
+		id, err := ds.SaveAPIToken(ctx, tok)
+		if err != nil {
+			t.Fatalf("SaveAPIToken(%s): %v", tok.Name, err)
+		}
+		ids[tok.Name] = int(id)
+	}
+
+	tok, err := ds.GetAPIToken(ctx, "h2")
+	if err != nil {
+		t.Fatalf("GetAPIToken(h2): %v", err)
+	}
+	if tok.Id != ids["extension"] || tok.UserId != alice || tok.Scope != types.ScopeRead || tok.LastUsedAt != nil ||
+		tok.ExpiresAt == nil || !tok.ExpiresAt.Round(time.Second).Equal(expires.Round(time.Second)) {
+		t.Errorf("GetAPIToken(h2) = %+v, want the extension token of alice expiring at %v", tok, expires)
+	}
+	for _, hash := range []string{"h3", "none"} {
+		if _, err = ds.GetAPIToken(ctx, hash); !errors.Is(err, models.ErrNotFound) {
+			t.Errorf("GetAPIToken(%s) error = %v, want ErrNotFound", hash, err)
+		}
+	}
+
+	used := time.Now()
+	if err = ds.UseAPIToken(ctx, ids["script"], used); err != nil {
+		t.Fatalf("UseAPIToken(%d): %v", ids["script"], err)
+	}
+	if tok, err = ds.GetAPIToken(ctx, "h1"); err != nil {
+		t.Fatalf("GetAPIToken(h1): %v", err)
+	}
+	if tok.LastUsedAt == nil || !tok.LastUsedAt.Round(time.Second).Equal(used.Round(time.Second)) {
+		t.Errorf("GetAPIToken(h1) last used at %v, want %v", tok.LastUsedAt, used)
+	}
+
+	// The expired tokens are listed, most recent first.
+	tokens, err := ds.GetAPITokens(ctx, alice)
+	if err != nil {
+		t.Fatalf("GetAPITokens(%d): %v", alice, err)
+	}
+	var names []string
+	for _, tok := range tokens {
+		names = append(names, tok.Name)
+	}
+	if want := []string{"old", "extension", "script"}; !equal(names, want) {
+		t.Errorf("GetAPITokens(%d) = %v, want %v", alice, names, want)
+	}
+
+	// The tokens of the other users can not be revoked.
+	if err = ds.DeleteAPIToken(ctx, alice, ids["bob"]); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("DeleteAPIToken(alice, bob token) error = %v, want ErrNotFound", err)
+	}
+	if err = ds.DeleteAPIToken(ctx, alice, ids["script"]); err != nil {
+		t.Fatalf("DeleteAPIToken(alice, %d): %v", ids["script"], err)
+	}
+	if _, err = ds.GetAPIToken(ctx, "h1"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetAPIToken(h1) after revocation error = %v, want ErrNotFound", err)
+	}
+
+	// Deleting a user deletes its tokens.
+	if err = ds.DeleteUser(ctx, bob); err != nil {
+		t.Fatalf("DeleteUser(%d): %v", bob, err)
+	}
+	if _, err = ds.GetAPIToken(ctx, "h4"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetAPIToken(h4) after user deletion error = %v, want ErrNotFound", err)
+	}
+
+}
+
+func testUserRootFolders(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	existing := saveFolder(ctx, t, ds, "existing", nil)
+
+	// The first user gets the existing folders.
+	id, err := ds.SaveUser(ctx, &types.User{Username: "alice", PasswordHash: "hash"})
+	if err != nil {
+		t.Fatalf("SaveUser(alice): %v", err)
+	}
+	aliceID := int(id)
+	alice := ds.ForUser(aliceID)
+	root, err := alice.GetRootFolder(ctx)
+	if err != nil || root.Id != 1 {
+		t.Fatalf("alice GetRootFolder = %v, %v, want the folder 1", root, err)
+	}
+	flds, err := alice.GetFolderSubfolders(ctx, root.Id)
+	if err != nil {
+		t.Fatalf("alice GetFolderSubfolders(%d): %v", root.Id, err)
+	}
+	if got, want := folderTitles(flds), []string{"existing"}; !equal(got, want) {
+		t.Errorf("alice GetFolderSubfolders(%d) = %v, want %v", root.Id, got, want)
+	}
+	if _, err = ds.GetFolder(ctx, existing.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetFolder(%d) without user error = %v, want ErrNotFound", existing.Id, err)
+	}
+
+	// The other ones an empty root folder.
+	if id, err = ds.SaveUser(ctx, &types.User{Username: "bob", PasswordHash: "hash"}); err != nil {
+		t.Fatalf("SaveUser(bob): %v", err)
+	}
+	bobID := int(id)
+	bob := ds.ForUser(bobID)
+	bobRoot, err := bob.GetRootFolder(ctx)
+	if err != nil {
+		t.Fatalf("bob GetRootFolder: %v", err)
+	}
+	if bobRoot.Id == root.Id || bobRoot.Title != "/" || !bobRoot.IsRootFolder() {
+		t.Errorf("bob GetRootFolder = %v, want a new / root folder", bobRoot)
+	}
+	if flds, err = bob.GetFolderSubfolders(ctx, bobRoot.Id); err != nil || len(flds) != 0 {
+		t.Errorf("bob GetFolderSubfolders(%d) = %v, %v, want no folders", bobRoot.Id, folderTitles(flds), err)
+	}
+	if err = bob.TrashFolder(ctx, bobRoot.Id); !errors.Is(err, models.ErrRootFolder) {
+		t.Errorf("bob TrashFolder(%d) error = %v, want ErrRootFolder", bobRoot.Id, err)
+	}
+
+	// The folders are saved in the root folder of their user.
+	fld := saveFolder(ctx, t, bob, "mine", nil)
+	if fld.Parent == nil || fld.Parent.Id != bobRoot.Id {
+		t.Errorf("bob SaveFolder parent = %v, want %d", fld.Parent, bobRoot.Id)
+	}
+
+	// The users are deleted with their folders, the last one
+	// giving back a root folder for the use without authentication.
+	for _, id := range []int{aliceID, bobID} {
+		if err = ds.DeleteUser(ctx, id); err != nil {
+			t.Fatalf("DeleteUser(%d): %v", id, err)
+		}
+	}
+	if _, err = bob.GetFolder(ctx, fld.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetFolder(%d) after DeleteUser error = %v, want ErrNotFound", fld.Id, err)
+	}
+	if root, err = ds.GetRootFolder(ctx); err != nil {
+		t.Fatalf("GetRootFolder after DeleteUser: %v", err)
+	}
+	if flds, err = ds.GetFolderSubfolders(ctx, root.Id); err != nil || len(flds) != 0 {
+		t.Errorf("GetFolderSubfolders(%d) after DeleteUser = %v, %v, want no folders", root.Id, folderTitles(flds), err)
+	}
+
+}
+
+func testUserIsolation(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	var users []models.Datastore
+	for _, name := range []string{"alice", "bob"} {
+		id, err := ds.SaveUser(ctx, &types.User{Username: name, PasswordHash: "hash"})
+		if err != nil {
+			t.Fatalf("SaveUser(%s): %v", name, err)
+		}
+		users = append(users, ds.ForUser(int(id)))
+	}
+	alice, bob := users[0], users[1]
+
+	aliceRoot, err := alice.GetRootFolder(ctx)
+	if err != nil {
+		t.Fatalf("alice GetRootFolder: %v", err)
+	}
+	bobRoot, err := bob.GetRootFolder(ctx)
+	if err != nil {
+		t.Fatalf("bob GetRootFolder: %v", err)
+	}
+	private := saveFolder(ctx, t, alice, "private", nil)
+	secret := saveBookmark(ctx, t, alice, &types.Bookmark{Title: "secret", URL: "https://secret.example.com/", Starred: true,
+		Folder: private, Tags: []*types.Tag{{Name: "confidential"}}})
+	tag := secret.Tags[0]
+
+	// Bob can not read the alice folders, bookmarks and tags.
+	if _, err = bob.GetFolder(ctx, private.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob GetFolder(%d) error = %v, want ErrNotFound", private.Id, err)
+	}
+	if _, err = bob.GetBookmark(ctx, secret.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob GetBookmark(%d) error = %v, want ErrNotFound", secret.Id, err)
+	}
+	if _, err = bob.GetTag(ctx, tag.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob GetTag(%d) error = %v, want ErrNotFound", tag.Id, err)
+	}
+	if flds, err := bob.GetFolderSubfolders(ctx, aliceRoot.Id); err != nil || len(flds) != 0 {
+		t.Errorf("bob GetFolderSubfolders(%d) = %v, %v, want no folders", aliceRoot.Id, folderTitles(flds), err)
+	}
+	if bkms, err := bob.GetFolderBookmarks(ctx, private.Id); err != nil || len(bkms) != 0 {
+		t.Errorf("bob GetFolderBookmarks(%d) = %v, %v, want no bookmarks", private.Id, bookmarkTitles(bkms), err)
+	}
+	if tags, err := bob.GetBookmarkTags(ctx, secret.Id); err != nil || len(tags) != 0 {
+		t.Errorf("bob GetBookmarkTags(%d) = %v, %v, want no tags", secret.Id, tagNames(tags), err)
+	}
+	if tags, err := bob.GetTags(ctx); err != nil || len(tags) != 0 {
+		t.Errorf("bob GetTags = %v, %v, want no tags", tagNames(tags), err)
+	}
+	if stars, err := bob.GetStars(ctx); err != nil || len(stars) != 0 {
+		t.Errorf("bob GetStars = %v, %v, want no bookmarks", bookmarkTitles(stars), err)
+	}
+	for _, q := range []string{"secret", "tag:confidential", "folder:/private", "starred:true"} {
+		if bkms, err := bob.SearchBookmarks(ctx, q); err != nil || len(bkms) != 0 {
+			t.Errorf("bob SearchBookmarks(%q) = %v, %v, want no bookmarks", q, bookmarkTitles(bkms), err)
+		}
+	}
+	if revs, err := bob.GetRevisions(ctx, types.RevisionBookmark, secret.Id); err != nil || len(revs) != 0 {
+		t.Errorf("bob GetRevisions(%d) = %d revisions, %v, want none", secret.Id, len(revs), err)
+	}
+
+	// Nor change them.
+	for name, err := range map[string]error{
+		"UpdateBookmark":        bob.UpdateBookmark(ctx, &types.Bookmark{Id: secret.Id, Title: "hacked", URL: "https://evil.example.com/", Folder: bobRoot}),
+		"UpdateFolder":          bob.UpdateFolder(ctx, &types.Folder{Id: private.Id, Title: "hacked", Parent: bobRoot}),
+		"VisitBookmark":         bob.VisitBookmark(ctx, secret.Id),
+		"VisitFolder":           bob.VisitFolder(ctx, private.Id),
+		"SetBookmarkFavicon":    bob.SetBookmarkFavicon(ctx, secret.Id, "data:,"),
+		"ReorderFolderChildren": bob.ReorderFolderChildren(ctx, private.Id, nil, []int{secret.Id}),
+		"TrashBookmark":         bob.TrashBookmark(ctx, secret.Id),
+		"TrashFolder":           bob.TrashFolder(ctx, private.Id),
+	} {
+		if !errors.Is(err, models.ErrNotFound) {
+			t.Errorf("bob %s error = %v, want ErrNotFound", name, err)
+		}
+	}
+	if _, err = bob.SaveFolder(ctx, &types.Folder{Title: "intruder", Parent: private}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob SaveFolder in %d error = %v, want ErrNotFound", private.Id, err)
+	}
+	if _, err = bob.SaveBookmark(ctx, &types.Bookmark{Title: "intruder", URL: "https://evil.example.com/", Folder: private}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob SaveBookmark in %d error = %v, want ErrNotFound", private.Id, err)
+	}
+	for _, err = range []error{
+		bob.DeleteBookmark(ctx, secret),
+		bob.DeleteFolder(ctx, private),
+	} {
+		if err != nil {
+			t.Errorf("bob delete error = %v", err)
+		}
+	}
+
+	// A tag of another user given by id is a new tag.
+	mine := saveBookmark(ctx, t, bob, &types.Bookmark{Title: "mine", URL: "https://bob.example.com/", Tags: []*types.Tag{tag}})
+	if len(mine.Tags) != 1 || mine.Tags[0].Id == tag.Id || mine.Tags[0].Name != tag.Name {
+		t.Errorf("bob SaveBookmark tags = %v, want a new %s tag", mine.Tags, tag.Name)
+	}
+
+	// The trash and undo are per user.
+	if err = alice.TrashBookmark(ctx, secret.Id); err != nil {
+		t.Fatalf("alice TrashBookmark(%d): %v", secret.Id, err)
+	}
+	if trash, err := bob.GetTrash(ctx); err != nil || len(trash.Bookmarks)+len(trash.Folders) != 0 {
+		t.Errorf("bob GetTrash = %v, %v, want an empty trash", trash, err)
+	}
+	if err = bob.RestoreBookmark(ctx, secret.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob RestoreBookmark(%d) error = %v, want ErrNotFound", secret.Id, err)
+	}
+	if n, err := bob.PurgeTrash(ctx, time.Now().Add(time.Hour)); err != nil || n != 0 {
+		t.Errorf("bob PurgeTrash = %d, %v, want 0", n, err)
+	}
+	undone, err := bob.Undo(ctx, 10)
+	if err != nil {
+		t.Fatalf("bob Undo: %v", err)
+	}
+	if len(undone) != 1 || undone[0].ItemId != mine.Id {
+		t.Errorf("bob Undo = %d revisions, want the creation of %d", len(undone), mine.Id)
+	}
+	if err = alice.RestoreBookmark(ctx, secret.Id); err != nil {
+		t.Fatalf("alice RestoreBookmark(%d): %v", secret.Id, err)
+	}
+
+	// The alice bookmark is unchanged.
+	got, err := alice.GetBookmark(ctx, secret.Id)
+	if err != nil {
+		t.Fatalf("alice GetBookmark(%d): %v", secret.Id, err)
+	}
+	if got.Title != "secret" || got.Folder == nil || got.Folder.Id != private.Id || got.Favicon != "" || got.LastVisitedAt != nil {
+		t.Errorf("alice GetBookmark(%d) = %+v, want it unchanged", secret.Id, got)
+	}
+	if got, want := tagNames(got.Tags), []string{"confidential"}; !equal(got, want) {
+		t.Errorf("alice GetBookmark(%d) tags = %v, want %v", secret.Id, got, want)
+	}
+	if fld, err := alice.GetFolder(ctx, private.Id); err != nil || fld.Title != "private" || fld.Parent == nil || fld.Parent.Id != aliceRoot.Id {
+		t.Errorf("alice GetFolder(%d) = %v, %v, want it unchanged", private.Id, fld, err)
+	}
+
+}
+
+// checkAccess checks the owner and role returned by a GetFolderAccess or
+// GetBookmarkAccess call, an empty role meaning ErrNotFound.
+func checkAccess(t *testing.T, call string, owner int, role string, err error, wantOwner int, wantRole string) {
+
+	t.Helper()
+
+	switch {
+	case wantRole == "" && !errors.Is(err, models.ErrNotFound):
+		t.Errorf("%s = %d, %q, %v, want ErrNotFound", call, owner, role, err)
+	case wantRole != "" && (err != nil || owner != wantOwner || role != wantRole):
+		t.Errorf("%s = %d, %q, %v, want %d, %q", call, owner, role, err, wantOwner, wantRole)
+	}
+
+}
+
+func testSharedFolders(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	var ids []int
+	for _, name := range []string{"alice", "bob", "carol"} {
+		id, err := ds.SaveUser(ctx, &types.User{Username: name, PasswordHash: "hash"})
+		if err != nil {
+			t.Fatalf("SaveUser(%s): %v", name, err)
+		}
+		ids = append(ids, int(id))
+	}
+	aliceID, bobID, carolID := ids[0], ids[1], ids[2]
+	alice, bob, carol := ds.ForUser(aliceID), ds.ForUser(bobID), ds.ForUser(carolID)
+
+	it := saveFolder(ctx, t, alice, "IT", nil)
+	dev := saveFolder(ctx, t, alice, "Development", it)
+	perso := saveFolder(ctx, t, alice, "Perso", nil)
+	bkm := saveBookmark(ctx, t, alice, &types.Bookmark{Title: "GoLang", URL: "https://golang.org/", Folder: dev})
+
+	owner, role, err := bob.GetFolderAccess(ctx, dev.Id)
+	checkAccess(t, "bob GetFolderAccess(Development) before sharing", owner, role, err, 0, "")
+
+	// Sharing IT with bob, Development being shared too.
+	if err = alice.ShareFolder(ctx, it.Id, bobID, types.RoleEditor); err != nil {
+		t.Fatalf("alice ShareFolder(IT, bob): %v", err)
+	}
+	if err = alice.ShareFolder(ctx, dev.Id, bobID, types.RoleViewer); err != nil {
+		t.Fatalf("alice ShareFolder(Development, bob): %v", err)
+	}
+	owner, role, err = alice.GetFolderAccess(ctx, dev.Id)
+	checkAccess(t, "alice GetFolderAccess(Development)", owner, role, err, aliceID, types.RoleOwner)
+	owner, role, err = bob.GetFolderAccess(ctx, dev.Id)
+	checkAccess(t, "bob GetFolderAccess(Development)", owner, role, err, aliceID, types.RoleEditor)
+	owner, role, err = bob.GetBookmarkAccess(ctx, bkm.Id)
+	checkAccess(t, "bob GetBookmarkAccess(GoLang)", owner, role, err, aliceID, types.RoleEditor)
+	owner, role, err = bob.GetFolderAccess(ctx, perso.Id)
+	checkAccess(t, "bob GetFolderAccess(Perso)", owner, role, err, 0, "")
+	owner, role, err = carol.GetBookmarkAccess(ctx, bkm.Id)
+	checkAccess(t, "carol GetBookmarkAccess(GoLang)", owner, role, err, 0, "")
+
+	// The grants do not change the datastores scope.
+	if _, err = bob.GetFolder(ctx, dev.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob GetFolder(Development) error = %v, want ErrNotFound", err)
+	}
+
+	// Bob sees IT only, Development being in it.
+	shared, err := bob.GetSharedFolders(ctx)
+	if err != nil {
+		t.Fatalf("bob GetSharedFolders: %v", err)
+	}
+	if len(shared) != 1 || shared[0].Id != it.Id || shared[0].Role != types.RoleEditor || shared[0].Owner != "alice" || shared[0].Parent != nil {
+		t.Errorf("bob GetSharedFolders = %+v, want IT of alice as editor", shared)
+	}
+	if shared, err = carol.GetSharedFolders(ctx); err != nil || len(shared) != 0 {
+		t.Errorf("carol GetSharedFolders = %v, %v, want none", shared, err)
+	}
+
+	// The shared folders are flagged.
+	root, err := alice.GetRootFolder(ctx)
+	if err != nil {
+		t.Fatalf("alice GetRootFolder: %v", err)
+	}
+	flds, err := alice.GetFolderSubfolders(ctx, root.Id)
+	if err != nil {
+		t.Fatalf("alice GetFolderSubfolders(root): %v", err)
+	}
+	for _, f := range flds {
+		if want := f.Id == it.Id; f.Shared != want {
+			t.Errorf("alice folder %s shared = %v, want %v", f.Title, f.Shared, want)
+		}
+	}
+
+	grants, err := alice.GetFolderGrants(ctx, it.Id)
+	if err != nil {
+		t.Fatalf("alice GetFolderGrants(IT): %v", err)
+	}
+	if len(grants) != 1 || grants[0].UserId != bobID || grants[0].Username != "bob" || grants[0].Role != types.RoleEditor {
+		t.Errorf("alice GetFolderGrants(IT) = %+v, want bob as editor", grants)
+	}
+
+	// Invalid grants.
+	if err = alice.ShareFolder(ctx, it.Id, carolID, "admin"); !errors.Is(err, models.ErrInvalidGrant) {
+		t.Errorf("ShareFolder(admin role) error = %v, want ErrInvalidGrant", err)
+	}
+	if err = alice.ShareFolder(ctx, it.Id, aliceID, types.RoleViewer); !errors.Is(err, models.ErrInvalidGrant) {
+		t.Errorf("ShareFolder(alice) error = %v, want ErrInvalidGrant", err)
+	}
+	if err = alice.ShareFolder(ctx, it.Id, 1000, types.RoleViewer); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("ShareFolder(unknown user) error = %v, want ErrNotFound", err)
+	}
+	if err = bob.ShareFolder(ctx, it.Id, carolID, types.RoleViewer); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob ShareFolder(IT) error = %v, want ErrNotFound", err)
+	}
+	if _, err = bob.GetFolderGrants(ctx, it.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob GetFolderGrants(IT) error = %v, want ErrNotFound", err)
+	}
+
+	// The trashed folders are not shared anymore.
+	if err = alice.TrashFolder(ctx, it.Id); err != nil {
+		t.Fatalf("alice TrashFolder(IT): %v", err)
+	}
+	owner, role, err = bob.GetFolderAccess(ctx, dev.Id)
+	checkAccess(t, "bob GetFolderAccess(Development) in the trash", owner, role, err, 0, "")
+	if shared, err = bob.GetSharedFolders(ctx); err != nil || len(shared) != 0 {
+		t.Errorf("bob GetSharedFolders with IT in the trash = %v, %v, want none", shared, err)
+	}
+	if err = alice.RestoreFolder(ctx, it.Id); err != nil {
+		t.Fatalf("alice RestoreFolder(IT): %v", err)
+	}
+
+	// Unsharing IT, Development is still shared.
+	if err = alice.UnshareFolder(ctx, it.Id, bobID); err != nil {
+		t.Fatalf("alice UnshareFolder(IT, bob): %v", err)
+	}
+	if err = alice.UnshareFolder(ctx, it.Id, bobID); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("alice UnshareFolder(IT, bob) twice error = %v, want ErrNotFound", err)
+	}
+	owner, role, err = bob.GetFolderAccess(ctx, dev.Id)
+	checkAccess(t, "bob GetFolderAccess(Development) after unsharing IT", owner, role, err, aliceID, types.RoleViewer)
+	owner, role, err = bob.GetFolderAccess(ctx, it.Id)
+	checkAccess(t, "bob GetFolderAccess(IT) after unsharing IT", owner, role, err, 0, "")
+	if shared, err = bob.GetSharedFolders(ctx); err != nil || len(shared) != 1 || shared[0].Id != dev.Id || shared[0].Role != types.RoleViewer {
+		t.Errorf("bob GetSharedFolders after unsharing IT = %+v, %v, want Development as viewer", shared, err)
+	}
+
+	// Deleting bob deletes his grants.
+	if err = ds.DeleteUser(ctx, bobID); err != nil {
+		t.Fatalf("DeleteUser(bob): %v", err)
+	}
+	if grants, err = alice.GetFolderGrants(ctx, dev.Id); err != nil || len(grants) != 0 {
+		t.Errorf("alice GetFolderGrants(Development) after deleting bob = %+v, %v, want none", grants, err)
+	}
+
+}
+
+func testShareLinks(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	var ids []int
+	for _, name := range []string{"alice", "bob"} {
+		id, err := ds.SaveUser(ctx, &types.User{Username: name, PasswordHash: "hash"})
+		if err != nil {
+			t.Fatalf("SaveUser(%s): %v", name, err)
+		}
+		ids = append(ids, int(id))
+	}
+	aliceID, bobID := ids[0], ids[1]
+	alice, bob := ds.ForUser(aliceID), ds.ForUser(bobID)
+
+	it := saveFolder(ctx, t, alice, "IT", nil)
+	dev := saveFolder(ctx, t, alice, "Development", it)
+
+	// The folders of the other users can not be shared.
+	if _, err := bob.SaveShareLink(ctx, &types.ShareLink{FolderId: it.Id, Hash: "h0"}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob SaveShareLink(IT) error = %v, want ErrNotFound", err)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	expired := time.Now().Add(-time.Hour)
+	links := make(map[string]int)
+	for _, l := range []*types.ShareLink{
+		{FolderId: it.Id, Hash: "h1", CreatedAt: time.Now().Add(-2 * time.Hour)},
+		{FolderId: it.Id, Hash: "h2", PasswordHash: "hash", ExpiresAt: &expires, CreatedAt: time.Now().Add(-time.Hour)},
+		{FolderId: it.Id, Hash: "h3", ExpiresAt: &expired},
+		{FolderId: dev.Id, Hash: "h4"},
+	} {
+		id, err := alice.SaveShareLink(ctx, l)
+		if err != nil {
+			t.Fatalf("alice SaveShareLink(%s): %v", l.Hash, err)
+		}
+		links[l.Hash] = int(id)
+	}
+
+	// The share links are found with any datastore.
+	l, err := bob.GetShareLink(ctx, "h2")
+	if err != nil {
+		t.Fatalf("bob GetShareLink(h2): %v", err)
+	}
+	if l.Id != links["h2"] || l.FolderId != it.Id || l.OwnerId != aliceID || !l.Protected || l.PasswordHash != "hash" ||
+		l.ExpiresAt == nil || !l.ExpiresAt.Round(time.Second).Equal(expires.Round(time.Second)) {
+		t.Errorf("bob GetShareLink(h2) = %+v, want the protected link of IT of alice expiring at %v", l, expires)
+	}
+	if l, err = ds.GetShareLink(ctx, "h1"); err != nil || l.Protected {
+		t.Errorf("GetShareLink(h1) = %+v, %v, want a link without password", l, err)
+	}
+	for _, hash := range []string{"h3", "none"} {
+		if _, err = ds.GetShareLink(ctx, hash); !errors.Is(err, models.ErrNotFound) {
+			t.Errorf("GetShareLink(%s) error = %v, want ErrNotFound", hash, err)
+		}
+	}
+
+	// The expired links are listed, most recent first.
+	list, err := alice.GetShareLinks(ctx, it.Id)
+	if err != nil {
+		t.Fatalf("alice GetShareLinks(IT): %v", err)
+	}
+	var got []string
+	for _, l := range list {
+		got = append(got, l.Hash)
+	}
+	if want := []string{"h3", "h2", "h1"}; !equal(got, want) {
+		t.Errorf("alice GetShareLinks(IT) = %v, want %v", got, want)
+	}
+	if _, err = bob.GetShareLinks(ctx, it.Id); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob GetShareLinks(IT) error = %v, want ErrNotFound", err)
+	}
+
+	// The links of the other users can not be revoked.
+	if err = bob.DeleteShareLink(ctx, links["h1"]); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob DeleteShareLink(h1) error = %v, want ErrNotFound", err)
+	}
+	if err = alice.DeleteShareLink(ctx, links["h1"]); err != nil {
+		t.Fatalf("alice DeleteShareLink(h1): %v", err)
+	}
+	if _, err = ds.GetShareLink(ctx, "h1"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetShareLink(h1) after revocation error = %v, want ErrNotFound", err)
+	}
+
+	// The links of the folders in the trash are not found until restored.
+	if err = alice.TrashFolder(ctx, it.Id); err != nil {
+		t.Fatalf("alice TrashFolder(IT): %v", err)
+	}
+	for _, hash := range []string{"h2", "h4"} {
+		if _, err = ds.GetShareLink(ctx, hash); !errors.Is(err, models.ErrNotFound) {
+			t.Errorf("GetShareLink(%s) of a trashed folder error = %v, want ErrNotFound", hash, err)
+		}
+	}
+	if _, err = alice.SaveShareLink(ctx, &types.ShareLink{FolderId: dev.Id, Hash: "h5"}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("alice SaveShareLink(Development) in the trash error = %v, want ErrNotFound", err)
+	}
+	if err = alice.RestoreFolder(ctx, it.Id); err != nil {
+		t.Fatalf("alice RestoreFolder(IT): %v", err)
+	}
+	if _, err = ds.GetShareLink(ctx, "h4"); err != nil {
+		t.Errorf("GetShareLink(h4) after restoration: %v", err)
+	}
+
+	// Deleting a folder deletes its links.
+	if err = alice.DeleteFolder(ctx, dev); err != nil {
+		t.Fatalf("alice DeleteFolder(Development): %v", err)
+	}
+	if _, err = ds.GetShareLink(ctx, "h4"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetShareLink(h4) after folder deletion error = %v, want ErrNotFound", err)
+	}
+
+}
+
+func testWebhooks(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	var ids []int
+	for _, name := range []string{"alice", "bob"} {
+		id, err := ds.SaveUser(ctx, &types.User{Username: name, PasswordHash: "hash"})
+		if err != nil {
+			t.Fatalf("SaveUser(%s): %v", name, err)
+		}
+		ids = append(ids, int(id))
+	}
+	alice, bob := ds.ForUser(ids[0]), ds.ForUser(ids[1])
+
+	for _, w := range []*types.Webhook{
+		{URL: "ftp://example.com/hook", Secret: "s"},
+		{URL: "https://example.com/hook"},
+		{URL: "https://example.com/hook", Secret: "s", Events: []string{"bookmark.visit"}},
+		{URL: "https://example.com/hook", Secret: "s", Events: []string{"share"}},
+	} {
+		if _, err := alice.SaveWebhook(ctx, w); !errors.Is(err, models.ErrInvalidWebhook) {
+			t.Errorf("SaveWebhook(%+v) error = %v, want ErrInvalidWebhook", w, err)
+		}
+	}
+
+	id, err := alice.SaveWebhook(ctx, &types.Webhook{URL: "https://example.com/hook", Secret: "s1", Events: []string{"bookmark.create", "folder"}})
+	if err != nil {
+		t.Fatalf("alice SaveWebhook: %v", err)
+	}
+	if _, err = alice.SaveWebhook(ctx, &types.Webhook{URL: "http://localhost:8080/all", Secret: "s2"}); err != nil {
+		t.Fatalf("alice SaveWebhook(all): %v", err)
+	}
+	w, err := alice.GetWebhook(ctx, int(id))
+	if err != nil {
+		t.Fatalf("alice GetWebhook: %v", err)
+	}
+	if w.URL != "https://example.com/hook" || w.Secret != "s1" || !equal(w.Events, []string{"bookmark.create", "folder"}) || w.CreatedAt.IsZero() {
+		t.Errorf("alice GetWebhook = %+v, want the saved webhook", w)
+	}
+	for eventType, want := range map[string]bool{"bookmark.create": true, "bookmark.update": false, "folder.move": true, "tag.create": false} {
+		if got := w.Matches(eventType); got != want {
+			t.Errorf("Matches(%s) = %v, want %v", eventType, got, want)
+		}
+	}
+
+	list, err := alice.GetWebhooks(ctx)
+	if err != nil {
+		t.Fatalf("alice GetWebhooks: %v", err)
+	}
+	if len(list) != 2 || list[0].Id != int(id) || len(list[1].Events) != 0 || list[1].Events == nil {
+		t.Errorf("alice GetWebhooks = %+v, want the 2 webhooks, oldest first", list)
+	}
+
+	// The webhooks of the other users are hidden.
+	if list, err = bob.GetWebhooks(ctx); err != nil || len(list) != 0 {
+		t.Errorf("bob GetWebhooks = %v, %v, want none", list, err)
+	}
+	if _, err = bob.GetWebhook(ctx, int(id)); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob GetWebhook error = %v, want ErrNotFound", err)
+	}
+	if _, err = bob.SaveWebhookDelivery(ctx, &types.WebhookDelivery{WebhookId: int(id), EventType: "bookmark.create", Attempt: 1}); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob SaveWebhookDelivery error = %v, want ErrNotFound", err)
+	}
+	if _, err = bob.GetWebhookDeliveries(ctx, int(id)); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob GetWebhookDeliveries error = %v, want ErrNotFound", err)
+	}
+	if err = bob.DeleteWebhook(ctx, int(id)); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("bob DeleteWebhook error = %v, want ErrNotFound", err)
+	}
+
+	// The last deliveries are kept, most recent first.
+	n := models.WebhookDeliveriesKept + 2
+	for i := 1; i <= n; i++ {
+		d := &types.WebhookDelivery{WebhookId: int(id), EventId: int64(i), EventType: "bookmark.create", Attempt: 1, StatusCode: 500, Error: "HTTP 500"}
+		if i == n {
+			d.Attempt, d.StatusCode, d.Error = 2, 204, ""
+		}
+		if _, err = alice.SaveWebhookDelivery(ctx, d); err != nil {
+			t.Fatalf("alice SaveWebhookDelivery(%d): %v", i, err)
+		}
+	}
+	deliveries, err := alice.GetWebhookDeliveries(ctx, int(id))
+	if err != nil {
+		t.Fatalf("alice GetWebhookDeliveries: %v", err)
+	}
+	if len(deliveries) != models.WebhookDeliveriesKept {
+		t.Fatalf("alice GetWebhookDeliveries = %d deliveries, want %d", len(deliveries), models.WebhookDeliveriesKept)
+	}
+	if d := deliveries[0]; d.EventId != int64(n) || d.Attempt != 2 || d.StatusCode != 204 || d.Error != "" || d.EventType != "bookmark.create" || d.CreatedAt.IsZero() {
+		t.Errorf("last delivery = %+v, want the successful second attempt of event %d", d, n)
+	}
+	if d := deliveries[len(deliveries)-1]; d.EventId != 3 || d.StatusCode != 500 || d.Error != "HTTP 500" {
+		t.Errorf("oldest delivery = %+v, want the failed attempt of event 3", d)
+	}
+
+	if err = alice.DeleteWebhook(ctx, int(id)); err != nil {
+		t.Fatalf("alice DeleteWebhook: %v", err)
+	}
+	if _, err = alice.GetWebhookDeliveries(ctx, int(id)); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("GetWebhookDeliveries after deletion error = %v, want ErrNotFound", err)
+	}
+
+	// The webhooks are deleted with their user.
+	if err = ds.DeleteUser(ctx, ids[0]); err != nil {
+		t.Fatalf("DeleteUser(alice): %v", err)
+	}
+	if list, err = alice.GetWebhooks(ctx); err != nil || len(list) != 0 {
+		t.Errorf("GetWebhooks after DeleteUser = %v, %v, want none", list, err)
+	}
+
+}
+
+func testBatch(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	a := saveFolder(ctx, t, ds, "a", nil)
+	b := saveFolder(ctx, t, ds, "b", nil)
+	b1 := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "b1", URL: "https://b1.org/", Folder: a, Tags: []*types.Tag{{Name: "x"}}})
+	b2 := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "b2", URL: "https://b2.org/", Folder: a})
+
+	var berr *models.BatchError
+	for _, op := range []*types.BatchOperation{
+		{Op: "rename", BookmarkId: b1.Id},
+		{Op: types.BatchMove, BookmarkId: b1.Id},
+		{Op: types.BatchTag, BookmarkId: b1.Id, Tags: []string{" "}},
+	} {
+		if err := ds.Batch(ctx, []*types.BatchOperation{op}); !errors.As(err, &berr) || berr.Index != 0 || !errors.Is(err, models.ErrInvalidBatch) {
+			t.Errorf("Batch(%+v) error = %v, want a BatchError 0 ErrInvalidBatch", op, err)
+		}
+	}
+
+	if err := ds.Batch(ctx, []*types.BatchOperation{
+		{Op: types.BatchMove, BookmarkId: b1.Id, FolderId: b.Id},
+		{Op: types.BatchTag, BookmarkId: b1.Id, Tags: []string{"y", "x"}},
+		{Op: types.BatchUntag, BookmarkId: b1.Id, Tags: []string{"x"}},
+		{Op: types.BatchStar, BookmarkId: b1.Id},
+		{Op: types.BatchTag, BookmarkId: b2.Id, Tags: []string{"y"}},
+		{Op: types.BatchDelete, BookmarkId: b2.Id},
+	}); err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+	got, err := ds.GetBookmark(ctx, b1.Id)
+	if err != nil {
+		t.Fatalf("GetBookmark(%d): %v", b1.Id, err)
+	}
+	if got.Folder == nil || got.Folder.Id != b.Id || !got.Starred || !equal(tagNames(got.Tags), []string{"y"}) {
+		t.Errorf("GetBookmark(%d) = folder %v starred %v tags %v, want b, starred, [y]", b1.Id, got.Folder, got.Starred, tagNames(got.Tags))
+	}
+	checkTrash(ctx, t, ds, nil, []string{"b2"})
+	tags, err := ds.GetTags(ctx)
+	if err != nil {
+		t.Fatalf("GetTags: %v", err)
+	}
+	if got, want := tagNames(tags), []string{"y"}; !equal(got, want) {
+		t.Errorf("GetTags = %v, want %v", got, want)
+	}
+
+	// A failed operation rolls back the previous ones.
+	rev := dataRevision(ctx, t, ds)
+	revs := checkHistory(ctx, t, ds, types.RevisionBookmark, b1.Id, []string{types.OperationStar, types.OperationTag, types.OperationTag, types.OperationMove, types.OperationCreate})
+	err = ds.Batch(ctx, []*types.BatchOperation{
+		{Op: types.BatchUnstar, BookmarkId: b1.Id},
+		{Op: types.BatchTag, BookmarkId: b1.Id, Tags: []string{"z"}},
+		{Op: types.BatchMove, BookmarkId: b1.Id, FolderId: a.Id},
+		{Op: types.BatchStar, BookmarkId: b2.Id},
+	})
+	if !errors.As(err, &berr) || berr.Index != 3 || !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("Batch(trashed) error = %v, want a BatchError 3 ErrNotFound", err)
+	}
+	if got, err = ds.GetBookmark(ctx, b1.Id); err != nil {
+		t.Fatalf("GetBookmark(%d): %v", b1.Id, err)
+	}
+	if got.Folder == nil || got.Folder.Id != b.Id || !got.Starred || !equal(tagNames(got.Tags), []string{"y"}) {
+		t.Errorf("GetBookmark(%d) = folder %v starred %v tags %v after a failed batch, want b, starred, [y]", b1.Id, got.Folder, got.Starred, tagNames(got.Tags))
+	}
+	if tags, err = ds.GetTags(ctx); err != nil || !equal(tagNames(tags), []string{"y"}) {
+		t.Errorf("GetTags = %v, %v after a failed batch, want [y]", tagNames(tags), err)
+	}
+	if got := dataRevision(ctx, t, ds); got != rev {
+		t.Errorf("data revision = %d after a failed batch, want %d", got, rev)
+	}
+	if got := checkHistory(ctx, t, ds, types.RevisionBookmark, b1.Id, operations(revs)); len(got) != len(revs) {
+		t.Errorf("history length = %d after a failed batch, want %d", len(got), len(revs))
+	}
+
+}
+
+func testWithTx(ctx context.Context, t *testing.T, ds models.Datastore) {
+
+	fld := saveFolder(ctx, t, ds, "fld", nil)
+	bkm := saveBookmark(ctx, t, ds, &types.Bookmark{Title: "b1", URL: "https://b1.org/", Folder: fld, Tags: []*types.Tag{{Name: "x"}}})
+
+	// The changes are committed if the function succeeds.
+	var id int64
+	err := ds.WithTx(ctx, func(tx models.Datastore) error {
+		var err error
+		if id, err = tx.SaveFolder(ctx, &types.Folder{Title: "committed", Parent: fld}); err != nil {
+			return err
+		}
+		_, err = tx.SaveBookmark(ctx, &types.Bookmark{Title: "b2", URL: "https://b2.org/", Folder: &types.Folder{Id: int(id)}, Tags: []*types.Tag{{Name: "y"}}})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+	checkChildren(ctx, t, ds, int(id), nil, []string{"b2"})
+
+	// All of them are rolled back if it fails, with the nested calls.
+	rev := dataRevision(ctx, t, ds)
+	errAbort := errors.New("abort")
+	err = ds.WithTx(ctx, func(tx models.Datastore) error {
+		if _, err := tx.SaveFolder(ctx, &types.Folder{Title: "rolled back", Parent: fld}); err != nil {
+			return err
+		}
+		if err := tx.TrashBookmark(ctx, bkm.Id); err != nil {
+			return err
+		}
+		if err := tx.WithTx(ctx, func(tx models.Datastore) error {
+			b, err := tx.GetBookmark(ctx, bkm.Id)
+			if err != nil {
+				return err
+			}
+			if b.DeletedAt == nil {
+				t.Errorf("GetBookmark(%d) in the transaction is not trashed", bkm.Id)
+			}
+			_, err = tx.SaveTag(ctx, &types.Tag{Name: "z"})
+			return err
+		}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Errorf("WithTx error = %v, want the function one", err)
+	}
+	checkChildren(ctx, t, ds, fld.Id, []string{"committed"}, []string{"b1"})
+	tags, err := ds.GetTags(ctx)
+	if err != nil {
+		t.Fatalf("GetTags: %v", err)
+	}
+	if got, want := tagNames(tags), []string{"x", "y"}; !equal(got, want) {
+		t.Errorf("GetTags = %v after a rollback, want %v", got, want)
+	}
+	if got := dataRevision(ctx, t, ds); got != rev {
+		t.Errorf("data revision = %d after a rollback, want %d", got, rev)
+	}
+	checkHistory(ctx, t, ds, types.RevisionBookmark, bkm.Id, []string{types.OperationCreate})
+
+	// The datastore works as usual after the transactions.
+	saveFolder(ctx, t, ds, "after", fld)
+	checkChildren(ctx, t, ds, fld.Id, []string{"after", "committed"}, []string{"b1"})
+
+}
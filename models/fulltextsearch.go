@@ -0,0 +1,211 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"html"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// The SQLite full text search indexes one bookmarkfts row per bookmark,
+// with the bookmark id as rowid, and is kept in sync with triggers.
+// It requires a SQLite library built with FTS5 (the sqlite_fts5 build tag
+// of go-sqlite3), SearchBookmarks falls back to LIKE queries otherwise.
+
+const (
+	// ftsMatchStart and ftsMatchEnd surround the matches in the snippets
+	// returned by SQLite, before they are HTML escaped and replaced by <mark> tags.
+	ftsMatchStart = "\x02"
+	ftsMatchEnd   = "\x03"
+	// ftsTags is the space separated tags names of the bookmark with the id X.
+	ftsTags = `COALESCE((SELECT group_concat(tag.name, ' ') FROM tag JOIN bookmarktag ON bookmarktag.tagId = tag.id WHERE bookmarktag.bookmarkId = X), '')`
+)
+
+// ftsTriggers are the triggers keeping bookmarkfts in sync, by name.
+var ftsTriggers = []struct {
+	name      string
+	statement string
+}{
+	{"bookmarkfts_bookmark_insert", `AFTER INSERT ON bookmark BEGIN
+		INSERT INTO bookmarkfts(rowid, title, url, tags, notes) VALUES (new.id, new.title, new.url, ` + strings.Replace(ftsTags, "X", "new.id", 1) + `, COALESCE(new.notes, ''));
+	END`},
+	{"bookmarkfts_bookmark_update", `AFTER UPDATE OF title, url, notes ON bookmark BEGIN
+		UPDATE bookmarkfts SET title = new.title, url = new.url, notes = COALESCE(new.notes, '') WHERE rowid = new.id;
+	END`},
+	{"bookmarkfts_bookmark_delete", `AFTER DELETE ON bookmark BEGIN
+		DELETE FROM bookmarkfts WHERE rowid = old.id;
+	END`},
+	{"bookmarkfts_bookmarktag_insert", `AFTER INSERT ON bookmarktag BEGIN
+		UPDATE bookmarkfts SET tags = ` + strings.Replace(ftsTags, "X", "new.bookmarkId", 1) + ` WHERE rowid = new.bookmarkId;
+	END`},
+	{"bookmarkfts_bookmarktag_delete", `AFTER DELETE ON bookmarktag BEGIN
+		UPDATE bookmarkfts SET tags = ` + strings.Replace(ftsTags, "X", "old.bookmarkId", 1) + ` WHERE rowid = old.bookmarkId;
+	END`},
+	{"bookmarkfts_tag_update", `AFTER UPDATE OF name ON tag BEGIN
+		UPDATE bookmarkfts SET tags = ` + strings.Replace(ftsTags, "X", "bookmarkfts.rowid", 1) + ` WHERE rowid IN (SELECT bookmarkId FROM bookmarktag WHERE tagId = new.id);
+	END`},
+}
+
+// setupFullTextSearch creates the bookmarkfts table and its triggers
+// and indexes the bookmarks if the SQLite library supports FTS5.
+// Otherwise the triggers, that would fail without FTS5, are dropped.
+// The index is rebuilt at each startup as the database may have been
+// modified by a gobkm binary without FTS5 in the meantime.
+func (db *sqlDataStore) setupFullTextSearch(ctx context.Context) error {
+
+	var fts5 bool
+	if err := db.queryRow(ctx, "SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("setupFullTextSearch:SELECT query error")
+		return err
+	}
+
+	statements := make([]string, 0, 2*len(ftsTriggers)+3)
+	for _, t := range ftsTriggers {
+		statements = append(statements, "DROP TRIGGER IF EXISTS "+t.name)
+	}
+	if fts5 {
+		statements = append(statements,
+			`CREATE VIRTUAL TABLE IF NOT EXISTS bookmarkfts USING fts5(title, url, tags, notes, tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3')`,
+			`DELETE FROM bookmarkfts`,
+			`INSERT INTO bookmarkfts(rowid, title, url, tags, notes) SELECT bookmark.id, bookmark.title, bookmark.url, `+strings.Replace(ftsTags, "X", "bookmark.id", 1)+`, COALESCE(bookmark.notes, '') FROM bookmark`)
+		for _, t := range ftsTriggers {
+			statements = append(statements, "CREATE TRIGGER "+t.name+" "+t.statement)
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("setupFullTextSearch:transaction begin failed")
+		return err
+	}
+	for _, s := range statements {
+		if _, err = tx.ExecContext(ctx, s); err != nil {
+			log.WithFields(log.Fields{
+				"err":       err,
+				"statement": s,
+			}).Error("setupFullTextSearch:statement error")
+			if rerr := tx.Rollback(); rerr != nil {
+				log.WithFields(log.Fields{
+					"err": rerr,
+				}).Error("setupFullTextSearch:transaction rollback error")
+			}
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	db.fullTextSearch = fts5
+	log.WithFields(log.Fields{
+		"fts5": fts5,
+	}).Info("setupFullTextSearch")
+
+	return nil
+
+}
+
+// fts returns the FTS5 query of the term: the documents with words
+// starting with each word of the term, or with the phrase words.
+// The words are made of letters and digits only, no quotes to escape.
+func (n *termNode) fts() string {
+
+	if n.phrase {
+		return `"` + strings.Join(n.words, " ") + `"`
+	}
+
+	words := make([]string, len(n.words))
+	for i, w := range n.words {
+		words[i] = `"` + w + `"*`
+	}
+	return strings.Join(words, " ")
+
+}
+
+// ftsQuery returns the FTS5 query of the given plain text terms.
+func ftsQuery(terms []*termNode) string {
+
+	queries := make([]string, 0, len(terms))
+	for _, t := range terms {
+		if len(t.words) == 0 {
+			// Matches nothing, as Query.Match.
+			return ""
+		}
+		queries = append(queries, t.fts())
+	}
+	return strings.Join(queries, " ")
+
+}
+
+// highlight HTML escapes the given snippet and replaces
+// the match delimiters by <mark> tags.
+func highlight(snippet string) string {
+	return strings.NewReplacer(ftsMatchStart, "<mark>", ftsMatchEnd, "</mark>").Replace(html.EscapeString(snippet))
+}
+
+// searchFullText returns the bookmarks matching the given plain text terms
+// in the bookmarkfts table ordered by relevance, with a highlighted snippet.
+func (db *sqlDataStore) searchFullText(ctx context.Context, terms []*termNode) ([]*types.Bookmark, error) {
+
+	var (
+		rows      *sql.Rows
+		bkms      []*types.Bookmark
+		folderIDs []int
+		err       error
+	)
+
+	query := ftsQuery(terms)
+	if query == "" {
+		return nil, nil
+	}
+
+	// Querying the bookmarks, the title matches
+	// weigh more than the URL and tags ones, then the notes ones.
+	if rows, err = db.query(ctx, db.liveFolders()+` SELECT `+bookmarkColumns+`, snippet(bookmarkfts, -1, ?, ?, '…', 12)
+		FROM bookmarkfts
+		JOIN bookmark ON bookmark.id = bookmarkfts.rowid
+		WHERE bookmarkfts MATCH ? AND `+inLiveFolder+`
+		ORDER BY bm25(bookmarkfts, 10.0, 4.0, 4.0, 1.0), bookmark.title`, ftsMatchStart, ftsMatchEnd, query); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("searchFullText:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "searchFullText")
+
+	for rows.Next() {
+		// Building a new Bookmark instance with each row.
+		var snippet string
+		bkm, folderID, err := scanBookmark(rows, &snippet)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("searchFullText:error scanning the query result row")
+			return nil, err
+		}
+		bkm.Snippet = highlight(snippet)
+		bkms = append(bkms, bkm)
+		folderIDs = append(folderIDs, folderID)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("searchFullText:error looping rows")
+		return nil, err
+	}
+
+	// Retrieving the bookmarks folders once the rows are consumed.
+	if err = db.setBookmarksFolder(ctx, bkms, folderIDs); err != nil {
+		return nil, err
+	}
+
+	return bkms, nil
+
+}
@@ -1,29 +1,169 @@
 package models
 
 import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
 	"github.com/tbellembois/gobkm/types"
 )
 
+// ErrNotFound is returned when the requested folder, bookmark or tag does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrRootFolder is returned when trying to move the root folder to the trash.
+var ErrRootFolder = errors.New("the root folder can not be deleted")
+
 // Datastore is a folders and bookmarks storage interface.
+// Every method takes the context of the caller (usually the HTTP request)
+// and returns its own error, there is no shared error state.
+// The folders and bookmarks in the trash are only returned
+// by GetTrash, GetFolder and GetBookmark.
+// The changes of the folders and bookmarks are logged in revisions
+// that can be undone, see GetRevisions and Undo.
+// Every change but the visits and the webhooks increases the data revision
+// of the user, see GetDataRevision.
+// The sessions, API tokens and share links are returned by GetSession,
+// GetAPIToken and GetShareLink until they expire.
+// The folders, bookmarks, tags, revisions and webhooks belong to a user, see ForUser,
+// the users, sessions and API tokens are shared.
+// The folders can be shared with the other users, see GetFolderAccess,
+// the datastore of their owner changing them, and with anyone with a share link.
+// The List methods sort and paginate the bookmarks, folders and tags, see ListOptions.
+// Several changes are made atomically with WithTx, the function only using
+// the datastore it is given, and several bookmark operations with Batch.
 type Datastore interface {
-	FlushErrors() error
-
-	SearchBookmarks(string) []*types.Bookmark
-	GetBookmark(int) *types.Bookmark
-	GetBookmarkTags(int) []*types.Tag
-	GetFolderBookmarks(int) types.Bookmarks
-	SaveBookmark(*types.Bookmark) int64
-	UpdateBookmark(*types.Bookmark)
-	DeleteBookmark(*types.Bookmark)
-
-	GetFolder(int) *types.Folder
-	GetFolderSubfolders(int) []*types.Folder
-	SaveFolder(*types.Folder) int64
-	UpdateFolder(*types.Folder)
-	DeleteFolder(*types.Folder)
-
-	GetTags() []*types.Tag
-	GetStars() []*types.Bookmark
-	GetTag(int) *types.Tag
-	SaveTag(*types.Tag) int64
+	ForUser(id int) Datastore
+	WithTx(ctx context.Context, f func(tx Datastore) error) error
+
+	SearchBookmarks(context.Context, string) ([]*types.Bookmark, error)
+	GetBookmark(context.Context, int) (*types.Bookmark, error)
+	GetBookmarkTags(context.Context, int) ([]*types.Tag, error)
+	GetFolderBookmarks(context.Context, int) (types.Bookmarks, error)
+	ListBookmarks(context.Context, BookmarkFilter, ListOptions) ([]*types.Bookmark, *ListCursor, error)
+	SaveBookmark(context.Context, *types.Bookmark) (int64, error)
+	UpdateBookmark(context.Context, *types.Bookmark) error
+	DeleteBookmark(context.Context, *types.Bookmark) error
+	VisitBookmark(context.Context, int) error
+	SetBookmarkFavicon(ctx context.Context, id int, favicon string) error
+	Batch(context.Context, []*types.BatchOperation) error
+
+	GetRootFolder(context.Context) (*types.Folder, error)
+	GetFolder(context.Context, int) (*types.Folder, error)
+	GetFolderSubfolders(context.Context, int) ([]*types.Folder, error)
+	ListFolders(ctx context.Context, parentID int, opts ListOptions) ([]*types.Folder, *ListCursor, error)
+	GetFolderTree(ctx context.Context, id int, depth int) (*types.Folder, error)
+	SaveFolder(context.Context, *types.Folder) (int64, error)
+	UpdateFolder(context.Context, *types.Folder) error
+	DeleteFolder(context.Context, *types.Folder) error
+	VisitFolder(context.Context, int) error
+	ReorderFolderChildren(ctx context.Context, id int, folderIDs []int, bookmarkIDs []int) error
+
+	GetFolderAccess(ctx context.Context, id int) (owner int, role string, err error)
+	GetBookmarkAccess(ctx context.Context, id int) (owner int, role string, err error)
+	GetSharedFolders(context.Context) ([]*types.Folder, error)
+	GetFolderGrants(ctx context.Context, id int) ([]*types.Grant, error)
+	ShareFolder(ctx context.Context, id int, userID int, role string) error
+	UnshareFolder(ctx context.Context, id int, userID int) error
+
+	SaveShareLink(context.Context, *types.ShareLink) (int64, error)
+	GetShareLinks(ctx context.Context, folderID int) ([]*types.ShareLink, error)
+	GetShareLink(ctx context.Context, hash string) (*types.ShareLink, error)
+	DeleteShareLink(ctx context.Context, id int) error
+
+	GetTrash(context.Context) (*types.Trash, error)
+	TrashBookmark(context.Context, int) error
+	TrashFolder(context.Context, int) error
+	RestoreBookmark(context.Context, int) error
+	RestoreFolder(context.Context, int) error
+	PurgeTrash(context.Context, time.Time) (int, error)
+
+	GetRevisions(ctx context.Context, kind string, id int) ([]*types.Revision, error)
+	Undo(ctx context.Context, n int) ([]*types.Revision, error)
+	GetDataRevision(context.Context) (*types.DataRevision, error)
+
+	GetTags(context.Context) ([]*types.Tag, error)
+	ListTags(context.Context, ListOptions) ([]*types.Tag, *ListCursor, error)
+	GetStars(context.Context) ([]*types.Bookmark, error)
+	GetTag(context.Context, int) (*types.Tag, error)
+	SaveTag(context.Context, *types.Tag) (int64, error)
+	UpdateTag(context.Context, *types.Tag) error
+	DeleteTag(context.Context, int) error
+
+	GetUsers(context.Context) ([]*types.User, error)
+	HasUsers(context.Context) (bool, error)
+	GetUser(context.Context, int) (*types.User, error)
+	GetUserByName(ctx context.Context, username string) (*types.User, error)
+	SaveUser(context.Context, *types.User) (int64, error)
+	UpdateUserPassword(ctx context.Context, id int, passwordHash string) error
+	DeleteUser(context.Context, int) error
+
+	SaveSession(context.Context, *types.Session) error
+	GetSession(ctx context.Context, id string) (*types.Session, error)
+	DeleteSession(ctx context.Context, id string) error
+	PurgeSessions(context.Context, time.Time) (int, error)
+
+	SaveAPIToken(context.Context, *types.APIToken) (int64, error)
+	GetAPITokens(ctx context.Context, userID int) ([]*types.APIToken, error)
+	GetAPIToken(ctx context.Context, hash string) (*types.APIToken, error)
+	UseAPIToken(ctx context.Context, id int, at time.Time) error
+	DeleteAPIToken(ctx context.Context, userID int, id int) error
+
+	SaveWebhook(context.Context, *types.Webhook) (int64, error)
+	GetWebhooks(context.Context) ([]*types.Webhook, error)
+	GetWebhook(context.Context, int) (*types.Webhook, error)
+	DeleteWebhook(context.Context, int) error
+	SaveWebhookDelivery(context.Context, *types.WebhookDelivery) (int64, error)
+	GetWebhookDeliveries(ctx context.Context, webhookID int) ([]*types.WebhookDelivery, error)
+}
+
+// now returns the current time used for the created, updated and visited dates.
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+// creationDates returns the dates of a new folder or bookmark:
+// the given ones if set (ie. imported), now otherwise.
+func creationDates(createdAt, updatedAt time.Time) (time.Time, time.Time) {
+
+	if createdAt.IsZero() {
+		createdAt = now()
+	}
+	if updatedAt.IsZero() {
+		updatedAt = createdAt
+	}
+	return createdAt, updatedAt
+
+}
+
+// Database is a Datastore managing its own storage.
+type Database interface {
+	Datastore
+
+	CreateDatabase(context.Context) error
+	PopulateDatabase(context.Context) error
+	Close() error
+}
+
+// Migrator is implemented by the Databases with a versioned schema.
+type Migrator interface {
+	SchemaVersion(context.Context) (current int, latest int, err error)
+	Migrate(context.Context) error
+}
+
+// Open returns the Database matching the given dataSourceName:
+// a postgres:// (or postgresql://) URL for PostgreSQL,
+// MemoryDataSourceName for the in-memory Datastore,
+// a path to the database file for SQLite3 otherwise.
+func Open(dataSourceName string) (Database, error) {
+
+	if dataSourceName == MemoryDataSourceName {
+		return NewMemoryDBstore(), nil
+	}
+	if strings.HasPrefix(dataSourceName, "postgres://") || strings.HasPrefix(dataSourceName, "postgresql://") {
+		return NewPostgresDBstore(dataSourceName)
+	}
+	return NewDBstore(dataSourceName)
+
 }
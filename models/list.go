@@ -0,0 +1,244 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tbellembois/gobkm/types"
+)
+
+// ErrInvalidCursor is returned when listing after a cursor
+// of another sort key.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListCursor is the position after the last item of a page
+// of ListBookmarks, ListFolders and ListTags, given by the sort key
+// of the item and its id.
+type ListCursor struct {
+	Key string
+	Id  int
+}
+
+// ListOptions are the sort and pagination options
+// of ListBookmarks, ListFolders and ListTags.
+type ListOptions struct {
+	// Sort is the sort key: id, title, url (bookmarks), name (tags),
+	// created, updated, visited or position, the id if empty.
+	// The titles, URLs and names are sorted case insensitively,
+	// the folders and bookmarks never visited come first.
+	Sort string
+	Desc bool
+	// After is the cursor of the previous page, nil for the first one.
+	After *ListCursor
+	// Limit is the number of items of the page, 0 for all of them.
+	Limit int
+}
+
+// BookmarkFilter selects the bookmarks of ListBookmarks.
+type BookmarkFilter struct {
+	FolderId int    // 0 for all the folders
+	Tag      string // case insensitive, empty for all the tags
+	Starred  *bool  // nil for all the bookmarks
+}
+
+// Kinds of the list sort keys.
+const (
+	keyInt = iota
+	keyText
+	keyTime
+)
+
+// listKey is a sort key of the lists.
+type listKey struct {
+	column   string
+	kind     int
+	nullable bool
+}
+
+// listKeys are the sort keys of the lists by name.
+var listKeys = map[string]listKey{
+	"id":       {column: "id", kind: keyInt},
+	"title":    {column: "title", kind: keyText},
+	"url":      {column: "url", kind: keyText},
+	"name":     {column: "name", kind: keyText},
+	"created":  {column: "created_at", kind: keyTime},
+	"updated":  {column: "updated_at", kind: keyTime},
+	"visited":  {column: "last_visited_at", kind: keyTime, nullable: true},
+	"position": {column: "position", kind: keyInt},
+}
+
+// timeKeyLayout is the layout of the date sort keys, sorted as strings.
+const timeKeyLayout = "2006-01-02T15:04:05.000000000"
+
+// listKeyOf returns the sort key of the given options.
+func listKeyOf(opts ListOptions) (listKey, error) {
+
+	if opts.Sort == "" {
+		return listKeys["id"], nil
+	}
+	k, ok := listKeys[opts.Sort]
+	if !ok {
+		return listKey{}, fmt.Errorf("unknown sort key %q", opts.Sort)
+	}
+	return k, nil
+
+}
+
+// textKey returns the sort key of the given text.
+func textKey(s string) string {
+	return strings.ToLower(s)
+}
+
+// timeKey returns the sort key of the given date, empty if nil.
+func timeKey(t *time.Time) string {
+
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(timeKeyLayout)
+
+}
+
+// intKey returns the sort key of the given integer.
+func intKey(i int) string {
+	return fmt.Sprintf("%020d", i)
+}
+
+// bookmarkListKey returns the given sort key of the given bookmark.
+func bookmarkListKey(b *types.Bookmark, s string) string {
+
+	switch s {
+	case "title":
+		return textKey(b.Title)
+	case "url":
+		return textKey(b.URL)
+	case "created":
+		return timeKey(&b.CreatedAt)
+	case "updated":
+		return timeKey(&b.UpdatedAt)
+	case "visited":
+		return timeKey(b.LastVisitedAt)
+	case "position":
+		return intKey(b.Position)
+	}
+	return intKey(b.Id)
+
+}
+
+// folderListKey returns the given sort key of the given folder.
+func folderListKey(f *types.Folder, s string) string {
+
+	switch s {
+	case "title":
+		return textKey(f.Title)
+	case "created":
+		return timeKey(&f.CreatedAt)
+	case "updated":
+		return timeKey(&f.UpdatedAt)
+	case "visited":
+		return timeKey(f.LastVisitedAt)
+	case "position":
+		return intKey(f.Position)
+	}
+	return intKey(f.Id)
+
+}
+
+// tagListKey returns the given sort key of the given tag.
+func tagListKey(t *types.Tag, s string) string {
+
+	if s == "name" {
+		return textKey(t.Name)
+	}
+	return intKey(t.Id)
+
+}
+
+// page returns the indexes of the n items of the page of the given options,
+// sorted, and the cursor of the next page, nil if it is the last one.
+// key returns the sort key and the id of the item with the given index.
+func page(n int, opts ListOptions, key func(i int) (string, int)) ([]int, *ListCursor) {
+
+	type entry struct {
+		index int
+		key   string
+		id    int
+	}
+	entries := make([]entry, n)
+	for i := range entries {
+		entries[i].index = i
+		entries[i].key, entries[i].id = key(i)
+	}
+
+	// before returns true if a is before b in the sort order.
+	before := func(a, b entry) bool {
+		if a.key != b.key {
+			return (a.key < b.key) != opts.Desc
+		}
+		return a.id != b.id && (a.id < b.id) != opts.Desc
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return before(entries[i], entries[j]) })
+	if opts.After != nil {
+		c := entry{key: opts.After.Key, id: opts.After.Id}
+		start := sort.Search(len(entries), func(i int) bool { return before(c, entries[i]) })
+		entries = entries[start:]
+	}
+
+	var next *ListCursor
+	if opts.Limit > 0 && len(entries) > opts.Limit {
+		entries = entries[:opts.Limit]
+		last := entries[len(entries)-1]
+		next = &ListCursor{Key: last.key, Id: last.id}
+	}
+
+	indexes := make([]int, len(entries))
+	for i, e := range entries {
+		indexes[i] = e.index
+	}
+	return indexes, next
+
+}
+
+// PageBookmarks returns the page of the given options of the given bookmarks
+// and the cursor of the next page, for the bookmarks not listed by the datastore
+// such as the search results.
+func PageBookmarks(bkms []*types.Bookmark, opts ListOptions) ([]*types.Bookmark, *ListCursor) {
+
+	indexes, next := page(len(bkms), opts, func(i int) (string, int) { return bookmarkListKey(bkms[i], opts.Sort), bkms[i].Id })
+	p := make([]*types.Bookmark, len(indexes))
+	for i, index := range indexes {
+		p[i] = bkms[index]
+	}
+	return p, next
+
+}
+
+// PageFolders returns the page of the given options of the given folders
+// and the cursor of the next page, for the folders not listed by the datastore
+// such as the shared ones.
+func PageFolders(flds []*types.Folder, opts ListOptions) ([]*types.Folder, *ListCursor) {
+
+	indexes, next := page(len(flds), opts, func(i int) (string, int) { return folderListKey(flds[i], opts.Sort), flds[i].Id })
+	p := make([]*types.Folder, len(indexes))
+	for i, index := range indexes {
+		p[i] = flds[index]
+	}
+	return p, next
+
+}
+
+// pageTags returns the page of the given options of the given tags
+// and the cursor of the next page.
+func pageTags(tags []*types.Tag, opts ListOptions) ([]*types.Tag, *ListCursor) {
+
+	indexes, next := page(len(tags), opts, func(i int) (string, int) { return tagListKey(tags[i], opts.Sort), tags[i].Id })
+	p := make([]*types.Tag, len(indexes))
+	for i, index := range indexes {
+		p[i] = tags[index]
+	}
+	return p, next
+
+}
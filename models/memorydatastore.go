@@ -0,0 +1,2621 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// MemoryDataSourceName is the dataSourceName selecting the in-memory Datastore.
+const MemoryDataSourceName = ":memory:"
+
+// memoryFolder is a folder row of the MemoryDataStore.
+type memoryFolder struct {
+	id                int
+	owner             int
+	title             string
+	parentID          int
+	nbChildrenFolders int
+	sort              types.SortMode
+	position          int
+	createdAt         time.Time
+	updatedAt         time.Time
+	lastVisitedAt     *time.Time
+
+	// The trashed folders have no parent.
+	deletedAt     *time.Time
+	trashParentID int
+	trashPath     []string
+
+	// grants are the grants of the folder by user id.
+	grants map[int]*types.Grant
+	// links are the share links of the folder by id.
+	links map[int]*types.ShareLink
+}
+
+// memoryBookmark is a bookmark row of the MemoryDataStore.
+type memoryBookmark struct {
+	id       int
+	owner    int
+	title    string
+	url      string
+	favicon  string
+	starred  bool
+	notes    string
+	folderID int
+	tagIDs   []int
+	position int
+
+	createdAt     time.Time
+	updatedAt     time.Time
+	lastVisitedAt *time.Time
+
+	// The trashed bookmarks have no folder.
+	deletedAt     *time.Time
+	trashParentID int
+	trashPath     []string
+}
+
+// memoryTag is a tag row of the MemoryDataStore.
+type memoryTag struct {
+	name  string
+	owner int
+}
+
+// memoryRevision is a revision row of the MemoryDataStore.
+type memoryRevision struct {
+	*types.Revision
+	owner int
+}
+
+// memoryWebhook is a webhook row of the MemoryDataStore
+// with its deliveries, oldest first.
+type memoryWebhook struct {
+	*types.Webhook
+	owner      int
+	deliveries []*types.WebhookDelivery
+}
+
+// memoryData are the rows of a MemoryDataStore,
+// shared by the copies returned by ForUser.
+type memoryData struct {
+	mu        sync.RWMutex
+	folders   map[int]*memoryFolder
+	bookmarks map[int]*memoryBookmark
+	tags      map[int]*memoryTag
+	revisions []*memoryRevision
+	users     map[int]*types.User
+	sessions  map[string]*types.Session
+	apiTokens map[int]*types.APIToken
+	webhooks  map[int]*memoryWebhook
+	// dataRevisions are the data revisions by owner.
+	dataRevisions map[int]*types.DataRevision
+
+	memoryIDs
+}
+
+// memoryIDs are the last ids of the rows of a MemoryDataStore.
+type memoryIDs struct {
+	lastFolderID   int
+	lastBookmarkID int
+	lastTagID      int
+	lastRevisionID int
+	lastUserID     int
+	lastAPITokenID int
+	lastLinkID     int
+	lastWebhookID  int
+	lastDeliveryID int
+}
+
+// MemoryDataStore implements the Datastore interface
+// to store the folders and bookmarks in memory.
+// It is pure Go and loses everything when the program exits,
+// it is intended for tests and demonstrations.
+type MemoryDataStore struct {
+	*memoryData
+	// owner is the id of the user owning the folders, bookmarks and tags
+	// of the datastore, 0 when the authentication is disabled, see ForUser.
+	owner int
+	// tx is true for the datastores given by withTx, holding the lock.
+	tx bool
+}
+
+// NewMemoryDBstore returns an empty in-memory Datastore.
+func NewMemoryDBstore() *MemoryDataStore {
+
+	log.Debug("NewMemoryDBstore")
+
+	return &MemoryDataStore{memoryData: &memoryData{
+		folders:   make(map[int]*memoryFolder),
+		bookmarks: make(map[int]*memoryBookmark),
+		tags:      make(map[int]*memoryTag),
+		users:     make(map[int]*types.User),
+		sessions:  make(map[string]*types.Session),
+		apiTokens: make(map[int]*types.APIToken),
+		webhooks:  make(map[int]*memoryWebhook),
+
+		dataRevisions: make(map[int]*types.DataRevision),
+	}}
+
+}
+
+// ForUser returns a copy of the datastore restricted to the folders,
+// bookmarks and tags of the user with the given id.
+func (db *MemoryDataStore) ForUser(id int) Datastore {
+	return &MemoryDataStore{memoryData: db.memoryData, owner: id, tx: db.tx}
+}
+
+// lock locks the rows for writing, unless the datastore holds the lock, see withTx.
+func (db *MemoryDataStore) lock() {
+
+	if !db.tx {
+		db.mu.Lock()
+	}
+
+}
+
+// unlock unlocks the rows locked by lock.
+func (db *MemoryDataStore) unlock() {
+
+	if !db.tx {
+		db.mu.Unlock()
+	}
+
+}
+
+// rlock locks the rows for reading, unless the datastore holds the lock, see withTx.
+func (db *MemoryDataStore) rlock() {
+
+	if !db.tx {
+		db.mu.RLock()
+	}
+
+}
+
+// runlock unlocks the rows locked by rlock.
+func (db *MemoryDataStore) runlock() {
+
+	if !db.tx {
+		db.mu.RUnlock()
+	}
+
+}
+
+// withTx calls the given function with a copy of the datastore
+// holding the lock for all its calls, the rows being restored
+// if the function fails. Nested calls share the transaction.
+func (db *MemoryDataStore) withTx(ctx context.Context, f func(db *MemoryDataStore) error) error {
+
+	if db.tx {
+		return f(db)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	saved := db.state()
+	err := f(&MemoryDataStore{memoryData: db.memoryData, owner: db.owner, tx: true})
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		db.setState(saved)
+		return err
+	}
+
+	return nil
+
+}
+
+// WithTx calls the given function with a copy of the datastore
+// holding the lock, all its changes being reverted if the function fails.
+// The function must only use the given datastore, the other ones waiting
+// for the lock. Nested calls share the transaction.
+func (db *MemoryDataStore) WithTx(ctx context.Context, f func(tx Datastore) error) error {
+
+	return db.withTx(ctx, func(db *MemoryDataStore) error {
+		return f(db)
+	})
+
+}
+
+// CreateDatabase creates the root folder.
+func (db *MemoryDataStore) CreateDatabase(ctx context.Context) error {
+
+	db.lock()
+	defer db.unlock()
+
+	if len(db.users) == 0 && db.rootID(0) == 0 {
+		db.saveRootFolder(0)
+	}
+
+	return ctx.Err()
+
+}
+
+// rootID returns the id of the root folder of the user with the given id, 0 if none.
+// The caller must hold the lock.
+func (db *MemoryDataStore) rootID(owner int) int {
+
+	var id int
+	for _, f := range db.folders {
+		if f.owner == owner && f.parentID == 0 && f.deletedAt == nil && (id == 0 || f.id < id) {
+			id = f.id
+		}
+	}
+	return id
+
+}
+
+// saveRootFolder saves a new root folder for the user with the given id.
+// The caller must hold the lock.
+func (db *MemoryDataStore) saveRootFolder(owner int) {
+
+	db.lastFolderID++
+	createdAt := now()
+	db.folders[db.lastFolderID] = &memoryFolder{id: db.lastFolderID, owner: owner, title: "/", sort: types.SortTitle, createdAt: createdAt, updatedAt: createdAt}
+
+}
+
+// ownFolder returns the row of the folder with the given id
+// if it is owned by the datastore user.
+// The caller must hold the lock.
+func (db *MemoryDataStore) ownFolder(id int) (*memoryFolder, bool) {
+
+	f, ok := db.folders[id]
+	if !ok || f.owner != db.owner {
+		return nil, false
+	}
+	return f, true
+
+}
+
+// ownBookmark returns the row of the bookmark with the given id
+// if it is owned by the datastore user.
+// The caller must hold the lock.
+func (db *MemoryDataStore) ownBookmark(id int) (*memoryBookmark, bool) {
+
+	b, ok := db.bookmarks[id]
+	if !ok || b.owner != db.owner {
+		return nil, false
+	}
+	return b, true
+
+}
+
+// ownTag returns the name of the tag with the given id
+// if it is owned by the datastore user.
+// The caller must hold the lock.
+func (db *MemoryDataStore) ownTag(id int) (string, bool) {
+
+	t, ok := db.tags[id]
+	if !ok || t.owner != db.owner {
+		return "", false
+	}
+	return t.name, true
+
+}
+
+// GetRootFolder returns the root folder of the datastore user.
+func (db *MemoryDataStore) GetRootFolder(ctx context.Context) (*types.Folder, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	id := db.rootID(db.owner)
+	if id == 0 {
+		return nil, ErrNotFound
+	}
+
+	return db.folders[id].folder(), ctx.Err()
+
+}
+
+// PopulateDatabase populate the database with sample folders and bookmarks.
+func (db *MemoryDataStore) PopulateDatabase(ctx context.Context) error {
+	return populateDatabase(ctx, db)
+}
+
+// Close does nothing, it implements the Database interface.
+func (db *MemoryDataStore) Close() error {
+	return nil
+}
+
+// folder returns the Folder with the given id and its parents.
+// The caller must hold the lock.
+func (db *MemoryDataStore) folder(id int) (*types.Folder, error) {
+
+	f, ok := db.ownFolder(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	fld := f.folder()
+	if f.parentID != 0 {
+		var err error
+		if fld.Parent, err = db.folder(f.parentID); err != nil {
+			return nil, err
+		}
+	}
+
+	return fld, nil
+
+}
+
+// copyTime returns a copy of the given optional time,
+// the rows never share their dates with the callers.
+func copyTime(t *time.Time) *time.Time {
+
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+
+}
+
+// copyPath returns a copy of the given trash path.
+func copyPath(p []string) []string {
+
+	if p == nil {
+		return nil
+	}
+	return append([]string{}, p...)
+
+}
+
+// live returns true if the folder with the given id is in the tree
+// of the datastore user root folder, ie. neither it nor a parent is in the trash.
+// The caller must hold the lock.
+func (db *MemoryDataStore) live(id int) bool {
+
+	// The depth guards against cycles.
+	for depth := 0; depth <= len(db.folders); depth++ {
+		f, ok := db.folders[id]
+		switch {
+		case !ok:
+			return false
+		case f.parentID == 0:
+			return f.deletedAt == nil && f.owner == db.owner
+		}
+		id = f.parentID
+	}
+	return false
+
+}
+
+// folder returns the Folder of the given row without its parent.
+func (f *memoryFolder) folder() *types.Folder {
+	return &types.Folder{Id: f.id, Title: f.title, NbChildrenFolders: f.nbChildrenFolders, Sort: f.sort, Position: f.position,
+		CreatedAt: f.createdAt, UpdatedAt: f.updatedAt, LastVisitedAt: copyTime(f.lastVisitedAt), DeletedAt: copyTime(f.deletedAt), TrashPath: copyPath(f.trashPath),
+		Shared: len(f.grants) > 0}
+}
+
+// sortKey returns the sort key of the folder.
+func (f *memoryFolder) sortKey() sortKey {
+	return sortKey{id: f.id, title: f.title, position: f.position, createdAt: f.createdAt, lastVisitedAt: f.lastVisitedAt}
+}
+
+// bookmark returns the Bookmark with the given row without its folder and tags.
+func (b *memoryBookmark) bookmark() *types.Bookmark {
+	return &types.Bookmark{Id: b.id, Title: b.title, URL: b.url, Favicon: b.favicon, Starred: b.starred, Notes: b.notes, Position: b.position,
+		CreatedAt: b.createdAt, UpdatedAt: b.updatedAt, LastVisitedAt: copyTime(b.lastVisitedAt), DeletedAt: copyTime(b.deletedAt), TrashPath: copyPath(b.trashPath)}
+}
+
+// sortKey returns the sort key of the bookmark.
+func (b *memoryBookmark) sortKey() sortKey {
+	return sortKey{id: b.id, title: b.title, url: b.url, position: b.position, createdAt: b.createdAt, lastVisitedAt: b.lastVisitedAt}
+}
+
+// folderSort returns the sort mode of the folder with the given id,
+// by title if the folder does not exist.
+// The caller must hold the lock.
+func (db *MemoryDataStore) folderSort(id int) types.SortMode {
+
+	if f, ok := db.folders[id]; ok {
+		return sortMode(f.sort)
+	}
+	return types.SortTitle
+
+}
+
+// folderChildren returns the subfolders and bookmarks rows of the folder
+// with the given id, sorted with the given sort mode.
+// The caller must hold the lock.
+func (db *MemoryDataStore) folderChildren(id int, m types.SortMode) ([]*memoryFolder, []*memoryBookmark) {
+
+	var (
+		flds []*memoryFolder
+		bkms []*memoryBookmark
+	)
+	for _, f := range db.folders {
+		if f.parentID == id && f.id != id && f.deletedAt == nil && f.owner == db.owner {
+			flds = append(flds, f)
+		}
+	}
+	for _, b := range db.bookmarks {
+		if b.folderID == id && b.deletedAt == nil && b.owner == db.owner {
+			bkms = append(bkms, b)
+		}
+	}
+	sort.Slice(flds, func(i, j int) bool { return less(m, flds[i].sortKey(), flds[j].sortKey()) })
+	sort.Slice(bkms, func(i, j int) bool { return less(m, bkms[i].sortKey(), bkms[j].sortKey()) })
+
+	return flds, bkms
+
+}
+
+// lastPosition returns the highest position of the children of the folder with the given id.
+// The caller must hold the lock.
+func (db *MemoryDataStore) lastPosition(id int) (int, int) {
+
+	var lastFolder, lastBookmark int
+	flds, bkms := db.folderChildren(id, types.SortManual)
+	if len(flds) > 0 {
+		lastFolder = flds[len(flds)-1].position
+	}
+	if len(bkms) > 0 {
+		lastBookmark = bkms[len(bkms)-1].position
+	}
+
+	return lastFolder, lastBookmark
+
+}
+
+// bookmarkTags returns the tags of the given bookmark sorted by name.
+// The caller must hold the lock.
+func (db *MemoryDataStore) bookmarkTags(b *memoryBookmark) []*types.Tag {
+
+	var tags []*types.Tag
+	for _, id := range b.tagIDs {
+		tags = append(tags, &types.Tag{Id: id, Name: db.tags[id].name})
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+
+	return tags
+
+}
+
+// sortBookmarks sorts the given bookmarks by title.
+func sortBookmarks(bkms []*types.Bookmark) {
+	sort.SliceStable(bkms, func(i, j int) bool {
+		if bkms[i].Title == bkms[j].Title {
+			return bkms[i].Id < bkms[j].Id
+		}
+		return bkms[i].Title < bkms[j].Title
+	})
+}
+
+// GetTags returns the full tags list.
+func (db *MemoryDataStore) GetTags(ctx context.Context) ([]*types.Tag, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	var tags []*types.Tag
+	for id, t := range db.tags {
+		if t.owner == db.owner {
+			tags = append(tags, &types.Tag{Id: id, Name: t.name})
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Name == tags[j].Name {
+			return tags[i].Id < tags[j].Id
+		}
+		return tags[i].Name < tags[j].Name
+	})
+
+	return tags, ctx.Err()
+
+}
+
+// ListTags returns the page of the given options of the tags
+// and the cursor of the next page, nil if it is the last one.
+func (db *MemoryDataStore) ListTags(ctx context.Context, opts ListOptions) ([]*types.Tag, *ListCursor, error) {
+
+	if _, err := listKeyOf(opts); err != nil {
+		return nil, nil, err
+	}
+	tags, err := db.GetTags(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	tags, next := pageTags(tags, opts)
+
+	return tags, next, nil
+
+}
+
+// GetTag returns a Tag instance with the given id.
+func (db *MemoryDataStore) GetTag(ctx context.Context, id int) (*types.Tag, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	name, ok := db.ownTag(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &types.Tag{Id: id, Name: name}, ctx.Err()
+
+}
+
+// SaveTag saves the new given Tag.
+func (db *MemoryDataStore) SaveTag(ctx context.Context, t *types.Tag) (int64, error) {
+
+	db.lock()
+	defer db.unlock()
+
+	id := db.saveTag(t)
+	db.touch()
+
+	return int64(id), ctx.Err()
+
+}
+
+// UpdateTag renames the given tag.
+func (db *MemoryDataStore) UpdateTag(ctx context.Context, t *types.Tag) error {
+
+	db.lock()
+	defer db.unlock()
+
+	if _, ok := db.ownTag(t.Id); !ok {
+		return ErrNotFound
+	}
+	db.tags[t.Id].name = t.Name
+	db.touch()
+
+	return ctx.Err()
+
+}
+
+// DeleteTag removes the tag with the given id from its bookmarks,
+// logging their change, and deletes it.
+func (db *MemoryDataStore) DeleteTag(ctx context.Context, id int) error {
+
+	db.lock()
+	defer db.unlock()
+
+	if _, ok := db.ownTag(id); !ok {
+		return ErrNotFound
+	}
+	// Iterating in id order for a stable history.
+	ids := make([]int, 0, len(db.bookmarks))
+	for bid := range db.bookmarks {
+		ids = append(ids, bid)
+	}
+	sort.Ints(ids)
+	for _, bid := range ids {
+		b := db.bookmarks[bid]
+		for i, tid := range b.tagIDs {
+			if tid != id {
+				continue
+			}
+			before := db.bookmarkSnapshot(bid)
+			b.tagIDs = append(b.tagIDs[:i:i], b.tagIDs[i+1:]...)
+			db.recordBookmark(bid, before)
+			break
+		}
+	}
+	delete(db.tags, id)
+	db.touch()
+
+	return ctx.Err()
+
+}
+
+// saveTag saves the new given Tag and returns its id.
+// The caller must hold the lock.
+func (db *MemoryDataStore) saveTag(t *types.Tag) int {
+
+	db.lastTagID++
+	id := db.lastTagID
+	db.tags[id] = &memoryTag{name: t.Name, owner: db.owner}
+
+	return id
+
+}
+
+// GetBookmark returns a Bookmark instance with the given id.
+func (db *MemoryDataStore) GetBookmark(ctx context.Context, id int) (*types.Bookmark, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	b, ok := db.ownBookmark(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	bkm := b.bookmark()
+	if b.folderID != 0 {
+		var err error
+		if bkm.Folder, err = db.folder(b.folderID); err != nil {
+			return nil, err
+		}
+	}
+	bkm.Tags = db.bookmarkTags(b)
+
+	return bkm, ctx.Err()
+
+}
+
+// GetBookmarkTags returns the tags of the bookmark.
+func (db *MemoryDataStore) GetBookmarkTags(ctx context.Context, id int) ([]*types.Tag, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	b, ok := db.ownBookmark(id)
+	if !ok {
+		return nil, ctx.Err()
+	}
+
+	return db.bookmarkTags(b), ctx.Err()
+
+}
+
+// GetFolderBookmarks returns the bookmarks of the given folder id.
+func (db *MemoryDataStore) GetFolderBookmarks(ctx context.Context, id int) (types.Bookmarks, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	var bkms types.Bookmarks
+	_, children := db.folderChildren(id, db.folderSort(id))
+	for _, b := range children {
+		bkm := b.bookmark()
+		bkm.Folder = &types.Folder{Id: b.folderID}
+		bkm.Tags = db.bookmarkTags(b)
+		bkms = append(bkms, bkm)
+	}
+
+	return bkms, ctx.Err()
+
+}
+
+// filterBookmarks returns the bookmarks matching the given function
+// with their folder, sorted by title.
+// The caller must hold the lock.
+func (db *MemoryDataStore) filterBookmarks(match func(b *memoryBookmark) bool) ([]*types.Bookmark, error) {
+
+	var (
+		bkms []*types.Bookmark
+		err  error
+	)
+	for _, b := range db.bookmarks {
+		if !match(b) {
+			continue
+		}
+		bkm := b.bookmark()
+		if b.folderID != 0 {
+			if bkm.Folder, err = db.folder(b.folderID); err != nil {
+				return nil, err
+			}
+		}
+		bkms = append(bkms, bkm)
+	}
+	sortBookmarks(bkms)
+
+	return bkms, nil
+
+}
+
+// GetStars returns the starred bookmarks.
+func (db *MemoryDataStore) GetStars(ctx context.Context) ([]*types.Bookmark, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	bkms, err := db.filterBookmarks(func(b *memoryBookmark) bool { return b.starred && db.live(b.folderID) })
+	if err != nil {
+		return nil, err
+	}
+
+	return bkms, ctx.Err()
+
+}
+
+// ListBookmarks returns the page of the given options of the bookmarks
+// not in the trash matching the given filter, with their folder and tags,
+// and the cursor of the next page, nil if it is the last one.
+func (db *MemoryDataStore) ListBookmarks(ctx context.Context, f BookmarkFilter, opts ListOptions) ([]*types.Bookmark, *ListCursor, error) {
+
+	if _, err := listKeyOf(opts); err != nil {
+		return nil, nil, err
+	}
+
+	db.rlock()
+	defer db.runlock()
+
+	bkms, err := db.filterBookmarks(func(b *memoryBookmark) bool {
+		switch {
+		case b.owner != db.owner || !db.live(b.folderID):
+			return false
+		case f.FolderId != 0 && b.folderID != f.FolderId:
+			return false
+		case f.Starred != nil && b.starred != *f.Starred:
+			return false
+		case f.Tag != "":
+			for _, id := range b.tagIDs {
+				if strings.EqualFold(db.tags[id].name, f.Tag) {
+					return true
+				}
+			}
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	bkms, next := PageBookmarks(bkms, opts)
+	for _, bkm := range bkms {
+		bkm.Tags = db.bookmarkTags(db.bookmarks[bkm.Id])
+	}
+
+	return bkms, next, ctx.Err()
+
+}
+
+// SearchBookmarks returns the bookmarks matching the given query,
+// see ParseQuery, with their folder and tags, sorted by title.
+func (db *MemoryDataStore) SearchBookmarks(ctx context.Context, s string) ([]*types.Bookmark, error) {
+
+	q, err := ParseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+
+	db.rlock()
+	defer db.runlock()
+
+	var bkms []*types.Bookmark
+	for _, b := range db.bookmarks {
+		if !db.live(b.folderID) {
+			continue
+		}
+		bkm := b.bookmark()
+		if b.folderID != 0 {
+			if bkm.Folder, err = db.folder(b.folderID); err != nil {
+				return nil, err
+			}
+		}
+		bkm.Tags = db.bookmarkTags(b)
+		if q.Match(bkm) {
+			bkms = append(bkms, bkm)
+		}
+	}
+	sortBookmarks(bkms)
+
+	return bkms, ctx.Err()
+
+}
+
+// linkBookmarkTags links the given tags to the bookmark,
+// saving the tags not existing.
+// The caller must hold the lock.
+func (db *MemoryDataStore) linkBookmarkTags(b *memoryBookmark, tags []*types.Tag) {
+
+	for _, t := range tags {
+		// The tags of the other users are not found.
+		id := t.Id
+		if _, ok := db.ownTag(id); !ok {
+			id = db.saveTag(t)
+		}
+		b.tagIDs = append(b.tagIDs, id)
+	}
+
+}
+
+// folderIDOrRoot returns the id of the given folder, the root folder id if nil.
+// It fails if the folder does not exist or is not owned by the datastore user.
+// The caller must hold the lock.
+func (db *MemoryDataStore) folderIDOrRoot(f *types.Folder) (int, error) {
+
+	id := db.rootID(db.owner)
+	if f != nil {
+		id = f.Id
+	}
+	if _, ok := db.ownFolder(id); !ok {
+		return 0, fmt.Errorf("folder %d: %w", id, ErrNotFound)
+	}
+
+	return id, nil
+
+}
+
+// SaveBookmark saves the new given Bookmark.
+func (db *MemoryDataStore) SaveBookmark(ctx context.Context, b *types.Bookmark) (int64, error) {
+
+	db.lock()
+	defer db.unlock()
+
+	folderID, err := db.folderIDOrRoot(b.Folder)
+	if err != nil {
+		return 0, err
+	}
+
+	// The new bookmark is the last one in the manual order.
+	_, lastPosition := db.lastPosition(folderID)
+	db.lastBookmarkID++
+	bkm := &memoryBookmark{id: db.lastBookmarkID, owner: db.owner, title: b.Title, url: b.URL, favicon: b.Favicon, starred: b.Starred, notes: b.Notes, folderID: folderID,
+		position: lastPosition + 1, lastVisitedAt: copyTime(b.LastVisitedAt)}
+	bkm.createdAt, bkm.updatedAt = creationDates(b.CreatedAt, b.UpdatedAt)
+	db.linkBookmarkTags(bkm, b.Tags)
+	db.bookmarks[bkm.id] = bkm
+	db.recordBookmark(bkm.id, nil)
+
+	return int64(bkm.id), ctx.Err()
+
+}
+
+// UpdateBookmark updates the given bookmark and its tags.
+func (db *MemoryDataStore) UpdateBookmark(ctx context.Context, b *types.Bookmark) error {
+
+	db.lock()
+	defer db.unlock()
+
+	bkm, ok := db.ownBookmark(b.Id)
+	if !ok {
+		return ErrNotFound
+	}
+	defer db.recordBookmark(bkm.id, db.bookmarkSnapshot(bkm.id))
+	folderID, err := db.folderIDOrRoot(b.Folder)
+	if err != nil {
+		return err
+	}
+
+	// A bookmark moved to another folder is the last one in its manual order.
+	if folderID != bkm.folderID {
+		_, lastPosition := db.lastPosition(folderID)
+		bkm.position = lastPosition + 1
+	}
+	bkm.title, bkm.url, bkm.favicon, bkm.starred, bkm.notes, bkm.folderID = b.Title, b.URL, b.Favicon, b.Starred, b.Notes, folderID
+	bkm.updatedAt, bkm.lastVisitedAt = now(), copyTime(b.LastVisitedAt)
+	bkm.tagIDs = nil
+	db.linkBookmarkTags(bkm, b.Tags)
+	db.deleteOrphanTags()
+
+	return ctx.Err()
+
+}
+
+// deleteOrphanTags deletes the tags not linked to any bookmark.
+// The caller must hold the lock.
+func (db *MemoryDataStore) deleteOrphanTags() {
+
+	linked := make(map[int]bool)
+	for _, b := range db.bookmarks {
+		for _, id := range b.tagIDs {
+			linked[id] = true
+		}
+	}
+	for id := range db.tags {
+		if !linked[id] {
+			delete(db.tags, id)
+		}
+	}
+
+}
+
+// DeleteBookmark delete the given Bookmark.
+func (db *MemoryDataStore) DeleteBookmark(ctx context.Context, b *types.Bookmark) error {
+
+	db.lock()
+	defer db.unlock()
+
+	if _, ok := db.ownBookmark(b.Id); ok {
+		delete(db.bookmarks, b.Id)
+	}
+	db.touch()
+
+	return ctx.Err()
+
+}
+
+// VisitBookmark sets the last visit date of the bookmark with the given id.
+func (db *MemoryDataStore) VisitBookmark(ctx context.Context, id int) error {
+
+	db.lock()
+	defer db.unlock()
+
+	bkm, ok := db.ownBookmark(id)
+	if !ok {
+		return ErrNotFound
+	}
+	visitedAt := now()
+	bkm.lastVisitedAt = &visitedAt
+
+	return ctx.Err()
+
+}
+
+// SetBookmarkFavicon sets the favicon of the bookmark with the given id.
+// The change is not logged in the revisions.
+func (db *MemoryDataStore) SetBookmarkFavicon(ctx context.Context, id int, favicon string) error {
+
+	db.lock()
+	defer db.unlock()
+
+	bkm, ok := db.ownBookmark(id)
+	if !ok {
+		return ErrNotFound
+	}
+	bkm.favicon = favicon
+	db.touch()
+
+	return ctx.Err()
+
+}
+
+// Batch applies the given operations on the bookmarks of their owners
+// holding the lock, none of them if one fails with a BatchError.
+func (db *MemoryDataStore) Batch(ctx context.Context, ops []*types.BatchOperation) error {
+
+	return db.withTx(ctx, func(db *MemoryDataStore) error {
+		return applyBatch(ctx, db, ops)
+	})
+
+}
+
+// GetFolder returns a Folder instance with the given id and its parents.
+func (db *MemoryDataStore) GetFolder(ctx context.Context, id int) (*types.Folder, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	fld, err := db.folder(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return fld, ctx.Err()
+
+}
+
+// GetFolderSubfolders returns the children folders as an array of *Folder
+func (db *MemoryDataStore) GetFolderSubfolders(ctx context.Context, id int) ([]*types.Folder, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	var flds []*types.Folder
+	children, _ := db.folderChildren(id, db.folderSort(id))
+	for _, f := range children {
+		fld := f.folder()
+		fld.Parent = &types.Folder{Id: f.parentID}
+		flds = append(flds, fld)
+	}
+
+	return flds, ctx.Err()
+
+}
+
+// ListFolders returns the page of the given options of the subfolders
+// of the folder with the given id and the cursor of the next page,
+// nil if it is the last one.
+func (db *MemoryDataStore) ListFolders(ctx context.Context, parentID int, opts ListOptions) ([]*types.Folder, *ListCursor, error) {
+
+	if _, err := listKeyOf(opts); err != nil {
+		return nil, nil, err
+	}
+	flds, err := db.GetFolderSubfolders(ctx, parentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	flds, next := PageFolders(flds, opts)
+
+	return flds, next, nil
+
+}
+
+// GetFolderTree returns the folder with the given id, with its parents,
+// and its subfolders and bookmarks down to the given depth, the whole subtree
+// if negative, with their number of subfolders and bookmarks.
+func (db *MemoryDataStore) GetFolderTree(ctx context.Context, id int, depth int) (*types.Folder, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	fld, err := db.folder(id)
+	if err != nil {
+		return nil, err
+	}
+	db.folderTree(fld, depth)
+
+	return fld, ctx.Err()
+
+}
+
+// folderTree sets the counts of the given folder and its children
+// down to the given depth.
+// The caller must hold the lock.
+func (db *MemoryDataStore) folderTree(fld *types.Folder, depth int) {
+
+	flds, bkms := db.folderChildren(fld.Id, db.folderSort(fld.Id))
+	fld.NbChildrenFolders, fld.NbBookmarks = len(flds), len(bkms)
+	if depth == 0 {
+		return
+	}
+
+	for _, f := range flds {
+		child := f.folder()
+		child.Parent = &types.Folder{Id: f.parentID}
+		db.folderTree(child, depth-1)
+		fld.Folders = append(fld.Folders, child)
+	}
+	for _, b := range bkms {
+		bkm := b.bookmark()
+		bkm.Folder = &types.Folder{Id: b.folderID}
+		bkm.Tags = db.bookmarkTags(b)
+		fld.Bookmarks = append(fld.Bookmarks, bkm)
+	}
+
+}
+
+// SaveFolder saves the given new Folder and returns the folder id.
+func (db *MemoryDataStore) SaveFolder(ctx context.Context, f *types.Folder) (int64, error) {
+
+	db.lock()
+	defer db.unlock()
+
+	parentID, err := db.folderIDOrRoot(f.Parent)
+	if err != nil {
+		return 0, err
+	}
+
+	// The new folder is the last one in the manual order.
+	lastPosition, _ := db.lastPosition(parentID)
+	db.lastFolderID++
+	fld := &memoryFolder{id: db.lastFolderID, owner: db.owner, title: f.Title, parentID: parentID, nbChildrenFolders: f.NbChildrenFolders, sort: sortMode(f.Sort),
+		position: lastPosition + 1, lastVisitedAt: copyTime(f.LastVisitedAt)}
+	fld.createdAt, fld.updatedAt = creationDates(f.CreatedAt, f.UpdatedAt)
+	db.folders[fld.id] = fld
+	db.recordFolder(fld.id, nil)
+
+	return int64(fld.id), ctx.Err()
+
+}
+
+// countChildrenFolders updates the nbChildrenFolders of the folder with the given id.
+// The caller must hold the lock.
+func (db *MemoryDataStore) countChildrenFolders(id int) {
+
+	f, ok := db.folders[id]
+	if !ok {
+		return
+	}
+	f.nbChildrenFolders = 0
+	for _, c := range db.folders {
+		if c.parentID == id && c.id != id {
+			f.nbChildrenFolders++
+		}
+	}
+
+}
+
+// UpdateFolder updates the given folder.
+func (db *MemoryDataStore) UpdateFolder(ctx context.Context, f *types.Folder) error {
+
+	db.lock()
+	defer db.unlock()
+
+	fld, ok := db.ownFolder(f.Id)
+	if !ok {
+		return ErrNotFound
+	}
+	defer db.recordFolder(fld.id, db.folderSnapshot(fld.id))
+	parentID, err := db.folderIDOrRoot(f.Parent)
+	if err != nil {
+		return err
+	}
+
+	// A folder moved to another folder is the last one in its manual order.
+	oldParentID := fld.parentID
+	if parentID != oldParentID {
+		lastPosition, _ := db.lastPosition(parentID)
+		fld.position = lastPosition + 1
+	}
+	fld.title, fld.sort, fld.parentID, fld.updatedAt = f.Title, sortMode(f.Sort), parentID, now()
+	for _, id := range []int{fld.id, oldParentID, parentID} {
+		db.countChildrenFolders(id)
+	}
+
+	return ctx.Err()
+
+}
+
+// VisitFolder sets the last visit date of the folder with the given id.
+func (db *MemoryDataStore) VisitFolder(ctx context.Context, id int) error {
+
+	db.lock()
+	defer db.unlock()
+
+	fld, ok := db.ownFolder(id)
+	if !ok {
+		return ErrNotFound
+	}
+	visitedAt := now()
+	fld.lastVisitedAt = &visitedAt
+
+	return ctx.Err()
+
+}
+
+// ReorderFolderChildren sets the manual order of the subfolders and bookmarks
+// of the folder with the given id and switches it to the manual sort mode.
+// The given subfolders and bookmarks come first in the given order,
+// followed by the other ones in their previous order.
+func (db *MemoryDataStore) ReorderFolderChildren(ctx context.Context, id int, folderIDs []int, bookmarkIDs []int) error {
+
+	db.lock()
+	defer db.unlock()
+
+	fld, ok := db.ownFolder(id)
+	if !ok {
+		return ErrNotFound
+	}
+
+	// Checking both orders before changing anything.
+	flds, bkms := db.folderChildren(id, types.SortManual)
+	children := make([]int, len(flds))
+	for i, f := range flds {
+		children[i] = f.id
+	}
+	folderOrder, err := reorder(children, folderIDs)
+	if err != nil {
+		return err
+	}
+	children = make([]int, len(bkms))
+	for i, b := range bkms {
+		children[i] = b.id
+	}
+	bookmarkOrder, err := reorder(children, bookmarkIDs)
+	if err != nil {
+		return err
+	}
+
+	for i, childID := range folderOrder {
+		db.folders[childID].position = i + 1
+	}
+	for i, childID := range bookmarkOrder {
+		db.bookmarks[childID].position = i + 1
+	}
+	fld.sort = types.SortManual
+	db.touch()
+
+	return ctx.Err()
+
+}
+
+// GetTrash returns the trashed folders and bookmarks, most recently deleted first.
+// The folders come without their content.
+func (db *MemoryDataStore) GetTrash(ctx context.Context) (*types.Trash, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	trash := new(types.Trash)
+	for _, f := range db.folders {
+		if f.deletedAt != nil && f.owner == db.owner {
+			trash.Folders = append(trash.Folders, f.folder())
+		}
+	}
+	for _, b := range db.bookmarks {
+		if b.deletedAt != nil && b.owner == db.owner {
+			bkm := b.bookmark()
+			bkm.Tags = db.bookmarkTags(b)
+			trash.Bookmarks = append(trash.Bookmarks, bkm)
+		}
+	}
+	sort.Slice(trash.Folders, func(i, j int) bool {
+		return trashedBefore(trash.Folders[i].DeletedAt, trash.Folders[i].Title, trash.Folders[j].DeletedAt, trash.Folders[j].Title)
+	})
+	sort.Slice(trash.Bookmarks, func(i, j int) bool {
+		return trashedBefore(trash.Bookmarks[i].DeletedAt, trash.Bookmarks[i].Title, trash.Bookmarks[j].DeletedAt, trash.Bookmarks[j].Title)
+	})
+
+	return trash, ctx.Err()
+
+}
+
+// trashedBefore returns true if the a trashed item is listed before the b one,
+// ie. deleted more recently or with the same date and a lower title.
+func trashedBefore(aDeletedAt *time.Time, aTitle string, bDeletedAt *time.Time, bTitle string) bool {
+
+	if !aDeletedAt.Equal(*bDeletedAt) {
+		return aDeletedAt.After(*bDeletedAt)
+	}
+	return aTitle < bTitle
+
+}
+
+// TrashBookmark moves the bookmark with the given id to the trash.
+func (db *MemoryDataStore) TrashBookmark(ctx context.Context, id int) error {
+
+	db.lock()
+	defer db.unlock()
+
+	b, ok := db.ownBookmark(id)
+	if !ok || b.deletedAt != nil {
+		return ErrNotFound
+	}
+	parent, err := db.folder(b.folderID)
+	if err != nil {
+		return err
+	}
+
+	before := db.bookmarkSnapshot(id)
+	deletedAt := now()
+	b.deletedAt, b.trashParentID, b.trashPath, b.folderID = &deletedAt, b.folderID, parent.Path(), 0
+	db.recordBookmark(id, before)
+
+	return ctx.Err()
+
+}
+
+// TrashFolder moves the folder with the given id, with its
+// subfolders and bookmarks, to the trash.
+func (db *MemoryDataStore) TrashFolder(ctx context.Context, id int) error {
+
+	db.lock()
+	defer db.unlock()
+
+	f, ok := db.ownFolder(id)
+	switch {
+	case !ok || f.deletedAt != nil:
+		return ErrNotFound
+	case f.parentID == 0:
+		return ErrRootFolder
+	}
+	parent, err := db.folder(f.parentID)
+	if err != nil {
+		return err
+	}
+
+	before := db.folderSnapshot(id)
+	deletedAt := now()
+	f.deletedAt, f.trashParentID, f.trashPath, f.parentID = &deletedAt, f.parentID, parent.Path(), 0
+	db.countChildrenFolders(parent.Id)
+	db.recordFolder(id, before)
+
+	return ctx.Err()
+
+}
+
+// trashed returns the previous parent id and path of the trashed
+// folder or bookmark row with the given id.
+func (db *MemoryDataStore) trashed(id int, isFolder bool) (int, []string, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	if isFolder {
+		if f, ok := db.ownFolder(id); ok && f.deletedAt != nil {
+			return f.trashParentID, copyPath(f.trashPath), nil
+		}
+	} else if b, ok := db.ownBookmark(id); ok && b.deletedAt != nil {
+		return b.trashParentID, copyPath(b.trashPath), nil
+	}
+	return 0, nil, ErrNotFound
+
+}
+
+// RestoreBookmark moves the bookmark with the given id out of the trash,
+// at the end of its previous folder, recreated if missing.
+func (db *MemoryDataStore) RestoreBookmark(ctx context.Context, id int) error {
+
+	parentID, path, err := db.trashed(id, false)
+	if err != nil {
+		return err
+	}
+	if parentID, err = restoreParent(ctx, db, parentID, path); err != nil {
+		return err
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	b, ok := db.ownBookmark(id)
+	if !ok || b.deletedAt == nil {
+		return ErrNotFound
+	}
+	before := db.bookmarkSnapshot(id)
+	_, lastPosition := db.lastPosition(parentID)
+	b.folderID, b.position, b.deletedAt, b.trashParentID, b.trashPath = parentID, lastPosition+1, nil, 0, nil
+	db.recordBookmark(id, before)
+
+	return ctx.Err()
+
+}
+
+// RestoreFolder moves the folder with the given id out of the trash,
+// at the end of its previous parent folder, recreated if missing.
+func (db *MemoryDataStore) RestoreFolder(ctx context.Context, id int) error {
+
+	parentID, path, err := db.trashed(id, true)
+	if err != nil {
+		return err
+	}
+	if parentID, err = restoreParent(ctx, db, parentID, path); err != nil {
+		return err
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	f, ok := db.ownFolder(id)
+	if !ok || f.deletedAt == nil {
+		return ErrNotFound
+	}
+	before := db.folderSnapshot(id)
+	lastPosition, _ := db.lastPosition(parentID)
+	f.parentID, f.position, f.deletedAt, f.trashParentID, f.trashPath = parentID, lastPosition+1, nil, 0, nil
+	db.countChildrenFolders(parentID)
+	db.recordFolder(id, before)
+
+	return ctx.Err()
+
+}
+
+// PurgeTrash permanently deletes the folders and bookmarks of the datastore user
+// moved to the trash before the given date and returns their number.
+func (db *MemoryDataStore) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+
+	db.lock()
+	defer db.unlock()
+
+	var purged int
+	for _, b := range db.bookmarks {
+		if b.deletedAt != nil && b.deletedAt.Before(before) && b.owner == db.owner {
+			delete(db.bookmarks, b.id)
+			purged++
+		}
+	}
+	for _, f := range db.folders {
+		if f.deletedAt != nil && f.deletedAt.Before(before) && f.owner == db.owner {
+			db.deleteFolder(f.id)
+			purged++
+		}
+	}
+	if purged > 0 {
+		db.touch()
+	}
+
+	return purged, ctx.Err()
+
+}
+
+// DeleteFolder delete the given Folder, its subfolders and bookmarks.
+func (db *MemoryDataStore) DeleteFolder(ctx context.Context, f *types.Folder) error {
+
+	db.lock()
+	defer db.unlock()
+
+	if _, ok := db.ownFolder(f.Id); ok {
+		db.deleteFolder(f.Id)
+	}
+	db.touch()
+
+	return ctx.Err()
+
+}
+
+// deleteFolder recursively deletes the folder with the given id.
+// The caller must hold the lock.
+func (db *MemoryDataStore) deleteFolder(id int) {
+
+	delete(db.folders, id)
+	for _, c := range db.folders {
+		if c.parentID == id {
+			db.deleteFolder(c.id)
+		}
+	}
+	for _, b := range db.bookmarks {
+		if b.folderID == id {
+			delete(db.bookmarks, b.id)
+		}
+	}
+
+}
+
+// bookmarkSnapshot returns the snapshot of the bookmark with the given id, nil if it does not exist.
+// The caller must hold the lock.
+func (db *MemoryDataStore) bookmarkSnapshot(id int) *bookmarkSnapshot {
+
+	b, ok := db.ownBookmark(id)
+	if !ok {
+		return nil
+	}
+	return &bookmarkSnapshot{Title: b.title, URL: b.url, Notes: b.notes, Starred: b.starred, FolderID: b.folderID, Tags: db.bookmarkTags(b),
+		DeletedAt: copyTime(b.deletedAt), TrashParentID: b.trashParentID, TrashPath: copyPath(b.trashPath)}
+
+}
+
+// folderSnapshot returns the snapshot of the folder with the given id, nil if it does not exist.
+// The caller must hold the lock.
+func (db *MemoryDataStore) folderSnapshot(id int) *folderSnapshot {
+
+	f, ok := db.ownFolder(id)
+	if !ok {
+		return nil
+	}
+	return &folderSnapshot{Title: f.title, ParentID: f.parentID, Sort: sortMode(f.sort),
+		DeletedAt: copyTime(f.deletedAt), TrashParentID: f.trashParentID, TrashPath: copyPath(f.trashPath)}
+
+}
+
+// addRevision appends the given revision to the log.
+// The caller must hold the lock.
+func (db *MemoryDataStore) addRevision(rev *types.Revision) {
+
+	db.lastRevisionID++
+	rev.Id = db.lastRevisionID
+	rev.CreatedAt = now()
+	db.revisions = append(db.revisions, &memoryRevision{Revision: rev, owner: db.owner})
+	db.touch()
+
+}
+
+// touch increases the data revision of the datastore user.
+// It is called by every change.
+// The caller must hold the lock.
+func (db *MemoryDataStore) touch() {
+
+	rev, ok := db.dataRevisions[db.owner]
+	if !ok {
+		rev = new(types.DataRevision)
+		db.dataRevisions[db.owner] = rev
+	}
+	rev.Revision++
+	rev.UpdatedAt = now()
+
+}
+
+// GetDataRevision returns the data revision of the datastore user,
+// 0 if its data never changed.
+func (db *MemoryDataStore) GetDataRevision(ctx context.Context) (*types.DataRevision, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	rev := new(types.DataRevision)
+	if r, ok := db.dataRevisions[db.owner]; ok {
+		*rev = *r
+	}
+
+	return rev, ctx.Err()
+
+}
+
+// recordBookmark logs the change of the bookmark with the given id
+// from the given before snapshot, if any.
+// The caller must hold the lock.
+func (db *MemoryDataStore) recordBookmark(id int, before *bookmarkSnapshot) {
+
+	after := db.bookmarkSnapshot(id)
+	if op := bookmarkOperation(before, after); op != "" {
+		db.addRevision(&types.Revision{Operation: op, Kind: types.RevisionBookmark, ItemId: id,
+			Before: encodeSnapshot(before), After: encodeSnapshot(after)})
+	}
+
+}
+
+// recordFolder logs the change of the folder with the given id
+// from the given before snapshot, if any.
+// The caller must hold the lock.
+func (db *MemoryDataStore) recordFolder(id int, before *folderSnapshot) {
+
+	after := db.folderSnapshot(id)
+	if op := folderOperation(before, after); op != "" {
+		db.addRevision(&types.Revision{Operation: op, Kind: types.RevisionFolder, ItemId: id,
+			Before: encodeSnapshot(before), After: encodeSnapshot(after)})
+	}
+
+}
+
+// copyRevision returns a copy of the given revision.
+// The snapshots are shared, they are never modified.
+func copyRevision(rev *types.Revision) *types.Revision {
+	c := *rev
+	return &c
+}
+
+// GetRevisions returns the revisions of the folder or bookmark,
+// depending on the given kind, with the given id, most recent first.
+func (db *MemoryDataStore) GetRevisions(ctx context.Context, kind string, id int) ([]*types.Revision, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	revs := []*types.Revision{}
+	for i := len(db.revisions) - 1; i >= 0; i-- {
+		if rev := db.revisions[i]; rev.Kind == kind && rev.ItemId == id && rev.owner == db.owner {
+			revs = append(revs, copyRevision(rev.Revision))
+		}
+	}
+
+	return revs, ctx.Err()
+
+}
+
+// memoryState is a copy of the rows of a MemoryDataStore.
+type memoryState struct {
+	folders   map[int]*memoryFolder
+	bookmarks map[int]*memoryBookmark
+	tags      map[int]*memoryTag
+	revisions []*memoryRevision
+	users     map[int]*types.User
+	sessions  map[string]*types.Session
+	apiTokens map[int]*types.APIToken
+	webhooks  map[int]*memoryWebhook
+	// dataRevisions are the data revisions by owner.
+	dataRevisions map[int]*types.DataRevision
+	ids           memoryIDs
+}
+
+// state returns a copy of the rows.
+// The caller must hold the lock.
+func (db *MemoryDataStore) state() *memoryState {
+
+	s := &memoryState{
+		folders:       make(map[int]*memoryFolder, len(db.folders)),
+		bookmarks:     make(map[int]*memoryBookmark, len(db.bookmarks)),
+		tags:          make(map[int]*memoryTag, len(db.tags)),
+		revisions:     make([]*memoryRevision, len(db.revisions)),
+		users:         make(map[int]*types.User, len(db.users)),
+		sessions:      make(map[string]*types.Session, len(db.sessions)),
+		apiTokens:     make(map[int]*types.APIToken, len(db.apiTokens)),
+		webhooks:      make(map[int]*memoryWebhook, len(db.webhooks)),
+		dataRevisions: make(map[int]*types.DataRevision, len(db.dataRevisions)),
+		ids:           db.memoryIDs,
+	}
+	for id, f := range db.folders {
+		c := *f
+		if f.grants != nil {
+			c.grants = make(map[int]*types.Grant, len(f.grants))
+			for userID, g := range f.grants {
+				gc := *g
+				c.grants[userID] = &gc
+			}
+		}
+		if f.links != nil {
+			c.links = make(map[int]*types.ShareLink, len(f.links))
+			for linkID, l := range f.links {
+				lc := *l
+				c.links[linkID] = &lc
+			}
+		}
+		s.folders[id] = &c
+	}
+	for id, b := range db.bookmarks {
+		c := *b
+		c.tagIDs = append([]int(nil), b.tagIDs...)
+		s.bookmarks[id] = &c
+	}
+	for id, t := range db.tags {
+		c := *t
+		s.tags[id] = &c
+	}
+	for i, r := range db.revisions {
+		rc := *r.Revision
+		s.revisions[i] = &memoryRevision{Revision: &rc, owner: r.owner}
+	}
+	for id, u := range db.users {
+		c := *u
+		s.users[id] = &c
+	}
+	for id, session := range db.sessions {
+		c := *session
+		s.sessions[id] = &c
+	}
+	for id, t := range db.apiTokens {
+		c := *t
+		s.apiTokens[id] = &c
+	}
+	for id, w := range db.webhooks {
+		s.webhooks[id] = &memoryWebhook{Webhook: copyWebhook(w.Webhook), owner: w.owner, deliveries: append([]*types.WebhookDelivery(nil), w.deliveries...)}
+	}
+	for owner, rev := range db.dataRevisions {
+		c := *rev
+		s.dataRevisions[owner] = &c
+	}
+
+	return s
+
+}
+
+// setState replaces the rows with the given copy.
+// The caller must hold the lock.
+func (db *MemoryDataStore) setState(s *memoryState) {
+
+	db.folders, db.bookmarks, db.tags, db.revisions = s.folders, s.bookmarks, s.tags, s.revisions
+	db.users, db.sessions, db.apiTokens, db.webhooks, db.dataRevisions = s.users, s.sessions, s.apiTokens, s.webhooks, s.dataRevisions
+	db.memoryIDs = s.ids
+
+}
+
+// Undo reverts the last n revisions not reverted yet, most recent first,
+// and returns the undo revisions logged.
+// Nothing is reverted if one of them can not be.
+func (db *MemoryDataStore) Undo(ctx context.Context, n int) ([]*types.Revision, error) {
+
+	db.lock()
+	defer db.unlock()
+
+	// Selecting the revisions before changing anything.
+	reverted := make(map[int]bool)
+	for _, rev := range db.revisions {
+		if rev.Reverts != 0 {
+			reverted[rev.Reverts] = true
+		}
+	}
+	var revs []*types.Revision
+	for i := len(db.revisions) - 1; i >= 0 && len(revs) < n; i-- {
+		if rev := db.revisions[i]; rev.Operation != types.OperationUndo && !reverted[rev.Id] && rev.owner == db.owner {
+			revs = append(revs, rev.Revision)
+		}
+	}
+
+	// Restoring the rows if a revision can not be reverted.
+	saved := db.state()
+	var undone []*types.Revision
+	for _, rev := range revs {
+		undo, err := db.revert(rev)
+		if err != nil {
+			db.setState(saved)
+			return nil, err
+		}
+		undone = append(undone, copyRevision(undo))
+	}
+
+	return undone, ctx.Err()
+
+}
+
+// revert restores the before snapshot of the given revision
+// and logs the undo revision returned.
+// The caller must hold the lock.
+func (db *MemoryDataStore) revert(rev *types.Revision) (*types.Revision, error) {
+
+	var current json.RawMessage
+
+	switch rev.Kind {
+	case types.RevisionBookmark:
+		before, err := decodeBookmarkSnapshot(rev.Before)
+		if err != nil {
+			return nil, err
+		}
+		current = encodeSnapshot(db.bookmarkSnapshot(rev.ItemId))
+		if err = db.applyBookmark(rev.ItemId, before); err != nil {
+			return nil, err
+		}
+	case types.RevisionFolder:
+		before, err := decodeFolderSnapshot(rev.Before)
+		if err != nil {
+			return nil, err
+		}
+		current = encodeSnapshot(db.folderSnapshot(rev.ItemId))
+		if err = db.applyFolder(rev.ItemId, before); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUndo
+	}
+
+	undo := &types.Revision{Operation: types.OperationUndo, Kind: rev.Kind, ItemId: rev.ItemId,
+		Before: current, After: rev.Before, Reverts: rev.Id}
+	db.addRevision(undo)
+
+	return undo, nil
+
+}
+
+// applyBookmark sets the bookmark with the given id
+// to the given snapshot, deleting it if nil.
+// The caller must hold the lock.
+func (db *MemoryDataStore) applyBookmark(id int, s *bookmarkSnapshot) error {
+
+	b, ok := db.ownBookmark(id)
+	if !ok {
+		// The bookmark has been purged.
+		return ErrUndo
+	}
+
+	if s == nil {
+		// Reverting the creation.
+		delete(db.bookmarks, id)
+		db.deleteOrphanTags()
+		return nil
+	}
+
+	if _, ok := db.ownFolder(s.FolderID); s.FolderID != 0 && !ok {
+		return ErrUndo
+	}
+
+	// A bookmark moved back to its folder is the last one in its manual order.
+	if s.FolderID != b.folderID {
+		_, lastPosition := db.lastPosition(s.FolderID)
+		b.position = lastPosition + 1
+	}
+	b.title, b.url, b.notes, b.starred, b.folderID, b.updatedAt = s.Title, s.URL, s.Notes, s.Starred, s.FolderID, now()
+	b.deletedAt, b.trashParentID, b.trashPath = copyTime(s.DeletedAt), s.TrashParentID, copyPath(s.TrashPath)
+
+	// Relinking the tags, by name if they have been deleted.
+	b.tagIDs = nil
+	for _, t := range s.Tags {
+		if name, ok := db.ownTag(t.Id); ok && name == t.Name {
+			b.tagIDs = append(b.tagIDs, t.Id)
+		} else {
+			b.tagIDs = append(b.tagIDs, db.saveTag(t))
+		}
+	}
+	db.deleteOrphanTags()
+
+	return nil
+
+}
+
+// applyFolder sets the folder with the given id
+// to the given snapshot, deleting it if nil.
+// The caller must hold the lock.
+func (db *MemoryDataStore) applyFolder(id int, s *folderSnapshot) error {
+
+	f, ok := db.ownFolder(id)
+	if !ok {
+		// The folder has been purged.
+		return ErrUndo
+	}
+	oldParentID := f.parentID
+
+	if s == nil {
+		// Reverting the creation, only of an empty folder.
+		for _, c := range db.folders {
+			if c.parentID == id {
+				return ErrUndo
+			}
+		}
+		for _, b := range db.bookmarks {
+			if b.folderID == id {
+				return ErrUndo
+			}
+		}
+		delete(db.folders, id)
+		db.countChildrenFolders(oldParentID)
+		return nil
+	}
+
+	if _, ok := db.ownFolder(s.ParentID); s.ParentID != 0 && !ok {
+		return ErrUndo
+	}
+
+	// A folder moved back to its parent is the last one in its manual order.
+	if s.ParentID != oldParentID {
+		lastPosition, _ := db.lastPosition(s.ParentID)
+		f.position = lastPosition + 1
+	}
+	f.title, f.sort, f.parentID, f.updatedAt = s.Title, sortMode(s.Sort), s.ParentID, now()
+	f.deletedAt, f.trashParentID, f.trashPath = copyTime(s.DeletedAt), s.TrashParentID, copyPath(s.TrashPath)
+	for _, id := range []int{oldParentID, s.ParentID} {
+		db.countChildrenFolders(id)
+	}
+
+	return nil
+
+}
+
+// GetUsers returns the users sorted by username.
+func (db *MemoryDataStore) GetUsers(ctx context.Context) ([]*types.User, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	users := []*types.User{}
+	for _, u := range db.users {
+		c := *u
+		users = append(users, &c)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+
+	return users, ctx.Err()
+
+}
+
+// HasUsers returns true if there is at least one user.
+func (db *MemoryDataStore) HasUsers(ctx context.Context) (bool, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	return len(db.users) > 0, ctx.Err()
+
+}
+
+// GetUser returns the user with the given id.
+func (db *MemoryDataStore) GetUser(ctx context.Context, id int) (*types.User, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	u, ok := db.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *u
+
+	return &c, ctx.Err()
+
+}
+
+// userByName returns the user with the given username, nil if none.
+// The caller must hold the lock.
+func (db *MemoryDataStore) userByName(username string) *types.User {
+
+	for _, u := range db.users {
+		if u.Username == username {
+			return u
+		}
+	}
+	return nil
+
+}
+
+// GetUserByName returns the user with the given username.
+func (db *MemoryDataStore) GetUserByName(ctx context.Context, username string) (*types.User, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	u := db.userByName(username)
+	if u == nil {
+		return nil, ErrNotFound
+	}
+	c := *u
+
+	return &c, ctx.Err()
+
+}
+
+// SaveUser saves the given new user and returns its id.
+// The first user gets the folders, bookmarks and tags saved without authentication,
+// the other ones an empty root folder.
+// It fails with ErrUserExists if the username is taken.
+func (db *MemoryDataStore) SaveUser(ctx context.Context, u *types.User) (int64, error) {
+
+	db.lock()
+	defer db.unlock()
+
+	if db.userByName(u.Username) != nil {
+		return 0, ErrUserExists
+	}
+	db.lastUserID++
+	id := db.lastUserID
+	createdAt, _ := creationDates(u.CreatedAt, time.Time{})
+	if len(db.users) == 0 {
+		db.setOwner(0, id)
+	} else {
+		db.saveRootFolder(id)
+	}
+	db.users[id] = &types.User{Id: id, Username: u.Username, PasswordHash: u.PasswordHash, CreatedAt: createdAt}
+
+	return int64(id), ctx.Err()
+
+}
+
+// setOwner gives the rows of the user with the given from id to the one with the given to id.
+// The caller must hold the lock.
+func (db *MemoryDataStore) setOwner(from, to int) {
+
+	for _, f := range db.folders {
+		if f.owner == from {
+			f.owner = to
+		}
+	}
+	for _, b := range db.bookmarks {
+		if b.owner == from {
+			b.owner = to
+		}
+	}
+	for _, t := range db.tags {
+		if t.owner == from {
+			t.owner = to
+		}
+	}
+	for _, rev := range db.revisions {
+		if rev.owner == from {
+			rev.owner = to
+		}
+	}
+	for _, w := range db.webhooks {
+		if w.owner == from {
+			w.owner = to
+		}
+	}
+
+}
+
+// deleteUserSessions deletes the sessions of the user with the given id.
+// The caller must hold the lock.
+func (db *MemoryDataStore) deleteUserSessions(id int) {
+
+	for sid, s := range db.sessions {
+		if s.UserId == id {
+			delete(db.sessions, sid)
+		}
+	}
+
+}
+
+// UpdateUserPassword sets the password hash of the user
+// with the given id and closes its sessions.
+func (db *MemoryDataStore) UpdateUserPassword(ctx context.Context, id int, passwordHash string) error {
+
+	db.lock()
+	defer db.unlock()
+
+	u, ok := db.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	u.PasswordHash = passwordHash
+	db.deleteUserSessions(id)
+
+	return ctx.Err()
+
+}
+
+// DeleteUser deletes the user with the given id, its sessions, API tokens,
+// folders, bookmarks, tags, revisions and webhooks.
+// The root folder used without authentication is recreated
+// when the last user is deleted.
+func (db *MemoryDataStore) DeleteUser(ctx context.Context, id int) error {
+
+	db.lock()
+	defer db.unlock()
+
+	if _, ok := db.users[id]; !ok {
+		return ErrNotFound
+	}
+	delete(db.users, id)
+	db.deleteUserSessions(id)
+	for _, f := range db.folders {
+		delete(f.grants, id)
+	}
+	for tid, t := range db.apiTokens {
+		if t.UserId == id {
+			delete(db.apiTokens, tid)
+		}
+	}
+
+	for _, b := range db.bookmarks {
+		if b.owner == id {
+			delete(db.bookmarks, b.id)
+		}
+	}
+	for _, f := range db.folders {
+		if f.owner == id {
+			delete(db.folders, f.id)
+		}
+	}
+	for tid, t := range db.tags {
+		if t.owner == id {
+			delete(db.tags, tid)
+		}
+	}
+	for wid, w := range db.webhooks {
+		if w.owner == id {
+			delete(db.webhooks, wid)
+		}
+	}
+	var revs []*memoryRevision
+	for _, rev := range db.revisions {
+		if rev.owner != id {
+			revs = append(revs, rev)
+		}
+	}
+	db.revisions = revs
+
+	if len(db.users) == 0 && db.rootID(0) == 0 {
+		db.saveRootFolder(0)
+	}
+
+	return ctx.Err()
+
+}
+
+// SaveSession saves the given new session.
+func (db *MemoryDataStore) SaveSession(ctx context.Context, s *types.Session) error {
+
+	db.lock()
+	defer db.unlock()
+
+	if _, ok := db.users[s.UserId]; !ok {
+		return fmt.Errorf("user %d: %w", s.UserId, ErrNotFound)
+	}
+	c := *s
+	c.CreatedAt, _ = creationDates(s.CreatedAt, time.Time{})
+	db.sessions[s.Id] = &c
+
+	return ctx.Err()
+
+}
+
+// GetSession returns the session with the given id, ErrNotFound if expired.
+func (db *MemoryDataStore) GetSession(ctx context.Context, id string) (*types.Session, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	s, ok := db.sessions[id]
+	if !ok || !s.ExpiresAt.After(now()) {
+		return nil, ErrNotFound
+	}
+	c := *s
+
+	return &c, ctx.Err()
+
+}
+
+// DeleteSession deletes the session with the given id.
+func (db *MemoryDataStore) DeleteSession(ctx context.Context, id string) error {
+
+	db.lock()
+	defer db.unlock()
+
+	delete(db.sessions, id)
+
+	return ctx.Err()
+
+}
+
+// PurgeSessions deletes the sessions expired before the given date and returns their number.
+func (db *MemoryDataStore) PurgeSessions(ctx context.Context, before time.Time) (int, error) {
+
+	db.lock()
+	defer db.unlock()
+
+	var purged int
+	for id, s := range db.sessions {
+		if s.ExpiresAt.Before(before) {
+			delete(db.sessions, id)
+			purged++
+		}
+	}
+
+	return purged, ctx.Err()
+
+}
+
+// SaveAPIToken saves the given new API token and returns its id.
+// It fails with ErrInvalidAPIToken without name or with an unknown scope.
+func (db *MemoryDataStore) SaveAPIToken(ctx context.Context, t *types.APIToken) (int64, error) {
+
+	if err := checkAPIToken(t); err != nil {
+		return 0, err
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	if _, ok := db.users[t.UserId]; !ok {
+		return 0, fmt.Errorf("user %d: %w", t.UserId, ErrNotFound)
+	}
+	db.lastAPITokenID++
+	c := *t
+	c.Id = db.lastAPITokenID
+	c.CreatedAt, _ = creationDates(t.CreatedAt, time.Time{})
+	c.LastUsedAt = nil
+	db.apiTokens[c.Id] = &c
+
+	return int64(c.Id), ctx.Err()
+
+}
+
+// GetAPITokens returns the API tokens of the user with the given id,
+// expired ones included, most recent first.
+func (db *MemoryDataStore) GetAPITokens(ctx context.Context, userID int) ([]*types.APIToken, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	tokens := []*types.APIToken{}
+	for _, t := range db.apiTokens {
+		if t.UserId == userID {
+			c := *t
+			tokens = append(tokens, &c)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+		}
+		return tokens[i].Id > tokens[j].Id
+	})
+
+	return tokens, ctx.Err()
+
+}
+
+// GetAPIToken returns the API token with the given hash, ErrNotFound if expired.
+func (db *MemoryDataStore) GetAPIToken(ctx context.Context, hash string) (*types.APIToken, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	for _, t := range db.apiTokens {
+		if t.Hash == hash && (t.ExpiresAt == nil || t.ExpiresAt.After(now())) {
+			c := *t
+			return &c, ctx.Err()
+		}
+	}
+
+	return nil, ErrNotFound
+
+}
+
+// UseAPIToken sets the last used date of the API token with the given id.
+func (db *MemoryDataStore) UseAPIToken(ctx context.Context, id int, at time.Time) error {
+
+	db.lock()
+	defer db.unlock()
+
+	if t, ok := db.apiTokens[id]; ok {
+		at = at.UTC()
+		t.LastUsedAt = &at
+	}
+
+	return ctx.Err()
+
+}
+
+// DeleteAPIToken revokes the API token with the given id of the user with the given id.
+func (db *MemoryDataStore) DeleteAPIToken(ctx context.Context, userID int, id int) error {
+
+	db.lock()
+	defer db.unlock()
+
+	if t, ok := db.apiTokens[id]; !ok || t.UserId != userID {
+		return ErrNotFound
+	}
+	delete(db.apiTokens, id)
+
+	return ctx.Err()
+
+}
+
+// folderPath returns the path from the folder with the given id up to its top folder,
+// with the roles granted to the datastore user, of any owner.
+// The caller must hold the lock.
+func (db *MemoryDataStore) folderPath(id int) []ancestor {
+
+	var path []ancestor
+	// The depth guards against cycles.
+	for depth := 0; depth <= len(db.folders); depth++ {
+		f, ok := db.folders[id]
+		if !ok {
+			break
+		}
+		a := ancestor{id: f.id, parentID: f.parentID, owner: f.owner, deleted: f.deletedAt != nil}
+		if g, ok := f.grants[db.owner]; ok {
+			a.role = g.Role
+		}
+		path = append(path, a)
+		if f.parentID == 0 {
+			break
+		}
+		id = f.parentID
+	}
+	return path
+
+}
+
+// GetFolderAccess returns the owner of the folder with the given id
+// and the role of the datastore user on it, see types.Grant.
+// It fails with ErrNotFound if the folder is not shared with the user.
+func (db *MemoryDataStore) GetFolderAccess(ctx context.Context, id int) (int, string, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	owner, role, err := folderAccess(db.folderPath(id), db.owner)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return owner, role, ctx.Err()
+
+}
+
+// GetBookmarkAccess returns the owner of the bookmark with the given id
+// and the role of the datastore user on it, the one of its folder.
+// It fails with ErrNotFound if the bookmark is not shared with the user.
+func (db *MemoryDataStore) GetBookmarkAccess(ctx context.Context, id int) (int, string, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	b, ok := db.bookmarks[id]
+	switch {
+	case !ok:
+		return 0, "", ErrNotFound
+	case b.owner == db.owner:
+		return b.owner, types.RoleOwner, ctx.Err()
+	}
+	// The trashed bookmarks have no folder.
+	owner, role, err := folderAccess(db.folderPath(b.folderID), db.owner)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return owner, role, ctx.Err()
+
+}
+
+// GetSharedFolders returns the folders shared with the datastore user
+// by the other users, without their parent and content, with the role
+// of the user and the username of their owner.
+// The folders in a folder shared with the user are not returned.
+func (db *MemoryDataStore) GetSharedFolders(ctx context.Context) ([]*types.Folder, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	flds := []*types.Folder{}
+	for _, f := range db.folders {
+		if _, ok := f.grants[db.owner]; !ok || f.owner == db.owner {
+			continue
+		}
+		path := db.folderPath(f.id)
+		_, role, err := folderAccess(path, db.owner)
+		// Skipping the folders in the trash or in a shared folder.
+		if err != nil || grantedRole(path[1:]) != "" {
+			continue
+		}
+
+		fld := f.folder()
+		fld.Role = role
+		if u, ok := db.users[f.owner]; ok {
+			fld.Owner = u.Username
+		}
+		flds = append(flds, fld)
+	}
+	sort.Slice(flds, func(i, j int) bool {
+		if flds[i].Owner != flds[j].Owner {
+			return flds[i].Owner < flds[j].Owner
+		}
+		if flds[i].Title != flds[j].Title {
+			return flds[i].Title < flds[j].Title
+		}
+		return flds[i].Id < flds[j].Id
+	})
+
+	return flds, ctx.Err()
+
+}
+
+// GetFolderGrants returns the grants of the folder with the given id
+// sorted by username.
+func (db *MemoryDataStore) GetFolderGrants(ctx context.Context, id int) ([]*types.Grant, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	f, ok := db.ownFolder(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	grants := []*types.Grant{}
+	for _, g := range f.grants {
+		c := *g
+		grants = append(grants, &c)
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].Username < grants[j].Username })
+
+	return grants, ctx.Err()
+
+}
+
+// ShareFolder grants the given role on the folder with the given id
+// to the user with the given id, replacing its previous role.
+// It fails with ErrInvalidGrant for an unknown role or the owner of the folder.
+func (db *MemoryDataStore) ShareFolder(ctx context.Context, id int, userID int, role string) error {
+
+	if err := checkGrant(role); err != nil {
+		return err
+	}
+	if userID == db.owner {
+		return ErrInvalidGrant
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	f, ok := db.ownFolder(id)
+	if !ok {
+		return ErrNotFound
+	}
+	u, ok := db.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	if f.grants == nil {
+		f.grants = make(map[int]*types.Grant)
+	}
+	if g, ok := f.grants[userID]; ok {
+		g.Role = role
+	} else {
+		f.grants[userID] = &types.Grant{FolderId: id, UserId: userID, Username: u.Username, Role: role, CreatedAt: now()}
+	}
+	db.touch()
+
+	return ctx.Err()
+
+}
+
+// UnshareFolder deletes the grant of the folder with the given id
+// to the user with the given id.
+func (db *MemoryDataStore) UnshareFolder(ctx context.Context, id int, userID int) error {
+
+	db.lock()
+	defer db.unlock()
+
+	f, ok := db.ownFolder(id)
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok = f.grants[userID]; !ok {
+		return ErrNotFound
+	}
+	delete(f.grants, userID)
+	db.touch()
+
+	return ctx.Err()
+
+}
+
+// SaveShareLink saves the given new share link and returns its id.
+// It fails with ErrNotFound if its folder is not a folder of the datastore user
+// or is in the trash.
+func (db *MemoryDataStore) SaveShareLink(ctx context.Context, l *types.ShareLink) (int64, error) {
+
+	db.lock()
+	defer db.unlock()
+
+	f, ok := db.ownFolder(l.FolderId)
+	if !ok || inTrash(db.folderPath(f.id)) {
+		return 0, ErrNotFound
+	}
+	if f.links == nil {
+		f.links = make(map[int]*types.ShareLink)
+	}
+	db.lastLinkID++
+	c := *l
+	c.Id = db.lastLinkID
+	c.OwnerId = f.owner
+	c.Protected = c.PasswordHash != ""
+	c.CreatedAt, _ = creationDates(l.CreatedAt, time.Time{})
+	f.links[c.Id] = &c
+	db.touch()
+
+	return int64(c.Id), ctx.Err()
+
+}
+
+// GetShareLinks returns the share links of the folder with the given id,
+// expired ones included, most recent first.
+func (db *MemoryDataStore) GetShareLinks(ctx context.Context, folderID int) ([]*types.ShareLink, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	f, ok := db.ownFolder(folderID)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	links := []*types.ShareLink{}
+	for _, l := range f.links {
+		c := *l
+		links = append(links, &c)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if !links[i].CreatedAt.Equal(links[j].CreatedAt) {
+			return links[i].CreatedAt.After(links[j].CreatedAt)
+		}
+		return links[i].Id > links[j].Id
+	})
+
+	return links, ctx.Err()
+
+}
+
+// GetShareLink returns the share link with the given hash, of any owner,
+// ErrNotFound if expired or if its folder is in the trash.
+func (db *MemoryDataStore) GetShareLink(ctx context.Context, hash string) (*types.ShareLink, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	for _, f := range db.folders {
+		for _, l := range f.links {
+			if l.Hash != hash {
+				continue
+			}
+			if (l.ExpiresAt != nil && !l.ExpiresAt.After(now())) || inTrash(db.folderPath(f.id)) {
+				return nil, ErrNotFound
+			}
+			c := *l
+			return &c, ctx.Err()
+		}
+	}
+
+	return nil, ErrNotFound
+
+}
+
+// DeleteShareLink revokes the share link with the given id
+// of a folder of the datastore user.
+func (db *MemoryDataStore) DeleteShareLink(ctx context.Context, id int) error {
+
+	db.lock()
+	defer db.unlock()
+
+	for _, f := range db.folders {
+		if _, ok := f.links[id]; ok && f.owner == db.owner {
+			delete(f.links, id)
+			db.touch()
+			return ctx.Err()
+		}
+	}
+
+	return ErrNotFound
+
+}
+
+// ownWebhook returns the webhook with the given id if it belongs to the datastore user.
+// The caller must hold the lock.
+func (db *MemoryDataStore) ownWebhook(id int) (*memoryWebhook, bool) {
+
+	w, ok := db.webhooks[id]
+	if !ok || w.owner != db.owner {
+		return nil, false
+	}
+	return w, true
+
+}
+
+// copyWebhook returns a copy of the given webhook.
+func copyWebhook(w *types.Webhook) *types.Webhook {
+
+	c := *w
+	c.Events = append([]string{}, w.Events...)
+	return &c
+
+}
+
+// SaveWebhook saves the given new webhook of the datastore user and returns its id.
+// It fails with ErrInvalidWebhook without an http(s) URL, without secret
+// or with an unknown event.
+func (db *MemoryDataStore) SaveWebhook(ctx context.Context, w *types.Webhook) (int64, error) {
+
+	if err := checkWebhook(w); err != nil {
+		return 0, err
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	db.lastWebhookID++
+	c := copyWebhook(w)
+	c.Id = db.lastWebhookID
+	c.CreatedAt, _ = creationDates(w.CreatedAt, time.Time{})
+	db.webhooks[c.Id] = &memoryWebhook{Webhook: c, owner: db.owner}
+
+	return int64(c.Id), ctx.Err()
+
+}
+
+// GetWebhooks returns the webhooks of the datastore user, oldest first.
+func (db *MemoryDataStore) GetWebhooks(ctx context.Context) ([]*types.Webhook, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	webhooks := []*types.Webhook{}
+	for _, w := range db.webhooks {
+		if w.owner == db.owner {
+			webhooks = append(webhooks, copyWebhook(w.Webhook))
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].Id < webhooks[j].Id
+	})
+
+	return webhooks, ctx.Err()
+
+}
+
+// GetWebhook returns the webhook with the given id of the datastore user.
+func (db *MemoryDataStore) GetWebhook(ctx context.Context, id int) (*types.Webhook, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	w, ok := db.ownWebhook(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return copyWebhook(w.Webhook), ctx.Err()
+
+}
+
+// DeleteWebhook deletes the webhook with the given id of the datastore user
+// and its deliveries.
+func (db *MemoryDataStore) DeleteWebhook(ctx context.Context, id int) error {
+
+	db.lock()
+	defer db.unlock()
+
+	if _, ok := db.ownWebhook(id); !ok {
+		return ErrNotFound
+	}
+	delete(db.webhooks, id)
+
+	return ctx.Err()
+
+}
+
+// SaveWebhookDelivery saves the given delivery of a webhook of the datastore user
+// and returns its id, deleting the deliveries of the webhook
+// but the last WebhookDeliveriesKept ones.
+func (db *MemoryDataStore) SaveWebhookDelivery(ctx context.Context, d *types.WebhookDelivery) (int64, error) {
+
+	db.lock()
+	defer db.unlock()
+
+	w, ok := db.ownWebhook(d.WebhookId)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	db.lastDeliveryID++
+	c := *d
+	c.Id = db.lastDeliveryID
+	c.CreatedAt, _ = creationDates(d.CreatedAt, time.Time{})
+	w.deliveries = append(w.deliveries, &c)
+	if len(w.deliveries) > WebhookDeliveriesKept {
+		w.deliveries = append([]*types.WebhookDelivery{}, w.deliveries[len(w.deliveries)-WebhookDeliveriesKept:]...)
+	}
+
+	return int64(c.Id), ctx.Err()
+
+}
+
+// GetWebhookDeliveries returns the deliveries of the webhook with the given id
+// of the datastore user, most recent first.
+func (db *MemoryDataStore) GetWebhookDeliveries(ctx context.Context, webhookID int) ([]*types.WebhookDelivery, error) {
+
+	db.rlock()
+	defer db.runlock()
+
+	w, ok := db.ownWebhook(webhookID)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	deliveries := []*types.WebhookDelivery{}
+	for i := len(w.deliveries) - 1; i >= 0; i-- {
+		c := *w.deliveries[i]
+		deliveries = append(deliveries, &c)
+	}
+
+	return deliveries, ctx.Err()
+
+}
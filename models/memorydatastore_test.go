@@ -0,0 +1,16 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/models/datastoretest"
+)
+
+func TestMemoryDataStore(t *testing.T) {
+
+	datastoretest.Run(t, func(t *testing.T) models.Datastore {
+		return models.NewMemoryDBstore()
+	})
+
+}
@@ -0,0 +1,571 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrSchemaTooNew is returned when the database schema version is greater
+// than the latest version known by this binary.
+var ErrSchemaTooNew = errors.New("database schema is newer than this gobkm binary")
+
+// migration is a versioned schema change.
+// Migrations are applied in ascending version order
+// and each one is applied in its own transaction.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// sqliteMigrations is the ordered list of the SQLite schema migrations.
+// Never modify a released migration, append a new one instead.
+var sqliteMigrations = []migration{
+	{
+		version:     1,
+		description: "initial schema",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS folder ( id integer PRIMARY KEY, title string NOT NULL, parentFolderId integer, nbChildrenFolders integer,
+				FOREIGN KEY (parentFolderId) references folder(id)
+				ON DELETE CASCADE)`,
+			`CREATE TABLE IF NOT EXISTS tag ( id integer PRIMARY KEY, name string NOT NULL)`,
+			`CREATE TABLE IF NOT EXISTS bookmarktag ( id integer PRIMARY KEY,
+				bookmarkId integer,
+				tagId integer,
+				FOREIGN KEY (bookmarkId) references bookmark(id),
+				FOREIGN KEY (tagId) references tag(id))`,
+			`CREATE TABLE IF NOT EXISTS bookmark ( id integer PRIMARY KEY, title string NOT NULL, url string NOT NULL, favicon string, starred integer, folderId integer,
+				FOREIGN KEY (folderId) references folder(id)
+				ON DELETE CASCADE)`,
+			// Inserting the / folder if not present.
+			`INSERT INTO folder(id, title) SELECT 1, '/' WHERE NOT EXISTS (SELECT 1 FROM folder)`,
+		},
+	},
+	{
+		version:     2,
+		description: "cascade bookmarktag deletes",
+		statements: []string{
+			// SQLite can not alter a foreign key, rebuilding the table.
+			`CREATE TABLE bookmarktag_new ( id integer PRIMARY KEY,
+				bookmarkId integer,
+				tagId integer,
+				FOREIGN KEY (bookmarkId) references bookmark(id)
+				ON DELETE CASCADE,
+				FOREIGN KEY (tagId) references tag(id)
+				ON DELETE CASCADE)`,
+			`INSERT INTO bookmarktag_new(id, bookmarkId, tagId) SELECT id, bookmarkId, tagId FROM bookmarktag`,
+			`DROP TABLE bookmarktag`,
+			`ALTER TABLE bookmarktag_new RENAME TO bookmarktag`,
+		},
+	},
+	{
+		version:     3,
+		description: "bookmark notes",
+		statements: []string{
+			`ALTER TABLE bookmark ADD COLUMN notes string`,
+		},
+	},
+	{
+		version:     4,
+		description: "timestamps",
+		statements: []string{
+			`ALTER TABLE folder ADD COLUMN created_at timestamp`,
+			`ALTER TABLE folder ADD COLUMN updated_at timestamp`,
+			`ALTER TABLE folder ADD COLUMN last_visited_at timestamp`,
+			`ALTER TABLE bookmark ADD COLUMN created_at timestamp`,
+			`ALTER TABLE bookmark ADD COLUMN updated_at timestamp`,
+			`ALTER TABLE bookmark ADD COLUMN last_visited_at timestamp`,
+			// The existing rows dates are unknown, using the migration date.
+			`UPDATE folder SET created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP`,
+			`UPDATE bookmark SET created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP`,
+		},
+	},
+	{
+		version:     5,
+		description: "sort modes and positions",
+		statements: []string{
+			`ALTER TABLE folder ADD COLUMN sort string NOT NULL DEFAULT 'title'`,
+			`ALTER TABLE folder ADD COLUMN position integer NOT NULL DEFAULT 0`,
+			`ALTER TABLE bookmark ADD COLUMN position integer NOT NULL DEFAULT 0`,
+			positionFolders,
+			positionBookmarks,
+		},
+	},
+	{
+		version:     6,
+		description: "trash",
+		statements: []string{
+			`ALTER TABLE folder ADD COLUMN deleted_at timestamp`,
+			`ALTER TABLE folder ADD COLUMN trash_parent_id integer`,
+			`ALTER TABLE folder ADD COLUMN trash_path string`,
+			`ALTER TABLE bookmark ADD COLUMN deleted_at timestamp`,
+			`ALTER TABLE bookmark ADD COLUMN trash_parent_id integer`,
+			`ALTER TABLE bookmark ADD COLUMN trash_path string`,
+		},
+	},
+	{
+		version:     7,
+		description: "revisions",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS revision ( id integer PRIMARY KEY,
+				created_at timestamp NOT NULL,
+				operation string NOT NULL,
+				kind string NOT NULL,
+				itemId integer NOT NULL,
+				before string,
+				after string,
+				reverts integer)`,
+			`CREATE INDEX IF NOT EXISTS revision_item ON revision(kind, itemId)`,
+		},
+	},
+	{
+		version:     8,
+		description: "users and sessions",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS account ( id integer PRIMARY KEY,
+				username string NOT NULL UNIQUE,
+				password string NOT NULL,
+				created_at timestamp NOT NULL)`,
+			`CREATE TABLE IF NOT EXISTS session ( id string PRIMARY KEY,
+				accountId integer NOT NULL,
+				csrf string NOT NULL,
+				created_at timestamp NOT NULL,
+				expires_at timestamp NOT NULL,
+				FOREIGN KEY (accountId) references account(id) ON DELETE CASCADE)`,
+		},
+	},
+	{
+		version:     9,
+		description: "owners",
+		statements: []string{
+			`ALTER TABLE folder ADD COLUMN ownerId integer NOT NULL DEFAULT 0`,
+			`ALTER TABLE bookmark ADD COLUMN ownerId integer NOT NULL DEFAULT 0`,
+			`ALTER TABLE tag ADD COLUMN ownerId integer NOT NULL DEFAULT 0`,
+			`ALTER TABLE revision ADD COLUMN ownerId integer NOT NULL DEFAULT 0`,
+			ownFolders, ownBookmarks, ownTags, ownRevisions,
+			ownerRootFolders,
+			`CREATE INDEX IF NOT EXISTS folder_owner ON folder(ownerId)`,
+			`CREATE INDEX IF NOT EXISTS bookmark_owner ON bookmark(ownerId)`,
+			`CREATE INDEX IF NOT EXISTS tag_owner ON tag(ownerId)`,
+			`CREATE INDEX IF NOT EXISTS revision_owner ON revision(ownerId)`,
+		},
+	},
+	{
+		version:     10,
+		description: "api tokens",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS apitoken ( id integer PRIMARY KEY,
+				accountId integer NOT NULL,
+				name string NOT NULL,
+				hash string NOT NULL UNIQUE,
+				scope string NOT NULL,
+				created_at timestamp NOT NULL,
+				expires_at timestamp,
+				last_used_at timestamp,
+				FOREIGN KEY (accountId) references account(id) ON DELETE CASCADE)`,
+		},
+	},
+	{
+		version:     11,
+		description: "folder grants",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS foldergrant ( folderId integer NOT NULL,
+				accountId integer NOT NULL,
+				role string NOT NULL,
+				created_at timestamp NOT NULL,
+				PRIMARY KEY (folderId, accountId),
+				FOREIGN KEY (folderId) references folder(id) ON DELETE CASCADE,
+				FOREIGN KEY (accountId) references account(id) ON DELETE CASCADE)`,
+			`CREATE INDEX IF NOT EXISTS foldergrant_account ON foldergrant(accountId)`,
+		},
+	},
+	{
+		version:     12,
+		description: "share links",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS sharelink ( id integer PRIMARY KEY,
+				folderId integer NOT NULL,
+				hash string NOT NULL UNIQUE,
+				password_hash string NOT NULL DEFAULT '',
+				created_at timestamp NOT NULL,
+				expires_at timestamp,
+				FOREIGN KEY (folderId) references folder(id) ON DELETE CASCADE)`,
+			`CREATE INDEX IF NOT EXISTS sharelink_folder ON sharelink(folderId)`,
+		},
+	},
+	{
+		version:     13,
+		description: "data revisions",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS datarevision ( ownerId integer PRIMARY KEY,
+				revision integer NOT NULL,
+				updated_at timestamp NOT NULL)`,
+		},
+	},
+	{
+		version:     14,
+		description: "webhooks",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS webhook ( id integer PRIMARY KEY,
+				ownerId integer NOT NULL,
+				url string NOT NULL,
+				events string NOT NULL DEFAULT '',
+				secret string NOT NULL,
+				created_at timestamp NOT NULL)`,
+			`CREATE INDEX IF NOT EXISTS webhook_owner ON webhook(ownerId)`,
+			`CREATE TABLE IF NOT EXISTS webhookdelivery ( id integer PRIMARY KEY,
+				webhookId integer NOT NULL,
+				eventId integer NOT NULL,
+				event_type string NOT NULL,
+				attempt integer NOT NULL,
+				status_code integer NOT NULL DEFAULT 0,
+				error string NOT NULL DEFAULT '',
+				created_at timestamp NOT NULL,
+				FOREIGN KEY (webhookId) references webhook(id) ON DELETE CASCADE)`,
+			`CREATE INDEX IF NOT EXISTS webhookdelivery_webhook ON webhookdelivery(webhookId)`,
+		},
+	},
+}
+
+// postgresMigrations is the ordered list of the PostgreSQL schema migrations.
+// They must be kept in sync with the SQLite ones.
+var postgresMigrations = []migration{
+	{
+		version:     1,
+		description: "initial schema",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS folder ( id serial PRIMARY KEY, title text NOT NULL, parentFolderId integer, nbChildrenFolders integer,
+				FOREIGN KEY (parentFolderId) references folder(id)
+				ON DELETE CASCADE)`,
+			`CREATE TABLE IF NOT EXISTS tag ( id serial PRIMARY KEY, name text NOT NULL)`,
+			`CREATE TABLE IF NOT EXISTS bookmark ( id serial PRIMARY KEY, title text NOT NULL, url text NOT NULL, favicon text, starred boolean, folderId integer,
+				FOREIGN KEY (folderId) references folder(id)
+				ON DELETE CASCADE)`,
+			`CREATE TABLE IF NOT EXISTS bookmarktag ( id serial PRIMARY KEY,
+				bookmarkId integer,
+				tagId integer,
+				FOREIGN KEY (bookmarkId) references bookmark(id)
+				ON DELETE CASCADE,
+				FOREIGN KEY (tagId) references tag(id)
+				ON DELETE CASCADE)`,
+			// Inserting the / folder if not present.
+			`INSERT INTO folder(id, title) SELECT 1, '/' WHERE NOT EXISTS (SELECT 1 FROM folder)`,
+			// The root folder id has been forced, moving the sequence.
+			`SELECT setval(pg_get_serial_sequence('folder', 'id'), (SELECT MAX(id) FROM folder))`,
+		},
+	},
+	{
+		version:     2,
+		description: "cascade bookmarktag deletes",
+		// The initial PostgreSQL schema already cascades,
+		// keeping the versions in sync with SQLite.
+		statements: nil,
+	},
+	{
+		version:     3,
+		description: "bookmark notes",
+		statements: []string{
+			`ALTER TABLE bookmark ADD COLUMN IF NOT EXISTS notes text`,
+		},
+	},
+	{
+		version:     4,
+		description: "timestamps",
+		statements: []string{
+			// The existing rows dates are unknown, using the migration date.
+			`ALTER TABLE folder ADD COLUMN IF NOT EXISTS created_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP`,
+			`ALTER TABLE folder ADD COLUMN IF NOT EXISTS updated_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP`,
+			`ALTER TABLE folder ADD COLUMN IF NOT EXISTS last_visited_at timestamp with time zone`,
+			`ALTER TABLE bookmark ADD COLUMN IF NOT EXISTS created_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP`,
+			`ALTER TABLE bookmark ADD COLUMN IF NOT EXISTS updated_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP`,
+			`ALTER TABLE bookmark ADD COLUMN IF NOT EXISTS last_visited_at timestamp with time zone`,
+		},
+	},
+	{
+		version:     5,
+		description: "sort modes and positions",
+		statements: []string{
+			`ALTER TABLE folder ADD COLUMN IF NOT EXISTS sort text NOT NULL DEFAULT 'title'`,
+			`ALTER TABLE folder ADD COLUMN IF NOT EXISTS position integer NOT NULL DEFAULT 0`,
+			`ALTER TABLE bookmark ADD COLUMN IF NOT EXISTS position integer NOT NULL DEFAULT 0`,
+			positionFolders,
+			positionBookmarks,
+		},
+	},
+	{
+		version:     6,
+		description: "trash",
+		statements: []string{
+			`ALTER TABLE folder ADD COLUMN IF NOT EXISTS deleted_at timestamp with time zone`,
+			`ALTER TABLE folder ADD COLUMN IF NOT EXISTS trash_parent_id integer`,
+			`ALTER TABLE folder ADD COLUMN IF NOT EXISTS trash_path text`,
+			`ALTER TABLE bookmark ADD COLUMN IF NOT EXISTS deleted_at timestamp with time zone`,
+			`ALTER TABLE bookmark ADD COLUMN IF NOT EXISTS trash_parent_id integer`,
+			`ALTER TABLE bookmark ADD COLUMN IF NOT EXISTS trash_path text`,
+		},
+	},
+	{
+		version:     7,
+		description: "revisions",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS revision ( id serial PRIMARY KEY,
+				created_at timestamp with time zone NOT NULL,
+				operation text NOT NULL,
+				kind text NOT NULL,
+				itemId integer NOT NULL,
+				before text,
+				after text,
+				reverts integer)`,
+			`CREATE INDEX IF NOT EXISTS revision_item ON revision(kind, itemId)`,
+		},
+	},
+	{
+		version:     8,
+		description: "users and sessions",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS account ( id serial PRIMARY KEY,
+				username text NOT NULL UNIQUE,
+				password text NOT NULL,
+				created_at timestamp with time zone NOT NULL)`,
+			`CREATE TABLE IF NOT EXISTS session ( id text PRIMARY KEY,
+				accountId integer NOT NULL,
+				csrf text NOT NULL,
+				created_at timestamp with time zone NOT NULL,
+				expires_at timestamp with time zone NOT NULL,
+				FOREIGN KEY (accountId) references account(id) ON DELETE CASCADE)`,
+		},
+	},
+	{
+		version:     9,
+		description: "owners",
+		statements: []string{
+			`ALTER TABLE folder ADD COLUMN IF NOT EXISTS ownerId integer NOT NULL DEFAULT 0`,
+			`ALTER TABLE bookmark ADD COLUMN IF NOT EXISTS ownerId integer NOT NULL DEFAULT 0`,
+			`ALTER TABLE tag ADD COLUMN IF NOT EXISTS ownerId integer NOT NULL DEFAULT 0`,
+			`ALTER TABLE revision ADD COLUMN IF NOT EXISTS ownerId integer NOT NULL DEFAULT 0`,
+			ownFolders, ownBookmarks, ownTags, ownRevisions,
+			ownerRootFolders,
+			`CREATE INDEX IF NOT EXISTS folder_owner ON folder(ownerId)`,
+			`CREATE INDEX IF NOT EXISTS bookmark_owner ON bookmark(ownerId)`,
+			`CREATE INDEX IF NOT EXISTS tag_owner ON tag(ownerId)`,
+			`CREATE INDEX IF NOT EXISTS revision_owner ON revision(ownerId)`,
+		},
+	},
+	{
+		version:     10,
+		description: "api tokens",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS apitoken ( id serial PRIMARY KEY,
+				accountId integer NOT NULL,
+				name text NOT NULL,
+				hash text NOT NULL UNIQUE,
+				scope text NOT NULL,
+				created_at timestamp with time zone NOT NULL,
+				expires_at timestamp with time zone,
+				last_used_at timestamp with time zone,
+				FOREIGN KEY (accountId) references account(id) ON DELETE CASCADE)`,
+		},
+	},
+	{
+		version:     11,
+		description: "folder grants",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS foldergrant ( folderId integer NOT NULL,
+				accountId integer NOT NULL,
+				role text NOT NULL,
+				created_at timestamp with time zone NOT NULL,
+				PRIMARY KEY (folderId, accountId),
+				FOREIGN KEY (folderId) references folder(id) ON DELETE CASCADE,
+				FOREIGN KEY (accountId) references account(id) ON DELETE CASCADE)`,
+			`CREATE INDEX IF NOT EXISTS foldergrant_account ON foldergrant(accountId)`,
+		},
+	},
+	{
+		version:     12,
+		description: "share links",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS sharelink ( id serial PRIMARY KEY,
+				folderId integer NOT NULL,
+				hash text NOT NULL UNIQUE,
+				password_hash text NOT NULL DEFAULT '',
+				created_at timestamp with time zone NOT NULL,
+				expires_at timestamp with time zone,
+				FOREIGN KEY (folderId) references folder(id) ON DELETE CASCADE)`,
+			`CREATE INDEX IF NOT EXISTS sharelink_folder ON sharelink(folderId)`,
+		},
+	},
+	{
+		version:     13,
+		description: "data revisions",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS datarevision ( ownerId integer PRIMARY KEY,
+				revision bigint NOT NULL,
+				updated_at timestamp with time zone NOT NULL)`,
+		},
+	},
+	{
+		version:     14,
+		description: "webhooks",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS webhook ( id serial PRIMARY KEY,
+				ownerId integer NOT NULL,
+				url text NOT NULL,
+				events text NOT NULL DEFAULT '',
+				secret text NOT NULL,
+				created_at timestamp with time zone NOT NULL)`,
+			`CREATE INDEX IF NOT EXISTS webhook_owner ON webhook(ownerId)`,
+			`CREATE TABLE IF NOT EXISTS webhookdelivery ( id serial PRIMARY KEY,
+				webhookId integer NOT NULL,
+				eventId bigint NOT NULL,
+				event_type text NOT NULL,
+				attempt integer NOT NULL,
+				status_code integer NOT NULL DEFAULT 0,
+				error text NOT NULL DEFAULT '',
+				created_at timestamp with time zone NOT NULL,
+				FOREIGN KEY (webhookId) references webhook(id) ON DELETE CASCADE)`,
+			`CREATE INDEX IF NOT EXISTS webhookdelivery_webhook ON webhookdelivery(webhookId)`,
+		},
+	},
+}
+
+// positionFolders and positionBookmarks initialize the manual order
+// of the existing folders and bookmarks with their title order.
+const (
+	positionFolders = `UPDATE folder SET position = (SELECT COUNT(*) FROM folder f WHERE f.parentFolderId = folder.parentFolderId
+		AND (f.title < folder.title OR (f.title = folder.title AND f.id <= folder.id)))`
+	positionBookmarks = `UPDATE bookmark SET position = (SELECT COUNT(*) FROM bookmark b WHERE b.folderId = bookmark.folderId
+		AND (b.title < bookmark.title OR (b.title = bookmark.title AND b.id <= bookmark.id)))`
+)
+
+// ownFolders, ownBookmarks, ownTags and ownRevisions give the existing rows
+// to the first user, if any, and ownerRootFolders creates
+// an empty root folder for the other users.
+const (
+	ownFolders       = `UPDATE folder SET ownerId = (SELECT MIN(id) FROM account) WHERE EXISTS (SELECT 1 FROM account)`
+	ownBookmarks     = `UPDATE bookmark SET ownerId = (SELECT MIN(id) FROM account) WHERE EXISTS (SELECT 1 FROM account)`
+	ownTags          = `UPDATE tag SET ownerId = (SELECT MIN(id) FROM account) WHERE EXISTS (SELECT 1 FROM account)`
+	ownRevisions     = `UPDATE revision SET ownerId = (SELECT MIN(id) FROM account) WHERE EXISTS (SELECT 1 FROM account)`
+	ownerRootFolders = `INSERT INTO folder(title, nbChildrenFolders, sort, position, created_at, updated_at, ownerId)
+		SELECT '/', 0, 'title', 0, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, id FROM account WHERE id > (SELECT MIN(id) FROM account)`
+)
+
+// latestVersion returns the highest version of the given migrations.
+func latestVersion(migrations []migration) int {
+
+	latest := 0
+	for _, m := range migrations {
+		if m.version > latest {
+			latest = m.version
+		}
+	}
+	return latest
+
+}
+
+// SchemaVersion returns the current schema version of the database
+// and the latest version supported by this binary.
+// A database never migrated has the version 0.
+func (db *sqlDataStore) SchemaVersion(ctx context.Context) (current int, latest int, err error) {
+
+	latest = latestVersion(db.migrations)
+
+	if _, err = db.exec(ctx, `CREATE TABLE IF NOT EXISTS schemamigration ( version integer PRIMARY KEY, description text NOT NULL, appliedAt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP)`); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("SchemaVersion:CREATE TABLE request error")
+		return 0, latest, err
+	}
+
+	var version sql.NullInt64
+	if err = db.queryRow(ctx, "SELECT MAX(version) FROM schemamigration").Scan(&version); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("SchemaVersion:SELECT query error")
+		return 0, latest, err
+	}
+
+	return int(version.Int64), latest, nil
+
+}
+
+// Migrate applies the pending migrations to the database.
+// It returns ErrSchemaTooNew if the database has been migrated
+// by a more recent version of the application.
+func (db *sqlDataStore) Migrate(ctx context.Context) error {
+
+	current, latest, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"current": current,
+		"latest":  latest,
+	}).Debug("Migrate")
+
+	if current > latest {
+		return fmt.Errorf("%w: database version %d, supported version %d", ErrSchemaTooNew, current, latest)
+	}
+
+	for _, m := range db.migrations {
+		if m.version <= current {
+			continue
+		}
+		if err = db.applyMigration(ctx, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		log.WithFields(log.Fields{
+			"version":     m.version,
+			"description": m.description,
+		}).Info("Migrate:migration applied")
+	}
+
+	return nil
+
+}
+
+// applyMigration runs the statements of the given migration
+// and records its version in a single transaction.
+func (db *sqlDataStore) applyMigration(ctx context.Context, m migration) error {
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("applyMigration:transaction begin failed")
+		return err
+	}
+
+	for _, s := range m.statements {
+		if _, err = tx.ExecContext(ctx, s); err != nil {
+			log.WithFields(log.Fields{
+				"err":       err,
+				"statement": s,
+			}).Error("applyMigration:statement error")
+			if rerr := tx.Rollback(); rerr != nil {
+				log.WithFields(log.Fields{
+					"err": rerr,
+				}).Error("applyMigration:transaction rollback error")
+			}
+			return err
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, db.rebind("INSERT INTO schemamigration(version, description) values(?,?)"), m.version, m.description); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("applyMigration:INSERT query error")
+		if rerr := tx.Rollback(); rerr != nil {
+			log.WithFields(log.Fields{
+				"err": rerr,
+			}).Error("applyMigration:transaction rollback error")
+		}
+		return err
+	}
+
+	return tx.Commit()
+
+}
@@ -0,0 +1,165 @@
+package models_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/tbellembois/gobkm/models"
+)
+
+// newBaselineDB returns the path of a new SQLite database created
+// with the schema and data of testdata/baseline.sql.
+func newBaselineDB(t *testing.T) string {
+
+	fixture, err := os.ReadFile(filepath.Join("testdata", "baseline.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "bkm.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, s := range strings.Split(string(fixture), ";\n") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if _, err = db.Exec(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	return path
+
+}
+
+func TestMigrateBaseline(t *testing.T) {
+
+	ctx := context.Background()
+	db, err := models.NewDBstore(newBaselineDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.CreateDatabase(ctx); err != nil {
+		t.Fatal(err)
+	}
+	current, latest, err := db.SchemaVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != latest {
+		t.Errorf("schema version %d, want %d", current, latest)
+	}
+	// Migrating again does nothing.
+	if err = db.CreateDatabase(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The folders survived.
+	root, err := db.GetRootFolder(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Id != 1 || root.Title != "/" {
+		t.Errorf("root folder %d %q, want 1 /", root.Id, root.Title)
+	}
+	flds, err := db.GetFolderSubfolders(ctx, root.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flds) != 1 || flds[0].Id != 2 || flds[0].Title != "Dev" {
+		t.Fatalf("root subfolders %v, want Dev", flds)
+	}
+	if flds, err = db.GetFolderSubfolders(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(flds) != 1 || flds[0].Id != 3 || flds[0].Title != "Go" {
+		t.Fatalf("Dev subfolders %v, want Go", flds)
+	}
+
+	// The bookmarks and their tags too.
+	bkms, err := db.GetFolderBookmarks(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bkms) != 2 {
+		t.Fatalf("%d Go bookmarks, want 2", len(bkms))
+	}
+	bkm, err := db.GetBookmark(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bkm.Title != "The Go Programming Language" || bkm.URL != "https://go.dev/" || !bkm.Starred ||
+		bkm.Favicon != "data:image/png;base64,AA==" || bkm.Folder == nil || bkm.Folder.Id != 3 {
+		t.Errorf("bookmark %+v changed", bkm)
+	}
+	tags, err := db.GetBookmarkTags(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tag := range tags {
+		names = append(names, tag.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "doc,lang" {
+		t.Errorf("tags %v, want doc and lang", names)
+	}
+	if bkm, err = db.GetBookmark(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	if bkm.Title != "SQLite" || bkm.Starred || bkm.Folder == nil || bkm.Folder.Id != 2 {
+		t.Errorf("bookmark %+v changed", bkm)
+	}
+
+	// And they are searchable.
+	if bkms, err = db.SearchBookmarks(ctx, "effective"); err != nil {
+		t.Fatal(err)
+	}
+	if len(bkms) != 1 || bkms[0].Id != 2 {
+		t.Errorf("search results %v, want Effective Go", bkms)
+	}
+
+}
+
+func TestSchemaTooNew(t *testing.T) {
+
+	ctx := context.Background()
+	path := newBaselineDB(t)
+	db, err := models.NewDBstore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.CreateDatabase(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, latest, err := db.SchemaVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Migrated by a more recent binary.
+	if _, err = db.Exec("INSERT INTO schemamigration(version, description) values(?,?)", latest+1, "future"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if db, err = models.NewDBstore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.CreateDatabase(ctx); !errors.Is(err, models.ErrSchemaTooNew) {
+		t.Errorf("CreateDatabase %v, want %v", err, models.ErrSchemaTooNew)
+	}
+	if err = db.Migrate(ctx); !errors.Is(err, models.ErrSchemaTooNew) {
+		t.Errorf("Migrate %v, want %v", err, models.ErrSchemaTooNew)
+	}
+
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"context"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// populateDatabase populates the given empty Datastore with sample folders and bookmarks.
+func populateDatabase(ctx context.Context, db Datastore) error {
+
+	log.Info("Populating database")
+
+	var (
+		folders   []*types.Folder
+		bookmarks []*types.Bookmark
+		err       error
+	)
+
+	// Getting the root folder, the users have their own ones.
+	folderRoot, err := db.GetRootFolder(ctx)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		log.Info("Database with users, leaving")
+		return nil
+	case err != nil:
+		return err
+	}
+
+	// Leaving if database is already populated.
+	rootFolders, err := db.GetFolderSubfolders(ctx, folderRoot.Id)
+	if err != nil {
+		return err
+	}
+	if len(rootFolders) > 0 {
+		log.Info("Database not empty, leaving")
+		return nil
+	}
+	// Creating new sample folders.
+	folder1 := types.Folder{Id: 1, Title: "IT", Parent: folderRoot}
+	folder2 := types.Folder{Id: 2, Title: "Development", Parent: &folder1}
+	// Creating new sample tags.
+	tag1 := []*types.Tag{{Id: 1, Name: "mytag1"}}
+	tag2 := []*types.Tag{{Id: 1, Name: "mytag1"}, {Id: 2, Name: "mytag2"}}
+	// Creating new sample bookmarks.
+	bookmark1 := types.Bookmark{Id: 1, Title: "GoLang", Tags: tag1, Starred: true, URL: "https://golang.org/", Favicon: "data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAABAAAAAQCAYAAAAf8/9hAAAABHNCSVQICAgIfAhkiAAAAb9JREFUOI3tkj9oU1EUh797c3lgjA4xL61FX0yhMQqmW5QgFim4+GcyQ3Hp1MlBqFIyOGUobRScnYoQikNA0Ao6WJS2UIdiK7SUVGtfIZg0iMSA+Iy5Dg9fGnyLu2e6nHPu9zv3/K7QWuMXjfqebjQbOM5PIuEjHI6Ywq9P/TlUdm09+3KeNxtlAHbLWzTrNeTBQxjhHuLHohrgwqkBRi5dpO+4JQDEh80NfePOXaIDJ3FigximBUAyk+5SOvFphR/tNovvyzg769TKmxQLecS5a9d1dOQ2zp7N6bjF1PAZlJKMv1hFpVxIa+0t96+cBWD82TLr2zaGaVGbvYcEqLx+gmFajKZiqANBeo/2MZcb89RHUzEAeiNh5nJjGKZF9VUJAFks5FGVrc7IuuW7VH518slMGlHdpljII/sTSW+7j5ohEIrP9S9cnnxIaShOaSjOzNoOBNz81ceLHqg/kRRqv0ggGGLCdm3t+fqRmZtZ15HKEhN2Go1ABUO06VjfBdDSLQS0IFNd4fytSQAWHuR4B8gW7lWJP8B7rtA8zU7zfH4V8f0brew0ou37j/wBHigx2D2d/LvHJ/Vv8R8AvwHjjZMncK4ImgAAAABJRU5ErkJggg==", Folder: &folder2}
+	bookmark2 := types.Bookmark{Id: 2, Title: "GoBkm Github", Tags: tag2, Starred: false, URL: "https://github.com/tbellembois/gobkm", Favicon: "data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAABAAAAAQCAYAAAAf8/9hAAAABHNCSVQICAgIfAhkiAAAAilJREFUOI2FUUFrE0EYfTuzNgaxtmlmd9ON3WiS0gQ3Fs+BPXmVCBb03EMPUhBELzmEQGjv3nsJSiRLLvkDnrxJo5XUnCRirWiaGmIhBLP5PNSpSbDxg4GZ4X3ve+99wESVs1lz1baLZihUNzTtxNC0EzMUqq/adrGczZqTeEVeKJdDynVL31ut+0QERVHGgPJPE+Ll3traAyWf/0tAuRwiOzt7vX7fxj+ax4gA+H2+98319ZSSz4MBQMp1S71+376gqh8cx3mkcP55MBiAM9bmjLU77TY451/j8fhjn6q+7fX7dsp1S2eedSFIF4Li0agrpxDRmHxZy7FYSeLL2azJtqrVbQmg4fCS9DVqY8KST5JuVavbihkK1QeDQRIAvrVa55uXarpdGNEoAYCqqvvM8zwLALqdznBU6nmlzM6CM/YTADzPsxgADgBX5ufZtPTPFBBhSHT5z5MxlfMmAPw4OgIR3fkfwe10Oi2Vcs4/sblAYBcA5hYW4OP8+TQbRIR3jUYFON2U8Pt32cNM5ikAxCxr87ppvtE1jcK6/rpWq92TjY7j3L22tPQqGAgQY0wDTje1ubHxBABgJ5NlPRgkIsKyZVXDi4v7dHw8NlnuXh47mSxLIhARLNNs/PI8cdU0M7FI5MuLSuXjaKiGppG0d3Fmpt48OLgxFvohEZKJRMXQNNKFoMksDCHIEIISKyvu4bR1P8vlwrfi8WJvAnTTtouFQsGaxP8GGFLoTDqN+p0AAAAASUVORK5CYII=", Folder: &folder2}
+
+	folders = append(folders, &folder1, &folder2)
+	bookmarks = append(bookmarks, &bookmark1, &bookmark2)
+
+	// DB save.
+	for _, fld := range folders {
+		var id int64
+		if id, err = db.SaveFolder(ctx, fld); err != nil {
+			return err
+		}
+		fld.Id = int(id)
+	}
+	for _, bkm := range bookmarks {
+		if _, err = db.SaveBookmark(ctx, bkm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
@@ -0,0 +1,533 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"github.com/tbellembois/gobkm/types"
+)
+
+// The search query language:
+//
+//	golang tutorial         bookmarks with words starting with "golang" and "tutorial"
+//	"exact phrase"          bookmarks with the consecutive words "exact phrase"
+//	tag:golang              bookmarks tagged golang
+//	folder:/IT/Dev          bookmarks in the /IT/Dev folder or its subfolders
+//	starred:true            starred (or not with false) bookmarks
+//	site:github.com         bookmarks of github.com or its subdomains (domain: is an alias)
+//	a b, a AND b            both a and b
+//	a OR b                  a or b, AND has precedence over OR
+//	NOT a, -a               not a
+//	(a OR b) c              grouping
+//
+// The words and phrases are searched in the titles, URLs, tags and notes.
+// The field values can be quoted: tag:"my tag", folder:"/My Folder".
+
+// ErrInvalidQuery is returned, wrapped in a *QueryError,
+// when a search query is malformed.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// QueryError describes a malformed search query.
+type QueryError struct {
+	Pos int // position of the error in the query, starting at 1
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s: %s at position %d", ErrInvalidQuery, e.Msg, e.Pos)
+}
+
+// Unwrap returns ErrInvalidQuery.
+func (e *QueryError) Unwrap() error {
+	return ErrInvalidQuery
+}
+
+// Query is a parsed search query.
+type Query struct {
+	root queryNode // nil for an empty query
+}
+
+// queryNode is a node of the query syntax tree.
+type queryNode interface {
+	match(t *matchTarget) bool
+}
+
+type (
+	andNode  struct{ left, right queryNode }
+	orNode   struct{ left, right queryNode }
+	notNode  struct{ operand queryNode }
+	termNode struct {
+		words  []string // lower case
+		phrase bool
+	}
+	tagNode     struct{ name string }
+	folderNode  struct{ path string }
+	starredNode struct{ starred bool }
+	siteNode    struct{ host string }
+)
+
+// queryFields are the supported field: prefixes.
+var queryFields = map[string]bool{"tag": true, "folder": true, "starred": true, "site": true, "domain": true}
+
+// ParseQuery parses the given search query.
+// It returns a *QueryError if the query is malformed.
+func ParseQuery(s string) (*Query, error) {
+
+	toks, err := lexQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 1 {
+		// Only the end token.
+		return &Query{}, nil
+	}
+
+	p := &queryParser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &QueryError{Pos: t.pos, Msg: fmt.Sprintf("unexpected %s", t)}
+	}
+
+	return &Query{root: root}, nil
+
+}
+
+// IsEmpty returns true if the query has no terms.
+func (q *Query) IsEmpty() bool {
+	return q.root == nil
+}
+
+// Match returns true if the given bookmark matches the query.
+// The bookmark must have its tags and its folder with its parents.
+func (q *Query) Match(b *types.Bookmark) bool {
+
+	if q.root == nil {
+		return false
+	}
+	return q.root.match(newMatchTarget(b))
+
+}
+
+// terms returns the terms of the query if it is only made of
+// words and phrases, ie. a plain text search.
+func (q *Query) terms() ([]*termNode, bool) {
+
+	var (
+		terms []*termNode
+		walk  func(n queryNode) bool
+	)
+	walk = func(n queryNode) bool {
+		switch n := n.(type) {
+		case *termNode:
+			terms = append(terms, n)
+			return true
+		case *andNode:
+			return walk(n.left) && walk(n.right)
+		}
+		return false
+	}
+	if q.root == nil || !walk(q.root) {
+		return nil, false
+	}
+	return terms, true
+
+}
+
+// splitWords returns the lower case words of s,
+// ie. its sequences of letters and digits.
+func splitWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// normalizeFolderPath returns the given folder path
+// with a leading and without a trailing slash.
+func normalizeFolderPath(p string) string {
+	return "/" + strings.Trim(p, "/")
+}
+
+// urlHost returns the lower case host name of the given URL
+// or domain name.
+func urlHost(s string) string {
+
+	s = strings.ToLower(strings.TrimSpace(s))
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+
+}
+
+// matchTarget is a bookmark prepared to be matched.
+type matchTarget struct {
+	bkm    *types.Bookmark
+	fields [][]string // title, URL, tags and notes words
+	tags   map[string]bool
+	path   string
+	host   string
+}
+
+func newMatchTarget(b *types.Bookmark) *matchTarget {
+
+	t := &matchTarget{
+		bkm:  b,
+		tags: make(map[string]bool),
+		path: strings.ToLower(b.PathString()),
+		host: urlHost(b.URL),
+	}
+	names := make([]string, 0, len(b.Tags))
+	for _, tag := range b.Tags {
+		t.tags[strings.ToLower(tag.Name)] = true
+		names = append(names, tag.Name)
+	}
+	for _, f := range []string{b.Title, b.URL, strings.Join(names, " "), b.Notes} {
+		t.fields = append(t.fields, splitWords(f))
+	}
+
+	return t
+
+}
+
+func (n *andNode) match(t *matchTarget) bool { return n.left.match(t) && n.right.match(t) }
+func (n *orNode) match(t *matchTarget) bool  { return n.left.match(t) || n.right.match(t) }
+func (n *notNode) match(t *matchTarget) bool { return !n.operand.match(t) }
+
+func (n *termNode) match(t *matchTarget) bool {
+
+	if len(n.words) == 0 {
+		return false
+	}
+
+	if n.phrase {
+		// The words must be consecutive in a field.
+		for _, f := range t.fields {
+			for i := 0; i+len(n.words) <= len(f); i++ {
+				j := 0
+				for j < len(n.words) && f[i+j] == n.words[j] {
+					j++
+				}
+				if j == len(n.words) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	// Each word must start a word of a field.
+	for _, w := range n.words {
+		found := false
+		for _, f := range t.fields {
+			for _, fw := range f {
+				if strings.HasPrefix(fw, w) {
+					found = true
+					break
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+
+}
+
+func (n *tagNode) match(t *matchTarget) bool { return t.tags[n.name] }
+
+func (n *folderNode) match(t *matchTarget) bool {
+	return n.path == "/" || t.path == n.path || strings.HasPrefix(t.path, n.path+"/")
+}
+
+func (n *starredNode) match(t *matchTarget) bool { return t.bkm.Starred == n.starred }
+
+func (n *siteNode) match(t *matchTarget) bool {
+	return t.host == n.host || strings.HasSuffix(t.host, "."+n.host)
+}
+
+//
+// Lexer
+//
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokPhrase
+	tokField
+	tokLParen
+	tokRParen
+	tokAnd
+	tokOr
+	tokNot
+)
+
+type token struct {
+	kind  tokenKind
+	text  string // word, phrase or field value
+	field string
+	pos   int
+}
+
+func (t token) String() string {
+
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokLParen:
+		return `"("`
+	case tokRParen:
+		return `")"`
+	case tokAnd:
+		return "AND"
+	case tokOr:
+		return "OR"
+	case tokNot:
+		return "NOT"
+	}
+	return fmt.Sprintf("%q", t.text)
+
+}
+
+// lexQuery splits the given query into tokens, ended by a tokEOF one.
+func lexQuery(s string) ([]token, error) {
+
+	var (
+		toks []token
+		rs   = []rune(s)
+		i    int
+	)
+
+	// readPhrase reads the phrase starting with the quote at i.
+	readPhrase := func() (string, error) {
+		start := i
+		i++
+		for i < len(rs) && rs[i] != '"' {
+			i++
+		}
+		if i == len(rs) {
+			return "", &QueryError{Pos: start + 1, Msg: "unterminated phrase"}
+		}
+		i++
+		return string(rs[start+1 : i-1]), nil
+	}
+
+	for i < len(rs) {
+		r := rs[i]
+		pos := i + 1
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			toks = append(toks, token{kind: tokLParen, pos: pos})
+			i++
+		case r == ')':
+			toks = append(toks, token{kind: tokRParen, pos: pos})
+			i++
+		case r == '-':
+			if i+1 == len(rs) || unicode.IsSpace(rs[i+1]) || rs[i+1] == ')' {
+				return nil, &QueryError{Pos: pos, Msg: "nothing to exclude after -"}
+			}
+			toks = append(toks, token{kind: tokNot, pos: pos})
+			i++
+		case r == '"':
+			phrase, err := readPhrase()
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{kind: tokPhrase, text: phrase, pos: pos})
+		default:
+			start := i
+			for i < len(rs) && !unicode.IsSpace(rs[i]) && rs[i] != '(' && rs[i] != ')' && rs[i] != '"' {
+				i++
+			}
+			word := string(rs[start:i])
+
+			switch word {
+			case "AND":
+				toks = append(toks, token{kind: tokAnd, pos: pos})
+				continue
+			case "OR":
+				toks = append(toks, token{kind: tokOr, pos: pos})
+				continue
+			case "NOT":
+				toks = append(toks, token{kind: tokNot, pos: pos})
+				continue
+			}
+
+			// field:value
+			if c := strings.Index(word, ":"); c > 0 && queryFields[strings.ToLower(word[:c])] {
+				field, value := strings.ToLower(word[:c]), word[c+1:]
+				if value == "" && i < len(rs) && rs[i] == '"' {
+					var err error
+					if value, err = readPhrase(); err != nil {
+						return nil, err
+					}
+				}
+				if strings.TrimSpace(value) == "" {
+					return nil, &QueryError{Pos: pos, Msg: fmt.Sprintf("missing value after %s:", field)}
+				}
+				toks = append(toks, token{kind: tokField, field: field, text: value, pos: pos})
+				continue
+			}
+
+			toks = append(toks, token{kind: tokWord, text: word, pos: pos})
+		}
+	}
+
+	return append(toks, token{kind: tokEOF, pos: len(rs) + 1}), nil
+
+}
+
+//
+// Parser
+//
+
+// queryParser is a recursive descent parser of the grammar:
+//
+//	or      = and { "OR" and }
+//	and     = unary { [ "AND" ] unary }
+//	unary   = ( "NOT" | "-" ) unary | primary
+//	primary = "(" or ")" | field | word | phrase
+type queryParser struct {
+	toks []token
+	i    int
+}
+
+func (p *queryParser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *queryParser) next() token {
+
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+	return left, nil
+
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek().kind {
+		case tokAnd:
+			p.next()
+		case tokWord, tokPhrase, tokField, tokLParen, tokNot:
+			// Implicit AND.
+		default:
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+
+	if p.peek().kind == tokNot {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parsePrimary()
+
+}
+
+func (p *queryParser) parsePrimary() (queryNode, error) {
+
+	t := p.next()
+	switch t.kind {
+	case tokLParen:
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokRParen {
+			return nil, &QueryError{Pos: t.pos, Msg: `missing ")"`}
+		}
+		return n, nil
+	case tokWord:
+		return &termNode{words: splitWords(t.text)}, nil
+	case tokPhrase:
+		return &termNode{words: splitWords(t.text), phrase: true}, nil
+	case tokField:
+		return parseField(t)
+	case tokEOF:
+		return nil, &QueryError{Pos: t.pos, Msg: "missing term at end of query"}
+	}
+	return nil, &QueryError{Pos: t.pos, Msg: fmt.Sprintf("unexpected %s", t)}
+
+}
+
+// parseField returns the node of the given field token.
+func parseField(t token) (queryNode, error) {
+
+	switch t.field {
+	case "tag":
+		return &tagNode{name: strings.ToLower(t.text)}, nil
+	case "folder":
+		return &folderNode{path: strings.ToLower(normalizeFolderPath(t.text))}, nil
+	case "starred":
+		switch strings.ToLower(t.text) {
+		case "true", "yes", "1":
+			return &starredNode{starred: true}, nil
+		case "false", "no", "0":
+			return &starredNode{starred: false}, nil
+		}
+		return nil, &QueryError{Pos: t.pos, Msg: fmt.Sprintf("starred: expects true or false, got %q", t.text)}
+	case "site", "domain":
+		host := urlHost(t.text)
+		if host == "" {
+			return nil, &QueryError{Pos: t.pos, Msg: fmt.Sprintf("%s: expects a domain name, got %q", t.field, t.text)}
+		}
+		return &siteNode{host: host}, nil
+	}
+	return nil, &QueryError{Pos: t.pos, Msg: fmt.Sprintf("unknown field %s:", t.field)}
+
+}
@@ -0,0 +1,162 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/tbellembois/gobkm/types"
+)
+
+// The revisions log the creations, updates, moves, stars, tags changes,
+// deletions and restorations of the folders and bookmarks with snapshots
+// of their state before and after. The log is append-only: undoing a revision
+// restores its before snapshot and appends an undo revision reverting it.
+// The visits, manual reorderings, favicons and trash purges are not logged.
+
+// ErrUndo is returned when a revision can not be undone,
+// ie. its folder or bookmark, or their parent, has been purged.
+var ErrUndo = errors.New("can not undo")
+
+// bookmarkSnapshot is the state of a bookmark logged in the revisions.
+type bookmarkSnapshot struct {
+	Title         string       `json:"title"`
+	URL           string       `json:"url"`
+	Notes         string       `json:"notes"`
+	Starred       bool         `json:"starred"`
+	FolderID      int          `json:"folder_id"` // 0 in the trash
+	Tags          []*types.Tag `json:"tags"`
+	DeletedAt     *time.Time   `json:"deleted_at,omitempty"`
+	TrashParentID int          `json:"trash_parent_id,omitempty"`
+	TrashPath     []string     `json:"trash_path,omitempty"`
+}
+
+// folderSnapshot is the state of a folder logged in the revisions.
+type folderSnapshot struct {
+	Title         string         `json:"title"`
+	ParentID      int            `json:"parent_id"` // 0 in the trash
+	Sort          types.SortMode `json:"sort"`
+	DeletedAt     *time.Time     `json:"deleted_at,omitempty"`
+	TrashParentID int            `json:"trash_parent_id,omitempty"`
+	TrashPath     []string       `json:"trash_path,omitempty"`
+}
+
+// encodeSnapshot returns the JSON of the given snapshot, nil if the snapshot is nil.
+func encodeSnapshot(s interface{}) json.RawMessage {
+
+	switch s := s.(type) {
+	case *bookmarkSnapshot:
+		if s == nil {
+			return nil
+		}
+	case *folderSnapshot:
+		if s == nil {
+			return nil
+		}
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		// Can not happen with the snapshots.
+		return nil
+	}
+	return b
+
+}
+
+// decodeBookmarkSnapshot returns the bookmark snapshot of the given JSON, nil for null.
+func decodeBookmarkSnapshot(b json.RawMessage) (*bookmarkSnapshot, error) {
+
+	var s *bookmarkSnapshot
+	if len(b) == 0 {
+		return nil, nil
+	}
+	err := json.Unmarshal(b, &s)
+	return s, err
+
+}
+
+// decodeFolderSnapshot returns the folder snapshot of the given JSON, nil for null.
+func decodeFolderSnapshot(b json.RawMessage) (*folderSnapshot, error) {
+
+	var s *folderSnapshot
+	if len(b) == 0 {
+		return nil, nil
+	}
+	err := json.Unmarshal(b, &s)
+	return s, err
+
+}
+
+// tagsNames returns the names of the given tags.
+func tagsNames(tags []*types.Tag) []string {
+
+	names := make([]string, len(tags))
+	for i, t := range tags {
+		names[i] = t.Name
+	}
+	return names
+
+}
+
+// equalStrings returns true if a and b have the same strings in the same order.
+func equalStrings(a, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+
+}
+
+// bookmarkOperation returns the operation changing the before bookmark
+// into the after one, an empty string if nothing changed.
+func bookmarkOperation(before, after *bookmarkSnapshot) string {
+
+	switch {
+	case before == nil && after == nil:
+		return ""
+	case before == nil:
+		return types.OperationCreate
+	case before.DeletedAt == nil && after.DeletedAt != nil:
+		return types.OperationDelete
+	case before.DeletedAt != nil && after.DeletedAt == nil:
+		return types.OperationRestore
+	case before.Title != after.Title || before.URL != after.URL || before.Notes != after.Notes:
+		return types.OperationUpdate
+	case before.FolderID != after.FolderID:
+		return types.OperationMove
+	case !equalStrings(tagsNames(before.Tags), tagsNames(after.Tags)):
+		return types.OperationTag
+	case before.Starred != after.Starred:
+		return types.OperationStar
+	}
+	return ""
+
+}
+
+// folderOperation returns the operation changing the before folder
+// into the after one, an empty string if nothing changed.
+func folderOperation(before, after *folderSnapshot) string {
+
+	switch {
+	case before == nil && after == nil:
+		return ""
+	case before == nil:
+		return types.OperationCreate
+	case before.DeletedAt == nil && after.DeletedAt != nil:
+		return types.OperationDelete
+	case before.DeletedAt != nil && after.DeletedAt == nil:
+		return types.OperationRestore
+	case before.ParentID != after.ParentID:
+		return types.OperationMove
+	case before.Title != after.Title || before.Sort != after.Sort:
+		return types.OperationUpdate
+	}
+	return ""
+
+}
@@ -0,0 +1,105 @@
+package models
+
+import (
+	"errors"
+
+	"github.com/tbellembois/gobkm/types"
+)
+
+// ErrForbidden is returned when the role of the user on a shared folder
+// does not allow the operation.
+var ErrForbidden = errors.New("permission denied")
+
+// ErrInvalidGrant is returned when sharing a folder with an unknown role or with its owner.
+var ErrInvalidGrant = errors.New("invalid role or user")
+
+// roleRank returns the rank of the given folder role, 0 if unknown.
+func roleRank(role string) int {
+
+	switch role {
+	case types.RoleViewer:
+		return 1
+	case types.RoleEditor:
+		return 2
+	case types.RoleOwner:
+		return 3
+	}
+	return 0
+
+}
+
+// CheckRole returns ErrForbidden if the given folder role
+// does not allow the operations of the wanted one.
+func CheckRole(role, wanted string) error {
+
+	if roleRank(role) == 0 || roleRank(role) < roleRank(wanted) {
+		return ErrForbidden
+	}
+	return nil
+
+}
+
+// ancestor is a folder of the path from a folder up to its top folder,
+// with the role granted on it to the datastore user, empty if none.
+type ancestor struct {
+	id       int
+	parentID int
+	owner    int
+	deleted  bool
+	role     string
+}
+
+// grantedRole returns the highest role granted on the given folders path.
+func grantedRole(path []ancestor) string {
+
+	var role string
+	for _, a := range path {
+		if roleRank(a.role) > roleRank(role) {
+			role = a.role
+		}
+	}
+	return role
+
+}
+
+// folderAccess returns the owner of the folders of the given path and the role
+// of the given user on its first folder: owner for their own folders,
+// the highest role granted on the path otherwise.
+// It fails with ErrNotFound if the folder is not shared with the user
+// or is in the trash.
+func folderAccess(path []ancestor, user int) (int, string, error) {
+
+	if len(path) == 0 {
+		return 0, "", ErrNotFound
+	}
+	owner := path[0].owner
+	if owner == user {
+		return owner, types.RoleOwner, nil
+	}
+
+	// The trashed folders have no parent.
+	if top := path[len(path)-1]; top.parentID != 0 || top.deleted {
+		return 0, "", ErrNotFound
+	}
+	role := grantedRole(path)
+	if role == "" {
+		return 0, "", ErrNotFound
+	}
+	return owner, role, nil
+
+}
+
+// inTrash returns true if the first folder of the given path is in the trash.
+func inTrash(path []ancestor) bool {
+	return len(path) == 0 || path[len(path)-1].deleted
+}
+
+// checkGrant returns ErrInvalidGrant if the given role can not be granted.
+func checkGrant(role string) error {
+
+	if roleRank(role) == 0 {
+		return ErrInvalidGrant
+	}
+	return nil
+
+}
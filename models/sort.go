@@ -0,0 +1,119 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tbellembois/gobkm/types"
+)
+
+// ErrInvalidOrder is returned when reordering a folder with ids
+// that are not its children or are given twice.
+var ErrInvalidOrder = errors.New("invalid order")
+
+// sortMode returns the given sort mode, by title if not valid (ie. not set).
+func sortMode(m types.SortMode) types.SortMode {
+
+	if !m.IsValid() {
+		return types.SortTitle
+	}
+	return m
+
+}
+
+// orderBy returns the ORDER BY clause sorting the rows of the given table,
+// folder or bookmark, with the given sort mode.
+// The ties are sorted by title, then id to be stable.
+func orderBy(table string, m types.SortMode) string {
+
+	var keys []string
+	switch sortMode(m) {
+	case types.SortURL:
+		if table == "bookmark" {
+			keys = append(keys, "bookmark.url")
+		}
+	case types.SortCreated:
+		keys = append(keys, table+".created_at DESC")
+	case types.SortVisited:
+		keys = append(keys, table+".last_visited_at IS NULL", table+".last_visited_at DESC")
+	case types.SortManual:
+		keys = append(keys, table+".position")
+	}
+	keys = append(keys, table+".title", table+".id")
+
+	return " ORDER BY " + strings.Join(keys, ", ")
+
+}
+
+// sortKey holds the fields of a folder or bookmark the sort modes use.
+type sortKey struct {
+	id            int
+	title         string
+	url           string
+	position      int
+	createdAt     time.Time
+	lastVisitedAt *time.Time
+}
+
+// less returns true if a is before b with the given sort mode,
+// in the same order as orderBy.
+func less(m types.SortMode, a, b sortKey) bool {
+
+	switch sortMode(m) {
+	case types.SortURL:
+		if a.url != b.url {
+			return a.url < b.url
+		}
+	case types.SortCreated:
+		if !a.createdAt.Equal(b.createdAt) {
+			return a.createdAt.After(b.createdAt)
+		}
+	case types.SortVisited:
+		switch {
+		case a.lastVisitedAt == nil && b.lastVisitedAt == nil:
+		case a.lastVisitedAt == nil || b.lastVisitedAt == nil:
+			return b.lastVisitedAt == nil
+		case !a.lastVisitedAt.Equal(*b.lastVisitedAt):
+			return a.lastVisitedAt.After(*b.lastVisitedAt)
+		}
+	case types.SortManual:
+		if a.position != b.position {
+			return a.position < b.position
+		}
+	}
+	if a.title != b.title {
+		return a.title < b.title
+	}
+	return a.id < b.id
+
+}
+
+// reorder returns the given children ids, in their current order,
+// moved after the given ids in the given order.
+// It fails if an id is not a child or is given twice.
+func reorder(children []int, ids []int) ([]int, error) {
+
+	rest := make(map[int]bool, len(children))
+	for _, id := range children {
+		rest[id] = true
+	}
+
+	order := make([]int, 0, len(children))
+	for _, id := range ids {
+		if !rest[id] {
+			return nil, fmt.Errorf("%w: %d is not a child or is given twice", ErrInvalidOrder, id)
+		}
+		rest[id] = false
+		order = append(order, id)
+	}
+	for _, id := range children {
+		if rest[id] {
+			order = append(order, id)
+		}
+	}
+
+	return order, nil
+
+}
@@ -0,0 +1,1252 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// sqlDataStore implements the Datastore interface on top of database/sql.
+// The queries are written with "?" placeholders and a portable SQL
+// understood by both SQLite3 and PostgreSQL.
+type sqlDataStore struct {
+	*sql.DB
+	// tx is the transaction of the datastores given by withTx, nil otherwise.
+	tx         *sql.Tx
+	driver     string
+	migrations []migration
+	// fullTextSearch is true when the bookmarks are indexed
+	// in the SQLite FTS5 bookmarkfts table.
+	fullTextSearch bool
+	// owner is the id of the user owning the folders, bookmarks and tags
+	// of the datastore, 0 when the authentication is disabled, see ForUser.
+	owner int
+}
+
+const (
+	// bookmarkColumns are the bookmark columns scanned by scanBookmark.
+	bookmarkColumns = "bookmark.id, bookmark.title, bookmark.url, bookmark.favicon, bookmark.starred, bookmark.folderId, bookmark.notes, bookmark.position, bookmark.created_at, bookmark.updated_at, bookmark.last_visited_at, bookmark.deleted_at, bookmark.trash_path"
+	// folderColumns are the folder columns scanned by scanFolder.
+	folderColumns = "folder.id, folder.title, folder.parentFolderId, folder.nbChildrenFolders, folder.sort, folder.position, folder.created_at, folder.updated_at, folder.last_visited_at, folder.deleted_at, folder.trash_path, " +
+		"EXISTS (SELECT 1 FROM foldergrant WHERE foldergrant.folderId = folder.id)"
+)
+
+// nullTime returns the given optional time as a sql.NullTime.
+func nullTime(t *time.Time) sql.NullTime {
+
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+
+}
+
+// timePtr returns the given sql.NullTime as an optional time.
+func timePtr(t sql.NullTime) *time.Time {
+
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// rebind replaces the "?" placeholders of the given query
+// with the "$n" PostgreSQL ones if needed.
+func (db *sqlDataStore) rebind(query string) string {
+
+	if db.driver != postgresDriver {
+		return query
+	}
+
+	var (
+		b strings.Builder
+		n int
+	)
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+
+}
+
+// exec executes a query without returning any rows.
+func (db *sqlDataStore) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+
+	if db.tx != nil {
+		return db.tx.ExecContext(ctx, db.rebind(query), args...)
+	}
+	return db.ExecContext(ctx, db.rebind(query), args...)
+
+}
+
+// query executes a query returning rows.
+func (db *sqlDataStore) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+
+	if db.tx != nil {
+		return db.tx.QueryContext(ctx, db.rebind(query), args...)
+	}
+	return db.QueryContext(ctx, db.rebind(query), args...)
+
+}
+
+// queryRow executes a query returning at most one row.
+func (db *sqlDataStore) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+
+	if db.tx != nil {
+		return db.tx.QueryRowContext(ctx, db.rebind(query), args...)
+	}
+	return db.QueryRowContext(ctx, db.rebind(query), args...)
+
+}
+
+// insert executes the given INSERT query and returns the id of the new row.
+func (db *sqlDataStore) insert(ctx context.Context, query string, args ...interface{}) (int64, error) {
+
+	var id int64
+	err := db.queryRow(ctx, query+" RETURNING id", args...).Scan(&id)
+	return id, err
+
+}
+
+// owned returns the condition selecting the rows
+// of the given table owned by the datastore user.
+func (db *sqlDataStore) owned(table string) string {
+	return table + ".ownerId = " + strconv.Itoa(db.owner)
+}
+
+// ForUser returns a copy of the datastore restricted to the folders,
+// bookmarks and tags of the user with the given id.
+func (db *sqlDataStore) ForUser(id int) Datastore {
+
+	udb := *db
+	udb.owner = id
+	return &udb
+
+}
+
+// withTx calls the given function with a copy of the datastore
+// running its queries in a new transaction, committed if the function
+// succeeds and rolled back otherwise. Nested calls share the transaction.
+func (db *sqlDataStore) withTx(ctx context.Context, f func(db *sqlDataStore) error) error {
+
+	if db.tx != nil {
+		return f(db)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("withTx:transaction begin failed")
+		return err
+	}
+
+	txdb := *db
+	txdb.tx = tx
+	if err = f(&txdb); err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			log.WithFields(log.Fields{
+				"err": rerr,
+			}).Error("withTx:transaction rollback error")
+		}
+		return err
+	}
+
+	return tx.Commit()
+
+}
+
+// WithTx calls the given function with a copy of the datastore
+// running its queries in a transaction, all its changes being committed
+// if the function succeeds and rolled back otherwise.
+// Nested calls share the transaction.
+func (db *sqlDataStore) WithTx(ctx context.Context, f func(tx Datastore) error) error {
+
+	return db.withTx(ctx, func(db *sqlDataStore) error {
+		return f(db)
+	})
+
+}
+
+// CreateDatabase creates or upgrades the database tables.
+// It fails if the database is newer than the application.
+func (db *sqlDataStore) CreateDatabase(ctx context.Context) error {
+
+	log.Info("Creating database")
+
+	// Applying the schema migrations.
+	if err := db.Migrate(ctx); err != nil {
+		log.Error("CreateDatabase: error migrating the database:" + err.Error())
+		return err
+	}
+
+	// Indexing the bookmarks for the full text search.
+	if db.driver == dbdriver {
+		if err := db.setupFullTextSearch(ctx); err != nil {
+			log.Error("CreateDatabase: error setting up the full text search:" + err.Error())
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// PopulateDatabase populate the database with sample folders and bookmarks.
+func (db *sqlDataStore) PopulateDatabase(ctx context.Context) error {
+	return populateDatabase(ctx, db)
+}
+
+// GetTags returns the full tags list.
+func (db *sqlDataStore) GetTags(ctx context.Context) ([]*types.Tag, error) {
+
+	var (
+		rows *sql.Rows
+		tags []*types.Tag
+		err  error
+	)
+
+	// Querying the tags.
+	if rows, err = db.query(ctx, "SELECT id, name FROM tag WHERE "+db.owned("tag")+" ORDER BY name"); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetTags:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetTags")
+
+	for rows.Next() {
+		// Building a new Tag instance with each row.
+		tag := new(types.Tag)
+		if err = rows.Scan(&tag.Id, &tag.Name); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetTags:error scanning the query result row")
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetTags:error looping rows")
+		return nil, err
+	}
+
+	return tags, nil
+
+}
+
+// GetTag returns a Tag instance with the given id.
+func (db *sqlDataStore) GetTag(ctx context.Context, id int) (*types.Tag, error) {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("GetTag")
+
+	// Querying the Tag.
+	tag := new(types.Tag)
+	err := db.queryRow(ctx, "SELECT id, name FROM tag WHERE id=? AND "+db.owned("tag"), id).Scan(&tag.Id, &tag.Name)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		log.WithFields(log.Fields{
+			"id": id,
+		}).Debug("GetTag:no tag with that ID")
+		return nil, ErrNotFound
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetTag:SELECT query error")
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"Id":   tag.Id,
+		"Name": tag.Name,
+	}).Debug("GetTag:tag found")
+	return tag, nil
+
+}
+
+// scanBookmark scans a bookmark row selected with the bookmarkColumns,
+// followed by the given extra columns,
+// and returns the bookmark and its folder id.
+func scanBookmark(row rowScanner, extra ...interface{}) (*types.Bookmark, int, error) {
+
+	var (
+		folderID                                     sql.NullInt64
+		favicon                                      sql.NullString
+		starred                                      sql.NullBool
+		notes, trashPath                             sql.NullString
+		createdAt, updatedAt, lastVisited, deletedAt sql.NullTime
+	)
+
+	bkm := new(types.Bookmark)
+	dest := append([]interface{}{&bkm.Id, &bkm.Title, &bkm.URL, &favicon, &starred, &folderID, &notes, &bkm.Position, &createdAt, &updatedAt, &lastVisited, &deletedAt, &trashPath}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, 0, err
+	}
+	bkm.Favicon = favicon.String
+	bkm.Starred = starred.Bool
+	bkm.Notes = notes.String
+	bkm.CreatedAt = createdAt.Time
+	bkm.UpdatedAt = updatedAt.Time
+	bkm.LastVisitedAt = timePtr(lastVisited)
+	bkm.DeletedAt = timePtr(deletedAt)
+	bkm.TrashPath = decodeTrashPath(trashPath)
+
+	return bkm, int(folderID.Int64), nil
+
+}
+
+// GetBookmark returns a Bookmark instance with the given id.
+func (db *sqlDataStore) GetBookmark(ctx context.Context, id int) (*types.Bookmark, error) {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("GetBookmark")
+
+	// Querying the bookmark.
+	bkm, folderID, err := scanBookmark(db.queryRow(ctx, "SELECT "+bookmarkColumns+" FROM bookmark WHERE id=? AND "+db.owned("bookmark"), id))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		log.WithFields(log.Fields{
+			"id": id,
+		}).Debug("GetBookmark:no bookmark with that ID")
+		return nil, ErrNotFound
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetBookmark:SELECT query error")
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"Id":       bkm.Id,
+		"Title":    bkm.Title,
+		"folderId": folderID,
+	}).Debug("GetBookmark:bookmark found")
+
+	// Retrieving the parent folder.
+	if folderID != 0 {
+		if bkm.Folder, err = db.GetFolder(ctx, folderID); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetBookmark:parent Folder retrieving error")
+			return nil, err
+		}
+	}
+
+	// Retrieving the tags.
+	if bkm.Tags, err = db.GetBookmarkTags(ctx, bkm.Id); err != nil {
+		return nil, err
+	}
+
+	return bkm, nil
+
+}
+
+// scanFolder scans a folder row selected with the folderColumns,
+// followed by the given extra columns,
+// and returns the folder and its parent id.
+func scanFolder(row rowScanner, extra ...interface{}) (*types.Folder, int, error) {
+
+	var (
+		parentFldID                                  sql.NullInt64
+		nbChildrenFolders                            sql.NullInt64
+		createdAt, updatedAt, lastVisited, deletedAt sql.NullTime
+		trashPath                                    sql.NullString
+	)
+
+	fld := new(types.Folder)
+	dest := append([]interface{}{&fld.Id, &fld.Title, &parentFldID, &nbChildrenFolders, &fld.Sort, &fld.Position, &createdAt, &updatedAt, &lastVisited, &deletedAt, &trashPath, &fld.Shared}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, 0, err
+	}
+	fld.NbChildrenFolders = int(nbChildrenFolders.Int64)
+	fld.CreatedAt = createdAt.Time
+	fld.UpdatedAt = updatedAt.Time
+	fld.LastVisitedAt = timePtr(lastVisited)
+	fld.DeletedAt = timePtr(deletedAt)
+	fld.TrashPath = decodeTrashPath(trashPath)
+
+	return fld, int(parentFldID.Int64), nil
+
+}
+
+// GetFolder returns a Folder instance with the given id
+// and its parents.
+func (db *sqlDataStore) GetFolder(ctx context.Context, id int) (*types.Folder, error) {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("GetFolder")
+
+	// Querying the folder.
+	fld, parentFldID, err := scanFolder(db.queryRow(ctx, "SELECT "+folderColumns+" FROM folder WHERE id=? AND "+db.owned("folder"), id))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		log.WithFields(log.Fields{
+			"id": id,
+		}).Debug("GetFolder:no folder with that ID")
+		return nil, ErrNotFound
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetFolder:SELECT query error")
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"Id":          fld.Id,
+		"Title":       fld.Title,
+		"parentFldId": parentFldID,
+	}).Debug("GetFolder:folder found")
+
+	// Recursively getting the parents.
+	if parentFldID != 0 {
+		if fld.Parent, err = db.GetFolder(ctx, parentFldID); err != nil {
+			return nil, err
+		}
+	}
+
+	return fld, nil
+
+}
+
+// GetRootFolder returns the root folder of the datastore user.
+func (db *sqlDataStore) GetRootFolder(ctx context.Context) (*types.Folder, error) {
+
+	fld, _, err := scanFolder(db.queryRow(ctx, "SELECT "+folderColumns+" FROM folder WHERE parentFolderId IS NULL AND deleted_at IS NULL AND "+db.owned("folder")+" ORDER BY id LIMIT 1"))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		log.WithFields(log.Fields{
+			"owner": db.owner,
+		}).Debug("GetRootFolder:no root folder")
+		return nil, ErrNotFound
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetRootFolder:SELECT query error")
+		return nil, err
+	}
+
+	return fld, nil
+
+}
+
+// folderIDOrRoot returns the id of the given folder, of the root folder if nil,
+// ErrNotFound if the folder is not owned by the datastore user.
+func (db *sqlDataStore) folderIDOrRoot(ctx context.Context, f *types.Folder) (int, error) {
+
+	if f == nil {
+		root, err := db.GetRootFolder(ctx)
+		if err != nil {
+			return 0, err
+		}
+		return root.Id, nil
+	}
+
+	ok, err := db.folderExists(ctx, f.Id)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return f.Id, nil
+
+}
+
+// GetStars returns the starred bookmarks.
+func (db *sqlDataStore) GetStars(ctx context.Context) ([]*types.Bookmark, error) {
+
+	var (
+		rows      *sql.Rows
+		bkms      []*types.Bookmark
+		folderIDs []int
+		err       error
+	)
+
+	// Querying the bookmarks.
+	if rows, err = db.query(ctx, db.liveFolders()+" SELECT "+bookmarkColumns+" FROM bookmark WHERE starred AND "+inLiveFolder+" ORDER BY title"); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetStars:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetStars")
+
+	for rows.Next() {
+		// Building a new Bookmark instance with each row.
+		bkm, folderID, err := scanBookmark(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetStars:error scanning the query result row")
+			return nil, err
+		}
+		bkms = append(bkms, bkm)
+		folderIDs = append(folderIDs, folderID)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetStars:error looping rows")
+		return nil, err
+	}
+
+	// Retrieving the bookmarks folders once the rows are consumed.
+	if err = db.setBookmarksFolder(ctx, bkms, folderIDs); err != nil {
+		return nil, err
+	}
+
+	return bkms, nil
+
+}
+
+// SearchBookmarks returns the bookmarks matching the given query,
+// see ParseQuery. With the full text search the plain text queries
+// are ranked by relevance and the bookmarks come with a snippet,
+// the other results are sorted by title.
+func (db *sqlDataStore) SearchBookmarks(ctx context.Context, s string) ([]*types.Bookmark, error) {
+
+	log.WithFields(log.Fields{
+		"s": s,
+	}).Debug("SearchBookmarks")
+
+	q, err := ParseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	if q.IsEmpty() {
+		return nil, nil
+	}
+
+	if terms, ok := q.terms(); ok && db.fullTextSearch {
+		return db.searchFullText(ctx, terms)
+	}
+	return db.searchQuery(ctx, q)
+
+}
+
+// setBookmarksFolder sets the folder of each bookmark, with its parents,
+// from the given folder ids.
+func (db *sqlDataStore) setBookmarksFolder(ctx context.Context, bkms []*types.Bookmark, folderIDs []int) error {
+
+	var err error
+
+	for i, bkm := range bkms {
+		if folderIDs[i] == 0 {
+			continue
+		}
+		if bkm.Folder, err = db.GetFolder(ctx, folderIDs[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// GetFolderBookmarks returns the bookmarks of the given folder id.
+func (db *sqlDataStore) GetFolderBookmarks(ctx context.Context, id int) (types.Bookmarks, error) {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("GetFolderBookmarks")
+
+	var (
+		rows *sql.Rows
+		bkms types.Bookmarks
+		err  error
+	)
+
+	// Querying the bookmarks with the folder sort mode.
+	m, err := db.folderSort(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if rows, err = db.query(ctx, "SELECT "+bookmarkColumns+" FROM bookmark WHERE folderId = ? AND "+db.owned("bookmark")+orderBy("bookmark", m), id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetFolderBookmarks:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetFolderBookmarks")
+
+	for rows.Next() {
+		// Building a new Bookmark instance with each row.
+		bkm, folderID, err := scanBookmark(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetFolderBookmarks:error scanning the query result row")
+			return nil, err
+		}
+		bkm.Folder = &types.Folder{Id: folderID}
+		bkms = append(bkms, bkm)
+		log.WithFields(log.Fields{
+			"bkm": bkm,
+		}).Debug("GetFolderBookmarks:bookmark found")
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetFolderBookmarks:error looping rows")
+		return nil, err
+	}
+
+	// Getting the bookmarks tags once the rows are consumed.
+	for _, bkm := range bkms {
+		if bkm.Tags, err = db.GetBookmarkTags(ctx, bkm.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	return bkms, nil
+
+}
+
+// GetBookmarkTags returns the tags of the bookmark.
+func (db *sqlDataStore) GetBookmarkTags(ctx context.Context, id int) ([]*types.Tag, error) {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("GetBookmarkTags")
+
+	var (
+		rows *sql.Rows
+		tags []*types.Tag
+		err  error
+	)
+
+	// Querying the tags.
+	if rows, err = db.query(ctx, `SELECT tag.id, tag.name FROM bookmarktag
+		JOIN tag ON bookmarktag.tagId = tag.id
+		WHERE bookmarktag.bookmarkId = ? AND `+db.owned("tag")+`
+		ORDER BY tag.name`, id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetBookmarkTags:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetBookmarkTags")
+
+	for rows.Next() {
+		tag := new(types.Tag)
+		if err = rows.Scan(&tag.Id, &tag.Name); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetBookmarkTags:error scanning the query result row")
+			return nil, err
+		}
+		log.WithFields(log.Fields{"tag": tag}).Debug("GetBookmarkTags")
+		tags = append(tags, tag)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetBookmarkTags:error looping rows")
+		return nil, err
+	}
+
+	return tags, nil
+
+}
+
+// folderSort returns the sort mode of the folder with the given id,
+// by title if the folder does not exist.
+func (db *sqlDataStore) folderSort(ctx context.Context, id int) (types.SortMode, error) {
+
+	var m types.SortMode
+	err := db.queryRow(ctx, "SELECT sort FROM folder WHERE id=? AND "+db.owned("folder"), id).Scan(&m)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return types.SortTitle, nil
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("folderSort:SELECT query error")
+		return "", err
+	}
+
+	return sortMode(m), nil
+
+}
+
+// GetFolderSubfolders returns the children folders as an array of *Folder
+func (db *sqlDataStore) GetFolderSubfolders(ctx context.Context, id int) ([]*types.Folder, error) {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("GetFolderSubfolders")
+
+	var (
+		rows *sql.Rows
+		flds []*types.Folder
+		err  error
+	)
+
+	// Querying the folders with the parent folder sort mode.
+	m, err := db.folderSort(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if rows, err = db.query(ctx, "SELECT "+folderColumns+" FROM folder WHERE parentFolderId = ? AND "+db.owned("folder")+orderBy("folder", m), id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetFolderSubfolders:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetFolderSubfolders")
+
+	for rows.Next() {
+		// Building a new Folder instance with each row.
+		fld, parentFldID, err := scanFolder(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetFolderSubfolders:error scanning the query result row")
+			return nil, err
+		}
+		fld.Parent = &types.Folder{Id: parentFldID}
+		flds = append(flds, fld)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetFolderSubfolders:error looping rows")
+		return nil, err
+	}
+
+	return flds, nil
+
+}
+
+// saveFolder implements SaveFolder within a transaction.
+func (db *sqlDataStore) saveFolder(ctx context.Context, f *types.Folder) (int64, error) {
+
+	log.WithFields(log.Fields{
+		"f": f,
+	}).Debug("saveFolder")
+
+	parentID, err := db.folderIDOrRoot(ctx, f.Parent)
+	if err != nil {
+		return 0, err
+	}
+
+	// Executing the query.
+	// id will be auto incremented
+	var id int64
+	createdAt, updatedAt := creationDates(f.CreatedAt, f.UpdatedAt)
+	// The new folder is the last one in the manual order.
+	if id, err = db.insert(ctx, `INSERT INTO folder(title, parentFolderId, nbChildrenFolders, sort, position, created_at, updated_at, last_visited_at, ownerId)
+		values(?,?,?,?,(SELECT COALESCE(MAX(position), 0) + 1 FROM folder WHERE parentFolderId = ?),?,?,?,?)`,
+		f.Title, parentID, f.NbChildrenFolders, sortMode(f.Sort), parentID, createdAt, updatedAt, nullTime(f.LastVisitedAt), db.owner); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("saveFolder:INSERT query error")
+		return 0, err
+	}
+
+	return id, nil
+
+}
+
+// updateBookmark implements UpdateBookmark within a transaction.
+func (db *sqlDataStore) updateBookmark(ctx context.Context, b *types.Bookmark) error {
+
+	log.WithFields(log.Fields{
+		"b": b,
+	}).Debug("updateBookmark")
+
+	folderID, err := db.folderIDOrRoot(ctx, b.Folder)
+	if err != nil {
+		return err
+	}
+
+	// Executing the query.
+	// A bookmark moved to another folder is the last one in its manual order.
+	res, err := db.exec(ctx, `UPDATE bookmark SET title=?, url=?, starred=?, favicon=?, notes=?, updated_at=?, last_visited_at=?,
+		position=CASE WHEN folderId=? THEN position ELSE (SELECT COALESCE(MAX(b.position), 0) + 1 FROM bookmark b WHERE b.folderId=?) END,
+		folderId=? WHERE id=? AND `+db.owned("bookmark"),
+		b.Title, b.URL, b.Starred, b.Favicon, b.Notes, now(), nullTime(b.LastVisitedAt), folderID, folderID, folderID, b.Id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("updateBookmark: UPDATE bookmark error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	//
+	// Tags
+	//
+	// lazily deleting current tags
+	if _, err = db.exec(ctx, "DELETE from bookmarktag WHERE bookmarkId = ?", b.Id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("updateBookmark: DELETE bookmarktag query error")
+		return err
+	}
+	// inserting new tags
+	if err = db.linkBookmarkTags(ctx, b.Id, b.Tags); err != nil {
+		return err
+	}
+	// cleaning orphan tags
+	return db.cleanTags(ctx)
+
+}
+
+// linkBookmarkTags links the given tags to the bookmark with the given id,
+// saving the tags not existing in the db.
+func (db *sqlDataStore) linkBookmarkTags(ctx context.Context, bookmarkID int, tags []*types.Tag) error {
+
+	for _, t := range tags {
+		log.WithFields(log.Fields{"t": t}).Debug("linkBookmarkTags")
+		// new tag id
+		var ntid int
+		// getting new tag from db, the tags of the other users are not found
+		nt, err := db.GetTag(ctx, t.Id)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			// inserting the new tag into the db if it does not exist
+			var id int64
+			if id, err = db.SaveTag(ctx, t); err != nil {
+				return err
+			}
+			ntid = int(id)
+		case err != nil:
+			return err
+		default:
+			ntid = nt.Id
+		}
+
+		// linking the new tag to the bookmark
+		log.WithFields(log.Fields{"bookmarkID": bookmarkID, "ntid": ntid}).Debug("linkBookmarkTags")
+		if _, err = db.exec(ctx, "INSERT INTO bookmarktag(bookmarkId, tagId) values(?,?)", bookmarkID, ntid); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("linkBookmarkTags: INSERT bookmarktag query error")
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// SaveTag saves the new given Tag into the db
+func (db *sqlDataStore) SaveTag(ctx context.Context, t *types.Tag) (int64, error) {
+
+	log.WithFields(log.Fields{
+		"t": t,
+	}).Debug("SaveTag")
+
+	// Executing the query.
+	var id int64
+	err := db.withTx(ctx, func(db *sqlDataStore) error {
+		var err error
+		if id, err = db.insert(ctx, "INSERT INTO tag(name, ownerId) values(?,?)", t.Name, db.owner); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("SaveTag:INSERT query error")
+			return err
+		}
+		return db.touch(ctx)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+
+}
+
+// UpdateTag renames the given tag.
+func (db *sqlDataStore) UpdateTag(ctx context.Context, t *types.Tag) error {
+
+	log.WithFields(log.Fields{
+		"t": t,
+	}).Debug("UpdateTag")
+
+	return db.withTx(ctx, func(db *sqlDataStore) error {
+		res, err := db.exec(ctx, "UPDATE tag SET name=? WHERE id=? AND "+db.owned("tag"), t.Name, t.Id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("UpdateTag:UPDATE query error")
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+		return db.touch(ctx)
+	})
+
+}
+
+// DeleteTag removes the tag with the given id from its bookmarks,
+// logging their change, and deletes it.
+func (db *sqlDataStore) DeleteTag(ctx context.Context, id int) error {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("DeleteTag")
+
+	return db.withTx(ctx, func(db *sqlDataStore) error {
+		if _, err := db.GetTag(ctx, id); err != nil {
+			return err
+		}
+
+		rows, err := db.query(ctx, "SELECT bookmarkId FROM bookmarktag WHERE tagId=?", id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("DeleteTag:SELECT query error")
+			return err
+		}
+		defer closeRows(rows, "DeleteTag")
+		var bookmarkIDs []int
+		for rows.Next() {
+			var bookmarkID int
+			if err = rows.Scan(&bookmarkID); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("DeleteTag:error scanning the row")
+				return err
+			}
+			bookmarkIDs = append(bookmarkIDs, bookmarkID)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		// Unlinking the bookmarks once the rows are consumed.
+		for _, bookmarkID := range bookmarkIDs {
+			bookmarkID := bookmarkID
+			if err = db.changeBookmark(ctx, bookmarkID, func(db *sqlDataStore) error {
+				_, err := db.exec(ctx, "DELETE FROM bookmarktag WHERE bookmarkId=? AND tagId=?", bookmarkID, id)
+				return err
+			}); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("DeleteTag:DELETE bookmarktag query error")
+				return err
+			}
+		}
+
+		if _, err = db.exec(ctx, "DELETE FROM tag WHERE id=?", id); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("DeleteTag:DELETE query error")
+			return err
+		}
+		return db.touch(ctx)
+	})
+
+}
+
+// saveBookmark implements SaveBookmark within a transaction.
+func (db *sqlDataStore) saveBookmark(ctx context.Context, b *types.Bookmark) (int64, error) {
+
+	log.WithFields(log.Fields{
+		"b": b,
+	}).Debug("saveBookmark")
+
+	folderID, err := db.folderIDOrRoot(ctx, b.Folder)
+	if err != nil {
+		return 0, err
+	}
+
+	//
+	// Bookmark
+	//
+	var id int64
+	createdAt, updatedAt := creationDates(b.CreatedAt, b.UpdatedAt)
+	// The new bookmark is the last one in the manual order.
+	if id, err = db.insert(ctx, `INSERT INTO bookmark(title, url, folderId, favicon, starred, notes, position, created_at, updated_at, last_visited_at, ownerId)
+		values(?,?,?,?,?,?,(SELECT COALESCE(MAX(position), 0) + 1 FROM bookmark WHERE folderId = ?),?,?,?,?)`,
+		b.Title, b.URL, folderID, b.Favicon, b.Starred, b.Notes, folderID, createdAt, updatedAt, nullTime(b.LastVisitedAt), db.owner); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("saveBookmark:INSERT query error")
+		return 0, err
+	}
+
+	//
+	// Tags
+	//
+	if err = db.linkBookmarkTags(ctx, int(id), b.Tags); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+
+}
+
+// DeleteBookmark delete the given Bookmark from the db
+func (db *sqlDataStore) DeleteBookmark(ctx context.Context, b *types.Bookmark) error {
+
+	log.WithFields(log.Fields{
+		"b": b,
+	}).Debug("DeleteBookmark")
+
+	// Executing the query.
+	return db.withTx(ctx, func(db *sqlDataStore) error {
+		if _, err := db.exec(ctx, "DELETE from bookmark WHERE id=? AND "+db.owned("bookmark"), b.Id); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("DeleteBookmark:DELETE query error")
+			return err
+		}
+		return db.touch(ctx)
+	})
+
+}
+
+// VisitBookmark sets the last visit date of the bookmark with the given id.
+func (db *sqlDataStore) VisitBookmark(ctx context.Context, id int) error {
+	return db.visit(ctx, "bookmark", id)
+}
+
+// VisitFolder sets the last visit date of the folder with the given id.
+func (db *sqlDataStore) VisitFolder(ctx context.Context, id int) error {
+	return db.visit(ctx, "folder", id)
+}
+
+// visit sets the last visit date of the row of the given table,
+// without changing its update date.
+func (db *sqlDataStore) visit(ctx context.Context, table string, id int) error {
+
+	log.WithFields(log.Fields{
+		"table": table,
+		"id":    id,
+	}).Debug("visit")
+
+	res, err := db.exec(ctx, "UPDATE "+table+" SET last_visited_at=? WHERE id=? AND "+db.owned(table), now(), id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("visit:UPDATE query error")
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+
+}
+
+// updateFolder implements UpdateFolder within a transaction.
+func (db *sqlDataStore) updateFolder(ctx context.Context, f *types.Folder) error {
+
+	log.WithFields(log.Fields{
+		"f": f,
+	}).Debug("updateFolder")
+
+	var oldParentFolderID sql.NullInt64
+
+	parentID, err := db.folderIDOrRoot(ctx, f.Parent)
+	if err != nil {
+		return err
+	}
+
+	// Retrieving the parentFolderId of the folder to be updated.
+	if err = db.queryRow(ctx, "SELECT parentFolderId from folder WHERE id=? AND "+db.owned("folder"), f.Id).Scan(&oldParentFolderID); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("updateFolder:SELECT query error")
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	log.WithFields(log.Fields{
+		"oldParentFolderId": oldParentFolderID,
+		"f.Parent":          f.Parent,
+	}).Debug("updateFolder")
+
+	// Updating the folder.
+	// A folder moved to another folder is the last one in its manual order.
+	if _, err = db.exec(ctx, `UPDATE folder SET title=?, sort=?, nbChildrenFolders=(SELECT count(*) from folder WHERE parentFolderId=?), updated_at=?,
+		position=CASE WHEN parentFolderId=? THEN position ELSE (SELECT COALESCE(MAX(f.position), 0) + 1 FROM folder f WHERE f.parentFolderId=?) END,
+		parentFolderId=? WHERE id=?`,
+		f.Title, sortMode(f.Sort), f.Id, now(), parentID, parentID, parentID, f.Id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("updateFolder:UPDATE query error")
+		return err
+	}
+
+	// Updating the old and new parent folders (to update the nbChildrenFolders).
+	for _, id := range []int{int(oldParentFolderID.Int64), parentID} {
+		if err = db.countChildrenFolders(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// countChildrenFolders updates the nbChildrenFolders of the folder with the given id.
+func (db *sqlDataStore) countChildrenFolders(ctx context.Context, id int) error {
+
+	if _, err := db.exec(ctx, "UPDATE folder SET nbChildrenFolders=(SELECT count(*) from folder WHERE parentFolderId=?) WHERE id=?", id, id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"id":  id,
+		}).Error("countChildrenFolders:UPDATE query error")
+		return err
+	}
+
+	return nil
+
+}
+
+// ReorderFolderChildren sets the manual order of the subfolders and bookmarks
+// of the folder with the given id and switches it to the manual sort mode.
+// The given subfolders and bookmarks come first in the given order,
+// followed by the other ones in their previous order.
+func (db *sqlDataStore) ReorderFolderChildren(ctx context.Context, id int, folderIDs []int, bookmarkIDs []int) error {
+
+	log.WithFields(log.Fields{
+		"id":          id,
+		"folderIDs":   folderIDs,
+		"bookmarkIDs": bookmarkIDs,
+	}).Debug("ReorderFolderChildren")
+
+	return db.withTx(ctx, func(db *sqlDataStore) error {
+		if err := db.reorderFolderChildren(ctx, id, folderIDs, bookmarkIDs); err != nil {
+			return err
+		}
+		return db.touch(ctx)
+	})
+
+}
+
+// reorderFolderChildren implements ReorderFolderChildren within a transaction.
+func (db *sqlDataStore) reorderFolderChildren(ctx context.Context, id int, folderIDs []int, bookmarkIDs []int) error {
+
+	res, err := db.exec(ctx, "UPDATE folder SET sort=? WHERE id=? AND "+db.owned("folder"), types.SortManual, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("reorderFolderChildren:UPDATE folder error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	for _, c := range []struct {
+		table, parentColumn string
+		ids                 []int
+	}{
+		{"folder", "parentFolderId", folderIDs},
+		{"bookmark", "folderId", bookmarkIDs},
+	} {
+		// Getting the children in their current manual order.
+		rows, err := db.query(ctx, "SELECT "+c.table+".id FROM "+c.table+" WHERE "+c.parentColumn+" = ?"+orderBy(c.table, types.SortManual), id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("reorderFolderChildren:SELECT query error")
+			return err
+		}
+		var children []int
+		for rows.Next() {
+			var childID int
+			if err = rows.Scan(&childID); err != nil {
+				closeRows(rows, "reorderFolderChildren")
+				return err
+			}
+			children = append(children, childID)
+		}
+		closeRows(rows, "reorderFolderChildren")
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		order, err := reorder(children, c.ids)
+		if err != nil {
+			return err
+		}
+		for i, childID := range order {
+			if _, err = db.exec(ctx, "UPDATE "+c.table+" SET position=? WHERE id=?", i+1, childID); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("reorderFolderChildren:UPDATE position error")
+				return err
+			}
+		}
+	}
+
+	return nil
+
+}
+
+// DeleteFolder delete the given Folder from the db.
+func (db *sqlDataStore) DeleteFolder(ctx context.Context, f *types.Folder) error {
+
+	log.WithFields(log.Fields{
+		"f": f,
+	}).Debug("DeleteFolder")
+
+	// Executing the query.
+	return db.withTx(ctx, func(db *sqlDataStore) error {
+		if _, err := db.exec(ctx, "DELETE from folder WHERE id=? AND "+db.owned("folder"), f.Id); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("DeleteFolder:DELETE query error")
+			return err
+		}
+		return db.touch(ctx)
+	})
+
+}
+
+// closeRows closes the given rows, just logging the error.
+func closeRows(rows *sql.Rows, functionName string) {
+
+	if err := rows.Close(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error(functionName + ":error closing rows")
+	}
+
+}
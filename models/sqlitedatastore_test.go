@@ -0,0 +1,21 @@
+package models_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/models/datastoretest"
+)
+
+func TestSQLiteDataStore(t *testing.T) {
+
+	datastoretest.Run(t, func(t *testing.T) models.Datastore {
+		db, err := models.NewDBstore(filepath.Join(t.TempDir(), "bkm.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+
+}
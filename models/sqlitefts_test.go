@@ -0,0 +1,83 @@
+//go:build sqlite_fts5
+
+package models_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+func TestSQLiteFullTextSearch(t *testing.T) {
+
+	ctx := context.Background()
+	db, err := models.NewDBstore(filepath.Join(t.TempDir(), "bkm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.CreateDatabase(ctx); err != nil {
+		t.Fatal(err)
+	}
+	root, err := db.GetRootFolder(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*types.Bookmark{
+		{Title: "Notes", URL: "https://example.com/notes", Notes: "About the gophers."},
+		{Title: "Example", URL: "https://example.com/gophers"},
+		{Title: "Go & <Gophers>", URL: "https://example.com/go"},
+		{Title: "Rust", URL: "https://rust-lang.org/"},
+	} {
+		b.Folder = root
+		if _, err = db.SaveBookmark(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		search   string
+		want     []string
+		snippets []string
+	}{
+		// The title matches come first, then the URL ones, then the notes ones.
+		{"gophers", []string{"Go & <Gophers>", "Example", "Notes"}, []string{
+			"Go &amp; &lt;<mark>Gophers</mark>&gt;",
+			"https://example.com/<mark>gophers</mark>",
+			"About the <mark>gophers</mark>.",
+		}},
+		// The words are prefixes.
+		{"goph", []string{"Go & <Gophers>", "Example", "Notes"}, nil},
+		{"rus lang", []string{"Rust"}, []string{"https://<mark>rust</mark>-<mark>lang</mark>.org/"}},
+		{`"the gophers"`, []string{"Notes"}, []string{"About <mark>the gophers</mark>."}},
+		{`"gophers the"`, nil, nil},
+	} {
+		bkms, err := db.SearchBookmarks(ctx, c.search)
+		if err != nil {
+			t.Fatalf("SearchBookmarks(%q): %v", c.search, err)
+		}
+		var titles []string
+		for _, b := range bkms {
+			titles = append(titles, b.Title)
+		}
+		if len(titles) != len(c.want) {
+			t.Errorf("SearchBookmarks(%q) = %q, want %q", c.search, titles, c.want)
+			continue
+		}
+		for i := range titles {
+			if titles[i] != c.want[i] {
+				t.Errorf("SearchBookmarks(%q) = %q, want %q", c.search, titles, c.want)
+				break
+			}
+		}
+		for i, s := range c.snippets {
+			if bkms[i].Snippet != s {
+				t.Errorf("SearchBookmarks(%q) %q snippet = %q, want %q", c.search, bkms[i].Title, bkms[i].Snippet, s)
+			}
+		}
+	}
+
+}
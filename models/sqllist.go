@@ -0,0 +1,391 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// sqlListKey is the sort key of a list query of a table.
+type sqlListKey struct {
+	listKey
+	table string
+	// expr is the sorted expression.
+	expr string
+	// selected is the expression selected after the item columns
+	// giving the cursor key.
+	selected string
+}
+
+// listKey returns the sort key of the given options for the given table.
+func (db *sqlDataStore) listKey(table string, opts ListOptions) (*sqlListKey, error) {
+
+	k, err := listKeyOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	key := &sqlListKey{listKey: k, table: table, expr: table + "." + k.column}
+	switch {
+	case k.kind == keyText:
+		key.expr = "LOWER(" + key.expr + ")"
+		// Sorting the bytes as the cursor keys, not with the locale.
+		if db.driver == postgresDriver {
+			key.expr += ` COLLATE "C"`
+		}
+	case k.kind == keyTime && db.driver != postgresDriver:
+		// SQLite compares the dates as they are stored, as text
+		// in several formats, the cursor keys are that text.
+		key.kind = keyText
+		key.selected = "CAST(" + key.expr + " AS TEXT)"
+	}
+	if key.selected == "" {
+		key.selected = key.expr
+	}
+	return key, nil
+
+}
+
+// dest returns the scan destination of the key expression
+// and the function returning the cursor key once scanned.
+func (k *sqlListKey) dest() (interface{}, func() string) {
+
+	switch k.kind {
+	case keyText:
+		var s sql.NullString
+		return &s, func() string { return s.String }
+	case keyTime:
+		var t sql.NullTime
+		return &t, func() string { return timeKey(timePtr(t)) }
+	}
+	var i sql.NullInt64
+	return &i, func() string { return intKey(int(i.Int64)) }
+
+}
+
+// param returns the query parameter of the given cursor key.
+func (k *sqlListKey) param(key string) (interface{}, error) {
+
+	switch k.kind {
+	case keyText:
+		return key, nil
+	case keyTime:
+		t, err := time.ParseInLocation(timeKeyLayout, key, time.UTC)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		return t, nil
+	}
+	i, err := strconv.Atoi(key)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return i, nil
+
+}
+
+// after returns the condition selecting the rows after the given cursor
+// with its parameters, by key then id, the null keys coming first
+// in the ascending order.
+func (k *sqlListKey) after(c *ListCursor, desc bool) (string, []interface{}, error) {
+
+	id := k.table + ".id"
+	cmp := ">"
+	if desc {
+		cmp = "<"
+	}
+
+	if k.nullable && c.Key == "" {
+		if desc {
+			return "(" + k.expr + " IS NULL AND " + id + " < ?)", []interface{}{c.Id}, nil
+		}
+		return "(" + k.expr + " IS NOT NULL OR " + id + " > ?)", []interface{}{c.Id}, nil
+	}
+
+	v, err := k.param(c.Key)
+	if err != nil {
+		return "", nil, err
+	}
+	cond := k.expr + " " + cmp + " ? OR (" + k.expr + " = ? AND " + id + " " + cmp + " ?)"
+	if k.nullable && desc {
+		cond = k.expr + " IS NULL OR " + cond
+	}
+	return "(" + cond + ")", []interface{}{v, v, c.Id}, nil
+
+}
+
+// orderBy returns the ORDER BY clause of the key.
+func (k *sqlListKey) orderBy(desc bool) string {
+
+	dir := ""
+	if desc {
+		dir = " DESC"
+	}
+	var keys []string
+	if k.nullable {
+		keys = append(keys, k.expr+" IS NOT NULL"+dir)
+	}
+	keys = append(keys, k.expr+dir, k.table+".id"+dir)
+	return " ORDER BY " + strings.Join(keys, ", ")
+
+}
+
+// listQuery returns the query of the columns of the given table rows
+// matching the given conditions, followed by the sort key, sorted and paginated
+// with the given options, and its parameters.
+func (db *sqlDataStore) listQuery(key *sqlListKey, columns string, conds []string, args []interface{}, opts ListOptions) (string, []interface{}, error) {
+
+	if opts.After != nil {
+		cond, afterArgs, err := key.after(opts.After, opts.Desc)
+		if err != nil {
+			return "", nil, err
+		}
+		conds = append(conds, cond)
+		args = append(args, afterArgs...)
+	}
+
+	query := "SELECT " + columns + ", " + key.selected + " FROM " + key.table + " WHERE " + strings.Join(conds, " AND ") + key.orderBy(opts.Desc)
+	// One more row tells if there is a next page.
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit+1)
+	}
+	return query, args, nil
+
+}
+
+// nextCursor returns the cursor after the item of the given index
+// of the given keys and ids if there are more rows than the limit.
+func nextCursor(opts ListOptions, keys []string, ids []int) *ListCursor {
+
+	if opts.Limit == 0 || len(ids) <= opts.Limit {
+		return nil
+	}
+	return &ListCursor{Key: keys[opts.Limit-1], Id: ids[opts.Limit-1]}
+
+}
+
+// ListBookmarks returns the page of the given options of the bookmarks
+// not in the trash matching the given filter, with their folder and tags,
+// and the cursor of the next page, nil if it is the last one.
+func (db *sqlDataStore) ListBookmarks(ctx context.Context, f BookmarkFilter, opts ListOptions) ([]*types.Bookmark, *ListCursor, error) {
+
+	log.WithFields(log.Fields{
+		"f":    f,
+		"opts": opts,
+	}).Debug("ListBookmarks")
+
+	var (
+		rows      *sql.Rows
+		bkms      []*types.Bookmark
+		folderIDs []int
+		keys      []string
+		ids       []int
+	)
+
+	key, err := db.listKey("bookmark", opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	conds := []string{db.owned("bookmark"), inLiveFolder}
+	var args []interface{}
+	if f.FolderId != 0 {
+		conds = append(conds, "bookmark.folderId = ?")
+		args = append(args, f.FolderId)
+	}
+	if f.Tag != "" {
+		conds = append(conds, `EXISTS (SELECT 1 FROM bookmarktag JOIN tag ON bookmarktag.tagId = tag.id
+			WHERE bookmarktag.bookmarkId = bookmark.id AND LOWER(tag.name) = LOWER(?))`)
+		args = append(args, f.Tag)
+	}
+	if f.Starred != nil {
+		conds = append(conds, "COALESCE(bookmark.starred, ?) = ?")
+		args = append(args, false, *f.Starred)
+	}
+	query, args, err := db.listQuery(key, bookmarkColumns, conds, args, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Querying the bookmarks.
+	if rows, err = db.query(ctx, db.liveFolders()+" "+query, args...); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("ListBookmarks:SELECT query error")
+		return nil, nil, err
+	}
+	defer closeRows(rows, "ListBookmarks")
+
+	for rows.Next() {
+		// Building a new Bookmark instance with each row.
+		dest, scanned := key.dest()
+		bkm, folderID, err := scanBookmark(rows, dest)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("ListBookmarks:error scanning the query result row")
+			return nil, nil, err
+		}
+		bkms = append(bkms, bkm)
+		folderIDs = append(folderIDs, folderID)
+		keys = append(keys, scanned())
+		ids = append(ids, bkm.Id)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("ListBookmarks:error looping rows")
+		return nil, nil, err
+	}
+
+	next := nextCursor(opts, keys, ids)
+	if next != nil {
+		bkms, folderIDs = bkms[:opts.Limit], folderIDs[:opts.Limit]
+	}
+
+	// Retrieving the bookmarks folders and tags once the rows are consumed.
+	if err = db.setBookmarksFolder(ctx, bkms, folderIDs); err != nil {
+		return nil, nil, err
+	}
+	for _, bkm := range bkms {
+		if bkm.Tags, err = db.GetBookmarkTags(ctx, bkm.Id); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return bkms, next, nil
+
+}
+
+// ListFolders returns the page of the given options of the subfolders
+// of the folder with the given id and the cursor of the next page,
+// nil if it is the last one.
+func (db *sqlDataStore) ListFolders(ctx context.Context, parentID int, opts ListOptions) ([]*types.Folder, *ListCursor, error) {
+
+	log.WithFields(log.Fields{
+		"parentID": parentID,
+		"opts":     opts,
+	}).Debug("ListFolders")
+
+	var (
+		rows *sql.Rows
+		flds []*types.Folder
+		keys []string
+		ids  []int
+	)
+
+	key, err := db.listKey("folder", opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	query, args, err := db.listQuery(key, folderColumns, []string{"folder.parentFolderId = ?", db.owned("folder")}, []interface{}{parentID}, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Querying the folders.
+	if rows, err = db.query(ctx, query, args...); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("ListFolders:SELECT query error")
+		return nil, nil, err
+	}
+	defer closeRows(rows, "ListFolders")
+
+	for rows.Next() {
+		// Building a new Folder instance with each row.
+		dest, scanned := key.dest()
+		fld, parentFldID, err := scanFolder(rows, dest)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("ListFolders:error scanning the query result row")
+			return nil, nil, err
+		}
+		fld.Parent = &types.Folder{Id: parentFldID}
+		flds = append(flds, fld)
+		keys = append(keys, scanned())
+		ids = append(ids, fld.Id)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("ListFolders:error looping rows")
+		return nil, nil, err
+	}
+
+	next := nextCursor(opts, keys, ids)
+	if next != nil {
+		flds = flds[:opts.Limit]
+	}
+
+	return flds, next, nil
+
+}
+
+// ListTags returns the page of the given options of the tags
+// and the cursor of the next page, nil if it is the last one.
+func (db *sqlDataStore) ListTags(ctx context.Context, opts ListOptions) ([]*types.Tag, *ListCursor, error) {
+
+	log.WithFields(log.Fields{
+		"opts": opts,
+	}).Debug("ListTags")
+
+	var (
+		rows *sql.Rows
+		tags []*types.Tag
+		keys []string
+		ids  []int
+	)
+
+	key, err := db.listKey("tag", opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	query, args, err := db.listQuery(key, "tag.id, tag.name", []string{db.owned("tag")}, nil, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Querying the tags.
+	if rows, err = db.query(ctx, query, args...); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("ListTags:SELECT query error")
+		return nil, nil, err
+	}
+	defer closeRows(rows, "ListTags")
+
+	for rows.Next() {
+		// Building a new Tag instance with each row.
+		tag := new(types.Tag)
+		dest, scanned := key.dest()
+		if err = rows.Scan(&tag.Id, &tag.Name, dest); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("ListTags:error scanning the query result row")
+			return nil, nil, err
+		}
+		tags = append(tags, tag)
+		keys = append(keys, scanned())
+		ids = append(ids, tag.Id)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("ListTags:error looping rows")
+		return nil, nil, err
+	}
+
+	next := nextCursor(opts, keys, ids)
+	if next != nil {
+		tags = tags[:opts.Limit]
+	}
+
+	return tags, next, nil
+
+}
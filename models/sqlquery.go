@@ -0,0 +1,275 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// sqlQueryCompiler translates a search query into a WHERE condition
+// selecting a superset of the matching bookmarks, that are then
+// filtered with Query.Match. The conditions that select exactly
+// the matching bookmarks can be negated, the others can not.
+type sqlQueryCompiler struct {
+	db   *sqlDataStore
+	args []interface{}
+	// folderPaths are the lower case folders paths by id, lazily loaded.
+	folderPaths map[int]string
+}
+
+// compile returns the condition of the given node
+// and whether it selects exactly the matching bookmarks.
+func (c *sqlQueryCompiler) compile(ctx context.Context, n queryNode) (string, bool, error) {
+
+	switch n := n.(type) {
+	case *andNode:
+		return c.compileBinary(ctx, n.left, "AND", n.right)
+	case *orNode:
+		return c.compileBinary(ctx, n.left, "OR", n.right)
+	case *notNode:
+		nargs := len(c.args)
+		cond, exact, err := c.compile(ctx, n.operand)
+		if err != nil {
+			return "", false, err
+		}
+		if !exact {
+			// The negation of a superset is not a superset,
+			// dropping the operand condition and its arguments.
+			c.args = c.args[:nargs]
+			return "1 = 1", false, nil
+		}
+		return "NOT " + cond, true, nil
+	case *termNode:
+		return c.compileTerm(n), false, nil
+	case *tagNode:
+		c.args = append(c.args, n.name)
+		return "EXISTS (SELECT 1 FROM bookmarktag JOIN tag ON tag.id = bookmarktag.tagId WHERE bookmarktag.bookmarkId = bookmark.id AND LOWER(tag.name) = ?)", true, nil
+	case *folderNode:
+		return c.compileFolder(ctx, n)
+	case *starredNode:
+		c.args = append(c.args, n.starred)
+		if n.starred {
+			return "bookmark.starred = ?", true, nil
+		}
+		return "(bookmark.starred IS NULL OR bookmark.starred = ?)", true, nil
+	case *siteNode:
+		c.args = append(c.args, "%"+n.host+"%")
+		return "LOWER(bookmark.url) LIKE ?", false, nil
+	}
+
+	return "1 = 1", false, nil
+
+}
+
+// compileBinary returns the condition of the given AND or OR operation.
+func (c *sqlQueryCompiler) compileBinary(ctx context.Context, left queryNode, op string, right queryNode) (string, bool, error) {
+
+	lcond, lexact, err := c.compile(ctx, left)
+	if err != nil {
+		return "", false, err
+	}
+	rcond, rexact, err := c.compile(ctx, right)
+	if err != nil {
+		return "", false, err
+	}
+	return "(" + lcond + " " + op + " " + rcond + ")", lexact && rexact, nil
+
+}
+
+// compileTerm returns the condition of the given term
+// using the full text search index if available.
+func (c *sqlQueryCompiler) compileTerm(n *termNode) string {
+
+	if len(n.words) == 0 {
+		return "1 = 0"
+	}
+
+	if c.db.fullTextSearch {
+		c.args = append(c.args, n.fts())
+		return "bookmark.id IN (SELECT rowid FROM bookmarkfts WHERE bookmarkfts MATCH ?)"
+	}
+
+	conds := make([]string, 0, len(n.words))
+	for _, w := range n.words {
+		pattern := "%" + w + "%"
+		c.args = append(c.args, pattern, pattern, pattern, pattern)
+		conds = append(conds, `(LOWER(bookmark.title) LIKE ? OR
+			LOWER(bookmark.url) LIKE ? OR
+			LOWER(bookmark.notes) LIKE ? OR
+			EXISTS (SELECT 1 FROM bookmarktag JOIN tag ON tag.id = bookmarktag.tagId WHERE bookmarktag.bookmarkId = bookmark.id AND LOWER(tag.name) LIKE ?))`)
+	}
+	return "(" + strings.Join(conds, " AND ") + ")"
+
+}
+
+// compileFolder returns the condition selecting the bookmarks
+// of the folders matching the given node. The root path matches every
+// folder, already selected by inLiveFolder. The other paths match the folders
+// with that path and their subfolders, selected with a recursive common
+// table expression rather than one parameter by folder, bounded by the
+// SQL parameters limit.
+func (c *sqlQueryCompiler) compileFolder(ctx context.Context, n *folderNode) (string, bool, error) {
+
+	if n.path == "/" {
+		return "1 = 1", true, nil
+	}
+
+	if c.folderPaths == nil {
+		var err error
+		if c.folderPaths, err = c.db.folderPaths(ctx); err != nil {
+			return "", false, err
+		}
+	}
+
+	var ids []string
+	for id, p := range c.folderPaths {
+		if p == n.path {
+			c.args = append(c.args, id)
+			ids = append(ids, "?")
+		}
+	}
+	if len(ids) == 0 {
+		return "1 = 0", true, nil
+	}
+	return `bookmark.folderId IN (WITH RECURSIVE pathfolder(id) AS (
+		SELECT id FROM folder WHERE id IN (` + strings.Join(ids, ", ") + `)
+		UNION
+		SELECT folder.id FROM folder JOIN pathfolder ON folder.parentFolderId = pathfolder.id)
+		SELECT id FROM pathfolder)`, true, nil
+
+}
+
+// folderPaths returns the lower case paths of the folders not in the trash by id,
+// with the types.Bookmark PathString format.
+func (db *sqlDataStore) folderPaths(ctx context.Context) (map[int]string, error) {
+
+	type folderRow struct {
+		title    string
+		parentID int
+	}
+
+	rows, err := db.query(ctx, db.liveFolders()+" SELECT id, title, parentFolderId FROM folder WHERE id IN (SELECT id FROM livefolder)")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("folderPaths:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "folderPaths")
+
+	folders := make(map[int]folderRow)
+	for rows.Next() {
+		var (
+			id       int
+			title    string
+			parentID sql.NullInt64
+		)
+		if err = rows.Scan(&id, &title, &parentID); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("folderPaths:error scanning the query result row")
+			return nil, err
+		}
+		folders[id] = folderRow{title: title, parentID: int(parentID.Int64)}
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("folderPaths:error looping rows")
+		return nil, err
+	}
+
+	// path returns the path of the given folder, empty for the root folder.
+	cache := make(map[int]string, len(folders))
+	var path func(id int, depth int) string
+	path = func(id int, depth int) string {
+		if p, ok := cache[id]; ok {
+			return p
+		}
+		f, ok := folders[id]
+		// The root folder has no parent, the depth guards against cycles.
+		if !ok || f.parentID == 0 || depth > len(folders) {
+			return ""
+		}
+		p := path(f.parentID, depth+1) + "/" + strings.ToLower(f.title)
+		cache[id] = p
+		return p
+	}
+
+	paths := make(map[int]string, len(folders))
+	for id := range folders {
+		if paths[id] = path(id, 0); paths[id] == "" {
+			paths[id] = "/"
+		}
+	}
+
+	return paths, nil
+
+}
+
+// searchQuery returns the bookmarks matching the given query
+// with their folder and tags, sorted by title.
+func (db *sqlDataStore) searchQuery(ctx context.Context, q *Query) ([]*types.Bookmark, error) {
+
+	var (
+		rows      *sql.Rows
+		bkms      []*types.Bookmark
+		folderIDs []int
+		err       error
+	)
+
+	c := &sqlQueryCompiler{db: db}
+	cond, _, err := c.compile(ctx, q.root)
+	if err != nil {
+		return nil, err
+	}
+
+	// Querying the candidate bookmarks.
+	if rows, err = db.query(ctx, db.liveFolders()+" SELECT "+bookmarkColumns+" FROM bookmark WHERE "+cond+" AND "+inLiveFolder+" ORDER BY bookmark.title", c.args...); err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"cond": cond,
+		}).Error("searchQuery:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "searchQuery")
+
+	for rows.Next() {
+		// Building a new Bookmark instance with each row.
+		bkm, folderID, err := scanBookmark(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("searchQuery:error scanning the query result row")
+			return nil, err
+		}
+		bkms = append(bkms, bkm)
+		folderIDs = append(folderIDs, folderID)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("searchQuery:error looping rows")
+		return nil, err
+	}
+
+	// Retrieving the bookmarks folders and tags once the rows are consumed.
+	if err = db.setBookmarksFolder(ctx, bkms, folderIDs); err != nil {
+		return nil, err
+	}
+	matches := bkms[:0]
+	for _, bkm := range bkms {
+		if bkm.Tags, err = db.GetBookmarkTags(ctx, bkm.Id); err != nil {
+			return nil, err
+		}
+		if q.Match(bkm) {
+			matches = append(matches, bkm)
+		}
+	}
+
+	return matches, nil
+
+}
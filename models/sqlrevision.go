@@ -0,0 +1,695 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// revisionColumns are the revision columns scanned by scanRevision.
+const revisionColumns = "id, created_at, operation, kind, itemId, before, after, reverts"
+
+// nullInt returns the given id as a sql.NullInt64, NULL for 0.
+func nullInt(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// nullJSON returns the given JSON as a sql.NullString, NULL for nil.
+func nullJSON(b json.RawMessage) sql.NullString {
+	return sql.NullString{String: string(b), Valid: b != nil}
+}
+
+// scanRevision returns the revision of the given row.
+func scanRevision(row rowScanner) (*types.Revision, error) {
+
+	var (
+		rev           = new(types.Revision)
+		before, after sql.NullString
+		reverts       sql.NullInt64
+	)
+
+	if err := row.Scan(&rev.Id, &rev.CreatedAt, &rev.Operation, &rev.Kind, &rev.ItemId, &before, &after, &reverts); err != nil {
+		return nil, err
+	}
+	if before.Valid {
+		rev.Before = json.RawMessage(before.String)
+	}
+	if after.Valid {
+		rev.After = json.RawMessage(after.String)
+	}
+	rev.Reverts = int(reverts.Int64)
+
+	return rev, nil
+
+}
+
+// bookmarkSnapshot returns the snapshot of the bookmark with the given id, nil if it does not exist.
+func (db *sqlDataStore) bookmarkSnapshot(ctx context.Context, id int) (*bookmarkSnapshot, error) {
+
+	var (
+		s                       = new(bookmarkSnapshot)
+		notes                   sql.NullString
+		folderID, trashParentID sql.NullInt64
+		deletedAt               sql.NullTime
+		trashPath               sql.NullString
+	)
+
+	err := db.queryRow(ctx, "SELECT title, url, notes, starred, folderId, deleted_at, trash_parent_id, trash_path FROM bookmark WHERE id=? AND "+db.owned("bookmark"), id).Scan(
+		&s.Title, &s.URL, &notes, &s.Starred, &folderID, &deletedAt, &trashParentID, &trashPath)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("bookmarkSnapshot:SELECT query error")
+		return nil, err
+	}
+	s.Notes = notes.String
+	s.FolderID = int(folderID.Int64)
+	s.DeletedAt = timePtr(deletedAt)
+	s.TrashParentID = int(trashParentID.Int64)
+	s.TrashPath = decodeTrashPath(trashPath)
+
+	if s.Tags, err = db.GetBookmarkTags(ctx, id); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+
+}
+
+// folderSnapshot returns the snapshot of the folder with the given id, nil if it does not exist.
+func (db *sqlDataStore) folderSnapshot(ctx context.Context, id int) (*folderSnapshot, error) {
+
+	var (
+		s                       = new(folderSnapshot)
+		parentID, trashParentID sql.NullInt64
+		deletedAt               sql.NullTime
+		trashPath               sql.NullString
+	)
+
+	err := db.queryRow(ctx, "SELECT title, parentFolderId, sort, deleted_at, trash_parent_id, trash_path FROM folder WHERE id=? AND "+db.owned("folder"), id).Scan(
+		&s.Title, &parentID, &s.Sort, &deletedAt, &trashParentID, &trashPath)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("folderSnapshot:SELECT query error")
+		return nil, err
+	}
+	s.ParentID = int(parentID.Int64)
+	s.DeletedAt = timePtr(deletedAt)
+	s.TrashParentID = int(trashParentID.Int64)
+	s.TrashPath = decodeTrashPath(trashPath)
+
+	return s, nil
+
+}
+
+// touch increases the data revision of the datastore user.
+// It is called by every change, within its transaction if any.
+func (db *sqlDataStore) touch(ctx context.Context) error {
+
+	if _, err := db.exec(ctx, `INSERT INTO datarevision(ownerId, revision, updated_at) values(?, 1, ?)
+		ON CONFLICT(ownerId) DO UPDATE SET revision = datarevision.revision + 1, updated_at = excluded.updated_at`, db.owner, now()); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("touch:INSERT query error")
+		return err
+	}
+
+	return nil
+
+}
+
+// GetDataRevision returns the data revision of the datastore user,
+// 0 if its data never changed.
+func (db *sqlDataStore) GetDataRevision(ctx context.Context) (*types.DataRevision, error) {
+
+	query := "SELECT revision, updated_at FROM datarevision WHERE ownerId=?"
+	// Locking it in the PostgreSQL transactions until they are over,
+	// the SQLite ones being serialized.
+	if db.tx != nil && db.driver == postgresDriver {
+		query += " FOR UPDATE"
+	}
+
+	rev := new(types.DataRevision)
+	err := db.queryRow(ctx, query, db.owner).Scan(&rev.Revision, &rev.UpdatedAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return rev, nil
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetDataRevision:SELECT query error")
+		return nil, err
+	}
+
+	return rev, nil
+
+}
+
+// addRevision appends the given revision to the log.
+func (db *sqlDataStore) addRevision(ctx context.Context, rev *types.Revision) error {
+
+	rev.CreatedAt = now()
+	id, err := db.insert(ctx, "INSERT INTO revision(created_at, operation, kind, itemId, before, after, reverts, ownerId) values(?,?,?,?,?,?,?,?)",
+		rev.CreatedAt, rev.Operation, rev.Kind, rev.ItemId, nullJSON(rev.Before), nullJSON(rev.After), nullInt(rev.Reverts), db.owner)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("addRevision:INSERT query error")
+		return err
+	}
+	rev.Id = int(id)
+
+	return db.touch(ctx)
+
+}
+
+// recordBookmark logs the change of the bookmark with the given id
+// from the given before snapshot, if any.
+func (db *sqlDataStore) recordBookmark(ctx context.Context, id int, before *bookmarkSnapshot) error {
+
+	after, err := db.bookmarkSnapshot(ctx, id)
+	if err != nil {
+		return err
+	}
+	op := bookmarkOperation(before, after)
+	if op == "" {
+		return nil
+	}
+
+	return db.addRevision(ctx, &types.Revision{Operation: op, Kind: types.RevisionBookmark, ItemId: id,
+		Before: encodeSnapshot(before), After: encodeSnapshot(after)})
+
+}
+
+// recordFolder logs the change of the folder with the given id
+// from the given before snapshot, if any.
+func (db *sqlDataStore) recordFolder(ctx context.Context, id int, before *folderSnapshot) error {
+
+	after, err := db.folderSnapshot(ctx, id)
+	if err != nil {
+		return err
+	}
+	op := folderOperation(before, after)
+	if op == "" {
+		return nil
+	}
+
+	return db.addRevision(ctx, &types.Revision{Operation: op, Kind: types.RevisionFolder, ItemId: id,
+		Before: encodeSnapshot(before), After: encodeSnapshot(after)})
+
+}
+
+// changeBookmark calls the given function changing the bookmark
+// with the given id in a transaction logging the change.
+func (db *sqlDataStore) changeBookmark(ctx context.Context, id int, f func(db *sqlDataStore) error) error {
+
+	return db.withTx(ctx, func(db *sqlDataStore) error {
+		before, err := db.bookmarkSnapshot(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err = f(db); err != nil {
+			return err
+		}
+		return db.recordBookmark(ctx, id, before)
+	})
+
+}
+
+// changeFolder calls the given function changing the folder
+// with the given id in a transaction logging the change.
+func (db *sqlDataStore) changeFolder(ctx context.Context, id int, f func(db *sqlDataStore) error) error {
+
+	return db.withTx(ctx, func(db *sqlDataStore) error {
+		before, err := db.folderSnapshot(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err = f(db); err != nil {
+			return err
+		}
+		return db.recordFolder(ctx, id, before)
+	})
+
+}
+
+// SaveBookmark saves the new given Bookmark into the db
+func (db *sqlDataStore) SaveBookmark(ctx context.Context, b *types.Bookmark) (int64, error) {
+
+	var id int64
+	err := db.withTx(ctx, func(db *sqlDataStore) error {
+		var err error
+		if id, err = db.saveBookmark(ctx, b); err != nil {
+			return err
+		}
+		return db.recordBookmark(ctx, int(id), nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+
+}
+
+// UpdateBookmark updates the given bookmark and its tags.
+func (db *sqlDataStore) UpdateBookmark(ctx context.Context, b *types.Bookmark) error {
+
+	return db.changeBookmark(ctx, b.Id, func(db *sqlDataStore) error {
+		return db.updateBookmark(ctx, b)
+	})
+
+}
+
+// SaveFolder saves the given new Folder into the db and returns the folder id.
+// Called only on folder creation or rename
+// so only the Title has to be set.
+func (db *sqlDataStore) SaveFolder(ctx context.Context, f *types.Folder) (int64, error) {
+
+	var id int64
+	err := db.withTx(ctx, func(db *sqlDataStore) error {
+		var err error
+		if id, err = db.saveFolder(ctx, f); err != nil {
+			return err
+		}
+		return db.recordFolder(ctx, int(id), nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+
+}
+
+// UpdateFolder updates the given folder.
+func (db *sqlDataStore) UpdateFolder(ctx context.Context, f *types.Folder) error {
+
+	return db.changeFolder(ctx, f.Id, func(db *sqlDataStore) error {
+		return db.updateFolder(ctx, f)
+	})
+
+}
+
+// TrashBookmark moves the bookmark with the given id to the trash.
+func (db *sqlDataStore) TrashBookmark(ctx context.Context, id int) error {
+
+	return db.changeBookmark(ctx, id, func(db *sqlDataStore) error {
+		return db.trashBookmark(ctx, id)
+	})
+
+}
+
+// TrashFolder moves the folder with the given id, with its
+// subfolders and bookmarks, to the trash.
+func (db *sqlDataStore) TrashFolder(ctx context.Context, id int) error {
+
+	return db.changeFolder(ctx, id, func(db *sqlDataStore) error {
+		return db.trashFolder(ctx, id)
+	})
+
+}
+
+// RestoreBookmark moves the bookmark with the given id out of the trash,
+// at the end of its previous folder, recreated if missing.
+func (db *sqlDataStore) RestoreBookmark(ctx context.Context, id int) error {
+
+	return db.changeBookmark(ctx, id, func(db *sqlDataStore) error {
+		return db.restoreBookmark(ctx, id)
+	})
+
+}
+
+// RestoreFolder moves the folder with the given id out of the trash,
+// at the end of its previous parent folder, recreated if missing.
+func (db *sqlDataStore) RestoreFolder(ctx context.Context, id int) error {
+
+	return db.changeFolder(ctx, id, func(db *sqlDataStore) error {
+		return db.restoreFolder(ctx, id)
+	})
+
+}
+
+// SetBookmarkFavicon sets the favicon of the bookmark with the given id.
+// The change is not logged in the revisions.
+func (db *sqlDataStore) SetBookmarkFavicon(ctx context.Context, id int, favicon string) error {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("SetBookmarkFavicon")
+
+	res, err := db.exec(ctx, "UPDATE bookmark SET favicon=? WHERE id=? AND "+db.owned("bookmark"), favicon, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("SetBookmarkFavicon:UPDATE query error")
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return db.touch(ctx)
+
+}
+
+// GetRevisions returns the revisions of the folder or bookmark,
+// depending on the given kind, with the given id, most recent first.
+func (db *sqlDataStore) GetRevisions(ctx context.Context, kind string, id int) ([]*types.Revision, error) {
+
+	rows, err := db.query(ctx, "SELECT "+revisionColumns+" FROM revision WHERE kind=? AND itemId=? AND "+db.owned("revision")+" ORDER BY id DESC", kind, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetRevisions:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetRevisions")
+
+	revs := []*types.Revision{}
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetRevisions:error scanning the row")
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetRevisions:error looping rows")
+		return nil, err
+	}
+
+	return revs, nil
+
+}
+
+// Undo reverts the last n revisions not reverted yet, most recent first,
+// in a single transaction and returns the undo revisions logged.
+// Nothing is reverted if one of them can not be.
+func (db *sqlDataStore) Undo(ctx context.Context, n int) ([]*types.Revision, error) {
+
+	log.WithFields(log.Fields{
+		"n": n,
+	}).Debug("Undo")
+
+	var undone []*types.Revision
+	err := db.withTx(ctx, func(db *sqlDataStore) error {
+		revs, err := db.undoableRevisions(ctx, n)
+		if err != nil {
+			return err
+		}
+		for _, rev := range revs {
+			undo, err := db.revert(ctx, rev)
+			if err != nil {
+				return err
+			}
+			undone = append(undone, undo)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return undone, nil
+
+}
+
+// undoableRevisions returns the last n revisions
+// neither undo nor reverted, most recent first.
+func (db *sqlDataStore) undoableRevisions(ctx context.Context, n int) ([]*types.Revision, error) {
+
+	rows, err := db.query(ctx, "SELECT "+revisionColumns+` FROM revision WHERE operation<>? AND `+db.owned("revision")+`
+		AND NOT EXISTS (SELECT 1 FROM revision u WHERE u.reverts=revision.id) ORDER BY id DESC LIMIT ?`, types.OperationUndo, n)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("undoableRevisions:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "undoableRevisions")
+
+	var revs []*types.Revision
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("undoableRevisions:error scanning the row")
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("undoableRevisions:error looping rows")
+		return nil, err
+	}
+
+	return revs, nil
+
+}
+
+// revert restores the before snapshot of the given revision
+// and logs the undo revision returned.
+func (db *sqlDataStore) revert(ctx context.Context, rev *types.Revision) (*types.Revision, error) {
+
+	var (
+		current json.RawMessage
+		err     error
+	)
+
+	switch rev.Kind {
+	case types.RevisionBookmark:
+		var cur, before *bookmarkSnapshot
+		if cur, err = db.bookmarkSnapshot(ctx, rev.ItemId); err != nil {
+			return nil, err
+		}
+		if before, err = decodeBookmarkSnapshot(rev.Before); err != nil {
+			return nil, err
+		}
+		if err = db.applyBookmark(ctx, rev.ItemId, cur, before); err != nil {
+			return nil, err
+		}
+		current = encodeSnapshot(cur)
+	case types.RevisionFolder:
+		var cur, before *folderSnapshot
+		if cur, err = db.folderSnapshot(ctx, rev.ItemId); err != nil {
+			return nil, err
+		}
+		if before, err = decodeFolderSnapshot(rev.Before); err != nil {
+			return nil, err
+		}
+		if err = db.applyFolder(ctx, rev.ItemId, cur, before); err != nil {
+			return nil, err
+		}
+		current = encodeSnapshot(cur)
+	default:
+		return nil, ErrUndo
+	}
+
+	undo := &types.Revision{Operation: types.OperationUndo, Kind: rev.Kind, ItemId: rev.ItemId,
+		Before: current, After: rev.Before, Reverts: rev.Id}
+	if err = db.addRevision(ctx, undo); err != nil {
+		return nil, err
+	}
+
+	return undo, nil
+
+}
+
+// folderExists returns true if the folder with the given id
+// of the datastore user exists, trashed or not.
+func (db *sqlDataStore) folderExists(ctx context.Context, id int) (bool, error) {
+
+	var n int
+	if err := db.queryRow(ctx, "SELECT count(*) FROM folder WHERE id=? AND "+db.owned("folder"), id).Scan(&n); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("folderExists:SELECT query error")
+		return false, err
+	}
+
+	return n > 0, nil
+
+}
+
+// applyBookmark sets the bookmark with the given id, currently cur,
+// to the given snapshot, deleting it if nil.
+func (db *sqlDataStore) applyBookmark(ctx context.Context, id int, cur, s *bookmarkSnapshot) error {
+
+	var err error
+
+	// The bookmark has been purged.
+	if cur == nil {
+		return ErrUndo
+	}
+
+	if s == nil {
+		// Reverting the creation.
+		if _, err = db.exec(ctx, "DELETE FROM bookmark WHERE id=?", id); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("applyBookmark:DELETE query error")
+			return err
+		}
+		return db.cleanTags(ctx)
+	}
+
+	if s.FolderID != 0 {
+		ok, err := db.folderExists(ctx, s.FolderID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrUndo
+		}
+	}
+
+	// A bookmark moved back to its folder is the last one in its manual order.
+	if _, err = db.exec(ctx, `UPDATE bookmark SET title=?, url=?, notes=?, starred=?, updated_at=?,
+		deleted_at=?, trash_parent_id=?, trash_path=?,
+		position=CASE WHEN folderId=? THEN position ELSE (SELECT COALESCE(MAX(b.position), 0) + 1 FROM bookmark b WHERE b.folderId=?) END,
+		folderId=? WHERE id=?`,
+		s.Title, s.URL, s.Notes, s.Starred, now(), nullTime(s.DeletedAt), nullInt(s.TrashParentID), trashPath(s.DeletedAt, s.TrashPath),
+		nullInt(s.FolderID), nullInt(s.FolderID), nullInt(s.FolderID), id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("applyBookmark:UPDATE query error")
+		return err
+	}
+
+	// Relinking the tags, by name if they have been deleted.
+	if _, err = db.exec(ctx, "DELETE from bookmarktag WHERE bookmarkId = ?", id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("applyBookmark:DELETE bookmarktag query error")
+		return err
+	}
+	tags := make([]*types.Tag, len(s.Tags))
+	for i, t := range s.Tags {
+		tags[i] = &types.Tag{Name: t.Name}
+		if tag, err := db.GetTag(ctx, t.Id); err == nil && tag.Name == t.Name {
+			tags[i] = tag
+		}
+	}
+	if err = db.linkBookmarkTags(ctx, id, tags); err != nil {
+		return err
+	}
+
+	return db.cleanTags(ctx)
+
+}
+
+// applyFolder sets the folder with the given id, currently cur,
+// to the given snapshot, deleting it if nil.
+func (db *sqlDataStore) applyFolder(ctx context.Context, id int, cur, s *folderSnapshot) error {
+
+	var err error
+
+	// The folder has been purged.
+	if cur == nil {
+		return ErrUndo
+	}
+
+	if s == nil {
+		// Reverting the creation, only of an empty folder.
+		var n int
+		if err = db.queryRow(ctx, "SELECT (SELECT count(*) FROM folder WHERE parentFolderId=?) + (SELECT count(*) FROM bookmark WHERE folderId=?)", id, id).Scan(&n); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("applyFolder:SELECT query error")
+			return err
+		}
+		if n > 0 {
+			return ErrUndo
+		}
+		if _, err = db.exec(ctx, "DELETE FROM folder WHERE id=?", id); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("applyFolder:DELETE query error")
+			return err
+		}
+		return db.countChildrenFolders(ctx, cur.ParentID)
+	}
+
+	if s.ParentID != 0 {
+		ok, err := db.folderExists(ctx, s.ParentID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrUndo
+		}
+	}
+
+	// A folder moved back to its parent is the last one in its manual order.
+	if _, err = db.exec(ctx, `UPDATE folder SET title=?, sort=?, updated_at=?,
+		deleted_at=?, trash_parent_id=?, trash_path=?,
+		position=CASE WHEN parentFolderId=? THEN position ELSE (SELECT COALESCE(MAX(f.position), 0) + 1 FROM folder f WHERE f.parentFolderId=?) END,
+		parentFolderId=? WHERE id=?`,
+		s.Title, sortMode(s.Sort), now(), nullTime(s.DeletedAt), nullInt(s.TrashParentID), trashPath(s.DeletedAt, s.TrashPath),
+		nullInt(s.ParentID), nullInt(s.ParentID), nullInt(s.ParentID), id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("applyFolder:UPDATE query error")
+		return err
+	}
+
+	// Updating the old and new parent folders (to update the nbChildrenFolders).
+	for _, id := range []int{cur.ParentID, s.ParentID} {
+		if err = db.countChildrenFolders(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// trashPath returns the trash_path column of a folder or bookmark
+// deleted at the given date, NULL if not deleted.
+func trashPath(deletedAt *time.Time, path []string) sql.NullString {
+
+	if deletedAt == nil {
+		return sql.NullString{}
+	}
+	return encodeTrashPath(path)
+
+}
+
+// cleanTags deletes the tags not linked to any bookmark.
+func (db *sqlDataStore) cleanTags(ctx context.Context) error {
+
+	if _, err := db.exec(ctx, "DELETE FROM tag WHERE tag.id NOT IN (SELECT tagId FROM bookmarktag)"); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("cleanTags:DELETE query error")
+		return err
+	}
+
+	return nil
+
+}
@@ -0,0 +1,439 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// folderPath returns the path from the folder with the given id up to its top folder,
+// with the roles granted to the datastore user, of any owner.
+func (db *sqlDataStore) folderPath(ctx context.Context, id int) ([]ancestor, error) {
+
+	rows, err := db.query(ctx, `WITH RECURSIVE path(id, parentFolderId, ownerId, deleted_at, depth) AS (
+			SELECT id, parentFolderId, ownerId, deleted_at, 0 FROM folder WHERE id = ?
+			UNION ALL
+			SELECT folder.id, folder.parentFolderId, folder.ownerId, folder.deleted_at, path.depth + 1 FROM folder JOIN path ON folder.id = path.parentFolderId)
+		SELECT path.id, path.parentFolderId, path.ownerId, path.deleted_at IS NOT NULL, foldergrant.role
+		FROM path LEFT JOIN foldergrant ON foldergrant.folderId = path.id AND foldergrant.accountId = ?
+		ORDER BY path.depth`, id, db.owner)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("folderPath:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "folderPath")
+
+	var path []ancestor
+	for rows.Next() {
+		var (
+			a        ancestor
+			parentID sql.NullInt64
+			role     sql.NullString
+		)
+		if err = rows.Scan(&a.id, &parentID, &a.owner, &a.deleted, &role); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("folderPath:error scanning the row")
+			return nil, err
+		}
+		a.parentID = int(parentID.Int64)
+		a.role = role.String
+		path = append(path, a)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("folderPath:error looping rows")
+		return nil, err
+	}
+
+	return path, nil
+
+}
+
+// GetFolderAccess returns the owner of the folder with the given id
+// and the role of the datastore user on it, see types.Grant.
+// It fails with ErrNotFound if the folder is not shared with the user.
+func (db *sqlDataStore) GetFolderAccess(ctx context.Context, id int) (int, string, error) {
+
+	path, err := db.folderPath(ctx, id)
+	if err != nil {
+		return 0, "", err
+	}
+	return folderAccess(path, db.owner)
+
+}
+
+// GetBookmarkAccess returns the owner of the bookmark with the given id
+// and the role of the datastore user on it, the one of its folder.
+// It fails with ErrNotFound if the bookmark is not shared with the user.
+func (db *sqlDataStore) GetBookmarkAccess(ctx context.Context, id int) (int, string, error) {
+
+	var (
+		owner    int
+		folderID sql.NullInt64
+	)
+	err := db.queryRow(ctx, "SELECT ownerId, folderId FROM bookmark WHERE id=?", id).Scan(&owner, &folderID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return 0, "", ErrNotFound
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetBookmarkAccess:SELECT query error")
+		return 0, "", err
+	}
+
+	if owner == db.owner {
+		return owner, types.RoleOwner, nil
+	}
+	// The trashed bookmarks have no folder.
+	if !folderID.Valid {
+		return 0, "", ErrNotFound
+	}
+	return db.GetFolderAccess(ctx, int(folderID.Int64))
+
+}
+
+// GetSharedFolders returns the folders shared with the datastore user
+// by the other users, without their parent and content, with the role
+// of the user and the username of their owner.
+// The folders in a folder shared with the user are not returned.
+func (db *sqlDataStore) GetSharedFolders(ctx context.Context) ([]*types.Folder, error) {
+
+	type shared struct {
+		id, owner int
+		username  string
+	}
+	var grants []shared
+
+	rows, err := db.query(ctx, `SELECT folder.id, folder.ownerId, account.username FROM foldergrant
+		JOIN folder ON folder.id = foldergrant.folderId JOIN account ON account.id = folder.ownerId
+		WHERE foldergrant.accountId = ? AND folder.ownerId <> ? ORDER BY account.username, folder.title, folder.id`, db.owner, db.owner)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetSharedFolders:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetSharedFolders")
+
+	for rows.Next() {
+		var s shared
+		if err = rows.Scan(&s.id, &s.owner, &s.username); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetSharedFolders:error scanning the row")
+			return nil, err
+		}
+		grants = append(grants, s)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetSharedFolders:error looping rows")
+		return nil, err
+	}
+
+	// Getting the folders once the rows are consumed.
+	flds := []*types.Folder{}
+	for _, s := range grants {
+		path, err := db.folderPath(ctx, s.id)
+		if err != nil {
+			return nil, err
+		}
+		_, role, err := folderAccess(path, db.owner)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			continue
+		case err != nil:
+			return nil, err
+		}
+		// Skipping the folders in a shared folder.
+		if grantedRole(path[1:]) != "" {
+			continue
+		}
+
+		fld, err := db.ForUser(s.owner).GetFolder(ctx, s.id)
+		if err != nil {
+			return nil, err
+		}
+		fld.Parent = nil
+		fld.Role = role
+		fld.Owner = s.username
+		flds = append(flds, fld)
+	}
+
+	return flds, nil
+
+}
+
+// GetFolderGrants returns the grants of the folder with the given id
+// sorted by username.
+func (db *sqlDataStore) GetFolderGrants(ctx context.Context, id int) ([]*types.Grant, error) {
+
+	if ok, err := db.folderExists(ctx, id); err != nil || !ok {
+		if err == nil {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+
+	rows, err := db.query(ctx, `SELECT foldergrant.folderId, foldergrant.accountId, account.username, foldergrant.role, foldergrant.created_at
+		FROM foldergrant JOIN account ON account.id = foldergrant.accountId WHERE foldergrant.folderId = ? ORDER BY account.username`, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetFolderGrants:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetFolderGrants")
+
+	grants := []*types.Grant{}
+	for rows.Next() {
+		g := new(types.Grant)
+		if err = rows.Scan(&g.FolderId, &g.UserId, &g.Username, &g.Role, &g.CreatedAt); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetFolderGrants:error scanning the row")
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetFolderGrants:error looping rows")
+		return nil, err
+	}
+
+	return grants, nil
+
+}
+
+// ShareFolder grants the given role on the folder with the given id
+// to the user with the given id, replacing its previous role.
+// It fails with ErrInvalidGrant for an unknown role or the owner of the folder.
+func (db *sqlDataStore) ShareFolder(ctx context.Context, id int, userID int, role string) error {
+
+	log.WithFields(log.Fields{
+		"id":     id,
+		"userId": userID,
+		"role":   role,
+	}).Debug("ShareFolder")
+
+	if err := checkGrant(role); err != nil {
+		return err
+	}
+	if userID == db.owner {
+		return ErrInvalidGrant
+	}
+
+	return db.withTx(ctx, func(db *sqlDataStore) error {
+		if ok, err := db.folderExists(ctx, id); err != nil || !ok {
+			if err == nil {
+				err = ErrNotFound
+			}
+			return err
+		}
+		if _, err := db.GetUser(ctx, userID); err != nil {
+			return err
+		}
+
+		if _, err := db.exec(ctx, `INSERT INTO foldergrant(folderId, accountId, role, created_at) values(?,?,?,?)
+			ON CONFLICT (folderId, accountId) DO UPDATE SET role = excluded.role`, id, userID, role, now()); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("ShareFolder:INSERT query error")
+			return err
+		}
+		return db.touch(ctx)
+	})
+
+}
+
+// UnshareFolder deletes the grant of the folder with the given id
+// to the user with the given id.
+func (db *sqlDataStore) UnshareFolder(ctx context.Context, id int, userID int) error {
+
+	log.WithFields(log.Fields{
+		"id":     id,
+		"userId": userID,
+	}).Debug("UnshareFolder")
+
+	res, err := db.exec(ctx, "DELETE FROM foldergrant WHERE folderId=? AND accountId=? AND folderId IN (SELECT id FROM folder WHERE "+db.owned("folder")+")", id, userID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("UnshareFolder:DELETE query error")
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return db.touch(ctx)
+
+}
+
+// shareLinkColumns are the sharelink and folder columns scanned by scanShareLink.
+const shareLinkColumns = "sharelink.id, sharelink.folderId, folder.ownerId, sharelink.hash, sharelink.password_hash, sharelink.created_at, sharelink.expires_at"
+
+// scanShareLink returns the share link of the given row.
+func scanShareLink(row rowScanner) (*types.ShareLink, error) {
+
+	var expiresAt sql.NullTime
+
+	l := new(types.ShareLink)
+	if err := row.Scan(&l.Id, &l.FolderId, &l.OwnerId, &l.Hash, &l.PasswordHash, &l.CreatedAt, &expiresAt); err != nil {
+		return nil, err
+	}
+	l.Protected = l.PasswordHash != ""
+	l.ExpiresAt = timePtr(expiresAt)
+	return l, nil
+
+}
+
+// SaveShareLink saves the given new share link and returns its id.
+// It fails with ErrNotFound if its folder is not a folder of the datastore user
+// or is in the trash.
+func (db *sqlDataStore) SaveShareLink(ctx context.Context, l *types.ShareLink) (int64, error) {
+
+	log.WithFields(log.Fields{
+		"folderId": l.FolderId,
+	}).Debug("SaveShareLink")
+
+	path, err := db.folderPath(ctx, l.FolderId)
+	if err != nil {
+		return 0, err
+	}
+	if inTrash(path) || path[0].owner != db.owner {
+		return 0, ErrNotFound
+	}
+
+	var expiresAt sql.NullTime
+	if l.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: l.ExpiresAt.UTC(), Valid: true}
+	}
+	createdAt, _ := creationDates(l.CreatedAt, time.Time{})
+	id, err := db.insert(ctx, "INSERT INTO sharelink(folderId, hash, password_hash, created_at, expires_at) values(?,?,?,?,?)",
+		l.FolderId, l.Hash, l.PasswordHash, createdAt, expiresAt)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("SaveShareLink:INSERT query error")
+		return 0, err
+	}
+	if err = db.touch(ctx); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+
+}
+
+// GetShareLinks returns the share links of the folder with the given id,
+// expired ones included, most recent first.
+func (db *sqlDataStore) GetShareLinks(ctx context.Context, folderID int) ([]*types.ShareLink, error) {
+
+	if ok, err := db.folderExists(ctx, folderID); err != nil || !ok {
+		if err == nil {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+
+	rows, err := db.query(ctx, "SELECT "+shareLinkColumns+" FROM sharelink JOIN folder ON folder.id = sharelink.folderId WHERE sharelink.folderId=? ORDER BY sharelink.created_at DESC, sharelink.id DESC", folderID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetShareLinks:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetShareLinks")
+
+	links := []*types.ShareLink{}
+	for rows.Next() {
+		l, err := scanShareLink(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetShareLinks:error scanning the row")
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetShareLinks:error looping rows")
+		return nil, err
+	}
+
+	return links, nil
+
+}
+
+// GetShareLink returns the share link with the given hash, of any owner,
+// ErrNotFound if expired or if its folder is in the trash.
+func (db *sqlDataStore) GetShareLink(ctx context.Context, hash string) (*types.ShareLink, error) {
+
+	l, err := scanShareLink(db.queryRow(ctx, "SELECT "+shareLinkColumns+" FROM sharelink JOIN folder ON folder.id = sharelink.folderId WHERE sharelink.hash=? AND (sharelink.expires_at IS NULL OR sharelink.expires_at > ?)", hash, now()))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetShareLink:SELECT query error")
+		return nil, err
+	}
+
+	path, err := db.folderPath(ctx, l.FolderId)
+	if err != nil {
+		return nil, err
+	}
+	if inTrash(path) {
+		return nil, ErrNotFound
+	}
+
+	return l, nil
+
+}
+
+// DeleteShareLink revokes the share link with the given id
+// of a folder of the datastore user.
+func (db *sqlDataStore) DeleteShareLink(ctx context.Context, id int) error {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("DeleteShareLink")
+
+	res, err := db.exec(ctx, "DELETE FROM sharelink WHERE id=? AND folderId IN (SELECT id FROM folder WHERE "+db.owned("folder")+")", id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("DeleteShareLink:DELETE query error")
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return db.touch(ctx)
+
+}
@@ -0,0 +1,299 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// inLiveFolder is the condition selecting the bookmarks not in the trash,
+// requiring liveFolders.
+const inLiveFolder = "bookmark.folderId IN (SELECT id FROM livefolder)"
+
+// liveFolders returns the common table expression of the folders
+// in the tree of the datastore user root folder, ie. not in the trash.
+func (db *sqlDataStore) liveFolders() string {
+
+	return `WITH RECURSIVE livefolder(id) AS (
+		SELECT id FROM folder WHERE parentFolderId IS NULL AND deleted_at IS NULL AND ` + db.owned("folder") + `
+		UNION
+		SELECT folder.id FROM folder JOIN livefolder ON folder.parentFolderId = livefolder.id)`
+
+}
+
+// encodeTrashPath returns the given trash path as stored in the trash_path columns.
+func encodeTrashPath(path []string) sql.NullString {
+
+	if path == nil {
+		path = []string{}
+	}
+	b, err := json.Marshal(path)
+	if err != nil {
+		// Can not happen with strings.
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(b), Valid: true}
+
+}
+
+// decodeTrashPath returns the trash path stored in a trash_path column.
+func decodeTrashPath(s sql.NullString) []string {
+
+	var path []string
+	if !s.Valid || json.Unmarshal([]byte(s.String), &path) != nil {
+		return nil
+	}
+	return path
+
+}
+
+// GetTrash returns the trashed folders and bookmarks, most recently deleted first.
+// The folders come without their content.
+func (db *sqlDataStore) GetTrash(ctx context.Context) (*types.Trash, error) {
+
+	var (
+		rows  *sql.Rows
+		trash = new(types.Trash)
+		err   error
+	)
+
+	// Querying the folders.
+	if rows, err = db.query(ctx, "SELECT "+folderColumns+" FROM folder WHERE deleted_at IS NOT NULL AND "+db.owned("folder")+" ORDER BY deleted_at DESC, title"); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetTrash:SELECT folder query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetTrash")
+
+	for rows.Next() {
+		fld, _, err := scanFolder(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetTrash:error scanning the folder row")
+			return nil, err
+		}
+		trash.Folders = append(trash.Folders, fld)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetTrash:error looping folder rows")
+		return nil, err
+	}
+
+	// Querying the bookmarks.
+	if rows, err = db.query(ctx, "SELECT "+bookmarkColumns+" FROM bookmark WHERE deleted_at IS NOT NULL AND "+db.owned("bookmark")+" ORDER BY deleted_at DESC, title"); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetTrash:SELECT bookmark query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetTrash")
+
+	for rows.Next() {
+		bkm, _, err := scanBookmark(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetTrash:error scanning the bookmark row")
+			return nil, err
+		}
+		trash.Bookmarks = append(trash.Bookmarks, bkm)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetTrash:error looping bookmark rows")
+		return nil, err
+	}
+
+	// Getting the bookmarks tags once the rows are consumed.
+	for _, bkm := range trash.Bookmarks {
+		if bkm.Tags, err = db.GetBookmarkTags(ctx, bkm.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	return trash, nil
+
+}
+
+// trashBookmark implements TrashBookmark within a transaction.
+func (db *sqlDataStore) trashBookmark(ctx context.Context, id int) error {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("trashBookmark")
+
+	bkm, err := db.GetBookmark(ctx, id)
+	if err != nil {
+		return err
+	}
+	if bkm.DeletedAt != nil || bkm.Folder == nil {
+		return ErrNotFound
+	}
+
+	if _, err = db.exec(ctx, "UPDATE bookmark SET folderId=NULL, trash_parent_id=?, trash_path=?, deleted_at=? WHERE id=?",
+		bkm.Folder.Id, encodeTrashPath(bkm.Folder.Path()), now(), id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("trashBookmark:UPDATE query error")
+		return err
+	}
+
+	return nil
+
+}
+
+// trashFolder implements TrashFolder within a transaction.
+func (db *sqlDataStore) trashFolder(ctx context.Context, id int) error {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("trashFolder")
+
+	fld, err := db.GetFolder(ctx, id)
+	if err != nil {
+		return err
+	}
+	if fld.DeletedAt != nil {
+		return ErrNotFound
+	}
+	if fld.Parent == nil {
+		return ErrRootFolder
+	}
+
+	if _, err = db.exec(ctx, "UPDATE folder SET parentFolderId=NULL, trash_parent_id=?, trash_path=?, deleted_at=? WHERE id=?",
+		fld.Parent.Id, encodeTrashPath(fld.Parent.Path()), now(), id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("trashFolder:UPDATE query error")
+		return err
+	}
+
+	return db.countChildrenFolders(ctx, fld.Parent.Id)
+
+}
+
+// trashedRow returns the previous parent id and path
+// of the trashed row with the given id of the given table.
+func (db *sqlDataStore) trashedRow(ctx context.Context, table string, id int) (int, []string, error) {
+
+	var (
+		parentID  sql.NullInt64
+		trashPath sql.NullString
+	)
+
+	err := db.queryRow(ctx, "SELECT trash_parent_id, trash_path FROM "+table+" WHERE id=? AND deleted_at IS NOT NULL AND "+db.owned(table), id).Scan(&parentID, &trashPath)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return 0, nil, ErrNotFound
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("trashedRow:SELECT query error")
+		return 0, nil, err
+	}
+
+	return int(parentID.Int64), decodeTrashPath(trashPath), nil
+
+}
+
+// restoreBookmark implements RestoreBookmark within a transaction.
+func (db *sqlDataStore) restoreBookmark(ctx context.Context, id int) error {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("restoreBookmark")
+
+	parentID, path, err := db.trashedRow(ctx, "bookmark", id)
+	if err != nil {
+		return err
+	}
+	if parentID, err = restoreParent(ctx, db, parentID, path); err != nil {
+		return err
+	}
+
+	if _, err = db.exec(ctx, `UPDATE bookmark SET folderId=?, trash_parent_id=NULL, trash_path=NULL, deleted_at=NULL,
+		position=(SELECT COALESCE(MAX(b.position), 0) + 1 FROM bookmark b WHERE b.folderId=?) WHERE id=?`, parentID, parentID, id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("restoreBookmark:UPDATE query error")
+		return err
+	}
+
+	return nil
+
+}
+
+// restoreFolder implements RestoreFolder within a transaction.
+func (db *sqlDataStore) restoreFolder(ctx context.Context, id int) error {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("restoreFolder")
+
+	parentID, path, err := db.trashedRow(ctx, "folder", id)
+	if err != nil {
+		return err
+	}
+	if parentID, err = restoreParent(ctx, db, parentID, path); err != nil {
+		return err
+	}
+
+	if _, err = db.exec(ctx, `UPDATE folder SET parentFolderId=?, trash_parent_id=NULL, trash_path=NULL, deleted_at=NULL,
+		position=(SELECT COALESCE(MAX(f.position), 0) + 1 FROM folder f WHERE f.parentFolderId=?) WHERE id=?`, parentID, parentID, id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("restoreFolder:UPDATE query error")
+		return err
+	}
+
+	return db.countChildrenFolders(ctx, parentID)
+
+}
+
+// PurgeTrash permanently deletes the folders and bookmarks of the datastore user
+// moved to the trash before the given date and returns their number.
+func (db *sqlDataStore) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+
+	log.WithFields(log.Fields{
+		"before": before,
+	}).Debug("PurgeTrash")
+
+	var purged int64
+	err := db.withTx(ctx, func(db *sqlDataStore) error {
+		// The folders contents are deleted by cascade.
+		for _, table := range []string{"bookmark", "folder"} {
+			res, err := db.exec(ctx, "DELETE FROM "+table+" WHERE deleted_at IS NOT NULL AND deleted_at < ? AND "+db.owned(table), before.UTC())
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("PurgeTrash:DELETE query error")
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			purged += n
+		}
+		if purged > 0 {
+			return db.touch(ctx)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(purged), nil
+
+}
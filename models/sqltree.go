@@ -0,0 +1,175 @@
+package models
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// subtree returns the common table expression of the folders
+// of the subtree of the folder given by the first parameter,
+// down to the level given by the second one, with their level.
+func (db *sqlDataStore) subtree() string {
+
+	return `WITH RECURSIVE subtree(id, level) AS (
+		SELECT id, 0 FROM folder WHERE id = ? AND ` + db.owned("folder") + `
+		UNION ALL
+		SELECT folder.id, subtree.level + 1 FROM folder JOIN subtree ON folder.parentFolderId = subtree.id
+		WHERE subtree.level < ? AND ` + db.owned("folder") + `)`
+
+}
+
+// folderKey returns the sort key of the given folder.
+func folderKey(f *types.Folder) sortKey {
+	return sortKey{id: f.Id, title: f.Title, position: f.Position, createdAt: f.CreatedAt, lastVisitedAt: f.LastVisitedAt}
+}
+
+// bookmarkKey returns the sort key of the given bookmark.
+func bookmarkKey(b *types.Bookmark) sortKey {
+	return sortKey{id: b.Id, title: b.Title, url: b.URL, position: b.Position, createdAt: b.CreatedAt, lastVisitedAt: b.LastVisitedAt}
+}
+
+// GetFolderTree returns the folder with the given id, with its parents,
+// and its subfolders and bookmarks down to the given depth, the whole subtree
+// if negative. The folders get their number of subfolders and bookmarks,
+// the ones of the last level having no children.
+// The subfolders are queried at once with a recursive common table expression,
+// then the bookmarks and their tags.
+func (db *sqlDataStore) GetFolderTree(ctx context.Context, id int, depth int) (*types.Folder, error) {
+
+	log.WithFields(log.Fields{
+		"id":    id,
+		"depth": depth,
+	}).Debug("GetFolderTree")
+
+	fld, err := db.GetFolder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if depth < 0 {
+		depth = math.MaxInt32
+	}
+
+	// Querying the subtree folders with their level and counts.
+	rows, err := db.query(ctx, db.subtree()+`
+		SELECT `+folderColumns+`, subtree.level,
+			(SELECT COUNT(*) FROM folder child WHERE child.parentFolderId = folder.id),
+			(SELECT COUNT(*) FROM bookmark WHERE bookmark.folderId = folder.id AND bookmark.deleted_at IS NULL)
+		FROM subtree JOIN folder ON folder.id = subtree.id
+		ORDER BY subtree.level`, id, depth)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetFolderTree:SELECT folder query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetFolderTree")
+
+	// The folders by id, the parents being before their children.
+	flds := map[int]*types.Folder{}
+	for rows.Next() {
+		var level, nbFolders, nbBookmarks int
+		f, parentID, err := scanFolder(rows, &level, &nbFolders, &nbBookmarks)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetFolderTree:error scanning the query result row")
+			return nil, err
+		}
+		if level == 0 {
+			f = fld
+		} else if parent := flds[parentID]; parent != nil {
+			f.Parent = &types.Folder{Id: parentID}
+			parent.Folders = append(parent.Folders, f)
+		}
+		f.NbChildrenFolders, f.NbBookmarks = nbFolders, nbBookmarks
+		flds[f.Id] = f
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetFolderTree:error looping rows")
+		return nil, err
+	}
+	if depth == 0 {
+		return fld, nil
+	}
+
+	// Querying the bookmarks of the folders above the last level, then their tags.
+	bkms := map[int]*types.Bookmark{}
+	if rows, err = db.query(ctx, db.subtree()+`
+		SELECT `+bookmarkColumns+` FROM subtree JOIN bookmark ON bookmark.folderId = subtree.id
+		WHERE bookmark.deleted_at IS NULL AND `+db.owned("bookmark"), id, depth-1); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetFolderTree:SELECT bookmark query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetFolderTree")
+	for rows.Next() {
+		bkm, folderID, err := scanBookmark(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetFolderTree:error scanning the query result row")
+			return nil, err
+		}
+		if f := flds[folderID]; f != nil {
+			bkm.Folder = &types.Folder{Id: folderID}
+			f.Bookmarks = append(f.Bookmarks, bkm)
+			bkms[bkm.Id] = bkm
+		}
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetFolderTree:error looping rows")
+		return nil, err
+	}
+
+	if rows, err = db.query(ctx, db.subtree()+`
+		SELECT bookmarktag.bookmarkId, tag.id, tag.name FROM subtree
+		JOIN bookmark ON bookmark.folderId = subtree.id
+		JOIN bookmarktag ON bookmarktag.bookmarkId = bookmark.id
+		JOIN tag ON bookmarktag.tagId = tag.id
+		WHERE bookmark.deleted_at IS NULL AND `+db.owned("tag")+`
+		ORDER BY tag.name`, id, depth-1); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetFolderTree:SELECT tag query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetFolderTree")
+	for rows.Next() {
+		var bookmarkID int
+		tag := new(types.Tag)
+		if err = rows.Scan(&bookmarkID, &tag.Id, &tag.Name); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetFolderTree:error scanning the query result row")
+			return nil, err
+		}
+		if bkm := bkms[bookmarkID]; bkm != nil {
+			bkm.Tags = append(bkm.Tags, tag)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetFolderTree:error looping rows")
+		return nil, err
+	}
+
+	// Sorting the children with the sort mode of their folder.
+	for _, f := range flds {
+		m := sortMode(f.Sort)
+		sort.Slice(f.Folders, func(i, j int) bool { return less(m, folderKey(f.Folders[i]), folderKey(f.Folders[j])) })
+		sort.Slice(f.Bookmarks, func(i, j int) bool { return less(m, bookmarkKey(f.Bookmarks[i]), bookmarkKey(f.Bookmarks[j])) })
+	}
+
+	return fld, nil
+
+}
@@ -0,0 +1,494 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+// The users are stored in the account table, user being reserved in PostgreSQL.
+
+// userColumns are the account columns scanned by scanUser.
+const userColumns = "account.id, account.username, account.password, account.created_at"
+
+// scanUser returns the user of the given row.
+func scanUser(row rowScanner) (*types.User, error) {
+
+	u := new(types.User)
+	if err := row.Scan(&u.Id, &u.Username, &u.PasswordHash, &u.CreatedAt); err != nil {
+		return nil, err
+	}
+	return u, nil
+
+}
+
+// GetUsers returns the users sorted by username.
+func (db *sqlDataStore) GetUsers(ctx context.Context) ([]*types.User, error) {
+
+	rows, err := db.query(ctx, "SELECT "+userColumns+" FROM account ORDER BY username")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetUsers:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetUsers")
+
+	users := []*types.User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetUsers:error scanning the row")
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetUsers:error looping rows")
+		return nil, err
+	}
+
+	return users, nil
+
+}
+
+// HasUsers returns true if there is at least one user.
+func (db *sqlDataStore) HasUsers(ctx context.Context) (bool, error) {
+
+	var one int
+	err := db.queryRow(ctx, "SELECT 1 FROM account LIMIT 1").Scan(&one)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return false, nil
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("HasUsers:SELECT query error")
+		return false, err
+	}
+
+	return true, nil
+
+}
+
+// getUser returns the user matching the given condition.
+func (db *sqlDataStore) getUser(ctx context.Context, where string, arg interface{}) (*types.User, error) {
+
+	u, err := scanUser(db.queryRow(ctx, "SELECT "+userColumns+" FROM account WHERE "+where, arg))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("getUser:SELECT query error")
+		return nil, err
+	}
+
+	return u, nil
+
+}
+
+// GetUser returns the user with the given id.
+func (db *sqlDataStore) GetUser(ctx context.Context, id int) (*types.User, error) {
+	return db.getUser(ctx, "id=?", id)
+}
+
+// GetUserByName returns the user with the given username.
+func (db *sqlDataStore) GetUserByName(ctx context.Context, username string) (*types.User, error) {
+	return db.getUser(ctx, "username=?", username)
+}
+
+// ownedTables are the tables of the rows owned by a user.
+var ownedTables = []string{"bookmark", "folder", "tag", "revision", "webhook"}
+
+// countUsers returns the number of users.
+func (db *sqlDataStore) countUsers(ctx context.Context) (int, error) {
+
+	var n int
+	if err := db.queryRow(ctx, "SELECT count(*) FROM account").Scan(&n); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("countUsers:SELECT query error")
+		return 0, err
+	}
+
+	return n, nil
+
+}
+
+// saveRootFolder saves a new root folder for the user with the given id.
+func (db *sqlDataStore) saveRootFolder(ctx context.Context, owner int) error {
+
+	createdAt := now()
+	if _, err := db.exec(ctx, "INSERT INTO folder(title, nbChildrenFolders, sort, position, created_at, updated_at, ownerId) values(?,?,?,?,?,?,?)",
+		"/", 0, types.SortTitle, 0, createdAt, createdAt, owner); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("saveRootFolder:INSERT query error")
+		return err
+	}
+
+	return nil
+
+}
+
+// SaveUser saves the given new user and returns its id.
+// The first user gets the folders, bookmarks and tags saved without authentication,
+// the other ones an empty root folder.
+// It fails with ErrUserExists if the username is taken.
+func (db *sqlDataStore) SaveUser(ctx context.Context, u *types.User) (int64, error) {
+
+	log.WithFields(log.Fields{
+		"username": u.Username,
+	}).Debug("SaveUser")
+
+	var id int64
+	err := db.withTx(ctx, func(db *sqlDataStore) error {
+		_, err := db.GetUserByName(ctx, u.Username)
+		switch {
+		case err == nil:
+			return ErrUserExists
+		case !errors.Is(err, ErrNotFound):
+			return err
+		}
+		n, err := db.countUsers(ctx)
+		if err != nil {
+			return err
+		}
+
+		createdAt, _ := creationDates(u.CreatedAt, time.Time{})
+		if id, err = db.insert(ctx, "INSERT INTO account(username, password, created_at) values(?,?,?)", u.Username, u.PasswordHash, createdAt); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("SaveUser:INSERT query error")
+			return err
+		}
+
+		if n > 0 {
+			return db.saveRootFolder(ctx, int(id))
+		}
+		for _, table := range ownedTables {
+			if _, err = db.exec(ctx, "UPDATE "+table+" SET ownerId=? WHERE ownerId=0", id); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("SaveUser:UPDATE query error")
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+
+}
+
+// UpdateUserPassword sets the password hash of the user
+// with the given id and closes its sessions.
+func (db *sqlDataStore) UpdateUserPassword(ctx context.Context, id int, passwordHash string) error {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("UpdateUserPassword")
+
+	return db.withTx(ctx, func(db *sqlDataStore) error {
+		res, err := db.exec(ctx, "UPDATE account SET password=? WHERE id=?", passwordHash, id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("UpdateUserPassword:UPDATE query error")
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+
+		if _, err = db.exec(ctx, "DELETE FROM session WHERE accountId=?", id); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("UpdateUserPassword:DELETE query error")
+			return err
+		}
+		return nil
+	})
+
+}
+
+// DeleteUser deletes the user with the given id, its sessions, API tokens,
+// folders, bookmarks, tags, revisions and webhooks.
+// The root folder used without authentication is recreated
+// when the last user is deleted.
+func (db *sqlDataStore) DeleteUser(ctx context.Context, id int) error {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("DeleteUser")
+
+	return db.withTx(ctx, func(db *sqlDataStore) error {
+		// The sessions and API tokens are deleted by cascade.
+		res, err := db.exec(ctx, "DELETE FROM account WHERE id=?", id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("DeleteUser:DELETE query error")
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+
+		for _, table := range ownedTables {
+			if _, err = db.exec(ctx, "DELETE FROM "+table+" WHERE ownerId=?", id); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("DeleteUser:DELETE " + table + " query error")
+				return err
+			}
+		}
+
+		if users, err := db.countUsers(ctx); err != nil || users > 0 {
+			return err
+		}
+		if _, err = db.ForUser(0).GetRootFolder(ctx); !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return db.saveRootFolder(ctx, 0)
+	})
+
+}
+
+// SaveSession saves the given new session.
+func (db *sqlDataStore) SaveSession(ctx context.Context, s *types.Session) error {
+
+	log.WithFields(log.Fields{
+		"userId": s.UserId,
+	}).Debug("SaveSession")
+
+	createdAt, _ := creationDates(s.CreatedAt, time.Time{})
+	if _, err := db.exec(ctx, "INSERT INTO session(id, accountId, csrf, created_at, expires_at) values(?,?,?,?,?)",
+		s.Id, s.UserId, s.CSRFToken, createdAt, s.ExpiresAt.UTC()); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("SaveSession:INSERT query error")
+		return err
+	}
+
+	return nil
+
+}
+
+// GetSession returns the session with the given id, ErrNotFound if expired.
+func (db *sqlDataStore) GetSession(ctx context.Context, id string) (*types.Session, error) {
+
+	s := new(types.Session)
+	err := db.queryRow(ctx, "SELECT id, accountId, csrf, created_at, expires_at FROM session WHERE id=? AND expires_at > ?", id, now()).Scan(
+		&s.Id, &s.UserId, &s.CSRFToken, &s.CreatedAt, &s.ExpiresAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetSession:SELECT query error")
+		return nil, err
+	}
+
+	return s, nil
+
+}
+
+// DeleteSession deletes the session with the given id.
+func (db *sqlDataStore) DeleteSession(ctx context.Context, id string) error {
+
+	if _, err := db.exec(ctx, "DELETE FROM session WHERE id=?", id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("DeleteSession:DELETE query error")
+		return err
+	}
+
+	return nil
+
+}
+
+// PurgeSessions deletes the sessions expired before the given date and returns their number.
+func (db *sqlDataStore) PurgeSessions(ctx context.Context, before time.Time) (int, error) {
+
+	res, err := db.exec(ctx, "DELETE FROM session WHERE expires_at < ?", before.UTC())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("PurgeSessions:DELETE query error")
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+
+}
+
+// apiTokenColumns are the apitoken columns scanned by scanAPIToken.
+const apiTokenColumns = "id, accountId, name, hash, scope, created_at, expires_at, last_used_at"
+
+// scanAPIToken returns the API token of the given row.
+func scanAPIToken(row rowScanner) (*types.APIToken, error) {
+
+	var expiresAt, lastUsedAt sql.NullTime
+
+	t := new(types.APIToken)
+	if err := row.Scan(&t.Id, &t.UserId, &t.Name, &t.Hash, &t.Scope, &t.CreatedAt, &expiresAt, &lastUsedAt); err != nil {
+		return nil, err
+	}
+	t.ExpiresAt = timePtr(expiresAt)
+	t.LastUsedAt = timePtr(lastUsedAt)
+	return t, nil
+
+}
+
+// SaveAPIToken saves the given new API token and returns its id.
+// It fails with ErrInvalidAPIToken without name or with an unknown scope.
+func (db *sqlDataStore) SaveAPIToken(ctx context.Context, t *types.APIToken) (int64, error) {
+
+	log.WithFields(log.Fields{
+		"userId": t.UserId,
+		"name":   t.Name,
+		"scope":  t.Scope,
+	}).Debug("SaveAPIToken")
+
+	if err := checkAPIToken(t); err != nil {
+		return 0, err
+	}
+
+	var expiresAt sql.NullTime
+	if t.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: t.ExpiresAt.UTC(), Valid: true}
+	}
+	createdAt, _ := creationDates(t.CreatedAt, time.Time{})
+	id, err := db.insert(ctx, "INSERT INTO apitoken(accountId, name, hash, scope, created_at, expires_at) values(?,?,?,?,?,?)",
+		t.UserId, t.Name, t.Hash, t.Scope, createdAt, expiresAt)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("SaveAPIToken:INSERT query error")
+		return 0, err
+	}
+
+	return id, nil
+
+}
+
+// GetAPITokens returns the API tokens of the user with the given id,
+// expired ones included, most recent first.
+func (db *sqlDataStore) GetAPITokens(ctx context.Context, userID int) ([]*types.APIToken, error) {
+
+	rows, err := db.query(ctx, "SELECT "+apiTokenColumns+" FROM apitoken WHERE accountId=? ORDER BY created_at DESC, id DESC", userID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetAPITokens:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetAPITokens")
+
+	tokens := []*types.APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetAPITokens:error scanning the row")
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetAPITokens:error looping rows")
+		return nil, err
+	}
+
+	return tokens, nil
+
+}
+
+// GetAPIToken returns the API token with the given hash, ErrNotFound if expired.
+func (db *sqlDataStore) GetAPIToken(ctx context.Context, hash string) (*types.APIToken, error) {
+
+	t, err := scanAPIToken(db.queryRow(ctx, "SELECT "+apiTokenColumns+" FROM apitoken WHERE hash=? AND (expires_at IS NULL OR expires_at > ?)", hash, now()))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetAPIToken:SELECT query error")
+		return nil, err
+	}
+
+	return t, nil
+
+}
+
+// UseAPIToken sets the last used date of the API token with the given id.
+func (db *sqlDataStore) UseAPIToken(ctx context.Context, id int, at time.Time) error {
+
+	if _, err := db.exec(ctx, "UPDATE apitoken SET last_used_at=? WHERE id=?", at.UTC(), id); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("UseAPIToken:UPDATE query error")
+		return err
+	}
+
+	return nil
+
+}
+
+// DeleteAPIToken revokes the API token with the given id of the user with the given id.
+func (db *sqlDataStore) DeleteAPIToken(ctx context.Context, userID int, id int) error {
+
+	log.WithFields(log.Fields{
+		"userId": userID,
+		"id":     id,
+	}).Debug("DeleteAPIToken")
+
+	res, err := db.exec(ctx, "DELETE FROM apitoken WHERE id=? AND accountId=?", id, userID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("DeleteAPIToken:DELETE query error")
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+
+}
@@ -0,0 +1,253 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/types"
+)
+
+const (
+	// webhookColumns are the webhook columns scanned by scanWebhook.
+	webhookColumns = "id, url, events, secret, created_at"
+	// webhookDeliveryColumns are the webhookdelivery columns scanned by scanWebhookDelivery.
+	webhookDeliveryColumns = "id, webhookId, eventId, event_type, attempt, status_code, error, created_at"
+)
+
+// scanWebhook returns the webhook of the given row.
+func scanWebhook(row rowScanner) (*types.Webhook, error) {
+
+	var events string
+
+	w := new(types.Webhook)
+	if err := row.Scan(&w.Id, &w.URL, &events, &w.Secret, &w.CreatedAt); err != nil {
+		return nil, err
+	}
+	w.Events = splitEvents(events)
+	return w, nil
+
+}
+
+// scanWebhookDelivery returns the webhook delivery of the given row.
+func scanWebhookDelivery(row rowScanner) (*types.WebhookDelivery, error) {
+
+	d := new(types.WebhookDelivery)
+	if err := row.Scan(&d.Id, &d.WebhookId, &d.EventId, &d.EventType, &d.Attempt, &d.StatusCode, &d.Error, &d.CreatedAt); err != nil {
+		return nil, err
+	}
+	return d, nil
+
+}
+
+// webhookExists returns true if the webhook with the given id
+// is a webhook of the datastore user.
+func (db *sqlDataStore) webhookExists(ctx context.Context, id int) (bool, error) {
+
+	var n int
+	if err := db.queryRow(ctx, "SELECT count(*) FROM webhook WHERE id=? AND "+db.owned("webhook"), id).Scan(&n); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("webhookExists:SELECT query error")
+		return false, err
+	}
+
+	return n > 0, nil
+
+}
+
+// SaveWebhook saves the given new webhook of the datastore user and returns its id.
+// It fails with ErrInvalidWebhook without an http(s) URL, without secret
+// or with an unknown event.
+func (db *sqlDataStore) SaveWebhook(ctx context.Context, w *types.Webhook) (int64, error) {
+
+	log.WithFields(log.Fields{
+		"url":    w.URL,
+		"events": w.Events,
+	}).Debug("SaveWebhook")
+
+	if err := checkWebhook(w); err != nil {
+		return 0, err
+	}
+
+	createdAt, _ := creationDates(w.CreatedAt, time.Time{})
+	id, err := db.insert(ctx, "INSERT INTO webhook(ownerId, url, events, secret, created_at) values(?,?,?,?,?)",
+		db.owner, w.URL, joinEvents(w.Events), w.Secret, createdAt)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("SaveWebhook:INSERT query error")
+		return 0, err
+	}
+
+	return id, nil
+
+}
+
+// GetWebhooks returns the webhooks of the datastore user, oldest first.
+func (db *sqlDataStore) GetWebhooks(ctx context.Context) ([]*types.Webhook, error) {
+
+	rows, err := db.query(ctx, "SELECT "+webhookColumns+" FROM webhook WHERE "+db.owned("webhook")+" ORDER BY id")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetWebhooks:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetWebhooks")
+
+	webhooks := []*types.Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetWebhooks:error scanning the row")
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetWebhooks:error looping rows")
+		return nil, err
+	}
+
+	return webhooks, nil
+
+}
+
+// GetWebhook returns the webhook with the given id of the datastore user.
+func (db *sqlDataStore) GetWebhook(ctx context.Context, id int) (*types.Webhook, error) {
+
+	w, err := scanWebhook(db.queryRow(ctx, "SELECT "+webhookColumns+" FROM webhook WHERE id=? AND "+db.owned("webhook"), id))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err != nil:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetWebhook:SELECT query error")
+		return nil, err
+	}
+
+	return w, nil
+
+}
+
+// DeleteWebhook deletes the webhook with the given id of the datastore user
+// and its deliveries.
+func (db *sqlDataStore) DeleteWebhook(ctx context.Context, id int) error {
+
+	log.WithFields(log.Fields{
+		"id": id,
+	}).Debug("DeleteWebhook")
+
+	// The deliveries are deleted by cascade.
+	res, err := db.exec(ctx, "DELETE FROM webhook WHERE id=? AND "+db.owned("webhook"), id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("DeleteWebhook:DELETE query error")
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+
+}
+
+// SaveWebhookDelivery saves the given delivery of a webhook of the datastore user
+// and returns its id, deleting the deliveries of the webhook
+// but the last WebhookDeliveriesKept ones.
+func (db *sqlDataStore) SaveWebhookDelivery(ctx context.Context, d *types.WebhookDelivery) (int64, error) {
+
+	log.WithFields(log.Fields{
+		"webhookId": d.WebhookId,
+		"eventId":   d.EventId,
+		"attempt":   d.Attempt,
+	}).Debug("SaveWebhookDelivery")
+
+	var id int64
+	err := db.withTx(ctx, func(db *sqlDataStore) error {
+		ok, err := db.webhookExists(ctx, d.WebhookId)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrNotFound
+		}
+
+		createdAt, _ := creationDates(d.CreatedAt, time.Time{})
+		if id, err = db.insert(ctx, "INSERT INTO webhookdelivery(webhookId, eventId, event_type, attempt, status_code, error, created_at) values(?,?,?,?,?,?,?)",
+			d.WebhookId, d.EventId, d.EventType, d.Attempt, d.StatusCode, d.Error, createdAt); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("SaveWebhookDelivery:INSERT query error")
+			return err
+		}
+
+		if _, err = db.exec(ctx, "DELETE FROM webhookdelivery WHERE webhookId=? AND id NOT IN (SELECT id FROM webhookdelivery WHERE webhookId=? ORDER BY id DESC LIMIT ?)",
+			d.WebhookId, d.WebhookId, WebhookDeliveriesKept); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("SaveWebhookDelivery:DELETE query error")
+			return err
+		}
+		return nil
+	})
+
+	return id, err
+
+}
+
+// GetWebhookDeliveries returns the deliveries of the webhook with the given id
+// of the datastore user, most recent first.
+func (db *sqlDataStore) GetWebhookDeliveries(ctx context.Context, webhookID int) ([]*types.WebhookDelivery, error) {
+
+	if ok, err := db.webhookExists(ctx, webhookID); err != nil || !ok {
+		if err == nil {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+
+	rows, err := db.query(ctx, "SELECT "+webhookDeliveryColumns+" FROM webhookdelivery WHERE webhookId=? ORDER BY id DESC", webhookID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetWebhookDeliveries:SELECT query error")
+		return nil, err
+	}
+	defer closeRows(rows, "GetWebhookDeliveries")
+
+	deliveries := []*types.WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("GetWebhookDeliveries:error scanning the row")
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("GetWebhookDeliveries:error looping rows")
+		return nil, err
+	}
+
+	return deliveries, nil
+
+}
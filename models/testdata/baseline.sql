@@ -0,0 +1,24 @@
+-- A database created by GoBkm before the schema migrations.
+CREATE TABLE IF NOT EXISTS folder ( id integer PRIMARY KEY, title string NOT NULL, parentFolderId integer, nbChildrenFolders integer,
+	FOREIGN KEY (parentFolderId) references folder(id)
+	ON DELETE CASCADE);
+CREATE TABLE IF NOT EXISTS tag ( id integer PRIMARY KEY, name string NOT NULL);
+CREATE TABLE IF NOT EXISTS bookmarktag ( id integer PRIMARY KEY,
+	bookmarkId integer,
+	tagId integer,
+	FOREIGN KEY (bookmarkId) references bookmark(id),
+	FOREIGN KEY (tagId) references tag(id));
+CREATE TABLE IF NOT EXISTS bookmark ( id integer PRIMARY KEY, title string NOT NULL, url string NOT NULL, favicon string, starred integer, folderId integer,
+	FOREIGN KEY (folderId) references folder(id)
+	ON DELETE CASCADE);
+INSERT INTO folder(id, title) values("1", "/");
+INSERT INTO folder(id, title, parentFolderId, nbChildrenFolders) values(2, "Dev", 1, 1);
+INSERT INTO folder(id, title, parentFolderId, nbChildrenFolders) values(3, "Go", 2, 0);
+INSERT INTO tag(id, name) values(1, "lang");
+INSERT INTO tag(id, name) values(2, "doc");
+INSERT INTO bookmark(id, title, url, folderId, favicon, starred) values(1, "The Go Programming Language", "https://go.dev/", 3, "data:image/png;base64,AA==", 1);
+INSERT INTO bookmark(id, title, url, folderId, favicon, starred) values(2, "Effective Go", "https://go.dev/doc/effective_go", 3, "", 0);
+INSERT INTO bookmark(id, title, url, folderId, favicon) values(3, "SQLite", "https://www.sqlite.org/", 2, "");
+INSERT INTO bookmarktag(bookmarkId, tagId) values(1, 1);
+INSERT INTO bookmarktag(bookmarkId, tagId) values(2, 1);
+INSERT INTO bookmarktag(bookmarkId, tagId) values(2, 2);
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"context"
+	"errors"
+
+	"github.com/tbellembois/gobkm/types"
+)
+
+// The trashed folders and bookmarks are detached from their parent folder,
+// keeping its id and path to be restored. The subfolders and bookmarks
+// of a trashed folder stay in it and are hidden with it.
+
+// isLive returns true if the given folder, with its parents,
+// is in the tree of a root folder, ie. neither it nor a parent is in the trash.
+// The trashed folders have no parent either but a deletion date.
+func isLive(f *types.Folder) bool {
+
+	for f.Parent != nil {
+		f = f.Parent
+	}
+	return f.DeletedAt == nil
+
+}
+
+// restoreParent returns the id of the folder to restore a trashed folder
+// or bookmark into: its previous parent if still in the tree,
+// otherwise the folder with the given path, created if missing.
+func restoreParent(ctx context.Context, ds Datastore, parentID int, path []string) (int, error) {
+
+	parent, err := ds.GetFolder(ctx, parentID)
+	switch {
+	case err == nil && isLive(parent):
+		return parentID, nil
+	case err != nil && !errors.Is(err, ErrNotFound):
+		return 0, err
+	}
+
+	// Recreating the missing folders from the root.
+	root, err := ds.GetRootFolder(ctx)
+	if err != nil {
+		return 0, err
+	}
+	id := root.Id
+next:
+	for _, title := range path {
+		children, err := ds.GetFolderSubfolders(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		for _, c := range children {
+			if c.Title == title {
+				id = c.Id
+				continue next
+			}
+		}
+		newID, err := ds.SaveFolder(ctx, &types.Folder{Title: title, Parent: &types.Folder{Id: id}})
+		if err != nil {
+			return 0, err
+		}
+		id = int(newID)
+	}
+
+	return id, nil
+
+}
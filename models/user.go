@@ -0,0 +1,68 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/tbellembois/gobkm/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUserExists is returned when saving a user with the username of another one.
+var ErrUserExists = errors.New("user already exists")
+
+// ErrInvalidCredentials is returned when checking an unknown username or a wrong password.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// ErrInvalidAPIToken is returned when saving an API token without name or with an unknown scope.
+var ErrInvalidAPIToken = errors.New("invalid API token name or scope")
+
+// dummyHash is checked against the passwords of the unknown users
+// so that they take as long as the known ones.
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// HashPassword returns the bcrypt hash of the given password.
+func HashPassword(password string) (string, error) {
+
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+
+}
+
+// CheckPassword returns ErrInvalidCredentials if the given password
+// does not match the given hash, empty for an unknown user.
+func CheckPassword(hash, password string) error {
+
+	if hash == "" {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("gobkm"), bcrypt.DefaultCost)
+		})
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return ErrInvalidCredentials
+	}
+	return nil
+
+}
+
+// checkAPIToken returns ErrInvalidAPIToken if the given token can not be saved.
+func checkAPIToken(t *types.APIToken) error {
+
+	if strings.TrimSpace(t.Name) == "" || (t.Scope != types.ScopeRead && t.Scope != types.ScopeWrite) {
+		return ErrInvalidAPIToken
+	}
+	return nil
+
+}
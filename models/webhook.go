@@ -0,0 +1,68 @@
+package models
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/tbellembois/gobkm/types"
+)
+
+// ErrInvalidWebhook is returned when saving a webhook without an http(s) URL,
+// without secret or with an unknown event in its filter.
+var ErrInvalidWebhook = errors.New("invalid webhook URL, secret or events")
+
+// WebhookDeliveriesKept is the number of deliveries kept by webhook,
+// the oldest ones being deleted.
+const WebhookDeliveriesKept = 100
+
+// webhookKinds and webhookOperations are the kinds and operations
+// of the events a webhook can be filtered on.
+var (
+	webhookKinds      = []string{types.RevisionFolder, types.RevisionBookmark, types.EventTag}
+	webhookOperations = []string{types.OperationCreate, types.OperationUpdate, types.OperationMove, types.OperationStar, types.OperationDelete}
+)
+
+// contains returns true if the given strings contain the given one.
+func contains(values []string, value string) bool {
+
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+
+}
+
+// checkWebhook returns ErrInvalidWebhook if the given webhook can not be saved.
+func checkWebhook(w *types.Webhook) error {
+
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || w.Secret == "" {
+		return ErrInvalidWebhook
+	}
+	for _, e := range w.Events {
+		kind, operation, typed := strings.Cut(e, ".")
+		if !contains(webhookKinds, kind) || (typed && !contains(webhookOperations, operation)) {
+			return ErrInvalidWebhook
+		}
+	}
+	return nil
+
+}
+
+// joinEvents returns the given webhook events filter as stored.
+func joinEvents(events []string) string {
+	return strings.Join(events, ",")
+}
+
+// splitEvents returns the webhook events filter of the given stored value.
+func splitEvents(events string) []string {
+
+	if events == "" {
+		return []string{}
+	}
+	return strings.Split(events, ",")
+
+}
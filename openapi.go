@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/handlers"
+)
+
+const openapiUsage = `usage: gobkm openapi [-proxy URL]
+
+Prints the OpenAPI document of the server routes, failing if a route
+has no OpenAPI entry. It is also served on /openapi.json and shown on /apidoc/.`
+
+// openapi implements the "gobkm openapi" command
+// printing the OpenAPI document.
+func openapi(args []string) {
+
+	fs := flag.NewFlagSet("openapi", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, openapiUsage) }
+	proxyURL := fs.String("proxy", "http://localhost:8081", "the proxy full URL if used")
+	if err := fs.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	env := handlers.Env{GoBkmProxyURL: *proxyURL}
+	if err := env.CheckOpenAPI(routes(&env).Patterns); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(handlers.OpenAPI(*proxyURL)); err != nil {
+		log.Fatal(err)
+	}
+
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/handlers"
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+)
+
+const tokenUsage = `usage: gobkm token add [-db path] [-scope read|write] [-expires duration] username name
+       gobkm token list [-db path] username
+       gobkm token revoke [-db path] username id
+
+The API tokens are sent in an "Authorization: Bearer <token>" header.
+A token is only shown when added, the read ones can not change the folders and bookmarks.`
+
+// token implements the "gobkm token" command managing
+// the API tokens of the users.
+func token(args []string) {
+
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, tokenUsage)
+		os.Exit(2)
+	}
+	command := args[0]
+
+	fs := flag.NewFlagSet("token "+command, flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, tokenUsage) }
+	dbPath := fs.String("db", "bkm.db", "the full sqlite db path or a postgres:// URL")
+	scope := fs.String("scope", types.ScopeRead, "the token scope, read or write")
+	expires := fs.Duration("expires", 0, "the token lifetime, 0 for a token that never expires")
+	debug := fs.Bool("debug", false, "debug (verbose log), default is error")
+	if err := fs.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.ErrorLevel)
+	}
+
+	var arg string
+	switch {
+	case command == "list" && fs.NArg() == 1:
+	case command != "list" && fs.NArg() == 2:
+		arg = fs.Arg(1)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	username := fs.Arg(0)
+
+	ctx := context.Background()
+
+	db, err := models.Open(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	// Creating or upgrading the database.
+	if err = db.CreateDatabase(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = runTokenCommand(ctx, db, command, username, arg, *scope, *expires); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		db.Close()
+		os.Exit(1)
+	}
+
+}
+
+// runTokenCommand runs the given token subcommand for the given user,
+// arg being the name of the token to add or the id of the token to revoke.
+func runTokenCommand(ctx context.Context, ds models.Datastore, command, username, arg, scope string, expires time.Duration) error {
+
+	u, err := ds.GetUserByName(ctx, username)
+	if err != nil {
+		return fmt.Errorf("user %s: %w", username, err)
+	}
+
+	switch command {
+	case "list":
+		tokens, err := ds.GetAPITokens(ctx, u.Id)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			expiresAt, lastUsedAt := "never", "never"
+			if t.ExpiresAt != nil {
+				expiresAt = t.ExpiresAt.Format("2006-01-02 15:04")
+			}
+			if t.LastUsedAt != nil {
+				lastUsedAt = t.LastUsedAt.Format("2006-01-02 15:04")
+			}
+			fmt.Printf("%d\t%s\t%s\texpires: %s\tlast used: %s\n", t.Id, t.Name, t.Scope, expiresAt, lastUsedAt)
+		}
+		return nil
+
+	case "add":
+		var expiresAt *time.Time
+		if expires > 0 {
+			t := time.Now().Add(expires).UTC()
+			expiresAt = &t
+		}
+		value, t, err := handlers.NewAPIToken(ctx, ds, u.Id, arg, scope, expiresAt)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("token %d %s added, it will not be shown again:\n%s\n", t.Id, t.Name, value)
+		return nil
+
+	case "revoke":
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("invalid token id %q", arg)
+		}
+		if err = ds.DeleteAPIToken(ctx, u.Id, id); err != nil {
+			return fmt.Errorf("token %d: %w", id, err)
+		}
+		fmt.Printf("token %d revoked\n", id)
+		return nil
+	}
+
+	return fmt.Errorf("unknown command %q\n%s", command, tokenUsage)
+
+}
@@ -2,9 +2,29 @@ package types
 
 import (
 	"encoding/json"
-	"strings"
+	"time"
 )
 
+// SortMode is the order of the subfolders and bookmarks of a folder.
+type SortMode string
+
+const (
+	SortTitle   SortMode = "title"   // by title
+	SortURL     SortMode = "url"     // by URL, the subfolders by title
+	SortCreated SortMode = "created" // most recently added first
+	SortVisited SortMode = "visited" // most recently visited first, never visited last
+	SortManual  SortMode = "manual"  // by position
+)
+
+// IsValid returns true if the sort mode is one of the above
+func (m SortMode) IsValid() bool {
+	switch m {
+	case SortTitle, SortURL, SortCreated, SortVisited, SortManual:
+		return true
+	}
+	return false
+}
+
 // Folder containing the bookmarks
 type Folder struct {
 	Id                int         `json:"id"`
@@ -13,6 +33,17 @@ type Folder struct {
 	Folders           []*Folder   `json:"folders"`
 	Bookmarks         []*Bookmark `json:"bookmarks"`
 	NbChildrenFolders int         `json:"nbchildrenfolders"`
+	NbBookmarks       int         `json:"nbbookmarks,omitempty"` // number of bookmarks, set by Datastore.GetFolderTree
+	Sort              SortMode    `json:"sort"`                  // order of the children
+	Position          int         `json:"position"`              // position in the parent folder in the manual order
+	CreatedAt         time.Time   `json:"created_at"`
+	UpdatedAt         time.Time   `json:"updated_at"`
+	LastVisitedAt     *time.Time  `json:"last_visited_at,omitempty"` // nil if never visited
+	DeletedAt         *time.Time  `json:"deleted_at,omitempty"`      // nil if not in the trash
+	TrashPath         []string    `json:"trash_path,omitempty"`      // parent folders titles before the deletion, from the root
+	Shared            bool        `json:"shared,omitempty"`          // true if the folder is shared with other users
+	Role              string      `json:"role,omitempty"`            // role of the user on a folder shared with them
+	Owner             string      `json:"owner,omitempty"`           // username of the owner of a folder shared with the user
 }
 
 // Bookmark
@@ -24,6 +55,23 @@ type Bookmark struct {
 	Starred bool    `json:"starred"`
 	Folder  *Folder `json:"folder"` // reference to the folder to help
 	Tags    []*Tag  `json:"tags"`
+	Notes   string  `json:"notes"`
+	Snippet string  `json:"snippet,omitempty"` // search match with <mark> highlights, set by the full text search
+	// Position in the folder in the manual order.
+	Position int `json:"position"`
+
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	LastVisitedAt *time.Time `json:"last_visited_at,omitempty"` // nil if never visited
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`      // nil if not in the trash
+	TrashPath     []string   `json:"trash_path,omitempty"`      // folders titles before the deletion, from the root
+}
+
+// Trash holds the deleted folders and bookmarks,
+// the folders with their subfolders and bookmarks.
+type Trash struct {
+	Folders   []*Folder   `json:"folders"`
+	Bookmarks []*Bookmark `json:"bookmarks"`
 }
 
 // Tag represents a bookmark tag
@@ -44,11 +92,7 @@ func (b Bookmarks) Swap(i, j int) {
 }
 
 func (b Bookmarks) Less(i, j int) bool {
-	url1 := b[i].Title
-	url2 := b[j].Title
-	title1 := url1[strings.Index(url1, "//")+2:]
-	title2 := url2[strings.Index(url2, "//")+2:]
-	return title1 < title2
+	return b[i].Title < b[j].Title
 }
 
 func (bk *Bookmark) String() string {
@@ -61,14 +105,18 @@ func (bk *Bookmark) String() string {
 	return string(out)
 }
 
-// PathString returns the bookmark full path as a string
+// PathString returns the bookmark folder full path as a string
+// such as /IT/Development, the root folder path is /
 func (bk *Bookmark) PathString() string {
 	var (
 		p *Folder
 		r string
 	)
-	for p = bk.Folder; p != nil; p = p.Parent {
-		r += "/" + p.Title
+	for p = bk.Folder; p != nil && !p.IsRootFolder(); p = p.Parent {
+		r = "/" + p.Title + r
+	}
+	if r == "" {
+		return "/"
 	}
 	return r
 }
@@ -83,6 +131,16 @@ func (fd *Folder) String() string {
 	return string(out)
 }
 
+// Path returns the titles of the given Folder and its parents
+// from the root folder excluded, empty for the root folder
+func (fd *Folder) Path() []string {
+	var r []string
+	for p := fd; p != nil && !p.IsRootFolder(); p = p.Parent {
+		r = append([]string{p.Title}, r...)
+	}
+	return r
+}
+
 // IsRootFolder returns true if the given Folder has no parent
 func (fd *Folder) IsRootFolder() bool {
 	return fd.Parent == nil
@@ -92,3 +150,62 @@ func (fd *Folder) IsRootFolder() bool {
 func (fd *Folder) HasChildrenFolders() bool {
 	return fd.NbChildrenFolders > 0
 }
+
+// Revision operations.
+const (
+	OperationCreate  = "create"
+	OperationUpdate  = "update" // title, URL, notes or sort mode change
+	OperationMove    = "move"
+	OperationStar    = "star" // star or unstar
+	OperationTag     = "tag"
+	OperationDelete  = "delete" // move to the trash
+	OperationRestore = "restore"
+	OperationUndo    = "undo"
+)
+
+// Revision kinds.
+const (
+	RevisionBookmark = "bookmark"
+	RevisionFolder   = "folder"
+)
+
+// DataRevision is the version of the folders, bookmarks, tags and shares
+// of a user, increased by every change but the visits.
+// It is not related to the Revision history entries.
+type DataRevision struct {
+	Revision  int64     `json:"revision"`
+	UpdatedAt time.Time `json:"updated_at"` // zero if never changed
+}
+
+// Revision is an entry of the change history of the folders and bookmarks,
+// with their state before and after the operation, null for the creations.
+// The undo revisions revert the revision Reverts.
+type Revision struct {
+	Id        int             `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Operation string          `json:"operation"`
+	Kind      string          `json:"kind"`
+	ItemId    int             `json:"item_id"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	Reverts   int             `json:"reverts,omitempty"`
+}
+
+// Batch operations on the bookmarks.
+const (
+	BatchMove   = OperationMove
+	BatchTag    = OperationTag // add tags
+	BatchUntag  = "untag"      // remove tags
+	BatchStar   = OperationStar
+	BatchUnstar = "unstar"
+	BatchDelete = OperationDelete // move to the trash
+)
+
+// BatchOperation is an operation of a batch on a bookmark.
+type BatchOperation struct {
+	Op         string   `json:"op"`
+	BookmarkId int      `json:"bookmark_id"`
+	FolderId   int      `json:"folder_id,omitempty"` // the destination of a move
+	Tags       []string `json:"tags,omitempty"`      // the names of the tags added or removed
+	OwnerId    int      `json:"-"`                   // the owner of the bookmark, with their access checked
+}
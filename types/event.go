@@ -0,0 +1,63 @@
+package types
+
+import (
+	"strings"
+	"time"
+)
+
+// EventTag is the kind of the tag events,
+// the folder and bookmark ones being RevisionFolder and RevisionBookmark.
+const EventTag = "tag"
+
+// Event is a change of a folder, bookmark or tag sent to the clients.
+// Its type is the item kind and the operation, as in bookmark.update:
+// create, update, move, star or delete (moved to the trash).
+type Event struct {
+	Id        int64       `json:"id"`
+	Type      string      `json:"type"`
+	ItemId    int         `json:"item_id"`
+	Item      interface{} `json:"item,omitempty"` // the item after the change, but for the deletions
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// EventType returns the type of the events of the given operation on the given kind of item.
+func EventType(kind, operation string) string {
+	return kind + "." + operation
+}
+
+// Webhook posts the events of its owner matching its filter to an URL,
+// signed with its secret, see WebhookDelivery.
+type Webhook struct {
+	Id        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"` // the event types, as bookmark.create, or kinds, as bookmark, all the events if empty
+	Secret    string    `json:"-"`      // the HMAC key of the payload signatures
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Matches returns true if the events of the given type are sent to the webhook.
+func (w *Webhook) Matches(eventType string) bool {
+
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == eventType || strings.HasPrefix(eventType, e+".") {
+			return true
+		}
+	}
+	return false
+
+}
+
+// WebhookDelivery is an attempt to post an event to a webhook.
+type WebhookDelivery struct {
+	Id         int       `json:"id"`
+	WebhookId  int       `json:"webhook_id"`
+	EventId    int64     `json:"event_id"`
+	EventType  string    `json:"event_type"`
+	Attempt    int       `json:"attempt"`               // from 1
+	StatusCode int       `json:"status_code,omitempty"` // 0 without response
+	Error      string    `json:"error,omitempty"`       // empty if delivered
+	CreatedAt  time.Time `json:"created_at"`
+}
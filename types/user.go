@@ -0,0 +1,70 @@
+package types
+
+import "time"
+
+// User is a GoBkm user.
+type User struct {
+	Id           int       `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"-"` // bcrypt hash
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Session is a logged in user session.
+type Session struct {
+	Id        string    `json:"-"` // hash of the session cookie token
+	UserId    int       `json:"user_id"`
+	CSRFToken string    `json:"-"` // to send back with the POST requests
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// API token scopes.
+const (
+	ScopeRead  = "read"  // the requests not changing the folders and bookmarks
+	ScopeWrite = "write" // all the requests
+)
+
+// APIToken is a named token authenticating the requests of a user scripts,
+// sent in the Authorization header.
+type APIToken struct {
+	Id         int        `json:"id"`
+	UserId     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"-"` // hash of the token
+	Scope      string     `json:"scope"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`   // nil if it never expires
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"` // nil if never used
+}
+
+// Folder roles of the users a folder is shared with,
+// each one allowing the operations of the previous ones.
+// The roles are inherited by the subfolders.
+const (
+	RoleViewer = "viewer" // reads the folder content
+	RoleEditor = "editor" // adds, changes, moves and deletes the folder content
+	RoleOwner  = "owner"  // shares the folder
+)
+
+// Grant gives a user a role on a folder and its subfolders.
+type Grant struct {
+	FolderId  int       `json:"folder_id"`
+	UserId    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ShareLink is an unguessable public link giving a read-only access
+// to a folder and its subfolders to the people without an account.
+type ShareLink struct {
+	Id           int        `json:"id"`
+	FolderId     int        `json:"folder_id"`
+	OwnerId      int        `json:"-"`         // the owner of the folder
+	Hash         string     `json:"-"`         // hash of the token
+	PasswordHash string     `json:"-"`         // bcrypt hash, empty without password
+	Protected    bool       `json:"protected"` // true with a password
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"` // nil if it never expires
+}
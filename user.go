@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tbellembois/gobkm/models"
+	"github.com/tbellembois/gobkm/types"
+	"golang.org/x/term"
+)
+
+const userUsage = `usage: gobkm user add|passwd|delete [-db path] username
+       gobkm user list [-db path]
+
+The passwords are read from the terminal, or from the first line of the standard input.`
+
+// user implements the "gobkm user" command managing the users
+// allowed to log in. GoBkm is open to everyone while there is no user.
+func user(args []string) {
+
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, userUsage)
+		os.Exit(2)
+	}
+	command := args[0]
+
+	fs := flag.NewFlagSet("user "+command, flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, userUsage) }
+	dbPath := fs.String("db", "bkm.db", "the full sqlite db path or a postgres:// URL")
+	debug := fs.Bool("debug", false, "debug (verbose log), default is error")
+	if err := fs.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.ErrorLevel)
+	}
+
+	var username string
+	switch {
+	case command == "list" && fs.NArg() == 0:
+	case command != "list" && fs.NArg() == 1:
+		username = fs.Arg(0)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	db, err := models.Open(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	// Creating or upgrading the database.
+	if err = db.CreateDatabase(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = runUserCommand(ctx, db, command, username); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		db.Close()
+		os.Exit(1)
+	}
+
+}
+
+// runUserCommand runs the given user subcommand.
+func runUserCommand(ctx context.Context, ds models.Datastore, command, username string) error {
+
+	switch command {
+	case "list":
+		users, err := ds.GetUsers(ctx)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			fmt.Printf("%s\t%s\n", u.Username, u.CreatedAt.Format("2006-01-02"))
+		}
+		return nil
+
+	case "add":
+		if username == "" || strings.TrimSpace(username) != username {
+			return errors.New("invalid username")
+		}
+		hash, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if _, err = ds.SaveUser(ctx, &types.User{Username: username, PasswordHash: hash}); err != nil {
+			return err
+		}
+		fmt.Printf("user %s added\n", username)
+		return nil
+
+	case "passwd":
+		u, err := ds.GetUserByName(ctx, username)
+		if err != nil {
+			return fmt.Errorf("user %s: %w", username, err)
+		}
+		hash, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err = ds.UpdateUserPassword(ctx, u.Id, hash); err != nil {
+			return err
+		}
+		fmt.Printf("password of %s changed, its sessions are closed\n", username)
+		return nil
+
+	case "delete":
+		u, err := ds.GetUserByName(ctx, username)
+		if err != nil {
+			return fmt.Errorf("user %s: %w", username, err)
+		}
+		if err = ds.DeleteUser(ctx, u.Id); err != nil {
+			return err
+		}
+		fmt.Printf("user %s deleted\n", username)
+		return nil
+	}
+
+	return fmt.Errorf("unknown command %q\n%s", command, userUsage)
+
+}
+
+// readPassword reads a new password, twice from the terminal,
+// and returns its hash.
+func readPassword() (string, error) {
+
+	var password string
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		var confirm []byte
+		fmt.Fprint(os.Stderr, "Password: ")
+		p, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprint(os.Stderr, "Confirm password: ")
+		if confirm, err = term.ReadPassword(fd); err != nil {
+			return "", err
+		}
+		fmt.Fprintln(os.Stderr)
+		if string(p) != string(confirm) {
+			return "", errors.New("the passwords do not match")
+		}
+		password = string(p)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	return models.HashPassword(password)
+
+}